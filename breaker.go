@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Unit status, as reported to monitoring.
+type UnitStatus struct {
+	UnitId		uint8		// modbus unit ID
+	Skipped		bool		// true if the breaker tripped and the unit is
+					// only probed every retry interval
+	Failures	uint		// number of consecutive failures
+	TotalFailures	uint		// number of failures since startup
+	SkippedCycles	uint		// number of poll cycles the unit was skipped in
+	Since		time.Time	// time of the last skipped/responding transition
+	NextProbe	time.Time	// time of the next probe (skipped units only)
+}
+
+// Per-unit circuit breaker, used to skip units which keep failing
+// instead of waiting for their requests to time out on every cycle.
+// Once tripped, a unit is only probed every retryInterval until it
+// answers again.
+type unitBreaker struct {
+	name		string
+	lock		sync.Mutex
+	maxFailures	uint
+	retryInterval	time.Duration
+	units		map[uint8]*UnitStatus
+}
+
+// Returns a new circuit breaker. The breaker is disabled if maxFailures is 0.
+func newUnitBreaker(name string, maxFailures uint,
+		    retryInterval time.Duration) (ub *unitBreaker) {
+	ub = &unitBreaker{
+		name:		name,
+		maxFailures:	maxFailures,
+		retryInterval:	retryInterval,
+		units:		make(map[uint8]*UnitStatus),
+	}
+
+	return
+}
+
+// Returns true if unitId should be polled, either because the breaker is
+// closed or because a probe is due.
+func (ub *unitBreaker) allow(unitId uint8) (yes bool) {
+	var us	*UnitStatus
+
+	ub.lock.Lock()
+	defer ub.lock.Unlock()
+
+	us	= ub.units[unitId]
+	if us == nil || !us.Skipped || !time.Now().Before(us.NextProbe) {
+		yes	= true
+		return
+	}
+
+	us.SkippedCycles++
+
+	return
+}
+
+// Records a successful request to unitId.
+func (ub *unitBreaker) success(unitId uint8) {
+	var us	*UnitStatus
+
+	ub.lock.Lock()
+	defer ub.lock.Unlock()
+
+	us	= ub.get(unitId)
+	us.Failures	= 0
+
+	if us.Skipped {
+		us.Skipped	= false
+		us.Since	= time.Now()
+		us.NextProbe	= time.Time{}
+
+		fmt.Printf("%s: unit %v is responding again\n", ub.name, unitId)
+	}
+
+	return
+}
+
+// Records a failed request to unitId. Returns true if the breaker is open,
+// i.e. if the remaining targets of the unit are to be skipped until the next
+// probe.
+func (ub *unitBreaker) failure(unitId uint8) (tripped bool) {
+	var us	*UnitStatus
+
+	ub.lock.Lock()
+	defer ub.lock.Unlock()
+
+	us	= ub.get(unitId)
+	us.Failures++
+	us.TotalFailures++
+
+	if ub.maxFailures == 0 || us.Failures < ub.maxFailures {
+		return
+	}
+
+	tripped		= true
+	us.NextProbe	= time.Now().Add(ub.retryInterval)
+
+	if !us.Skipped {
+		us.Skipped	= true
+		us.Since	= time.Now()
+
+		fmt.Printf("%s: unit %v not responding after %v consecutive failures, " +
+			   "probing every %v\n",
+			   ub.name, unitId, us.Failures, ub.retryInterval)
+	}
+
+	return
+}
+
+// Returns the status of all units seen so far, ordered by unit ID.
+func (ub *unitBreaker) status() (res []UnitStatus) {
+	ub.lock.Lock()
+	for _, us := range ub.units {
+		res	= append(res, *us)
+	}
+	ub.lock.Unlock()
+
+	sort.Slice(res, func(i int, j int) bool {
+		return res[i].UnitId < res[j].UnitId
+	})
+
+	return
+}
+
+// Returns the state of unitId, creating it if needed.
+// Must be called with the lock held.
+func (ub *unitBreaker) get(unitId uint8) (us *UnitStatus) {
+	us	= ub.units[unitId]
+	if us == nil {
+		us	= &UnitStatus{
+			UnitId:	unitId,
+			Since:	time.Now(),
+		}
+		ub.units[unitId]	= us
+	}
+
+	return
+}
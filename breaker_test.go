@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnitBreaker(t *testing.T) {
+	var ub	*unitBreaker
+	var us	[]UnitStatus
+
+	// a disabled breaker should never trip
+	ub	= newUnitBreaker("test", 0, time.Minute)
+	for i := 0; i < 10; i++ {
+		if ub.failure(1) {
+			t.Errorf("disabled breaker should not have tripped")
+		}
+	}
+	if !ub.allow(1) {
+		t.Errorf("unit 1 should have been allowed")
+	}
+
+	ub	= newUnitBreaker("test", 3, 50 * time.Millisecond)
+
+	if ub.failure(1) || ub.failure(1) {
+		t.Errorf("breaker should not have tripped before 3 failures")
+	}
+	if !ub.allow(1) {
+		t.Errorf("unit 1 should have been allowed")
+	}
+
+	// a success should reset the failure count
+	ub.success(1)
+	if ub.failure(1) || ub.failure(1) {
+		t.Errorf("breaker should not have tripped before 3 failures")
+	}
+
+	if !ub.failure(1) {
+		t.Errorf("breaker should have tripped after 3 failures")
+	}
+	if ub.allow(1) || ub.allow(1) {
+		t.Errorf("unit 1 should have been skipped")
+	}
+
+	// other units should not be affected
+	if !ub.allow(2) {
+		t.Errorf("unit 2 should have been allowed")
+	}
+	ub.success(2)
+
+	us	= ub.status()
+	if len(us) != 2 {
+		t.Fatalf("expected 2 units, got: %v", len(us))
+	}
+
+	if us[0].UnitId != 1 || !us[0].Skipped || us[0].Failures != 3 ||
+	   us[0].TotalFailures != 5 || us[0].SkippedCycles != 2 ||
+	   us[0].NextProbe.IsZero() {
+		t.Errorf("unexpected status for unit 1: %+v", us[0])
+	}
+
+	if us[1].UnitId != 2 || us[1].Skipped || us[1].Failures != 0 ||
+	   us[1].TotalFailures != 0 || us[1].SkippedCycles != 0 {
+		t.Errorf("unexpected status for unit 2: %+v", us[1])
+	}
+
+	// the unit should be probed once the retry interval expires
+	time.Sleep(60 * time.Millisecond)
+	if !ub.allow(1) {
+		t.Errorf("unit 1 should have been allowed after the retry interval")
+	}
+
+	// a single failed probe should trip the breaker again
+	if !ub.failure(1) {
+		t.Errorf("breaker should have tripped again")
+	}
+	if ub.allow(1) {
+		t.Errorf("unit 1 should have been skipped")
+	}
+
+	// a successful probe should close the breaker
+	ub.success(1)
+	if !ub.allow(1) {
+		t.Errorf("unit 1 should have been allowed after a success")
+	}
+
+	us	= ub.status()
+	if us[0].Skipped || us[0].Failures != 0 || us[0].TotalFailures != 6 ||
+	   !us[0].NextProbe.IsZero() {
+		t.Errorf("unexpected status for unit 1: %+v", us[0])
+	}
+
+	return
+}
@@ -1,16 +1,20 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"io/ioutil"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/simonvetter/modbus"
 )
 
 type pollerConf struct {
+	Name		string		`json:"name"`
 	Url		string		`json:"url"`
 	Targets		[]*targetConf	`json:"targets"`
 	PollInterval_ms	uint		`json:"poll_interval_ms"`
@@ -21,6 +25,17 @@ type pollerConf struct {
 	Parity		string		`json:"parity"`
 	Endianness	string		`json:"endianness"`
 	WordOrder	string		`json:"word_order"`
+	ReconnectDelay_ms uint		`json:"reconnect_delay_ms"`
+	MaxReconnectDelay_ms uint	`json:"max_reconnect_delay_ms"`
+	ReconnectMultiplier float64	`json:"reconnect_multiplier"`
+	ReconnectJitter	float64		`json:"reconnect_jitter"`
+	MaxConsecutiveTimeouts uint	`json:"max_consecutive_timeouts"`
+	TLSClientCert	string		`json:"tls_client_cert"`
+	TLSClientKey	string		`json:"tls_client_key"`
+	TLSRootCA	string		`json:"tls_root_ca"`
+	Connections	uint		`json:"connections"`
+	UnitMaxFailures	uint		`json:"unit_max_failures"`
+	UnitRetryInterval_ms uint	`json:"unit_retry_interval_ms"`
 }
 
 type targetConf struct {
@@ -31,6 +46,9 @@ type targetConf struct {
 	ScaleFactor	float64		`json:"scale_factor"`
 	Offset		float64		`json:"offset"`
 	DecimalPlaces	uint		`json:"decimal_places"`
+	Tags		map[string]string `json:"tags"`
+	StoreAs		string		`json:"store_as"`
+	Counter		bool		`json:"counter"`
 }
 
 type sinkConf	struct {
@@ -38,12 +56,80 @@ type sinkConf	struct {
 	FifoSize	uint		`json:"fifo_size"`
 	MaxAge_ms	uint		`json:"max_age_ms"`
 	Url		string		`json:"url"`
+	Timeout_ms	uint		`json:"timeout_ms"`
+	Username	string		`json:"username"`
+	Password	string		`json:"password"`
+	TLSRootCA	string		`json:"tls_root_ca"`
+	TLSClientCert	string		`json:"tls_client_cert"`
+	TLSClientKey	string		`json:"tls_client_key"`
+	TLSSkipVerify	bool		`json:"tls_skip_verify"`
+	ClientId	string		`json:"client_id"`
+	Topic		string		`json:"topic"`
+	QoS		uint		`json:"qos"`
+	Retain		bool		`json:"retain"`
+	PayloadFormat	string		`json:"payload_format"`
+	ListenAddress	string		`json:"listen_address"`
+	Path		string		`json:"path"`
+	Rules		[]*labelRuleConf `json:"rules"`
+	StaleAge_ms	uint		`json:"stale_age_ms"`
+	Version		uint		`json:"version"`
+	Org		string		`json:"org"`
+	Bucket		string		`json:"bucket"`
+	Token		string		`json:"token"`
+	TokenFile	string		`json:"token_file"`
+	Tags		map[string]string `json:"tags"`
+	GroupFields	bool		`json:"group_fields"`
+	IntegerFields	bool		`json:"integer_fields"`
+	QueueDir	string		`json:"queue_dir"`
+	QueueMaxSize_mb	uint		`json:"queue_max_size_mb"`
+	QueueMaxAge_ms	uint		`json:"queue_max_age_ms"`
+	QuarantineFile	string		`json:"quarantine_file"`
+	MaxRetryDelay_ms uint		`json:"max_retry_delay_ms"`
+	BatchSize	uint		`json:"batch_size"`
+	Concurrency	uint		`json:"concurrency"`
+	Gzip		bool		`json:"gzip"`
+	OverflowPolicy	string		`json:"overflow_policy"`
+	Table		string		`json:"table"`
+	Retention_ms	uint64		`json:"retention_ms"`
+	Headers		map[string]string `json:"headers"`
+	Prefix		string		`json:"prefix"`
+	TagFormat	string		`json:"tag_format"`
+	MTU		uint		`json:"mtu"`
+	Speed		uint		`json:"speed_bps"`
+	DataBits	uint		`json:"data_bits"`
+	StopBits	uint		`json:"stop_bits"`
+	Parity		string		`json:"parity"`
+	Endianness	string		`json:"endianness"`
+	WordOrder	string		`json:"word_order"`
+	Writes		[]*writeConf	`json:"writes"`
+	Layout		string		`json:"layout"`
+	BucketInterval_ms uint		`json:"bucket_interval_ms"`
+	BucketTolerance_ms uint		`json:"bucket_tolerance_ms"`
+	TimestampFormat	string		`json:"timestamp_format"`
+	TimeZone	string		`json:"timezone"`
+	Name		string		`json:"name"`
+	Rotation	string		`json:"rotation"`
+	MaxFileSize_mb	uint		`json:"max_file_size_mb"`
+	FileNameTemplate string		`json:"file_name_template"`
+	Compression	string		`json:"compression"`
+	CompressionMode	string		`json:"compression_mode"`
+	CompressionLevel int		`json:"compression_level"`
+}
+
+type writeConf struct {
+	Label		string		`json:"label"`
+	UnitId		uint8		`json:"unit_id"`
+	RegType		string		`json:"register_type"`
+	RegAddr		uint16		`json:"register_address"`
+	ScaleFactor	float64		`json:"scale_factor"`
 }
 
 type jsonConf struct {
 	Pollers		[]*pollerConf	`json:"pollers"`
 	Sinks		[]*sinkConf	`json:"sinks"`
 	DispatchRate_ms uint		`json:"dispatch_rate_ms"`
+	StatsInterval_ms uint		`json:"stats_interval_ms"`
+	StatsPrefix	string		`json:"stats_prefix"`
 }
 
 // Main configuration object.
@@ -51,6 +137,9 @@ type Configuration struct {
 	Pollers		[]*PollerConfiguration
 	Sinks		[]*sinkConf
 	DispatchRate	time.Duration
+	StatsInterval	time.Duration	// how often to emit self-monitoring points
+					// (disabled if 0)
+	StatsPrefix	string		// label prefix of self-monitoring points
 }
 
 // Loads a JSON configuration file, validates it and builds out
@@ -80,6 +169,14 @@ func Load(path string) (conf *Configuration, err error) {
 		conf.DispatchRate = 250 * time.Millisecond
 	}
 
+	// self-monitoring is disabled unless stats_interval_ms is set.
+	// stats_prefix defaults to "datalogger".
+	conf.StatsInterval	= time.Duration(jsonConf.StatsInterval_ms) * time.Millisecond
+	conf.StatsPrefix	= jsonConf.StatsPrefix
+	if conf.StatsPrefix == "" {
+		conf.StatsPrefix = "datalogger"
+	}
+
 	if jsonConf.Pollers == nil {
 		err	= errors.New("pollers section missing")
 		return
@@ -90,9 +187,16 @@ func Load(path string) (conf *Configuration, err error) {
 		return
 	}
 
-	for _, pc := range jsonConf.Pollers {
+	for idx, pc := range jsonConf.Pollers {
 		var pollerConf	PollerConfiguration
 
+		// name defaults to poller<index>, and is used to label
+		// self-monitoring points
+		pollerConf.Name	= pc.Name
+		if pollerConf.Name == "" {
+			pollerConf.Name = fmt.Sprintf("poller%d", idx)
+		}
+
 		switch pc.Parity {
 		case "odd": pollerConf.Parity = modbus.PARITY_ODD
 		case "even": pollerConf.Parity = modbus.PARITY_EVEN
@@ -108,6 +212,12 @@ func Load(path string) (conf *Configuration, err error) {
 		}
 		pollerConf.Url		= pc.Url
 
+		// load TLS client certificate and root CAs, if any
+		err	= loadTLSSettings(pc, &pollerConf)
+		if err != nil {
+			return
+		}
+
 		// timeout defaults to 1s
 		pollerConf.Timeout	= time.Duration(pc.Timeout_ms) * time.Millisecond
 		if pollerConf.Timeout == 0 {
@@ -120,6 +230,67 @@ func Load(path string) (conf *Configuration, err error) {
 			return
 		}
 
+		// reconnection delay defaults to 5s, growing up to 25s
+		pollerConf.ReconnectDelay	=
+			time.Duration(pc.ReconnectDelay_ms) * time.Millisecond
+		if pollerConf.ReconnectDelay == 0 {
+			pollerConf.ReconnectDelay = 5 * time.Second
+		}
+
+		pollerConf.MaxReconnectDelay	=
+			time.Duration(pc.MaxReconnectDelay_ms) * time.Millisecond
+		if pollerConf.MaxReconnectDelay == 0 {
+			pollerConf.MaxReconnectDelay = 25 * time.Second
+		}
+
+		if pollerConf.MaxReconnectDelay < pollerConf.ReconnectDelay {
+			err = fmt.Errorf("poller max_reconnect_delay_ms must be greater " +
+					 "than or equal to reconnect_delay_ms")
+			return
+		}
+
+		// unless a multiplier is set, the reconnection delay grows
+		// linearly (5s, 10s, 15s, ...)
+		pollerConf.ReconnectMultiplier	= pc.ReconnectMultiplier
+		if pollerConf.ReconnectMultiplier != 0 && pollerConf.ReconnectMultiplier < 1 {
+			err = fmt.Errorf("poller reconnect_multiplier must be greater " +
+					 "than or equal to 1, got %v", pc.ReconnectMultiplier)
+			return
+		}
+
+		if pc.ReconnectJitter < 0 || pc.ReconnectJitter > 1 {
+			err = fmt.Errorf("poller reconnect_jitter must be between 0 and 1, " +
+					 "got %v", pc.ReconnectJitter)
+			return
+		}
+		pollerConf.ReconnectJitter	= pc.ReconnectJitter
+
+		pollerConf.MaxConsecutiveTimeouts = pc.MaxConsecutiveTimeouts
+
+		// connections defaults to 1. Multiple connections can only be used
+		// on TCP links as serial lines can't be shared.
+		pollerConf.Connections	= pc.Connections
+		if pollerConf.Connections == 0 {
+			pollerConf.Connections = 1
+		}
+
+		if pollerConf.Connections > 1 &&
+		   !strings.HasPrefix(pc.Url, "tcp://") &&
+		   !strings.HasPrefix(pc.Url, "tcp+tls://") {
+			err = fmt.Errorf("poller %s: connections can only be used " +
+					 "with tcp:// and tcp+tls:// links", pc.Url)
+			return
+		}
+
+		// units are skipped for 30s by default once unit_max_failures
+		// consecutive failures are seen
+		pollerConf.UnitMaxFailures	= pc.UnitMaxFailures
+		pollerConf.UnitRetryInterval	=
+			time.Duration(pc.UnitRetryInterval_ms) * time.Millisecond
+		if pollerConf.UnitRetryInterval == 0 {
+			pollerConf.UnitRetryInterval = 30 * time.Second
+		}
+
 		pollerConf.Speed	= pc.Speed
 		pollerConf.DataBits	= pc.DataBits
 		pollerConf.StopBits	= pc.StopBits
@@ -160,6 +331,8 @@ func Load(path string) (conf *Configuration, err error) {
 				ScaleFactor:	tc.ScaleFactor,
 				Offset:		tc.Offset,
 				DecimalPlaces:	tc.DecimalPlaces,
+				Tags:		tc.Tags,
+				Counter:	tc.Counter,
 			}
 
 			// each target needs a system-wide unique label
@@ -174,6 +347,22 @@ func Load(path string) (conf *Configuration, err error) {
 				return
 			}
 
+			switch tc.StoreAs {
+			case "auto", "":
+				target.StoreAs		= STORE_AUTO
+
+			case "float":
+				target.StoreAs		= STORE_FLOAT
+
+			case "integer", "int":
+				target.StoreAs		= STORE_INTEGER
+
+			default:
+				err	= fmt.Errorf("unknown store_as setting '%s' for target '%s'",
+						     tc.StoreAs, target.Label)
+				return
+			}
+
 			switch tc.RegType {
 			case "h:uint16", "holding:uint16":
 				target.ValueType	= UINT16
@@ -244,3 +433,84 @@ func Load(path string) (conf *Configuration, err error) {
 
 	return
 }
+
+// Loads the TLS client certificate/key pair and root CA certificates of
+// a poller. A client certificate, a key and a root CA are required for
+// tcp+tls:// links.
+func loadTLSSettings(pc *pollerConf, pollerConf *PollerConfiguration) (err error) {
+	var tlsConfig	*tls.Config
+
+	tlsConfig, err	= newTLSConfig(pc.TLSRootCA, pc.TLSClientCert, pc.TLSClientKey, false)
+	if err != nil {
+		err	= fmt.Errorf("poller %s: %v", pc.Url, err)
+		return
+	}
+
+	if strings.HasPrefix(pc.Url, "tcp+tls://") &&
+	   (pc.TLSClientCert == "" || pc.TLSRootCA == "") {
+		err	= fmt.Errorf("poller %s: tls_client_cert, tls_client_key " +
+				     "and tls_root_ca are required for tcp+tls:// links",
+				     pc.Url)
+		return
+	}
+
+	if tlsConfig == nil {
+		return
+	}
+
+	if len(tlsConfig.Certificates) > 0 {
+		pollerConf.TLSClientCert	= &tlsConfig.Certificates[0]
+	}
+	pollerConf.TLSRootCAs	= tlsConfig.RootCAs
+
+	return
+}
+
+// Builds a TLS client configuration out of optional root CA, client
+// certificate and key files. Returns a nil configuration if no TLS setting
+// is given.
+func newTLSConfig(rootCA string, clientCert string, clientKey string,
+		  skipVerify bool) (tlsConfig *tls.Config, err error) {
+	var cert	tls.Certificate
+	var buf		[]byte
+
+	if rootCA == "" && clientCert == "" && clientKey == "" && !skipVerify {
+		return
+	}
+
+	if (clientCert == "") != (clientKey == "") {
+		err	= errors.New("tls_client_cert and tls_client_key must be used together")
+		return
+	}
+
+	tlsConfig	= &tls.Config{
+		InsecureSkipVerify:	skipVerify,
+	}
+
+	if clientCert != "" {
+		cert, err	= tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			err	= fmt.Errorf("failed to load client certificate '%s' " +
+					     "and key '%s': %v", clientCert, clientKey, err)
+			return
+		}
+		tlsConfig.Certificates	= []tls.Certificate{ cert }
+	}
+
+	if rootCA != "" {
+		buf, err	= ioutil.ReadFile(rootCA)
+		if err != nil {
+			err	= fmt.Errorf("failed to read root CA '%s': %v", rootCA, err)
+			return
+		}
+
+		tlsConfig.RootCAs	= x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(buf) {
+			err	= fmt.Errorf("no valid PEM certificate found in root CA '%s'",
+					     rootCA)
+			return
+		}
+	}
+
+	return
+}
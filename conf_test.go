@@ -1,6 +1,18 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
 	"testing"
 	"os"
 	"time"
@@ -32,11 +44,25 @@ func TestLoadConf(t *testing.T) {
 		t.Errorf("conf.DispatchRate should have been 250ms")
 	}
 
+	if conf.StatsInterval != 60 * time.Second {
+		t.Errorf("conf.StatsInterval should have been 60s, saw: %v",
+			 conf.StatsInterval)
+	}
+
+	if conf.StatsPrefix != "datalogger" {
+		t.Errorf("conf.StatsPrefix should have been 'datalogger', saw: '%s'",
+			 conf.StatsPrefix)
+	}
+
 	if len(conf.Pollers) != 2 {
 		t.Errorf("expected 2 pollers, got: %v", len(conf.Pollers))
 	}
 
 	for idx, pc := range conf.Pollers {
+		if pc.Name != fmt.Sprintf("poller%d", idx) {
+			t.Errorf("poller #%v: unexpected name '%s'", idx, pc.Name)
+		}
+
 		switch idx {
 		case 0:
 			if pc.Url != "tcp://plc:502" {
@@ -63,6 +89,16 @@ func TestLoadConf(t *testing.T) {
 				t.Errorf("poller #%v: pollInterval should have been %v, saw: %v",
 					 idx, 5 * time.Second, pc.PollInterval)
 			}
+			if pc.ReconnectDelay != 5 * time.Second ||
+			   pc.MaxReconnectDelay != 25 * time.Second ||
+			   pc.ReconnectMultiplier != 0 ||
+			   pc.ReconnectJitter != 0 ||
+			   pc.MaxConsecutiveTimeouts != 0 {
+				t.Errorf("poller #%v: unexpected reconnection settings: " +
+					 "%v, %v, %v, %v, %v", idx, pc.ReconnectDelay,
+					 pc.MaxReconnectDelay, pc.ReconnectMultiplier,
+					 pc.ReconnectJitter, pc.MaxConsecutiveTimeouts)
+			}
 
 			if len(pc.Targets) != 5 {
 				t.Errorf("poller #%v: expected 5 targets, got: %v",
@@ -152,9 +188,24 @@ func TestLoadConf(t *testing.T) {
 				t.Errorf("poller #%v: pollInterval should have been %v, saw: %v",
 					 idx, 1 * time.Second, pc.PollInterval)
 			}
+			if pc.UnitMaxFailures != 3 ||
+			   pc.UnitRetryInterval != 60 * time.Second {
+				t.Errorf("poller #%v: unexpected unit breaker settings: %v, %v",
+					 idx, pc.UnitMaxFailures, pc.UnitRetryInterval)
+			}
+			if pc.ReconnectDelay != 1 * time.Second ||
+			   pc.MaxReconnectDelay != 60 * time.Second ||
+			   pc.ReconnectMultiplier != 1.5 ||
+			   pc.ReconnectJitter != 0.1 ||
+			   pc.MaxConsecutiveTimeouts != 10 {
+				t.Errorf("poller #%v: unexpected reconnection settings: " +
+					 "%v, %v, %v, %v, %v", idx, pc.ReconnectDelay,
+					 pc.MaxReconnectDelay, pc.ReconnectMultiplier,
+					 pc.ReconnectJitter, pc.MaxConsecutiveTimeouts)
+			}
 
-			if len(pc.Targets) != 4 {
-				t.Errorf("poller #%v: expected 4 targets, got: %v",
+			if len(pc.Targets) != 5 {
+				t.Errorf("poller #%v: expected 5 targets, got: %v",
 					 idx, len(pc.Targets))
 			}
 
@@ -198,6 +249,15 @@ func TestLoadConf(t *testing.T) {
 					ScaleFactor:	0,
 					Offset:		0,
 					DecimalPlaces:	3,
+					StoreAs:	STORE_FLOAT,
+				},
+				{
+					UnitId:		5,
+					MbType:		modbus.INPUT_REGISTER,
+					ValueType:	UINT32,
+					Label:		"main_power_meter.e_kWh",
+					RegAddr:	50770,
+					Counter:	true,
 				},
 			} {
 				if !confTestTargetEqual(pc.Targets[i], expected) {
@@ -208,8 +268,8 @@ func TestLoadConf(t *testing.T) {
 		}
 	}
 
-	if len(conf.Sinks) != 4 {
-		t.Errorf("expected 4 sinks, got: %v", len(conf.Sinks))
+	if len(conf.Sinks) != 14 {
+		t.Fatalf("expected 14 sinks, got: %v", len(conf.Sinks))
 	}
 
 	if conf.Sinks[0].Type != "json" {
@@ -225,6 +285,11 @@ func TestLoadConf(t *testing.T) {
 		t.Errorf("unexpected fifoSize for sink #0: %v", conf.Sinks[0].FifoSize)
 	}
 
+	if conf.Sinks[1].Type != "csv" || conf.Sinks[1].Compression != "gzip" ||
+	   conf.Sinks[1].CompressionMode != "" || conf.Sinks[1].CompressionLevel != 0 {
+		t.Errorf("unexpected compression settings for sink #1: %+v", conf.Sinks[1])
+	}
+
 	if conf.Sinks[2].Type != "influxdb" {
 		t.Errorf("unexpected type for sink #2: %v", conf.Sinks[2].Type)
 	}
@@ -237,6 +302,100 @@ func TestLoadConf(t *testing.T) {
 	if conf.Sinks[2].FifoSize != 200000 {
 		t.Errorf("unexpected fifoSize for sink #2: %v", conf.Sinks[2].FifoSize)
 	}
+	if conf.Sinks[2].Tags["site"] != "house" || !conf.Sinks[2].GroupFields ||
+	   len(conf.Sinks[2].Rules) != 1 ||
+	   conf.Sinks[2].Rules[0].Template != "room.sensor.field" {
+		t.Errorf("unexpected tag settings for sink #2: %+v", conf.Sinks[2])
+	}
+	if conf.Sinks[2].BatchSize != 5000 || conf.Sinks[2].Concurrency != 2 ||
+	   !conf.Sinks[2].Gzip || conf.Sinks[2].Timeout_ms != 30000 {
+		t.Errorf("unexpected batching settings for sink #2: %+v", conf.Sinks[2])
+	}
+	if conf.Sinks[2].QueueDir != "/var/lib/datalogger/influxdb-queue" ||
+	   conf.Sinks[2].QueueMaxSize_mb != 512 ||
+	   conf.Sinks[2].QueueMaxAge_ms != 604800000 ||
+	   conf.Sinks[2].QuarantineFile != "/var/lib/datalogger/influxdb-rejected.txt" {
+		t.Errorf("unexpected queue settings for sink #2: %+v", conf.Sinks[2])
+	}
+	if conf.Pollers[0].Targets[0].Tags["plc"] != "main" ||
+	   len(conf.Pollers[0].Targets[1].Tags) != 0 {
+		t.Errorf("unexpected target tags: %v, %v", conf.Pollers[0].Targets[0].Tags,
+			 conf.Pollers[0].Targets[1].Tags)
+	}
+
+	if conf.Sinks[4].Type != "mqtt" {
+		t.Errorf("unexpected type for sink #4: %v", conf.Sinks[4].Type)
+	}
+	if conf.Sinks[4].Topic != "house/{path}" || conf.Sinks[4].QoS != 1 ||
+	   !conf.Sinks[4].Retain || conf.Sinks[4].PayloadFormat != "raw" ||
+	   conf.Sinks[4].Username != "datalogger" || conf.Sinks[4].Password != "secret" {
+		t.Errorf("unexpected mqtt settings for sink #4: %+v", conf.Sinks[4])
+	}
+
+	if conf.Sinks[5].Type != "prometheus" {
+		t.Errorf("unexpected type for sink #5: %v", conf.Sinks[5].Type)
+	}
+	if conf.Sinks[5].ListenAddress != ":9273" || conf.Sinks[5].StaleAge_ms != 60000 ||
+	   len(conf.Sinks[5].Rules) != 1 ||
+	   conf.Sinks[5].Rules[0].Match != `^([^.]+)\.(sensor[0-9]+)\.([^.]+)$` ||
+	   conf.Sinks[5].Rules[0].Name != "house_$3" ||
+	   conf.Sinks[5].Rules[0].Tags["room"] != "$1" {
+		t.Errorf("unexpected prometheus settings for sink #5: %+v", conf.Sinks[5])
+	}
+
+	if conf.Sinks[6].Type != "sqlite" || conf.Sinks[6].Url != "/var/lib/datalogger/house.db" ||
+	   conf.Sinks[6].MaxAge_ms != 10000 || conf.Sinks[6].Retention_ms != 7776000000 {
+		t.Errorf("unexpected sqlite settings for sink #6: %+v", conf.Sinks[6])
+	}
+
+	if conf.Sinks[7].Type != "http" || conf.Sinks[7].PayloadFormat != "ndjson" ||
+	   conf.Sinks[7].TokenFile != "/etc/datalogger/ingest-token" ||
+	   conf.Sinks[7].Headers["X-Site"] != "house" || conf.Sinks[7].BatchSize != 500 ||
+	   conf.Sinks[7].MaxRetryDelay_ms != 300000 {
+		t.Errorf("unexpected http settings for sink #7: %+v", conf.Sinks[7])
+	}
+
+	if conf.Sinks[8].Type != "graphite" || conf.Sinks[8].Url != "tcp://carbon:2003" ||
+	   conf.Sinks[8].Prefix != "house" || conf.Sinks[8].MaxAge_ms != 5000 {
+		t.Errorf("unexpected graphite settings for sink #8: %+v", conf.Sinks[8])
+	}
+
+	if conf.Sinks[9].Type != "statsd" || conf.Sinks[9].TagFormat != "dogstatsd" ||
+	   conf.Sinks[9].MTU != 8932 || conf.Sinks[9].Tags["site"] != "house" ||
+	   len(conf.Sinks[9].Rules) != 1 {
+		t.Errorf("unexpected statsd settings for sink #9: %+v", conf.Sinks[9])
+	}
+
+	if conf.Sinks[10].Type != "opentsdb" || conf.Sinks[10].Url != "http://opentsdb:4242" ||
+	   conf.Sinks[10].BatchSize != 50 || len(conf.Sinks[10].Rules) != 1 ||
+	   conf.Sinks[10].Rules[0].Name != "house.$3" {
+		t.Errorf("unexpected opentsdb settings for sink #10: %+v", conf.Sinks[10])
+	}
+
+	if conf.Sinks[11].Type != "modbus" || conf.Sinks[11].Url != "tcp://display-panel:502" ||
+	   conf.Sinks[11].WordOrder != "lowfirst" || len(conf.Sinks[11].Writes) != 2 ||
+	   conf.Sinks[11].Writes[0].Label != "main_power_meter.p_kW" ||
+	   conf.Sinks[11].Writes[0].RegType != "h:int32" ||
+	   conf.Sinks[11].Writes[0].RegAddr != 100 ||
+	   conf.Sinks[11].Writes[0].ScaleFactor != 1000 ||
+	   conf.Sinks[11].Writes[1].UnitId != 1 {
+		t.Errorf("unexpected modbus settings for sink #11: %+v", conf.Sinks[11])
+	}
+
+	if conf.Sinks[12].Type != "parquet" || conf.Sinks[12].Url != "/mnt/data_archive/parquet" ||
+	   conf.Sinks[12].FifoSize != 100000 || conf.Sinks[12].MaxAge_ms != 300000 ||
+	   conf.Sinks[12].Name != "plant1" || conf.Sinks[12].Rotation != "hourly" ||
+	   conf.Sinks[12].FileNameTemplate != "{year}/{month}/{day}/{sink}-{hour}" {
+		t.Errorf("unexpected parquet settings for sink #12: %+v", conf.Sinks[12])
+	}
+
+	if conf.Sinks[13].Type != "csv" || conf.Sinks[13].Layout != "wide" ||
+	   conf.Sinks[13].BucketTolerance_ms != 2000 || conf.Sinks[13].BucketInterval_ms != 0 ||
+	   conf.Sinks[13].TimestampFormat != "rfc3339" || conf.Sinks[13].TimeZone != "Europe/Paris" ||
+	   conf.Sinks[13].MaxFileSize_mb != 64 || conf.Sinks[13].Compression != "zstd" ||
+	   conf.Sinks[13].CompressionMode != "rotate" || conf.Sinks[13].CompressionLevel != 19 {
+		t.Errorf("unexpected wide csv settings for sink #13: %+v", conf.Sinks[13])
+	}
 
 	return
 }
@@ -253,7 +412,9 @@ func confTestTargetEqual(a *Target, b *Target) (yes bool) {
 	   a.RegAddr != b.RegAddr ||
 	   a.ScaleFactor != b.ScaleFactor ||
 	   a.Offset != b.Offset ||
-	   a.DecimalPlaces != b.DecimalPlaces {
+	   a.DecimalPlaces != b.DecimalPlaces ||
+	   a.StoreAs != b.StoreAs ||
+	   a.Counter != b.Counter {
 		   return
 	 }
 
@@ -261,3 +422,245 @@ func confTestTargetEqual(a *Target, b *Target) (yes bool) {
 
 	return
 }
+
+func TestLoadConfTLS(t *testing.T) {
+	var err		error
+	var conf	*Configuration
+	var dir		string
+	var certPath	string
+	var keyPath	string
+	var confPath	string
+
+	dir		= t.TempDir()
+	certPath	= filepath.Join(dir, "client.crt")
+	keyPath		= filepath.Join(dir, "client.key")
+	confPath	= filepath.Join(dir, "conf.json")
+
+	confTestGenerateCert(t, certPath, keyPath)
+
+	writeConf := func(pollerSettings string) {
+		err	= ioutil.WriteFile(confPath, []byte(fmt.Sprintf(`{
+			"pollers": [{
+				"url": "tcp+tls://plc:802",
+				"poll_interval_ms": 1000,
+				%s
+				"targets": [{
+					"register_type": "h:uint16",
+					"register_address": 0,
+					"label": "plc.reg0"
+				}]
+			}],
+			"sinks": [{ "type": "console" }]
+		}`, pollerSettings)), 0600)
+		if err != nil {
+			t.Fatalf("failed to write config file: %v", err)
+		}
+	}
+
+	// tcp+tls links without certificates should be rejected
+	writeConf("")
+	_, err	= Load(confPath)
+	if err == nil || !strings.Contains(err.Error(), "required for tcp+tls") {
+		t.Errorf("Load() should have failed with a missing cert error, got: %v", err)
+	}
+
+	// a certificate without a key should be rejected
+	writeConf(fmt.Sprintf(`"tls_client_cert": "%s", "tls_root_ca": "%s",`,
+			      certPath, certPath))
+	_, err	= Load(confPath)
+	if err == nil || !strings.Contains(err.Error(), "must be used together") {
+		t.Errorf("Load() should have failed with a missing key error, got: %v", err)
+	}
+
+	// non-existent files should be reported
+	writeConf(fmt.Sprintf(`"tls_client_cert": "%s", "tls_client_key": "%s",
+			       "tls_root_ca": "%s",`,
+			      certPath, filepath.Join(dir, "missing.key"), certPath))
+	_, err	= Load(confPath)
+	if err == nil || !strings.Contains(err.Error(), "failed to load client certificate") {
+		t.Errorf("Load() should have failed with a load error, got: %v", err)
+	}
+
+	// a root CA file without any certificate should be rejected
+	writeConf(fmt.Sprintf(`"tls_client_cert": "%s", "tls_client_key": "%s",
+			       "tls_root_ca": "%s",`,
+			      certPath, keyPath, keyPath))
+	_, err	= Load(confPath)
+	if err == nil || !strings.Contains(err.Error(), "no valid PEM certificate") {
+		t.Errorf("Load() should have failed with a PEM error, got: %v", err)
+	}
+
+	// valid settings
+	writeConf(fmt.Sprintf(`"tls_client_cert": "%s", "tls_client_key": "%s",
+			       "tls_root_ca": "%s",`,
+			      certPath, keyPath, certPath))
+	conf, err	= Load(confPath)
+	if err != nil {
+		t.Fatalf("Load() should have succeeded, got: %v", err)
+	}
+
+	if conf.Pollers[0].TLSClientCert == nil {
+		t.Errorf("TLSClientCert should have been set")
+	}
+	if conf.Pollers[0].TLSRootCAs == nil {
+		t.Errorf("TLSRootCAs should have been set")
+	}
+
+	return
+}
+
+// Generates a self-signed certificate and its private key.
+func confTestGenerateCert(t *testing.T, certPath string, keyPath string) {
+	var err		error
+	var key		*ecdsa.PrivateKey
+	var der		[]byte
+	var keyDer	[]byte
+	var template	x509.Certificate
+
+	key, err	= ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template	= x509.Certificate{
+		SerialNumber:		big.NewInt(1),
+		Subject:		pkix.Name{CommonName: "datalogger"},
+		NotBefore:		time.Now().Add(-1 * time.Hour),
+		NotAfter:		time.Now().Add(1 * time.Hour),
+		IsCA:			true,
+		BasicConstraintsValid:	true,
+	}
+
+	der, err	= x509.CreateCertificate(rand.Reader, &template, &template,
+						 &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	keyDer, err	= x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	err	= ioutil.WriteFile(certPath, pem.EncodeToMemory(
+			&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+
+	err	= ioutil.WriteFile(keyPath, pem.EncodeToMemory(
+			&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+
+	return
+}
+
+func TestLoadConfConnections(t *testing.T) {
+	var err		error
+	var conf	*Configuration
+	var confPath	string
+
+	confPath	= filepath.Join(t.TempDir(), "conf.json")
+
+	for _, tc := range []struct {
+		url		string
+		connections	uint
+		valid		bool
+	}{
+		{ "tcp://gateway:502", 0, true },
+		{ "tcp://gateway:502", 4, true },
+		{ "rtu:///dev/ttyUSB0", 1, true },
+		{ "rtu:///dev/ttyUSB0", 2, false },
+		{ "rtuovertcp://gateway:502", 2, false },
+	} {
+		err	= ioutil.WriteFile(confPath, []byte(fmt.Sprintf(`{
+			"pollers": [{
+				"url": "%s",
+				"poll_interval_ms": 1000,
+				"connections": %d,
+				"unit_max_failures": 3,
+				"targets": [{
+					"register_type": "h:uint16",
+					"register_address": 0,
+					"label": "plc.reg0"
+				}]
+			}],
+			"sinks": [{ "type": "console" }]
+		}`, tc.url, tc.connections)), 0600)
+		if err != nil {
+			t.Fatalf("failed to write config file: %v", err)
+		}
+
+		conf, err	= Load(confPath)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("%s with %v connections should have been rejected",
+					 tc.url, tc.connections)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Load() should have succeeded, got: %v", err)
+			continue
+		}
+
+		if tc.connections == 0 && conf.Pollers[0].Connections != 1 {
+			t.Errorf("connections should have defaulted to 1, got: %v",
+				 conf.Pollers[0].Connections)
+		}
+		if conf.Pollers[0].UnitMaxFailures != 3 {
+			t.Errorf("unit_max_failures should have been 3, got: %v",
+				 conf.Pollers[0].UnitMaxFailures)
+		}
+		if conf.Pollers[0].UnitRetryInterval != 30 * time.Second {
+			t.Errorf("unit_retry_interval should have defaulted to 30s, got: %v",
+				 conf.Pollers[0].UnitRetryInterval)
+		}
+	}
+
+	return
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	var err		error
+	var tlsConfig	*tls.Config
+	var dir		string
+	var certPath	string
+	var keyPath	string
+
+	dir		= t.TempDir()
+	certPath	= filepath.Join(dir, "client.crt")
+	keyPath		= filepath.Join(dir, "client.key")
+	confTestGenerateCert(t, certPath, keyPath)
+
+	// no setting should yield no configuration
+	tlsConfig, err	= newTLSConfig("", "", "", false)
+	if err != nil || tlsConfig != nil {
+		t.Errorf("expected a nil configuration, got: %v, %v", tlsConfig, err)
+	}
+
+	_, err	= newTLSConfig("", certPath, "", false)
+	if err == nil {
+		t.Errorf("newTLSConfig() should have failed without a key")
+	}
+
+	_, err	= newTLSConfig(filepath.Join(dir, "missing.crt"), "", "", false)
+	if err == nil {
+		t.Errorf("newTLSConfig() should have failed on a missing root CA")
+	}
+
+	tlsConfig, err	= newTLSConfig(certPath, certPath, keyPath, true)
+	if err != nil {
+		t.Fatalf("newTLSConfig() should have succeeded, got: %v", err)
+	}
+
+	if len(tlsConfig.Certificates) != 1 || tlsConfig.RootCAs == nil ||
+	   !tlsConfig.InsecureSkipVerify {
+		t.Errorf("unexpected configuration: %+v", tlsConfig)
+	}
+
+	return
+}
@@ -0,0 +1,696 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errQueueFull	= errors.New("queue full")
+
+// Disk-backed FIFO queue of points, made of append-only segment files.
+// Points are stored one per line, as JSON records. The read position is
+// persisted in a cursor file so that the queue survives restarts.
+// The queue is meant to be used by a single consumer (peek/ack).
+type diskQueue struct {
+	lock		sync.Mutex
+	dir		string
+	maxSize		int64		// max. total size of all segments, in bytes
+	segmentSize	int64		// size after which segments are rotated
+	maxAge		time.Duration	// points older than this are dropped on read
+					// (disabled if 0)
+	segments	[]*queueSegment	// oldest first, the last one being written to
+	file		*os.File	// last segment, open for writing
+	size		int64		// total size of all segments
+	depth		uint64		// number of unread points
+	lost		uint64		// number of points lost to unreadable
+					// segments
+}
+
+// Queue segment (file).
+type queueSegment struct {
+	seq		uint64
+	size		int64		// size of the segment, in bytes
+	count		uint64		// number of points in the segment
+	offset		int64		// read offset (first segment only)
+	read		uint64		// number of points read (first segment only)
+}
+
+// Position in the queue, returned by peek() and used to acknowledge points.
+type queueCursor struct {
+	seq		uint64
+	offset		int64
+	read		uint64
+}
+
+// On-disk point record.
+type queueRecord struct {
+	Timestamp	int64			`json:"ts"`
+	Label		string			`json:"label"`
+	Type		string			`json:"type"`
+	Value		string			`json:"value"`
+	Tags		map[string]string	`json:"tags,omitempty"`
+}
+
+// Returns a new disk queue rooted at dir, loading any existing segment.
+func newDiskQueue(dir string, maxSize int64, segmentSize int64,
+		  maxAge time.Duration) (dq *diskQueue, err error) {
+	var names	[]string
+	var seq		uint64
+	var seg		*queueSegment
+	var cursor	queueCursor
+	var buf		[]byte
+
+	dq = &diskQueue{
+		dir:		dir,
+		maxSize:	maxSize,
+		segmentSize:	segmentSize,
+		maxAge:		maxAge,
+	}
+
+	// default to 1GB of queued data
+	if dq.maxSize <= 0 {
+		dq.maxSize	= 1 << 30
+	}
+
+	// default to 16MB segments
+	if dq.segmentSize <= 0 {
+		dq.segmentSize	= 16 << 20
+	}
+
+	if dq.segmentSize > dq.maxSize {
+		dq.segmentSize	= dq.maxSize
+	}
+
+	err	= os.MkdirAll(dq.dir, 0750)
+	if err != nil {
+		return
+	}
+
+	names, err	= filepath.Glob(filepath.Join(dq.dir, "*.seg"))
+	if err != nil {
+		return
+	}
+	sort.Strings(names)
+
+	// load the read position, if any
+	buf, err	= ioutil.ReadFile(filepath.Join(dq.dir, "cursor"))
+	if err == nil {
+		_, err	= fmt.Sscanf(string(buf), "%d %d", &cursor.seq, &cursor.offset)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("disk queue %s: ignoring invalid cursor file: %v\n", dq.dir, err)
+	}
+	err	= nil
+
+	for _, name := range names {
+		seq, err	= strconv.ParseUint(
+			strings.TrimSuffix(filepath.Base(name), ".seg"), 10, 64)
+		if err != nil {
+			err	= fmt.Errorf("invalid segment name '%s'", name)
+			return
+		}
+
+		// remove segments which have been fully read
+		if seq < cursor.seq {
+			os.Remove(name)
+			continue
+		}
+
+		seg	= &queueSegment{
+			seq:	seq,
+		}
+
+		if seq == cursor.seq {
+			seg.offset	= cursor.offset
+		}
+
+		err	= dq.scanSegment(seg)
+		if err != nil {
+			return
+		}
+
+		dq.segments	= append(dq.segments, seg)
+		dq.size		+= seg.size
+		dq.depth	+= seg.count - seg.read
+	}
+
+	// start with an empty segment, numbered after the last read one
+	if len(dq.segments) == 0 {
+		dq.segments	= []*queueSegment{ { seq: cursor.seq + 1 } }
+	}
+
+	seg		= dq.segments[len(dq.segments) - 1]
+	dq.file, err	= os.OpenFile(dq.segmentPath(seg.seq),
+				      os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+
+	return
+}
+
+// Counts records in a segment and truncates any partially written record
+// (e.g. following a crash).
+func (dq *diskQueue) scanSegment(seg *queueSegment) (err error) {
+	var file	*os.File
+	var r		*bufio.Reader
+	var line	[]byte
+	var pos		int64
+
+	file, err	= os.OpenFile(dq.segmentPath(seg.seq), os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	r	= bufio.NewReader(file)
+	for {
+		line, err	= r.ReadBytes('\n')
+		if err == io.EOF {
+			err	= nil
+			break
+		}
+		if err != nil {
+			return
+		}
+
+		pos	+= int64(len(line))
+		seg.count++
+		if pos <= seg.offset {
+			seg.read++
+		}
+	}
+
+	if len(line) > 0 {
+		fmt.Printf("disk queue %s: truncating partial record in segment %d\n",
+			   dq.dir, seg.seq)
+		err	= file.Truncate(pos)
+		if err != nil {
+			return
+		}
+	}
+
+	seg.size	= pos
+	if seg.offset > seg.size {
+		seg.offset	= seg.size
+	}
+
+	return
+}
+
+// Returns the number of unread points.
+func (dq *diskQueue) Depth() (depth uint64) {
+	dq.lock.Lock()
+	depth	= dq.depth
+	dq.lock.Unlock()
+
+	return
+}
+
+// Returns the total size of all segments, in bytes.
+func (dq *diskQueue) Size() (size int64) {
+	dq.lock.Lock()
+	size	= dq.size
+	dq.lock.Unlock()
+
+	return
+}
+
+// Returns the number of points lost to unreadable segments.
+func (dq *diskQueue) Lost() (lost uint64) {
+	dq.lock.Lock()
+	lost	= dq.lost
+	dq.lock.Unlock()
+
+	return
+}
+
+// Returns the timestamp of the oldest unread point, if any.
+func (dq *diskQueue) Oldest() (ts time.Time, ok bool) {
+	var points	[]*Point
+	var err		error
+
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+
+	points, _, err	= dq.read(1, false)
+	if err != nil || len(points) == 0 {
+		return
+	}
+
+	ts	= points[0].Timestamp
+	ok	= true
+
+	return
+}
+
+// Appends points to the queue. When the queue is full, the oldest segments
+// are dropped to make room for new points. Returns the number of points
+// written.
+func (dq *diskQueue) push(points []*Point) (count uint, err error) {
+	var buf		bytes.Buffer
+	var line	[]byte
+	var n		uint
+
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+
+	for _, p := range points {
+		if p == nil {
+			continue
+		}
+
+		line, err	= encodeQueueRecord(p)
+		if err != nil {
+			fmt.Printf("disk queue %s: discarding point with label '%s': %v\n",
+				   dq.dir, p.Label, err)
+			err	= nil
+			continue
+		}
+
+		buf.Write(line)
+		buf.WriteByte('\n')
+		n++
+
+		if int64(buf.Len()) >= dq.segmentSize {
+			err	= dq.write(buf.Bytes(), uint64(n))
+			if err != nil {
+				return
+			}
+			count	+= n
+			n	= 0
+			buf.Reset()
+		}
+	}
+
+	if n > 0 {
+		err	= dq.write(buf.Bytes(), uint64(n))
+		if err != nil {
+			return
+		}
+		count	+= n
+	}
+
+	return
+}
+
+// Writes count serialized records to the last segment, rotating segments and
+// enforcing the size limit as needed.
+func (dq *diskQueue) write(data []byte, count uint64) (err error) {
+	var seg		*queueSegment
+
+	seg	= dq.segments[len(dq.segments) - 1]
+
+	// start a new segment if the current one is full
+	if seg.size > 0 && seg.size + int64(len(data)) > dq.segmentSize {
+		err	= dq.rotate()
+		if err != nil {
+			return
+		}
+	}
+
+	// make room by dropping the oldest segments
+	for dq.size + int64(len(data)) > dq.maxSize && len(dq.segments) > 1 {
+		seg		= dq.segments[0]
+		dq.segments	= dq.segments[1:]
+		dq.size		-= seg.size
+		dq.depth	-= seg.count - seg.read
+		os.Remove(dq.segmentPath(seg.seq))
+
+		fmt.Printf("disk queue %s: full, dropped %v points\n",
+			   dq.dir, seg.count - seg.read)
+	}
+
+	if dq.size + int64(len(data)) > dq.maxSize {
+		err	= errQueueFull
+		return
+	}
+
+	seg	= dq.segments[len(dq.segments) - 1]
+
+	_, err	= dq.file.Write(data)
+	if err != nil {
+		return
+	}
+
+	err	= dq.file.Sync()
+	if err != nil {
+		return
+	}
+
+	seg.size	+= int64(len(data))
+	seg.count	+= count
+	dq.size		+= int64(len(data))
+	dq.depth	+= count
+
+	return
+}
+
+// Closes the last segment and opens a new one.
+func (dq *diskQueue) rotate() (err error) {
+	var seg		*queueSegment
+
+	dq.file.Close()
+
+	seg		= &queueSegment{
+		seq:	dq.segments[len(dq.segments) - 1].seq + 1,
+	}
+	dq.file, err	= os.OpenFile(dq.segmentPath(seg.seq),
+				      os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return
+	}
+
+	dq.segments	= append(dq.segments, seg)
+
+	return
+}
+
+// Returns up to max unread points, without removing them from the queue.
+// Points older than maxAge are skipped. The returned cursor is to be passed to
+// ack() once points have been processed.
+func (dq *diskQueue) peek(max uint) (points []*Point, cursor queueCursor, err error) {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+
+	points, cursor, err	= dq.read(max, true)
+
+	return
+}
+
+// Reads up to max points from the head of the queue, optionally skipping
+// expired ones. Segments which cannot be read (e.g. truncated or removed
+// behind the queue's back) are quarantined rather than blocking the queue
+// forever.
+func (dq *diskQueue) read(max uint, skipExpired bool) (points []*Point, cursor queueCursor, err error) {
+	var file	*os.File
+	var r		*bufio.Reader
+	var line	[]byte
+	var p		*Point
+	var expired	uint64
+	var seg		*queueSegment
+	var prev	queueCursor
+	var start	int
+
+	for idx := 0; idx < len(dq.segments); idx++ {
+		if uint(len(points)) >= max {
+			break
+		}
+
+		seg	= dq.segments[idx]
+		prev	= cursor
+		start	= len(points)
+		cursor	= queueCursor{
+			seq:	seg.seq,
+			offset:	seg.offset,
+			read:	seg.read,
+		}
+
+		if seg.read >= seg.count {
+			continue
+		}
+
+		file, err	= os.Open(dq.segmentPath(seg.seq))
+		if err == nil {
+			_, err	= file.Seek(seg.offset, io.SeekStart)
+			r	= bufio.NewReader(file)
+		}
+
+		for err == nil && cursor.read < seg.count && uint(len(points)) < max {
+			line, err	= r.ReadBytes('\n')
+			if err != nil {
+				break
+			}
+
+			cursor.offset	+= int64(len(line))
+			cursor.read++
+
+			p, err	= decodeQueueRecord(line)
+			if err != nil {
+				fmt.Printf("disk queue %s: discarding invalid record: %v\n",
+					   dq.dir, err)
+				err	= nil
+				continue
+			}
+
+			if skipExpired && dq.maxAge > 0 && time.Since(p.Timestamp) > dq.maxAge {
+				expired++
+				continue
+			}
+
+			points	= append(points, p)
+		}
+		if file != nil {
+			file.Close()
+		}
+
+		// give up on the whole segment, including points read from it
+		// so far, and go on with the next one
+		if err != nil {
+			fmt.Printf("disk queue %s: failed to read segment %d: %v\n",
+				   dq.dir, seg.seq, err)
+
+			err	= dq.quarantine(idx)
+			if err != nil {
+				return
+			}
+
+			points	= points[:start]
+			cursor	= prev
+			idx--
+		}
+	}
+
+	if expired > 0 {
+		fmt.Printf("disk queue %s: dropped %v expired points\n", dq.dir, expired)
+	}
+
+	return
+}
+
+// Removes the unreadable segment at index idx from the queue, renaming its
+// file so that it is not loaded again but can still be inspected, and counts
+// its unread points as lost.
+func (dq *diskQueue) quarantine(idx int) (err error) {
+	var seg		*queueSegment
+	var path	string
+	var lost	uint64
+
+	seg	= dq.segments[idx]
+
+	// stop writing to the segment if it is the last one
+	if idx == len(dq.segments) - 1 {
+		err	= dq.rotate()
+		if err != nil {
+			return
+		}
+	}
+
+	dq.segments	= append(dq.segments[:idx], dq.segments[idx + 1:]...)
+	lost		= seg.count - seg.read
+	dq.size		-= seg.size
+	dq.depth	-= lost
+	dq.lost		+= lost
+
+	path	= dq.segmentPath(seg.seq)
+	err	= os.Rename(path, path + ".bad")
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("disk queue %s: failed to move segment %d aside: %v\n",
+			   dq.dir, seg.seq, err)
+	}
+
+	fmt.Printf("disk queue %s: quarantined segment %d, dropped %v points\n",
+		   dq.dir, seg.seq, lost)
+
+	err	= dq.saveCursor()
+
+	return
+}
+
+// Removes all points up to cursor from the queue.
+func (dq *diskQueue) ack(cursor queueCursor) (err error) {
+	var seg		*queueSegment
+
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+
+	for len(dq.segments) > 0 {
+		seg	= dq.segments[0]
+
+		// the cursor refers to a segment which has already been dropped
+		if seg.seq > cursor.seq {
+			break
+		}
+
+		if seg.seq == cursor.seq {
+			dq.depth	-= cursor.read - seg.read
+			seg.offset	= cursor.offset
+			seg.read	= cursor.read
+		} else {
+			dq.depth	-= seg.count - seg.read
+			seg.read	= seg.count
+		}
+
+		// keep the last segment around, as it is being written to
+		if seg.read < seg.count || len(dq.segments) == 1 {
+			break
+		}
+
+		dq.segments	= dq.segments[1:]
+		dq.size		-= seg.size
+		os.Remove(dq.segmentPath(seg.seq))
+	}
+
+	// if all points were read, start over with an empty segment
+	seg	= dq.segments[0]
+	if len(dq.segments) == 1 && seg.read == seg.count && seg.size > 0 {
+		err	= dq.rotate()
+		if err != nil {
+			return
+		}
+		dq.segments	= dq.segments[1:]
+		dq.size		-= seg.size
+		os.Remove(dq.segmentPath(seg.seq))
+	}
+
+	err	= dq.saveCursor()
+
+	return
+}
+
+// Persists the read position of the first segment.
+func (dq *diskQueue) saveCursor() (err error) {
+	var tmpPath	string
+
+	tmpPath	= filepath.Join(dq.dir, "cursor.tmp")
+	err	= ioutil.WriteFile(tmpPath, []byte(fmt.Sprintf("%d %d\n",
+				   dq.segments[0].seq, dq.segments[0].offset)), 0640)
+	if err != nil {
+		return
+	}
+
+	err	= os.Rename(tmpPath, filepath.Join(dq.dir, "cursor"))
+
+	return
+}
+
+// Returns the path of a segment file.
+func (dq *diskQueue) segmentPath(seq uint64) (path string) {
+	path	= filepath.Join(dq.dir, fmt.Sprintf("%020d.seg", seq))
+
+	return
+}
+
+// Serializes a point into a queue record, preserving the value type.
+func encodeQueueRecord(p *Point) (line []byte, err error) {
+	var rec	queueRecord
+
+	rec	= queueRecord{
+		Timestamp:	p.Timestamp.UnixNano(),
+		Label:		p.Label,
+		Tags:		p.Tags,
+	}
+
+	switch v := p.Value.(type) {
+	case float64:	rec.Type, rec.Value = "f64", strconv.FormatFloat(v, 'g', -1, 64)
+	case float32:	rec.Type, rec.Value = "f32", strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case int:	rec.Type, rec.Value = "int", strconv.FormatInt(int64(v), 10)
+	case int8:	rec.Type, rec.Value = "i8", strconv.FormatInt(int64(v), 10)
+	case int16:	rec.Type, rec.Value = "i16", strconv.FormatInt(int64(v), 10)
+	case int32:	rec.Type, rec.Value = "i32", strconv.FormatInt(int64(v), 10)
+	case int64:	rec.Type, rec.Value = "i64", strconv.FormatInt(v, 10)
+	case uint:	rec.Type, rec.Value = "uint", strconv.FormatUint(uint64(v), 10)
+	case uint8:	rec.Type, rec.Value = "u8", strconv.FormatUint(uint64(v), 10)
+	case uint16:	rec.Type, rec.Value = "u16", strconv.FormatUint(uint64(v), 10)
+	case uint32:	rec.Type, rec.Value = "u32", strconv.FormatUint(uint64(v), 10)
+	case uint64:	rec.Type, rec.Value = "u64", strconv.FormatUint(v, 10)
+	case bool:	rec.Type, rec.Value = "bool", strconv.FormatBool(v)
+	case string:	rec.Type, rec.Value = "str", v
+	default:
+		err	= fmt.Errorf("unsupported value type %T", p.Value)
+		return
+	}
+
+	line, err	= json.Marshal(&rec)
+
+	return
+}
+
+// Deserializes a queue record into a point.
+func decodeQueueRecord(line []byte) (p *Point, err error) {
+	var rec	queueRecord
+	var f64	float64
+	var i64	int64
+	var u64	uint64
+
+	err	= json.Unmarshal(line, &rec)
+	if err != nil {
+		return
+	}
+
+	p	= &Point{
+		Timestamp:	time.Unix(0, rec.Timestamp).UTC(),
+		Label:		rec.Label,
+		Tags:		rec.Tags,
+	}
+
+	switch rec.Type {
+	case "f64":
+		f64, err	= strconv.ParseFloat(rec.Value, 64)
+		p.Value		= f64
+	case "f32":
+		f64, err	= strconv.ParseFloat(rec.Value, 32)
+		p.Value		= float32(f64)
+	case "int":
+		i64, err	= strconv.ParseInt(rec.Value, 10, 0)
+		p.Value		= int(i64)
+	case "i8":
+		i64, err	= strconv.ParseInt(rec.Value, 10, 8)
+		p.Value		= int8(i64)
+	case "i16":
+		i64, err	= strconv.ParseInt(rec.Value, 10, 16)
+		p.Value		= int16(i64)
+	case "i32":
+		i64, err	= strconv.ParseInt(rec.Value, 10, 32)
+		p.Value		= int32(i64)
+	case "i64":
+		i64, err	= strconv.ParseInt(rec.Value, 10, 64)
+		p.Value		= i64
+	case "uint":
+		u64, err	= strconv.ParseUint(rec.Value, 10, 0)
+		p.Value		= uint(u64)
+	case "u8":
+		u64, err	= strconv.ParseUint(rec.Value, 10, 8)
+		p.Value		= uint8(u64)
+	case "u16":
+		u64, err	= strconv.ParseUint(rec.Value, 10, 16)
+		p.Value		= uint16(u64)
+	case "u32":
+		u64, err	= strconv.ParseUint(rec.Value, 10, 32)
+		p.Value		= uint32(u64)
+	case "u64":
+		u64, err	= strconv.ParseUint(rec.Value, 10, 64)
+		p.Value		= u64
+	case "bool":
+		p.Value, err	= strconv.ParseBool(rec.Value)
+	case "str":
+		p.Value		= rec.Value
+	default:
+		err		= fmt.Errorf("unsupported value type '%s'", rec.Type)
+	}
+
+	if err != nil {
+		p	= nil
+	}
+
+	return
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskQueueRecords(t *testing.T) {
+	var line	[]byte
+	var p		*Point
+	var err		error
+
+	for _, value := range []interface{}{
+		float64(1.5), float32(-2.25), math.Inf(1), int(-1), int8(-8), int16(-16),
+		int32(-32), int64(math.MinInt64), uint(1), uint8(8), uint16(16),
+		uint32(32), uint64(math.MaxUint64), true, "some \"text\"\n",
+	} {
+		line, err	= encodeQueueRecord(&Point{
+			Timestamp:	time.Unix(1569150729, 123456789),
+			Label:		"sensor0.value",
+			Value:		value,
+			Tags:		map[string]string{ "room": "kitchen" },
+		})
+		if err != nil {
+			t.Errorf("encodeQueueRecord(%T) should have succeeded, got: %v",
+				 value, err)
+			continue
+		}
+
+		p, err	= decodeQueueRecord(line)
+		if err != nil {
+			t.Errorf("decodeQueueRecord(%T) should have succeeded, got: %v",
+				 value, err)
+			continue
+		}
+
+		if p.Value != value || p.Label != "sensor0.value" ||
+		   !p.Timestamp.Equal(time.Unix(1569150729, 123456789)) ||
+		   p.Tags["room"] != "kitchen" {
+			t.Errorf("unexpected point: %+v (expected %T(%v))", p, value, value)
+		}
+	}
+
+	_, err	= encodeQueueRecord(&Point{ Value: struct{}{} })
+	if err == nil {
+		t.Errorf("encodeQueueRecord() should have failed")
+	}
+
+	_, err	= decodeQueueRecord([]byte(`{"type":"u16","value":"70000"}`))
+	if err == nil {
+		t.Errorf("decodeQueueRecord() should have failed")
+	}
+
+	return
+}
+
+func TestDiskQueue(t *testing.T) {
+	var dq		*diskQueue
+	var dir		string
+	var err		error
+	var points	[]*Point
+	var cursor	queueCursor
+	var count	uint
+	var oldest	time.Time
+	var ok		bool
+
+	dir, err	= ioutil.TempDir("", "datalogger-queue")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// use small segments so that points span several of them
+	dq, err	= newDiskQueue(dir, 1 << 20, 256, 0)
+	if err != nil {
+		t.Fatalf("newDiskQueue() should have succeeded, got: %v", err)
+	}
+
+	_, ok	= dq.Oldest()
+	if ok || dq.Depth() != 0 {
+		t.Errorf("queue should have been empty")
+	}
+
+	count, err	= dq.push(diskQueueTestPoints(0, 10))
+	if err != nil || count != 10 {
+		t.Fatalf("push() should have written 10 points, got: %v, %v", count, err)
+	}
+
+	if dq.Depth() != 10 {
+		t.Errorf("expected a depth of 10, got: %v", dq.Depth())
+	}
+
+	if len(dq.segments) < 3 {
+		t.Errorf("expected at least 3 segments, got: %v", len(dq.segments))
+	}
+
+	oldest, ok	= dq.Oldest()
+	if !ok || !oldest.Equal(time.Unix(1569150000, 0)) {
+		t.Errorf("unexpected oldest point timestamp: %v (%v)", oldest, ok)
+	}
+
+	// peek without acknowledging: the same points should be returned again
+	points, _, err	= dq.peek(4)
+	if err != nil || len(points) != 4 {
+		t.Fatalf("peek() should have returned 4 points, got: %v, %v", len(points), err)
+	}
+	points, cursor, err	= dq.peek(4)
+	if err != nil || len(points) != 4 || points[0].Label != "sensor.p0" ||
+	   points[3].Label != "sensor.p3" {
+		t.Fatalf("unexpected peek() result: %v, %v", points, err)
+	}
+
+	err	= dq.ack(cursor)
+	if err != nil {
+		t.Errorf("ack() should have succeeded, got: %v", err)
+	}
+	if dq.Depth() != 6 {
+		t.Errorf("expected a depth of 6, got: %v", dq.Depth())
+	}
+
+	// reopen the queue: unacknowledged points should still be there
+	dq.file.Close()
+	dq, err	= newDiskQueue(dir, 1 << 20, 256, 0)
+	if err != nil {
+		t.Fatalf("newDiskQueue() should have succeeded, got: %v", err)
+	}
+	if dq.Depth() != 6 {
+		t.Errorf("expected a depth of 6 after reopening, got: %v", dq.Depth())
+	}
+
+	count, err	= dq.push(diskQueueTestPoints(10, 2))
+	if err != nil || count != 2 {
+		t.Fatalf("push() should have written 2 points, got: %v, %v", count, err)
+	}
+
+	points, cursor, err	= dq.peek(100)
+	if err != nil || len(points) != 8 {
+		t.Fatalf("peek() should have returned 8 points, got: %v, %v", len(points), err)
+	}
+	for idx, p := range points {
+		if p.Label != fmt.Sprintf("sensor.p%d", idx + 4) || p.Value != uint16(idx + 4) {
+			t.Errorf("unexpected point #%v: %+v", idx, p)
+		}
+	}
+
+	err	= dq.ack(cursor)
+	if err != nil {
+		t.Errorf("ack() should have succeeded, got: %v", err)
+	}
+	if dq.Depth() != 0 || dq.Size() != 0 || len(dq.segments) != 1 {
+		t.Errorf("queue should have been empty, got depth %v, size %v and %v segments",
+			 dq.Depth(), dq.Size(), len(dq.segments))
+	}
+
+	// segments which have been fully read should have been removed
+	points, _, _	= dq.peek(1)
+	if len(points) != 0 {
+		t.Errorf("peek() should have returned no point, got: %v", points)
+	}
+	if diskQueueTestSegmentCount(t, dir) != 1 {
+		t.Errorf("expected a single segment file, got: %v",
+			 diskQueueTestSegmentCount(t, dir))
+	}
+
+	// reopening an empty queue should not bring back any point
+	dq.file.Close()
+	dq, err	= newDiskQueue(dir, 1 << 20, 256, 0)
+	if err != nil {
+		t.Fatalf("newDiskQueue() should have succeeded, got: %v", err)
+	}
+	if dq.Depth() != 0 {
+		t.Errorf("expected an empty queue after reopening, got: %v", dq.Depth())
+	}
+	dq.file.Close()
+
+	return
+}
+
+func TestDiskQueueLimits(t *testing.T) {
+	var dq		*diskQueue
+	var dir		string
+	var err		error
+	var points	[]*Point
+	var cursor	queueCursor
+	var file	*os.File
+
+	dir, err	= ioutil.TempDir("", "datalogger-queue")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// each record is about 80 bytes long: 1kB fits roughly 12 points
+	dq, err	= newDiskQueue(dir, 1024, 256, 0)
+	if err != nil {
+		t.Fatalf("newDiskQueue() should have succeeded, got: %v", err)
+	}
+
+	_, err	= dq.push(diskQueueTestPoints(0, 50))
+	if err != nil {
+		t.Fatalf("push() should have succeeded, got: %v", err)
+	}
+
+	if dq.Size() > 1024 {
+		t.Errorf("queue size should not exceed 1024 bytes, got: %v", dq.Size())
+	}
+
+	// the oldest points should have been dropped
+	points, _, err	= dq.peek(100)
+	if err != nil || len(points) == 0 || len(points) >= 50 ||
+	   points[len(points) - 1].Label != "sensor.p49" {
+		t.Errorf("unexpected peek() result: %v, %v", len(points), err)
+	}
+
+	// test points are years old and should be skipped as expired
+	dq.maxAge	= time.Hour
+	points, cursor, err	= dq.peek(100)
+	if err != nil || len(points) != 0 {
+		t.Errorf("peek() should have returned no point, got: %v, %v", len(points), err)
+	}
+	dq.ack(cursor)
+	if dq.Depth() != 0 {
+		t.Errorf("expected an empty queue, got: %v", dq.Depth())
+	}
+
+	// simulate a crash while writing a record
+	dq.maxAge	= 0
+	dq.push(diskQueueTestPoints(0, 2))
+	dq.file.Close()
+
+	file, err	= os.OpenFile(dq.segmentPath(dq.segments[len(dq.segments) - 1].seq),
+				      os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("failed to open segment: %v", err)
+	}
+	file.Write([]byte(`{"ts":1569150000000000000,"label":"sens`))
+	file.Close()
+
+	dq, err	= newDiskQueue(dir, 1024, 256, 0)
+	if err != nil {
+		t.Fatalf("newDiskQueue() should have succeeded, got: %v", err)
+	}
+	dq.push(diskQueueTestPoints(2, 1))
+
+	points, _, err	= dq.peek(100)
+	if err != nil || len(points) != 3 || points[2].Label != "sensor.p2" {
+		t.Errorf("unexpected peek() result: %v, %v", points, err)
+	}
+	dq.file.Close()
+
+	return
+}
+
+func TestDiskQueueCorruption(t *testing.T) {
+	var dq		*diskQueue
+	var dir		string
+	var err		error
+	var points	[]*Point
+	var cursor	queueCursor
+	var first	*queueSegment
+	var lost	uint64
+
+	dir, err	= ioutil.TempDir("", "datalogger-queue")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dq, err	= newDiskQueue(dir, 1 << 20, 256, 0)
+	if err != nil {
+		t.Fatalf("newDiskQueue() should have succeeded, got: %v", err)
+	}
+
+	_, err	= dq.push(diskQueueTestPoints(0, 10))
+	if err != nil {
+		t.Fatalf("push() should have succeeded, got: %v", err)
+	}
+
+	// truncate the first segment behind the queue's back
+	first	= dq.segments[0]
+	lost	= first.count
+	err	= os.Truncate(dq.segmentPath(first.seq), 10)
+	if err != nil {
+		t.Fatalf("failed to truncate segment: %v", err)
+	}
+
+	// the segment should be moved aside and reading resume with the next one
+	points, cursor, err	= dq.peek(100)
+	if err != nil || uint64(len(points)) != 10 - lost ||
+	   points[0].Label != fmt.Sprintf("sensor.p%d", lost) {
+		t.Fatalf("unexpected peek() result: %v, %v", points, err)
+	}
+
+	if dq.Lost() != lost || dq.Depth() != 10 - lost {
+		t.Errorf("expected %v lost points and a depth of %v, got: %v, %v",
+			 lost, 10 - lost, dq.Lost(), dq.Depth())
+	}
+
+	_, err	= os.Stat(dq.segmentPath(first.seq) + ".bad")
+	if err != nil {
+		t.Errorf("the segment should have been quarantined, got: %v", err)
+	}
+
+	err	= dq.ack(cursor)
+	if err != nil || dq.Depth() != 0 {
+		t.Errorf("expected an empty queue, got: %v, %v", dq.Depth(), err)
+	}
+
+	// the segment being written to should be replaced when unreadable
+	dq.push(diskQueueTestPoints(10, 1))
+	err	= os.Truncate(dq.segmentPath(dq.segments[len(dq.segments) - 1].seq), 0)
+	if err != nil {
+		t.Fatalf("failed to truncate segment: %v", err)
+	}
+
+	points, _, err	= dq.peek(100)
+	if err != nil || len(points) != 0 || dq.Depth() != 0 || dq.Lost() != lost + 1 {
+		t.Errorf("unexpected peek() result: %v, %v (depth: %v, lost: %v)",
+			 points, err, dq.Depth(), dq.Lost())
+	}
+
+	dq.push(diskQueueTestPoints(11, 1))
+	points, _, err	= dq.peek(100)
+	if err != nil || len(points) != 1 || points[0].Label != "sensor.p11" {
+		t.Errorf("unexpected peek() result: %v, %v", points, err)
+	}
+
+	// quarantined segments should not be loaded again
+	dq.file.Close()
+	dq, err	= newDiskQueue(dir, 1 << 20, 256, 0)
+	if err != nil {
+		t.Fatalf("newDiskQueue() should have succeeded, got: %v", err)
+	}
+	if dq.Depth() != 1 {
+		t.Errorf("expected a depth of 1 after reopening, got: %v", dq.Depth())
+	}
+	dq.file.Close()
+
+	return
+}
+
+func diskQueueTestPoints(start int, count int) (points []*Point) {
+	for i := start; i < start + count; i++ {
+		points	= append(points, &Point{
+			Timestamp:	time.Unix(1569150000 + int64(i), 0),
+			Label:		fmt.Sprintf("sensor.p%d", i),
+			Value:		uint16(i),
+		})
+	}
+
+	return
+}
+
+func diskQueueTestSegmentCount(t *testing.T, dir string) (count int) {
+	var names	[]string
+	var err		error
+
+	names, err	= filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		t.Fatalf("failed to list segments: %v", err)
+	}
+	count	= len(names)
+
+	return
+}
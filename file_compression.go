@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	COMPRESSION_GZIP	uint	= 1
+	COMPRESSION_ZSTD	uint	= 2
+)
+
+// File compressor, producing gzip or zstd data.
+// Both formats allow concatenating members (gzip) or frames (zstd): a file
+// made of several complete members decompresses to the concatenation of
+// their contents, which makes appending to compressed files possible.
+type fileCompressor struct {
+	algorithm	uint		// one of COMPRESSION_*
+	level		int		// compression level (0 for the default)
+	zenc		*zstd.Encoder	// zstd encoder of compressMember()
+}
+
+// Returns a new compressor. algorithm is either "gzip" or "zstd", level
+// either 0 (default level) or 1 (fastest) to 9 (best) for gzip, 1 to 22 for
+// zstd.
+func newFileCompressor(algorithm string, level int) (fc *fileCompressor, err error) {
+	fc	= &fileCompressor{
+		level:	level,
+	}
+
+	switch algorithm {
+	case "gzip":
+		fc.algorithm	= COMPRESSION_GZIP
+		if level < 0 || level > gzip.BestCompression {
+			err	= fmt.Errorf("invalid gzip compression level %v (expected 1-9)", level)
+			return
+		}
+		if level == 0 {
+			fc.level	= gzip.DefaultCompression
+		}
+
+	case "zstd":
+		fc.algorithm	= COMPRESSION_ZSTD
+		if level < 0 || level > 22 {
+			err	= fmt.Errorf("invalid zstd compression level %v (expected 1-22)", level)
+			return
+		}
+
+		// EncodeAll() is safe for concurrent use, a single encoder is enough
+		fc.zenc, err	= zstd.NewWriter(nil, fc.zstdOptions()...)
+		if err != nil {
+			return
+		}
+
+	default:
+		err	= fmt.Errorf("unsupported compression algorithm '%s'", algorithm)
+		return
+	}
+
+	return
+}
+
+// Returns the file name extension of compressed files.
+func (fc *fileCompressor) extension() (ext string) {
+	if fc.algorithm == COMPRESSION_ZSTD {
+		ext	= ".zst"
+	} else {
+		ext	= ".gz"
+	}
+
+	return
+}
+
+// Compresses data into a complete gzip member or zstd frame, which can be
+// appended to a compressed file as is.
+func (fc *fileCompressor) compressMember(data []byte) (res []byte, err error) {
+	var buf	bytes.Buffer
+	var zw	*gzip.Writer
+
+	if fc.algorithm == COMPRESSION_ZSTD {
+		res	= fc.zenc.EncodeAll(data, nil)
+		return
+	}
+
+	zw, err	= gzip.NewWriterLevel(&buf, fc.level)
+	if err != nil {
+		return
+	}
+
+	_, err	= zw.Write(data)
+	if err != nil {
+		return
+	}
+
+	err	= zw.Close()
+	if err != nil {
+		return
+	}
+
+	res	= buf.Bytes()
+
+	return
+}
+
+// Compresses the file at path into path + extension(), then removes the
+// original file. Data is first compressed into a temporary file, so that
+// an interrupted compression never leaves a truncated archive behind.
+func (fc *fileCompressor) compressFile(path string) (err error) {
+	var src		*os.File
+	var dst		*os.File
+	var zw		io.WriteCloser
+	var dstPath	string
+	var tmpPath	string
+
+	dstPath	= path + fc.extension()
+	tmpPath	= dstPath + ".tmp"
+
+	src, err	= os.Open(path)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	dst, err	= os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+
+	if fc.algorithm == COMPRESSION_ZSTD {
+		zw, err	= zstd.NewWriter(dst, fc.zstdOptions()...)
+	} else {
+		zw, err	= gzip.NewWriterLevel(dst, fc.level)
+	}
+
+	if err == nil {
+		_, err	= io.Copy(zw, src)
+		if err == nil {
+			err	= zw.Close()
+		} else {
+			zw.Close()
+		}
+	}
+	if err == nil {
+		err	= dst.Sync()
+	}
+	dst.Close()
+
+	if err == nil {
+		err	= os.Rename(tmpPath, dstPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+
+	err	= os.Remove(path)
+
+	return
+}
+
+// Returns zstd encoder options matching the configured level.
+func (fc *fileCompressor) zstdOptions() (opts []zstd.EOption) {
+	opts	= []zstd.EOption{
+		zstd.WithEncoderConcurrency(1),
+	}
+
+	if fc.level > 0 {
+		opts	= append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(fc.level)))
+	}
+
+	return
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestFileCompressor(t *testing.T) {
+	var err		error
+	var dir		string
+	var path	string
+	var fc		*fileCompressor
+	var member	[]byte
+	var contents	[]byte
+
+	dir, err	= ioutil.TempDir("", "datalogger-file-compression")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		algorithm	string
+		level		int
+	}{
+		{ "lz4", 0 },
+		{ "gzip", 10 },
+		{ "gzip", -1 },
+		{ "zstd", 23 },
+	} {
+		_, err	= newFileCompressor(tc.algorithm, tc.level)
+		if err == nil {
+			t.Errorf("newFileCompressor() should have failed with %+v", tc)
+		}
+	}
+
+	for _, tc := range []struct {
+		algorithm	string
+		level		int
+		extension	string
+	}{
+		{ "gzip", 0, ".gz" },
+		{ "gzip", 9, ".gz" },
+		{ "zstd", 0, ".zst" },
+		{ "zstd", 19, ".zst" },
+	} {
+		fc, err	= newFileCompressor(tc.algorithm, tc.level)
+		if err != nil {
+			t.Errorf("newFileCompressor() should have succeeded with %+v, got: %v", tc, err)
+			continue
+		}
+
+		if fc.extension() != tc.extension {
+			t.Errorf("expected extension %s, got: %s", tc.extension, fc.extension())
+		}
+
+		// concatenated members should decompress to the concatenation
+		// of their contents
+		path	= filepath.Join(dir, "members" + fc.extension())
+		contents	= nil
+		for _, data := range []string{
+			"1569150729000,sensor0.temperature,18.7\n",
+			"1569150730000,sensor0.temperature,18.8\n",
+		} {
+			member, err	= fc.compressMember([]byte(data))
+			if err != nil {
+				t.Fatalf("compressMember() should have succeeded, got: %v", err)
+			}
+			contents	= append(contents, member...)
+		}
+		ioutil.WriteFile(path, contents, 0600)
+
+		contents	= compressionTestReadFile(t, path)
+		if string(contents) != "1569150729000,sensor0.temperature,18.7\n" +
+					"1569150730000,sensor0.temperature,18.8\n" {
+			t.Errorf("%+v: unexpected contents: %q", tc, contents)
+		}
+
+		// compressing a file should replace it with its compressed version
+		path	= filepath.Join(dir, "rotated.csv")
+		ioutil.WriteFile(path, bytes.Repeat([]byte("1569150729000,sensor0.humidity,54\n"), 1000), 0600)
+
+		err	= fc.compressFile(path)
+		if err != nil {
+			t.Errorf("compressFile() should have succeeded, got: %v", err)
+			continue
+		}
+
+		_, err	= os.Stat(path)
+		if !os.IsNotExist(err) {
+			t.Errorf("%s should have been removed, got: %v", path, err)
+		}
+
+		contents	= compressionTestReadFile(t, path + fc.extension())
+		if !bytes.Equal(contents, bytes.Repeat([]byte("1569150729000,sensor0.humidity,54\n"), 1000)) {
+			t.Errorf("%+v: unexpected contents (%v bytes)", tc, len(contents))
+		}
+		os.Remove(path + fc.extension())
+	}
+
+	// compressing a missing file should fail
+	err	= fc.compressFile(filepath.Join(dir, "missing.csv"))
+	if err == nil {
+		t.Errorf("compressFile() should have failed")
+	}
+
+	return
+}
+
+// Returns the decompressed contents of a .gz or .zst file.
+func compressionTestReadFile(t *testing.T, path string) (contents []byte) {
+	var err		error
+	var raw		[]byte
+	var gz		*gzip.Reader
+	var zdec	*zstd.Decoder
+
+	raw, err	= ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+
+	if filepath.Ext(path) == ".zst" {
+		zdec, err	= zstd.NewReader(nil)
+		if err != nil {
+			t.Fatalf("failed to create zstd decoder: %v", err)
+		}
+		defer zdec.Close()
+
+		contents, err	= zdec.DecodeAll(raw, nil)
+	} else {
+		gz, err	= gzip.NewReader(bytes.NewReader(raw))
+		if err == nil {
+			contents, err	= ioutil.ReadAll(gz)
+		}
+	}
+
+	if err != nil {
+		t.Fatalf("failed to decompress %s: %v", path, err)
+	}
+
+	return
+}
@@ -2,22 +2,106 @@ package main
 
 import (
 	"bytes"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"path/filepath"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	FILE_TYPE_CSV	uint	= 1
 	FILE_TYPE_JSON	uint	= 2
+	FILE_TYPE_PARQUET uint	= 3
+	FILE_TYPE_WIDE_CSV uint	= 4
 )
 
+// Timestamp formats of CSV and JSON files.
+const (
+	TIMESTAMP_EPOCH_MS	uint	= 0	// milliseconds since the epoch (default)
+	TIMESTAMP_EPOCH_S	uint	= 1
+	TIMESTAMP_EPOCH_US	uint	= 2
+	TIMESTAMP_EPOCH_NS	uint	= 3
+	TIMESTAMP_RFC3339	uint	= 4	// RFC3339 with milliseconds
+	TIMESTAMP_RFC3339_NANO	uint	= 5	// RFC3339 with nanoseconds (trailing
+						// zeros removed)
+)
+
+// File rotation periods.
+const (
+	ROTATE_DAILY	uint	= 0
+	ROTATE_HOURLY	uint	= 1
+)
+
+type FileSinkConfiguration struct {
+	Path		string		// directory where files are created
+	FileType	uint		// one of FILE_TYPE_*
+	BufferSize	uint		// max. number of points buffered between writes
+					// (defaults to 1000)
+	MaxAge		time.Duration	// how often to write buffered points
+					// (defaults to 1 minute)
+	BucketInterval	time.Duration	// wide CSV only: when set, points are grouped
+					// into rows aligned on multiples of this interval
+	BucketTolerance	time.Duration	// wide CSV only: when no bucket interval is set,
+					// points within this duration of the first point
+					// of a row are grouped into that row (defaults
+					// to 1s)
+	TimestampFormat	string		// CSV and JSON only: either "epoch_ms" (default),
+					// "epoch_s", "epoch_us", "epoch_ns", "rfc3339"
+					// or "rfc3339nano"
+	TimeZone	string		// time zone of file names, rotation and RFC3339
+					// timestamps, either an IANA name (e.g.
+					// "Europe/Paris"), "Local" or "UTC" (default)
+	Name		string		// sink name, as used in file name templates
+	Rotation	string		// either "daily" (default) or "hourly"
+	MaxFileSize	int64		// size (in bytes) after which files are rotated
+					// within the same period (disabled if 0), on disk
+					// (i.e. compressed, if compressing while writing)
+	FileNameTemplate string		// file name template, relative to Path and
+					// without extension (see fileName())
+	Compression	string		// CSV and JSON only: either "gzip" or "zstd"
+					// (disabled if empty)
+	CompressionMode	string		// either "stream" (default), compressing data as
+					// it is written, or "rotate", compressing files
+					// in the background once rotated (and files of
+					// earlier periods found on startup)
+	CompressionLevel int		// 1-9 for gzip, 1-22 for zstd (defaults to the
+					// default level of the algorithm)
+}
+
+// JSON file record.
+type fileSinkJSONRecord struct {
+	Timestamp	interface{}	`json:"timestamp"`
+	Label		string		`json:"label"`
+	Value		interface{}	`json:"value"`
+}
+
 type FileSink struct {
 	path		string
+	name		string
+	hostname	string
+	template	string
+	rotation	uint
+	maxFileSize	int64
 	file		*os.File
+	filePath	string
+	parquet		*parquetWriter	// parquet encoder of the current file
+	wide		*wideCSVWriter	// wide CSV encoder
+	compressor	*fileCompressor	// compressor (nil if disabled)
+	compressOnRotate bool		// compress files once closed rather than
+					// while writing
+	compressing	map[string]bool	// files being compressed in the background
+	lock		sync.Mutex	// protects compressing
 	fileType	uint
+	tsFormat	uint
+	location	*time.Location	// time zone of file names, rotation and
+					// RFC3339 timestamps
 	fifo		chan *Point
 	maxAge		time.Duration
 	lastSave	time.Time
@@ -25,18 +109,101 @@ type FileSink struct {
 }
 
 // Returns a new file sink.
-func NewFileSink(path string, fileType uint, fifoSize uint, maxAge time.Duration) (fs *FileSink, err error) {
+func NewFileSink(conf *FileSinkConfiguration) (fs *FileSink, err error) {
 	var writeInterval	time.Duration
 	var fileInfo		os.FileInfo
+	var fifoSize		uint
+	var fileName		string
 
 	fs = &FileSink{
-		path:		path,
-		fileType:	fileType,
-		maxAge:		maxAge,
+		path:		conf.Path,
+		fileType:	conf.FileType,
+		maxAge:		conf.MaxAge,
+		compressing:	make(map[string]bool),
+	}
+
+	switch conf.TimestampFormat {
+	case "epoch_ms", "":	fs.tsFormat = TIMESTAMP_EPOCH_MS
+	case "epoch_s":		fs.tsFormat = TIMESTAMP_EPOCH_S
+	case "epoch_us":	fs.tsFormat = TIMESTAMP_EPOCH_US
+	case "epoch_ns":	fs.tsFormat = TIMESTAMP_EPOCH_NS
+	case "rfc3339":		fs.tsFormat = TIMESTAMP_RFC3339
+	case "rfc3339nano":	fs.tsFormat = TIMESTAMP_RFC3339_NANO
+	default:
+		err	= fmt.Errorf("unsupported timestamp format '%s'", conf.TimestampFormat)
+		return
+	}
+
+	fs.location, err	= time.LoadLocation(conf.TimeZone)
+	if err != nil {
+		err	= fmt.Errorf("invalid time zone '%s': %v", conf.TimeZone, err)
+		return
 	}
 
-	if fileType != FILE_TYPE_JSON && fileType != FILE_TYPE_CSV {
-		err	= fmt.Errorf("unsupported file type %v", fileType)
+	switch conf.Rotation {
+	case "daily", "":
+		fs.rotation	= ROTATE_DAILY
+		fs.template	= "{year}-{month}-{day}"
+	case "hourly":
+		fs.rotation	= ROTATE_HOURLY
+		fs.template	= "{year}-{month}-{day}-{hour}"
+	default:
+		err	= fmt.Errorf("unsupported rotation period '%s'", conf.Rotation)
+		return
+	}
+
+	if conf.FileNameTemplate != "" {
+		fs.template	= conf.FileNameTemplate
+	}
+
+	if conf.Compression != "" {
+		fs.compressor, err	= newFileCompressor(conf.Compression, conf.CompressionLevel)
+		if err != nil {
+			return
+		}
+
+		switch conf.CompressionMode {
+		case "stream", "":
+		case "rotate":
+			fs.compressOnRotate	= true
+		default:
+			err	= fmt.Errorf("unsupported compression mode '%s'", conf.CompressionMode)
+			return
+		}
+
+		switch {
+		case fs.fileType == FILE_TYPE_PARQUET:
+			err	= errors.New("parquet files are compressed already")
+			return
+		case fs.fileType == FILE_TYPE_WIDE_CSV && !fs.compressOnRotate:
+			// header rewrites require plain files
+			err	= errors.New("wide csv files can only be compressed on rotation")
+			return
+		}
+	}
+
+	fs.name			= conf.Name
+	fs.maxFileSize		= conf.MaxFileSize
+	fs.hostname, _		= os.Hostname()
+
+	// make sure file names stay within path
+	fileName		= fs.fileName(time.Now(), 0)
+	if filepath.IsAbs(fileName) || fileName == "." ||
+	   strings.HasPrefix(filepath.Clean(fileName), "..") {
+		err	= fmt.Errorf("invalid file name template '%s'", fs.template)
+		return
+	}
+
+	switch fs.fileType {
+	case FILE_TYPE_CSV, FILE_TYPE_JSON, FILE_TYPE_PARQUET:
+	case FILE_TYPE_WIDE_CSV:
+		if conf.BucketTolerance == 0 {
+			conf.BucketTolerance	= 1 * time.Second
+		}
+		fs.wide	= newWideCSVWriter(conf.BucketInterval, conf.BucketTolerance,
+					   fs.formatTimestamp)
+	default:
+		err	= fmt.Errorf("unsupported file type %v", fs.fileType)
 		return
 	}
 
@@ -53,6 +220,7 @@ func NewFileSink(path string, fileType uint, fifoSize uint, maxAge time.Duration
 	}
 
 	// default to 1k points
+	fifoSize	= conf.BufferSize
 	if fifoSize == 0 {
 		fifoSize	= 1000
 	}
@@ -70,6 +238,12 @@ func NewFileSink(path string, fileType uint, fifoSize uint, maxAge time.Duration
 
 	fs.fifo	= make(chan *Point, fifoSize)
 
+	// files of earlier periods may have been left uncompressed by a
+	// previous run (e.g. stopped before rotating)
+	if fs.compressOnRotate {
+		fs.compressLeftovers(time.Now())
+	}
+
 	go fs.writer(writeInterval)
 
 	return
@@ -87,16 +261,16 @@ func (fs *FileSink) Save(points []*Point) (acceptedCount uint) {
 	return
 }
 
-// Writer goroutine. Creates one datafile per day and invokes write() as appropriate.
+// Writer goroutine. Creates one datafile per rotation period (and more if
+// files exceed their max. size) and invokes write() as appropriate.
 func (fs *FileSink) writer(tickRate time.Duration) {
 	var err			error
 	var highWaterMark	int
 	var ticker		*time.Ticker
-	var file		*os.File
-	var filePath		string
-	var fileName		string
 	var now			time.Time
-	var dayOfMonth		int
+	var period		time.Time
+	var currentPeriod	time.Time
+	var info		os.FileInfo
 
 	highWaterMark	= (cap(fs.fifo) * 80) / 100
 
@@ -105,43 +279,29 @@ func (fs *FileSink) writer(tickRate time.Duration) {
 	for {
 		<-ticker.C
 
-		now	= time.Now().UTC()
+		now	= time.Now().In(fs.location)
 
-		// close the file on day changes
-		if dayOfMonth != now.Day() {
-			dayOfMonth = now.Day()
+		// close the file when entering a new rotation period
+		period	= fs.period(now)
+		if !period.Equal(currentPeriod) {
+			currentPeriod	= period
 
 			if fs.file != nil {
-				fs.file.Close()
-				fs.file	= nil
-
-				fmt.Printf("saved %d records in %s\n", fs.recordCount, filePath)
-				fs.recordCount	= 0
+				fs.closeFile(now)
 			}
 		}
 
-		// open a log file if needed, in the form path/YYYY-MM-DD.suffix, with suffix
-		// either csv or json, depending on the file type.
+		// open a log file if needed
 		if fs.file == nil {
-			fileName	= now.Format("2006-01-02")
-
-			if fs.fileType == FILE_TYPE_JSON {
-				fileName += ".json"
-			} else {
-				fileName += ".csv"
-			}
-
-			filePath	= filepath.Join(fs.path, fileName)
-			file, err	= os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+			err	= fs.openFile(now)
 			// if we failed to open the file, sleep for 30s before trying again
 			if err != nil {
-				fmt.Printf("failed to open file '%s': %v\n", filePath, err)
+				fmt.Printf("failed to open file '%s': %v\n", fs.filePath, err)
 				time.Sleep(30 * time.Second)
 				continue
 			}
-			fs.file		= file
 
-			fmt.Printf("opened %s for writing\n", filePath)
+			fmt.Printf("opened %s for writing\n", fs.filePath)
 		}
 
 		if time.Since(fs.lastSave) >= fs.maxAge || len(fs.fifo) > highWaterMark {
@@ -153,6 +313,310 @@ func (fs *FileSink) writer(tickRate time.Duration) {
 
 		   fs.lastSave	= time.Now()
 		}
+
+		// move on to the next file once the current one is full
+		if fs.maxFileSize > 0 && fs.file != nil {
+			info, err	= fs.file.Stat()
+			if err == nil && info.Size() >= fs.maxFileSize {
+				fs.closeFile(now)
+			}
+		}
+	}
+
+	return
+}
+
+// Opens the file of the current period for writing, creating directories
+// as needed. Files which reached their max. size are skipped, as are
+// existing parquet files, which cannot be appended to, files compressed
+// (or being compressed) on rotation and, with the wide csv layout, files
+// lacking a wide csv header.
+func (fs *FileSink) openFile(now time.Time) (err error) {
+	var file	*os.File
+	var info	os.FileInfo
+
+	for seq := 0; ; seq++ {
+		fs.filePath	= filepath.Join(fs.path, fs.fileName(now, seq))
+
+		err	= os.MkdirAll(filepath.Dir(fs.filePath), 0700)
+		if err != nil {
+			return
+		}
+
+		if fs.fileType == FILE_TYPE_PARQUET {
+			file, err	= os.OpenFile(fs.filePath, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+			if os.IsExist(err) {
+				continue
+			}
+			break
+		}
+
+		if fs.maxFileSize > 0 {
+			info, err	= os.Stat(fs.filePath)
+			if err == nil && info.Size() >= fs.maxFileSize {
+				continue
+			}
+		}
+
+		if fs.compressOnRotate && fs.isCompressed(fs.filePath) {
+			continue
+		}
+
+		if fs.fileType == FILE_TYPE_WIDE_CSV {
+			file, err	= fs.wide.open(fs.filePath)
+			// e.g. a long csv file written before switching layouts
+			if err == errNotWideCSV {
+				fmt.Printf("%s is not a wide csv file, skipping it\n", fs.filePath)
+				continue
+			}
+		} else {
+			file, err	= os.OpenFile(fs.filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		}
+		break
+	}
+
+	if err != nil {
+		return
+	}
+
+	if fs.fileType == FILE_TYPE_PARQUET {
+		fs.parquet, err	= newParquetWriter(file)
+		if err != nil {
+			file.Close()
+			os.Remove(fs.filePath)
+			return
+		}
+	}
+
+	fs.file	= file
+
+	return
+}
+
+// Closes the current file.
+func (fs *FileSink) closeFile(now time.Time) {
+	var err	error
+
+	// write wide CSV rows still waiting for points, as they belong to
+	// the file being closed
+	if fs.wide != nil {
+		_, err	= fs.wide.flush(now, true)
+		if err != nil {
+			fmt.Printf("failed to write: %v\n", err)
+		}
+		fs.file	= fs.wide.file
+	}
+
+	// parquet files are finalized after each row group: closing them
+	// is enough
+	if fs.file != nil {
+		fs.file.Close()
+	}
+	fs.file		= nil
+	fs.parquet	= nil
+
+	fmt.Printf("saved %d records in %s\n", fs.recordCount, fs.filePath)
+	fs.recordCount	= 0
+
+	if fs.compressOnRotate {
+		fs.lock.Lock()
+		fs.compressing[fs.filePath]	= true
+		fs.lock.Unlock()
+
+		go fs.compressFile(fs.filePath)
+	}
+
+	return
+}
+
+// Compresses a closed file, replacing it with its compressed version.
+func (fs *FileSink) compressFile(path string) {
+	var err	error
+
+	err	= fs.compressor.compressFile(path)
+	if err != nil {
+		fmt.Printf("failed to compress %s: %v\n", path, err)
+	} else {
+		fmt.Printf("compressed %s\n", path)
+	}
+
+	fs.lock.Lock()
+	delete(fs.compressing, path)
+	fs.lock.Unlock()
+
+	return
+}
+
+// Looks for uncompressed files of this sink from rotation periods before
+// now, and compresses them one after the other in the background. Files of
+// the current period are left alone, as they may be reopened for writing.
+func (fs *FileSink) compressLeftovers(now time.Time) {
+	var err		error
+	var all		*regexp.Regexp
+	var current	*regexp.Regexp
+	var paths	[]string
+
+	all, err	= fs.fileNamePattern(nil)
+	if err == nil {
+		current, err	= fs.fileNamePattern(&now)
+	}
+	if err != nil {
+		fmt.Printf("failed to look for uncompressed files: %v\n", err)
+		return
+	}
+
+	filepath.Walk(fs.path, func(path string, info os.FileInfo, err error) error {
+		var rel	string
+
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err	= filepath.Rel(fs.path, path)
+		if err != nil {
+			return nil
+		}
+		rel	= filepath.ToSlash(rel)
+
+		if all.MatchString(rel) && !current.MatchString(rel) {
+			paths	= append(paths, path)
+		}
+
+		return nil
+	})
+
+	if len(paths) == 0 {
+		return
+	}
+
+	fs.lock.Lock()
+	for _, path := range paths {
+		fs.compressing[path]	= true
+	}
+	fs.lock.Unlock()
+
+	go func() {
+		for _, path := range paths {
+			fs.compressFile(path)
+		}
+	}()
+
+	return
+}
+
+// Returns a regular expression matching the names (relative to the sink
+// path, with forward slashes) of uncompressed files of this sink, either
+// of the rotation period containing t or, if t is nil, of any period.
+func (fs *FileSink) fileNamePattern(t *time.Time) (re *regexp.Regexp, err error) {
+	var expr	string
+	var year	string
+	var month	string
+	var day		string
+	var hour	string
+
+	if t != nil {
+		year	= t.In(fs.location).Format("2006")
+		month	= t.In(fs.location).Format("01")
+		day	= t.In(fs.location).Format("02")
+		hour	= t.In(fs.location).Format("15")
+	} else {
+		year	= `\d{4}`
+		month	= `\d{2}`
+		day	= `\d{2}`
+		hour	= `\d{2}`
+	}
+
+	expr	= strings.NewReplacer(
+		regexp.QuoteMeta("{year}"),	year,
+		regexp.QuoteMeta("{month}"),	month,
+		regexp.QuoteMeta("{day}"),	day,
+		regexp.QuoteMeta("{hour}"),	hour,
+		regexp.QuoteMeta("{hostname}"),	regexp.QuoteMeta(fs.hostname),
+		regexp.QuoteMeta("{sink}"),	regexp.QuoteMeta(fs.name),
+		regexp.QuoteMeta("{seq}"),	`\d+`,
+	).Replace(regexp.QuoteMeta(filepath.ToSlash(fs.template)))
+
+	if !strings.Contains(fs.template, "{seq}") {
+		expr	+= `(\.\d+)?`
+	}
+
+	switch fs.fileType {
+	case FILE_TYPE_JSON:	expr += `\.json`
+	case FILE_TYPE_PARQUET:	expr += `\.parquet`
+	default:		expr += `\.csv`
+	}
+
+	re, err	= regexp.Compile("^" + expr + "$")
+
+	return
+}
+
+// Returns true if the file at path was compressed on rotation, or is being
+// compressed.
+func (fs *FileSink) isCompressed(path string) (compressed bool) {
+	var err	error
+
+	fs.lock.Lock()
+	compressed	= fs.compressing[path]
+	fs.lock.Unlock()
+
+	if !compressed {
+		_, err		= os.Stat(path + fs.compressor.extension())
+		compressed	= (err == nil)
+	}
+
+	return
+}
+
+// Returns the start of the rotation period of t.
+func (fs *FileSink) period(t time.Time) (start time.Time) {
+	if fs.rotation == ROTATE_HOURLY {
+		start	= time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	} else {
+		start	= time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+
+	return
+}
+
+// Returns the name of a file, relative to the sink path, by expanding the
+// file name template with the following placeholders:
+//	{year}, {month}, {day}, {hour}: date and time of the file (in the sink's
+//					time zone)
+//	{hostname}:			name of the host
+//	{sink}:				name of the sink
+//	{seq}:				sequence number of the file within the
+//					rotation period (when rotating on size)
+// e.g. "{year}/{month}/{day}/{hostname}-{hour}" yields 2026/10/17/plant1-14.csv.
+// When seq is not 0 and the template has no {seq} placeholder, .seq is
+// appended to the name.
+// The extension (.csv, .json or .parquet) is added depending on the file type,
+// followed by .gz or .zst when compressing while writing.
+func (fs *FileSink) fileName(t time.Time, seq int) (name string) {
+	t	= t.In(fs.location)
+
+	name	= strings.NewReplacer(
+		"{year}",	t.Format("2006"),
+		"{month}",	t.Format("01"),
+		"{day}",	t.Format("02"),
+		"{hour}",	t.Format("15"),
+		"{hostname}",	fs.hostname,
+		"{sink}",	fs.name,
+		"{seq}",	fmt.Sprintf("%d", seq),
+	).Replace(fs.template)
+
+	if seq != 0 && !strings.Contains(fs.template, "{seq}") {
+		name	+= fmt.Sprintf(".%d", seq)
+	}
+
+	switch fs.fileType {
+	case FILE_TYPE_JSON:	name += ".json"
+	case FILE_TYPE_PARQUET:	name += ".parquet"
+	default:		name += ".csv"
+	}
+
+	if fs.compressor != nil && !fs.compressOnRotate {
+		name	+= fs.compressor.extension()
 	}
 
 	return
@@ -161,14 +625,32 @@ func (fs *FileSink) writer(tickRate time.Duration) {
 // Flushes the fifo contents to disk.
 func (fs *FileSink) write() (err error) {
 	var buf		bytes.Buffer
+	var cw		*csv.Writer
+	var je		*json.Encoder
 	var count	uint
 	var p		*Point
+	var data	[]byte
 
 	if fs.file == nil {
 		err	= errors.New("sink closed")
 		return
 	}
 
+	// parquet files get one row group per write
+	if fs.fileType == FILE_TYPE_PARQUET {
+		err	= fs.writeParquet()
+		return
+	}
+
+	if fs.fileType == FILE_TYPE_WIDE_CSV {
+		err	= fs.writeWide()
+		return
+	}
+
+	cw	= csv.NewWriter(&buf)
+	je	= json.NewEncoder(&buf)
+	je.SetEscapeHTML(false)
+
 	for len(fs.fifo) > 0 {
 		p = <-fs.fifo
 
@@ -179,18 +661,21 @@ func (fs *FileSink) write() (err error) {
 
 		switch fs.fileType {
 		case FILE_TYPE_CSV:
-			_, err = buf.WriteString(
-				fmt.Sprintf("%d,%s,%v\n",
-					    p.Timestamp.UnixNano() / 1e6,
-					    p.Label,
-					    p.Value))
+			cw.Write([]string{
+				fmt.Sprintf("%v", fs.timestamp(p.Timestamp)),
+				p.Label,
+				fmt.Sprintf("%v", p.Value),
+			})
+			cw.Flush()
+			err	= cw.Error()
 
 		case FILE_TYPE_JSON:
-			_, err = buf.WriteString(
-				fmt.Sprintf("{\"timestamp\":%d,\"label\":\"%s\",\"value\":%v}\n",
-					    p.Timestamp.UnixNano() / 1e6,
-					    p.Label,
-					    p.Value))
+			err	= je.Encode(&fileSinkJSONRecord{
+				Timestamp:	fs.timestamp(p.Timestamp),
+				Label:		p.Label,
+				Value:		jsonValue(p.Value),
+			})
+
 		default:
 			err	= fmt.Errorf("unknown file type %v", fs.fileType)
 			return
@@ -204,7 +689,18 @@ func (fs *FileSink) write() (err error) {
 		count++
 	}
 
-	_,err	= buf.WriteTo(fs.file)
+	// when compressing while writing, each write is a complete gzip member
+	// or zstd frame, so that files stay readable should the process stop
+	// at any point (the last member may be truncated, but earlier ones can
+	// be decompressed)
+	if fs.compressor != nil && !fs.compressOnRotate && buf.Len() > 0 {
+		data, err	= fs.compressor.compressMember(buf.Bytes())
+		if err == nil {
+			_, err	= fs.file.Write(data)
+		}
+	} else {
+		_,err	= buf.WriteTo(fs.file)
+	}
 	buf.Reset()
 
 	// keep track of successful writes
@@ -214,3 +710,104 @@ func (fs *FileSink) write() (err error) {
 
 	return
 }
+
+// Returns a timestamp in the configured format: an int64 for epoch formats,
+// a string for RFC3339 formats.
+func (fs *FileSink) timestamp(ts time.Time) (res interface{}) {
+	switch fs.tsFormat {
+	case TIMESTAMP_EPOCH_S:		res = ts.Unix()
+	case TIMESTAMP_EPOCH_US:	res = ts.UnixNano() / 1e3
+	case TIMESTAMP_EPOCH_NS:	res = ts.UnixNano()
+	case TIMESTAMP_RFC3339:
+		res	= ts.In(fs.location).Format("2006-01-02T15:04:05.000Z07:00")
+	case TIMESTAMP_RFC3339_NANO:
+		res	= ts.In(fs.location).Format(time.RFC3339Nano)
+	default:
+		res	= ts.UnixNano() / 1e6
+	}
+
+	return
+}
+
+// Returns a timestamp in the configured format, as a string.
+func (fs *FileSink) formatTimestamp(ts time.Time) (res string) {
+	res	= fmt.Sprintf("%v", fs.timestamp(ts))
+
+	return
+}
+
+// Returns a value suitable for JSON encoding: NaN and infinite values, which
+// JSON cannot represent, are turned into nulls.
+func jsonValue(value interface{}) (res interface{}) {
+	res	= value
+
+	switch v := value.(type) {
+	case float32:
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			res	= nil
+		}
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			res	= nil
+		}
+	}
+
+	return
+}
+
+// Flushes the fifo contents to the parquet file as a new row group.
+func (fs *FileSink) writeParquet() (err error) {
+	var points	[]*Point
+	var p		*Point
+
+	for len(fs.fifo) > 0 {
+		p	= <-fs.fifo
+
+		// drop nil points
+		if p != nil {
+			points	= append(points, p)
+		}
+	}
+
+	if len(points) == 0 {
+		return
+	}
+
+	err	= fs.parquet.writeRowGroup(points)
+
+	// keep track of successful writes
+	if err == nil {
+		fs.recordCount += uint(len(points))
+	}
+
+	return
+}
+
+// Groups fifo contents into wide CSV rows, and writes rows which are
+// complete.
+func (fs *FileSink) writeWide() (err error) {
+	var count	uint
+	var p		*Point
+
+	for len(fs.fifo) > 0 {
+		p	= <-fs.fifo
+
+		// drop nil points
+		if p != nil {
+			fs.wide.add(p)
+		}
+	}
+
+	count, err	= fs.wide.flush(time.Now(), false)
+
+	// the file is replaced when its header is rewritten (and closed if
+	// that fails, to be reopened on the next run)
+	fs.file		= fs.wide.file
+
+	// keep track of successful writes
+	if err == nil {
+		fs.recordCount += count
+	}
+
+	return
+}
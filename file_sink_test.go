@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
 	"testing"
 	"strings"
 	"time"
@@ -14,13 +16,23 @@ func TestFileSink(t *testing.T) {
 	var fs		*FileSink
 
 	// pass an unknown file type, should fail
-	fs, err	= NewFileSink("/tmp", 5, 100, time.Minute)
+	fs, err	= NewFileSink(&FileSinkConfiguration{
+		Path:		"/tmp",
+		FileType:	5,
+		BufferSize:	100,
+		MaxAge:		time.Minute,
+	})
 	if err == nil {
 		t.Errorf("NewFileSink() should have failed")
 	}
 
 	// pass a non-existent path, should fail
-	fs, err	= NewFileSink("/tmp33222", FILE_TYPE_CSV, 100, time.Minute)
+	fs, err	= NewFileSink(&FileSinkConfiguration{
+		Path:		"/tmp33222",
+		FileType:	FILE_TYPE_CSV,
+		BufferSize:	100,
+		MaxAge:		time.Minute,
+	})
 	if err == nil {
 		t.Errorf("NewFileSink() should have failed")
 	}
@@ -29,13 +41,23 @@ func TestFileSink(t *testing.T) {
 	}
 
 	// pass an existent, non-directory path, should fail
-	fs, err	= NewFileSink("/etc/hosts", FILE_TYPE_CSV, 100, time.Minute)
+	fs, err	= NewFileSink(&FileSinkConfiguration{
+		Path:		"/etc/hosts",
+		FileType:	FILE_TYPE_CSV,
+		BufferSize:	100,
+		MaxAge:		time.Minute,
+	})
 	if err == nil {
 		t.Errorf("NewFileSink() should have failed")
 	}
 
 	// pass an existent directory as path
-	fs, err	= NewFileSink("/tmp", FILE_TYPE_CSV, 100, time.Minute)
+	fs, err	= NewFileSink(&FileSinkConfiguration{
+		Path:		"/tmp",
+		FileType:	FILE_TYPE_CSV,
+		BufferSize:	100,
+		MaxAge:		time.Minute,
+	})
 	if err != nil {
 		t.Errorf("NewFileSink() should have succeeded, got: %v", err)
 	}
@@ -71,7 +93,12 @@ func TestJsonFileSink(t *testing.T) {
 	defer os.Remove(path)
 
 	// pass an existent directory as path
-	fs, err	= NewFileSink("/tmp", FILE_TYPE_JSON, 2, 100 * time.Millisecond)
+	fs, err	= NewFileSink(&FileSinkConfiguration{
+		Path:		"/tmp",
+		FileType:	FILE_TYPE_JSON,
+		BufferSize:	2,
+		MaxAge:		100 * time.Millisecond,
+	})
 	if err != nil {
 		t.Errorf("NewFileSink() should have succeeded, got: %v", err)
 	}
@@ -237,7 +264,12 @@ func TestCSVFileSink(t *testing.T) {
 	defer os.Remove(path)
 
 	// pass an existent directory as path
-	fs, err	= NewFileSink("/tmp", FILE_TYPE_CSV, 2, 100 * time.Millisecond)
+	fs, err	= NewFileSink(&FileSinkConfiguration{
+		Path:		"/tmp",
+		FileType:	FILE_TYPE_CSV,
+		BufferSize:	2,
+		MaxAge:		100 * time.Millisecond,
+	})
 	if err != nil {
 		t.Errorf("NewFileSink() should have succeeded, got: %v", err)
 	}
@@ -385,3 +417,490 @@ func TestCSVFileSink(t *testing.T) {
 
 	return
 }
+
+func TestParquetFileSink(t *testing.T) {
+	var err		error
+	var fs		*FileSink
+	var dir		string
+	var path	string
+	var meta	map[int16]interface{}
+
+	dir, err	= ioutil.TempDir("", "datalogger-parquet")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// leave a file from a previous run behind, which should not be touched
+	path	= fmt.Sprintf("%s/%s.parquet", dir, time.Now().UTC().Format("2006-01-02"))
+	err	= ioutil.WriteFile(path, []byte("previous run"), 0600)
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	fs, err	= NewFileSink(&FileSinkConfiguration{
+		Path:		dir,
+		FileType:	FILE_TYPE_PARQUET,
+		BufferSize:	100,
+		MaxAge:		100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewFileSink() should have succeeded, got: %v", err)
+	}
+
+	fs.Save([]*Point{
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor0.temperature", Value: 18.7 },
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor0.humidity", Value: 54 },
+	})
+
+	time.Sleep(200 * time.Millisecond)
+
+	fs.Save([]*Point{
+		{ Timestamp: time.Unix(1569150730, 0), Label: "sensor0.temperature", Value: 18.8 },
+	})
+
+	time.Sleep(500 * time.Millisecond)
+
+	// each write should have produced a row group, with the file readable
+	// in between
+	meta	= parquetTestReadFooter(t,
+		fmt.Sprintf("%s/%s.1.parquet", dir, time.Now().UTC().Format("2006-01-02")))
+	if meta[3] != int64(3) || len(meta[4].([]interface{})) != 2 {
+		t.Errorf("unexpected file metadata: %v", meta)
+	}
+
+	return
+}
+
+func TestWideCSVFileSink(t *testing.T) {
+	var err		error
+	var fs		*FileSink
+	var dir		string
+	var path	string
+	var contents	[]byte
+
+	dir, err	= ioutil.TempDir("", "datalogger-wide-csv")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// leave a long csv file of the same period behind (e.g. written before
+	// switching layouts), which should be skipped rather than appended to
+	path	= fmt.Sprintf("%s/%s.csv", dir, time.Now().UTC().Format("2006-01-02"))
+	err	= ioutil.WriteFile(path, []byte("1569150729000,sensor0.humidity,54\n"), 0600)
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	fs, err	= NewFileSink(&FileSinkConfiguration{
+		Path:		dir,
+		FileType:	FILE_TYPE_WIDE_CSV,
+		BufferSize:	100,
+		MaxAge:		100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewFileSink() should have succeeded, got: %v", err)
+	}
+
+	fs.Save([]*Point{
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor0.temperature", Value: 18.7 },
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor0.humidity", Value: 54 },
+	})
+
+	time.Sleep(500 * time.Millisecond)
+
+	contents, _	= ioutil.ReadFile(path)
+	if string(contents) != "1569150729000,sensor0.humidity,54\n" {
+		t.Errorf("unexpected contents of %s: %q", path, contents)
+	}
+
+	path		= fmt.Sprintf("%s/%s.1.csv", dir, time.Now().UTC().Format("2006-01-02"))
+	contents, _	= ioutil.ReadFile(path)
+	if string(contents) != "timestamp,sensor0.humidity,sensor0.temperature\n" +
+				"1569150729000,54,18.7\n" {
+		t.Errorf("unexpected contents of %s: %q", path, contents)
+	}
+
+	return
+}
+
+func TestFileSinkEncoding(t *testing.T) {
+	var err		error
+	var fs		*FileSink
+	var dir		string
+	var contents	[]byte
+	var paris	*time.Location
+	var ts		time.Time
+
+	dir, err	= ioutil.TempDir("", "datalogger-file-sink")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	paris, err	= time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skipf("time zone database not available: %v", err)
+	}
+
+	ts	= time.Unix(1569150729, 123456789)
+	for _, tc := range []struct {
+		format		string
+		timeZone	string
+		expected	interface{}
+	}{
+		{ "", "", int64(1569150729123) },
+		{ "epoch_s", "", int64(1569150729) },
+		{ "epoch_us", "", int64(1569150729123456) },
+		{ "epoch_ns", "", int64(1569150729123456789) },
+		{ "rfc3339", "", "2019-09-22T11:12:09.123Z" },
+		{ "rfc3339", "Europe/Paris", "2019-09-22T13:12:09.123+02:00" },
+		{ "rfc3339nano", "Europe/Paris", ts.In(paris).Format(time.RFC3339Nano) },
+	} {
+		fs, err	= NewFileSink(&FileSinkConfiguration{
+			Path:			dir,
+			FileType:		FILE_TYPE_CSV,
+			MaxAge:			time.Hour,
+			TimestampFormat:	tc.format,
+			TimeZone:		tc.timeZone,
+		})
+		if err != nil {
+			t.Errorf("NewFileSink() should have succeeded with %v, got: %v", tc.format, err)
+			continue
+		}
+
+		if fs.timestamp(ts) != tc.expected {
+			t.Errorf("%s/%s: expected %v, got: %v",
+				 tc.format, tc.timeZone, tc.expected, fs.timestamp(ts))
+		}
+	}
+
+	for _, conf := range []*FileSinkConfiguration{
+		{ Path: dir, FileType: FILE_TYPE_CSV, TimestampFormat: "epoch_minutes" },
+		{ Path: dir, FileType: FILE_TYPE_JSON, TimeZone: "Mars/Olympus_Mons" },
+	} {
+		_, err	= NewFileSink(conf)
+		if err == nil {
+			t.Errorf("NewFileSink() should have failed with %+v", conf)
+		}
+	}
+
+	// labels and values should be escaped, with NaN turned into nulls
+	fs, err	= NewFileSink(&FileSinkConfiguration{
+		Path:			dir,
+		FileType:		FILE_TYPE_JSON,
+		MaxAge:			100 * time.Millisecond,
+		TimestampFormat:	"rfc3339",
+	})
+	if err != nil {
+		t.Fatalf("NewFileSink() should have succeeded, got: %v", err)
+	}
+
+	fs.Save([]*Point{
+		{ Timestamp: ts, Label: "plc.\"status\"", Value: "running <ok>" },
+		{ Timestamp: ts, Label: "sensor0.temperature", Value: math.NaN() },
+		{ Timestamp: ts, Label: "plc.running", Value: true },
+		{ Timestamp: ts, Label: "plc.counter", Value: uint32(12) },
+	})
+
+	time.Sleep(500 * time.Millisecond)
+
+	contents, err	= ioutil.ReadFile(fmt.Sprintf("%s/%s.json", dir,
+					  time.Now().UTC().Format("2006-01-02")))
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+
+	if string(contents) !=
+	   `{"timestamp":"2019-09-22T11:12:09.123Z","label":"plc.\"status\"","value":"running <ok>"}` + "\n" +
+	   `{"timestamp":"2019-09-22T11:12:09.123Z","label":"sensor0.temperature","value":null}` + "\n" +
+	   `{"timestamp":"2019-09-22T11:12:09.123Z","label":"plc.running","value":true}` + "\n" +
+	   `{"timestamp":"2019-09-22T11:12:09.123Z","label":"plc.counter","value":12}` + "\n" {
+		t.Errorf("unexpected contents: %s", contents)
+	}
+
+	return
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	var err		error
+	var fs		*FileSink
+	var dir		string
+	var hostname	string
+	var ts		time.Time
+	var files	[]string
+	var contents	[]byte
+	var next	string
+	var deadline	time.Time
+
+	dir, err	= ioutil.TempDir("", "datalogger-file-sink")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	hostname, _	= os.Hostname()
+	ts		= time.Date(2026, 10, 17, 14, 59, 59, 0, time.UTC)
+
+	for _, tc := range []struct {
+		conf		FileSinkConfiguration
+		seq		int
+		expected	string
+		period		time.Time
+	}{
+		{ FileSinkConfiguration{ FileType: FILE_TYPE_CSV }, 0,
+		  "2026-10-17.csv", time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC) },
+		{ FileSinkConfiguration{ FileType: FILE_TYPE_JSON, Rotation: "hourly" }, 0,
+		  "2026-10-17-14.json", time.Date(2026, 10, 17, 14, 0, 0, 0, time.UTC) },
+		{ FileSinkConfiguration{ FileType: FILE_TYPE_CSV, MaxFileSize: 1000 }, 2,
+		  "2026-10-17.2.csv", time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC) },
+		{ FileSinkConfiguration{
+			FileType:		FILE_TYPE_PARQUET,
+			Name:			"plant1",
+			Rotation:		"hourly",
+			FileNameTemplate:	"{year}/{month}/{day}/{sink}-{hour}",
+		  }, 0, "2026/10/17/plant1-14.parquet", time.Date(2026, 10, 17, 14, 0, 0, 0, time.UTC) },
+		{ FileSinkConfiguration{
+			FileType:		FILE_TYPE_CSV,
+			FileNameTemplate:	"{hostname}/{year}{month}{day}-{seq}",
+		  }, 3, hostname + "/20261017-3.csv", time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC) },
+		// rotation happens in the configured time zone
+		{ FileSinkConfiguration{ FileType: FILE_TYPE_CSV, TimeZone: "Asia/Tokyo" }, 0,
+		  "2026-10-17.csv", time.Date(2026, 10, 17, 0, 0, 0, 0, time.FixedZone("JST", 9 * 3600)) },
+		{ FileSinkConfiguration{ FileType: FILE_TYPE_CSV, TimeZone: "America/New_York" }, 0,
+		  "2026-10-17.csv", time.Date(2026, 10, 17, 4, 0, 0, 0, time.UTC) },
+	} {
+		tc.conf.Path	= dir
+		tc.conf.MaxAge	= time.Hour
+		fs, err	= NewFileSink(&tc.conf)
+		if err != nil {
+			t.Errorf("NewFileSink() should have succeeded with %+v, got: %v", tc.conf, err)
+			continue
+		}
+
+		// skip time zone checks if the time zone database is not available
+		if tc.conf.TimeZone != "" && fs.location == time.UTC {
+			continue
+		}
+
+		if fs.fileName(ts, tc.seq) != tc.expected {
+			t.Errorf("expected file name %s, got: %s", tc.expected, fs.fileName(ts, tc.seq))
+		}
+
+		if !fs.period(ts.In(fs.location)).Equal(tc.period) {
+			t.Errorf("%+v: expected period %v, got: %v",
+				 tc.conf, tc.period, fs.period(ts.In(fs.location)))
+		}
+	}
+
+	for _, conf := range []*FileSinkConfiguration{
+		{ Path: dir, FileType: FILE_TYPE_CSV, Rotation: "weekly" },
+		{ Path: dir, FileType: FILE_TYPE_CSV, FileNameTemplate: "../{year}" },
+		{ Path: dir, FileType: FILE_TYPE_CSV, FileNameTemplate: "/var/log/{year}" },
+	} {
+		_, err	= NewFileSink(conf)
+		if err == nil {
+			t.Errorf("NewFileSink() should have failed with %+v", conf)
+		}
+	}
+
+	// files should be rotated once they exceed their max. size, with
+	// directories created on demand
+	fs, err	= NewFileSink(&FileSinkConfiguration{
+		Path:			dir,
+		FileType:		FILE_TYPE_CSV,
+		MaxAge:			100 * time.Millisecond,
+		Name:			"plant1",
+		MaxFileSize:		40,
+		FileNameTemplate:	"size/{sink}",
+	})
+	if err != nil {
+		t.Fatalf("NewFileSink() should have succeeded, got: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		fs.Save([]*Point{
+			{ Timestamp: time.Unix(1569150729, 0), Label: "sensor0.temperature", Value: 18.7 },
+			{ Timestamp: time.Unix(1569150729, 0), Label: "sensor0.humidity", Value: 54 },
+		})
+
+		// wait for the points to fill the current file and for the
+		// next one to be opened, rather than guessing how long it takes
+		next		= filepath.Join(dir, "size", fmt.Sprintf("plant1.%d.csv", i + 1))
+		deadline	= time.Now().Add(10 * time.Second)
+		for {
+			_, err	= os.Stat(next)
+			if err == nil || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	for _, name := range []string{ "plant1.csv", "plant1.1.csv", "plant1.2.csv" } {
+		contents, err	= ioutil.ReadFile(filepath.Join(dir, "size", name))
+		if err != nil {
+			t.Errorf("failed to read %s: %v", name, err)
+			continue
+		}
+
+		if string(contents) != "1569150729000,sensor0.temperature,18.7\n" +
+					"1569150729000,sensor0.humidity,54\n" {
+			t.Errorf("unexpected contents in %s: %q", name, contents)
+		}
+	}
+
+	// the next file should have been opened right away
+	files, _	= filepath.Glob(filepath.Join(dir, "size", "*"))
+	if len(files) != 4 {
+		t.Errorf("expected 4 files, got: %v", files)
+	}
+
+	contents, err	= ioutil.ReadFile(filepath.Join(dir, "size", "plant1.3.csv"))
+	if err != nil || len(contents) != 0 {
+		t.Errorf("plant1.3.csv should have been empty, got: %q (err: %v)", contents, err)
+	}
+
+	return
+}
+
+func TestFileSinkCompression(t *testing.T) {
+	var err		error
+	var fs		*FileSink
+	var dir		string
+	var files	[]string
+	var contents	[]byte
+	var today	string
+
+	dir, err	= ioutil.TempDir("", "datalogger-file-sink")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, conf := range []*FileSinkConfiguration{
+		{ Path: dir, FileType: FILE_TYPE_CSV, Compression: "lz4" },
+		{ Path: dir, FileType: FILE_TYPE_CSV, Compression: "gzip", CompressionLevel: 12 },
+		{ Path: dir, FileType: FILE_TYPE_CSV, Compression: "gzip", CompressionMode: "daily" },
+		{ Path: dir, FileType: FILE_TYPE_PARQUET, Compression: "zstd" },
+		{ Path: dir, FileType: FILE_TYPE_WIDE_CSV, Compression: "zstd" },
+	} {
+		_, err	= NewFileSink(conf)
+		if err == nil {
+			t.Errorf("NewFileSink() should have failed with %+v", conf)
+		}
+	}
+
+	// when compressing while writing, each write should append a gzip
+	// member to the file
+	fs, err	= NewFileSink(&FileSinkConfiguration{
+		Path:			dir,
+		FileType:		FILE_TYPE_JSON,
+		MaxAge:			100 * time.Millisecond,
+		Name:			"plant1",
+		FileNameTemplate:	"stream/{sink}",
+		Compression:		"gzip",
+		CompressionLevel:	9,
+	})
+	if err != nil {
+		t.Fatalf("NewFileSink() should have succeeded, got: %v", err)
+	}
+
+	for _, value := range []float64{ 18.7, 18.8 } {
+		fs.Save([]*Point{
+			{ Timestamp: time.Unix(1569150729, 0), Label: "sensor0.temperature", Value: value },
+		})
+		time.Sleep(300 * time.Millisecond)
+	}
+
+	contents	= compressionTestReadFile(t, filepath.Join(dir, "stream", "plant1.json.gz"))
+	if string(contents) != `{"timestamp":1569150729000,"label":"sensor0.temperature","value":18.7}` + "\n" +
+				`{"timestamp":1569150729000,"label":"sensor0.temperature","value":18.8}` + "\n" {
+		t.Errorf("unexpected contents: %q", contents)
+	}
+
+	// when compressing on rotation, closed files should be replaced by
+	// their compressed version and never reopened
+	fs, err	= NewFileSink(&FileSinkConfiguration{
+		Path:			dir,
+		FileType:		FILE_TYPE_CSV,
+		MaxAge:			100 * time.Millisecond,
+		Name:			"plant1",
+		MaxFileSize:		40,
+		FileNameTemplate:	"rotate/{sink}",
+		Compression:		"zstd",
+		CompressionMode:	"rotate",
+	})
+	if err != nil {
+		t.Fatalf("NewFileSink() should have succeeded, got: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		fs.Save([]*Point{
+			{ Timestamp: time.Unix(1569150729, 0), Label: "sensor0.temperature", Value: 18.7 },
+			{ Timestamp: time.Unix(1569150729, 0), Label: "sensor0.humidity", Value: 54 },
+		})
+		time.Sleep(300 * time.Millisecond)
+	}
+
+	for _, name := range []string{ "plant1.csv.zst", "plant1.1.csv.zst" } {
+		contents	= compressionTestReadFile(t, filepath.Join(dir, "rotate", name))
+		if string(contents) != "1569150729000,sensor0.temperature,18.7\n" +
+					"1569150729000,sensor0.humidity,54\n" {
+			t.Errorf("unexpected contents in %s: %q", name, contents)
+		}
+	}
+
+	// give the writer time to open the next file
+	time.Sleep(300 * time.Millisecond)
+
+	files, _	= filepath.Glob(filepath.Join(dir, "rotate", "*"))
+	if len(files) != 3 || filepath.Base(files[1]) != "plant1.2.csv" {
+		t.Errorf("expected 2 compressed files and plant1.2.csv, got: %v", files)
+	}
+
+	// on startup, uncompressed files of earlier periods should be compressed,
+	// leaving files of the current period and foreign files alone
+	today	= time.Now().UTC().Format("2006-01-02")
+	os.MkdirAll(filepath.Join(dir, "leftovers"), 0700)
+	for _, name := range []string{
+		"plant1-2019-09-22.csv", "plant1-2019-09-22.1.csv", "plant1-" + today + ".csv",
+		"plant2-2019-09-22.csv", "notes.csv", "plant1-2019-09-21.csv.zst.tmp",
+	} {
+		ioutil.WriteFile(filepath.Join(dir, "leftovers", name),
+				 []byte("1569150729000,sensor0.humidity,54\n"), 0600)
+	}
+
+	_, err	= NewFileSink(&FileSinkConfiguration{
+		Path:			dir,
+		FileType:		FILE_TYPE_CSV,
+		MaxAge:			100 * time.Millisecond,
+		Name:			"plant1",
+		FileNameTemplate:	"leftovers/{sink}-{year}-{month}-{day}",
+		Compression:		"zstd",
+		CompressionMode:	"rotate",
+	})
+	if err != nil {
+		t.Fatalf("NewFileSink() should have succeeded, got: %v", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	files, _	= filepath.Glob(filepath.Join(dir, "leftovers", "*"))
+	for idx := range files {
+		files[idx]	= filepath.Base(files[idx])
+	}
+	if strings.Join(files, " ") != "notes.csv plant1-2019-09-21.csv.zst.tmp " +
+					"plant1-2019-09-22.1.csv.zst plant1-2019-09-22.csv.zst " +
+					"plant1-" + today + ".csv plant2-2019-09-22.csv" {
+		t.Errorf("unexpected files: %v", files)
+	}
+
+	contents	= compressionTestReadFile(t, filepath.Join(dir, "leftovers", "plant1-2019-09-22.csv.zst"))
+	if string(contents) != "1569150729000,sensor0.humidity,54\n" {
+		t.Errorf("unexpected contents: %q", contents)
+	}
+
+	return
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type GraphiteSinkConfiguration struct {
+	Url		string		// carbon endpoint, either tcp://host:port or
+					// udp://host:port (port defaults to 2003)
+	Prefix		string		// metric name prefix (e.g. house.datalogger)
+	BufferSize	uint		// max. number of points to buffer while
+					// disconnected
+	OverflowPolicy	string		// what to do with new points when the buffer
+					// is full: either "drop_newest" (default) or
+					// "drop_oldest"
+	PushInterval	time.Duration	// how often to send buffered points
+	Timeout		time.Duration	// connect and write timeout
+	MaxRetryDelay	time.Duration	// upper bound of the delay between
+					// reconnection attempts (defaults to 1 minute)
+}
+
+// Graphite sink object.
+type GraphiteSink struct {
+	conf		GraphiteSinkConfiguration
+	network		string
+	address		string
+	prefix		string
+	overflowPolicy	uint
+	fifo		*pointRing
+	lock		sync.Mutex
+	conn		net.Conn
+	backoff		backoff
+}
+
+// Max. size of UDP datagrams, so that they fit in a single ethernet frame.
+const graphiteMaxDatagramSize	= 1400
+
+// Max. number of points sent at once.
+const graphiteBatchSize		= 1000
+
+// Returns a new graphite sink.
+func NewGraphiteSink(conf *GraphiteSinkConfiguration) (gs *GraphiteSink, err error) {
+	var host	string
+	var port	string
+
+	gs = &GraphiteSink{
+		conf:	*conf,
+	}
+
+	switch {
+	case strings.HasPrefix(gs.conf.Url, "tcp://"):
+		gs.network	= "tcp"
+		gs.address	= strings.TrimPrefix(gs.conf.Url, "tcp://")
+	case strings.HasPrefix(gs.conf.Url, "udp://"):
+		gs.network	= "udp"
+		gs.address	= strings.TrimPrefix(gs.conf.Url, "udp://")
+	default:
+		err	= fmt.Errorf("unsupported url '%s' (expected tcp:// or udp://)",
+				     gs.conf.Url)
+		return
+	}
+
+	// use the default carbon port if none is specified
+	host, port, err	= net.SplitHostPort(gs.address)
+	if err != nil {
+		host	= gs.address
+		port	= "2003"
+		err	= nil
+	}
+	if host == "" {
+		err	= errors.New("missing host")
+		return
+	}
+	gs.address	= net.JoinHostPort(host, port)
+
+	if gs.conf.Prefix != "" {
+		gs.prefix	= graphiteSanitize(gs.conf.Prefix) + "."
+	}
+
+	switch gs.conf.OverflowPolicy {
+	case "drop_newest", "":
+		gs.overflowPolicy	= OVERFLOW_DROP_NEWEST
+
+	case "drop_oldest":
+		gs.overflowPolicy	= OVERFLOW_DROP_OLDEST
+
+	default:
+		err	= fmt.Errorf("unsupported overflow policy '%s'", gs.conf.OverflowPolicy)
+		return
+	}
+
+	// buffer 100k points by default
+	if gs.conf.BufferSize == 0 {
+		gs.conf.BufferSize	= 100000
+	}
+
+	// default to sending once every second
+	if gs.conf.PushInterval == 0 {
+		gs.conf.PushInterval	= 1 * time.Second
+	}
+
+	if gs.conf.Timeout == 0 {
+		gs.conf.Timeout		= 10 * time.Second
+	}
+
+	gs.fifo		= newPointRing(gs.conf.BufferSize)
+
+	// retry failed connections on the next push, then back off exponentially
+	gs.backoff	= backoff{
+		initial:	gs.conf.PushInterval,
+		max:		gs.conf.MaxRetryDelay,
+		multiplier:	2,
+		jitter:		0.1,
+	}
+	if gs.backoff.max == 0 {
+		gs.backoff.max	= 1 * time.Minute
+	}
+
+	go gs.writer()
+
+	return
+}
+
+// Pushes points to the sink's internal buffer. Depending on the overflow
+// policy, either new or old points are dropped when the buffer is full.
+func (gs *GraphiteSink) Save(points []*Point) (acceptedCount uint) {
+	var pointCount	uint
+	var evicted	uint
+
+	pointCount	= uint(len(points))
+	if pointCount == 0 {
+		return
+	}
+
+	gs.lock.Lock()
+	acceptedCount, evicted	= gs.fifo.push(points, gs.overflowPolicy)
+	gs.lock.Unlock()
+
+	if acceptedCount != pointCount {
+		fmt.Printf("graphite sink: dropped %v points out of %v\n",
+			   pointCount - acceptedCount, pointCount)
+	}
+
+	if evicted > 0 {
+		fmt.Printf("graphite sink: buffer full, dropped %v old points\n", evicted)
+	}
+
+	return
+}
+
+// Periodically (re)connects to the carbon endpoint and sends buffered points
+// over a persistent connection. Points stay in the buffer until written.
+func (gs *GraphiteSink) writer() {
+	var ticker	*time.Ticker
+	var points	[]*Point
+	var seq		uint64
+	var failures	uint
+	var skipTicks	int
+	var delay	time.Duration
+	var err		error
+
+	ticker	= time.NewTicker(gs.conf.PushInterval)
+
+	for {
+		<-ticker.C
+
+		// wait for the backoff delay to expire
+		if skipTicks > 0 {
+			skipTicks--
+			continue
+		}
+
+		for {
+			gs.lock.Lock()
+			points, seq	= gs.fifo.peek(points, graphiteBatchSize)
+			gs.lock.Unlock()
+
+			if len(points) == 0 {
+				break
+			}
+
+			err	= gs.write(points)
+			if err != nil {
+				break
+			}
+
+			gs.lock.Lock()
+			gs.fifo.release(seq + uint64(len(points)))
+			gs.lock.Unlock()
+		}
+
+		if err != nil {
+			if gs.conn != nil {
+				gs.conn.Close()
+				gs.conn	= nil
+			}
+
+			failures++
+			delay		= gs.backoff.delay(failures)
+			skipTicks	= int(delay / gs.conf.PushInterval) - 1
+
+			fmt.Printf("graphite sink: failed to send to %s (retrying in %v): %v\n",
+				   gs.conf.Url, delay, err)
+			err	= nil
+			continue
+		}
+		failures	= 0
+	}
+
+	return
+}
+
+// Serializes and sends points, connecting first if needed. UDP payloads are
+// split into datagrams of whole lines.
+func (gs *GraphiteSink) write(points []*Point) (err error) {
+	var buf		bytes.Buffer
+	var line	string
+	var ok		bool
+
+	// carbon never writes anything back: a connection closed by the server
+	// is only detected when reading from it
+	if gs.conn != nil && gs.network == "tcp" && !graphiteConnAlive(gs.conn) {
+		fmt.Printf("graphite sink: connection to %s closed by peer\n", gs.conf.Url)
+		gs.conn.Close()
+		gs.conn	= nil
+	}
+
+	if gs.conn == nil {
+		gs.conn, err	= net.DialTimeout(gs.network, gs.address, gs.conf.Timeout)
+		if err != nil {
+			gs.conn	= nil
+			return
+		}
+		fmt.Printf("graphite sink: connected to %s\n", gs.conf.Url)
+	}
+
+	err	= gs.conn.SetWriteDeadline(time.Now().Add(gs.conf.Timeout))
+	if err != nil {
+		return
+	}
+
+	for _, p := range points {
+		line, ok	= gs.serialize(p)
+		if !ok {
+			continue
+		}
+
+		if gs.network == "udp" && buf.Len() > 0 &&
+		   buf.Len() + len(line) > graphiteMaxDatagramSize {
+			_, err	= gs.conn.Write(buf.Bytes())
+			if err != nil {
+				return
+			}
+			buf.Reset()
+		}
+		buf.WriteString(line)
+	}
+
+	if buf.Len() > 0 {
+		_, err	= gs.conn.Write(buf.Bytes())
+	}
+
+	return
+}
+
+// Returns the plaintext protocol line of a point, in the form
+// <prefix><label> <value> <timestamp>. Non-numeric values are skipped.
+func (gs *GraphiteSink) serialize(p *Point) (line string, ok bool) {
+	var f64	float64
+
+	if p == nil {
+		return
+	}
+
+	f64, ok	= p.Float64()
+	if !ok || math.IsNaN(f64) || math.IsInf(f64, 0) {
+		ok	= false
+		return
+	}
+
+	line	= gs.prefix + graphiteSanitize(p.Label) + " " +
+		  strconv.FormatFloat(f64, 'f', -1, 64) + " " +
+		  strconv.FormatInt(p.Timestamp.Unix(), 10) + "\n"
+
+	return
+}
+
+// Returns self-monitoring metrics.
+func (gs *GraphiteSink) StatsPoints(prefix string, now time.Time) (points []*Point) {
+	var fifoDepth	int
+
+	gs.lock.Lock()
+	fifoDepth	= gs.fifo.len()
+	gs.lock.Unlock()
+
+	points	= append(points, &Point{
+		Timestamp:	now,
+		Label:		prefix + ".fifo_depth",
+		Value:		uint64(fifoDepth),
+	})
+
+	return
+}
+
+// Returns false if the connection was closed by the remote end.
+func graphiteConnAlive(conn net.Conn) (alive bool) {
+	var buf	[1]byte
+	var err	error
+	var ne	net.Error
+	var ok	bool
+
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err	= conn.Read(buf[:])
+	conn.SetReadDeadline(time.Time{})
+
+	ne, ok	= err.(net.Error)
+	alive	= err == nil || (ok && ne.Timeout())
+
+	return
+}
+
+// Replaces characters which are not allowed in graphite metric names
+// (anything but letters, digits, dots, dashes and underscores) with
+// underscores, and drops empty path components.
+func graphiteSanitize(label string) (name string) {
+	var b		strings.Builder
+	var last	rune
+
+	for _, r := range label {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+		     r == '-', r == '_':
+		case r == '.':
+			// skip leading and consecutive dots
+			if last == '.' || b.Len() == 0 {
+				continue
+			}
+		default:
+			r	= '_'
+		}
+
+		b.WriteRune(r)
+		last	= r
+	}
+	name	= strings.TrimSuffix(b.String(), ".")
+
+	return
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGraphiteSinkSerialize(t *testing.T) {
+	var gs		*GraphiteSink
+	var err		error
+	var line	string
+	var ok		bool
+
+	for _, tc := range []struct {
+		label		string
+		expected	string
+	}{
+		{ "sensor0.temperature", "sensor0.temperature" },
+		{ "room 1.sensor/2.temp (°C)", "room_1.sensor_2.temp___C_" },
+		{ ".a..b.", "a.b" },
+		{ "a-b_c.D9", "a-b_c.D9" },
+	} {
+		if graphiteSanitize(tc.label) != tc.expected {
+			t.Errorf("graphiteSanitize('%s'): expected '%s', got: '%s'",
+				 tc.label, tc.expected, graphiteSanitize(tc.label))
+		}
+	}
+
+	gs, err	= NewGraphiteSink(&GraphiteSinkConfiguration{
+		Url:		"tcp://localhost",
+		Prefix:		"house.",
+		PushInterval:	time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	if gs.address != "localhost:2003" {
+		t.Errorf("unexpected address: %v", gs.address)
+	}
+
+	line, ok	= gs.serialize(&Point{
+		Timestamp:	time.Unix(1569150729, 500000000),
+		Label:		"kitchen.temperature",
+		Value:		float32(18.5),
+	})
+	if !ok || line != "house.kitchen.temperature 18.5 1569150729\n" {
+		t.Errorf("unexpected line: '%s' (%v)", line, ok)
+	}
+
+	line, ok	= gs.serialize(&Point{
+		Timestamp:	time.Unix(1569150729, 0),
+		Label:		"kitchen.alarm",
+		Value:		true,
+	})
+	if !ok || line != "house.kitchen.alarm 1 1569150729\n" {
+		t.Errorf("unexpected line: '%s' (%v)", line, ok)
+	}
+
+	// strings and NaN values cannot be stored by graphite
+	for _, value := range []interface{}{ "text", math.NaN(), math.Inf(-1) } {
+		_, ok	= gs.serialize(&Point{ Label: "kitchen.status", Value: value })
+		if ok {
+			t.Errorf("serialize(%v) should have failed", value)
+		}
+	}
+
+	for _, url := range []string{ "localhost:2003", "http://localhost", "tcp://:2003" } {
+		_, err	= NewGraphiteSink(&GraphiteSinkConfiguration{ Url: url })
+		if err == nil {
+			t.Errorf("sink creation should have failed with url '%s'", url)
+		}
+	}
+
+	return
+}
+
+func TestGraphiteSinkTCP(t *testing.T) {
+	var gs		*GraphiteSink
+	var err		error
+	var l		net.Listener
+	var conns	chan net.Conn
+	var conn	net.Conn
+	var lines	[]string
+
+	l, err	= net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	conns	= make(chan net.Conn, 4)
+	go func() {
+		for {
+			c, err	:= l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- c
+		}
+	}()
+
+	gs, err	= NewGraphiteSink(&GraphiteSinkConfiguration{
+		Url:		"tcp://" + l.Addr().String(),
+		PushInterval:	50 * time.Millisecond,
+		MaxRetryDelay:	100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	gs.Save([]*Point{
+		{ Timestamp: time.Unix(1569150729, 0), Label: "p0", Value: 0 },
+		{ Timestamp: time.Unix(1569150729, 0), Label: "p1", Value: 1.5 },
+	})
+
+	conn	= graphiteTestAccept(t, conns)
+	lines	= graphiteTestRead(t, conn, 2)
+	if len(lines) != 2 || lines[0] != "p0 0 1569150729" || lines[1] != "p1 1.5 1569150729" {
+		t.Errorf("unexpected lines: %v", lines)
+	}
+
+	// the connection should be kept open between pushes
+	gs.Save([]*Point{{ Timestamp: time.Unix(1569150730, 0), Label: "p2", Value: 2 }})
+	lines	= graphiteTestRead(t, conn, 1)
+	if len(lines) != 1 || lines[0] != "p2 2 1569150730" {
+		t.Errorf("unexpected lines: %v", lines)
+	}
+
+	// points saved while disconnected should be sent after reconnecting
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	gs.Save([]*Point{{ Timestamp: time.Unix(1569150731, 0), Label: "p3", Value: 3 }})
+
+	conn	= graphiteTestAccept(t, conns)
+	lines	= graphiteTestRead(t, conn, 1)
+	if len(lines) != 1 || lines[0] != "p3 3 1569150731" {
+		t.Errorf("unexpected lines: %v", lines)
+	}
+	conn.Close()
+
+	return
+}
+
+func TestGraphiteSinkUDP(t *testing.T) {
+	var gs		*GraphiteSink
+	var err		error
+	var pc		net.PacketConn
+	var buf		[]byte
+	var n		int
+	var points	[]*Point
+	var count	int
+
+	pc, err	= net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer pc.Close()
+
+	gs, err	= NewGraphiteSink(&GraphiteSinkConfiguration{
+		Url:		"udp://" + pc.LocalAddr().String(),
+		Prefix:		"house",
+		PushInterval:	50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		points	= append(points, &Point{
+			Timestamp:	time.Unix(1569150729, 0),
+			Label:		"sensor.value",
+			Value:		i,
+		})
+	}
+	gs.Save(points)
+
+	// 100 lines of about 40 bytes each should be split in several datagrams
+	buf	= make([]byte, 65536)
+	for dgrams := 0; count < 100; dgrams++ {
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err	= pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("failed to read datagram #%v: %v", dgrams, err)
+		}
+
+		if n > graphiteMaxDatagramSize || buf[n - 1] != '\n' {
+			t.Errorf("unexpected datagram (%v bytes)", n)
+		}
+
+		for _, line := range strings.Split(strings.TrimSpace(string(buf[:n])), "\n") {
+			if !strings.HasPrefix(line, "house.sensor.value ") {
+				t.Errorf("unexpected line: '%s'", line)
+			}
+			count++
+		}
+
+		if count == 100 && dgrams < 2 {
+			t.Errorf("expected at least 3 datagrams, got: %v", dgrams + 1)
+		}
+	}
+
+	return
+}
+
+func graphiteTestAccept(t *testing.T, conns chan net.Conn) (conn net.Conn) {
+	select {
+	case conn = <-conns:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for a connection")
+	}
+
+	return
+}
+
+func graphiteTestRead(t *testing.T, conn net.Conn, count int) (lines []string) {
+	var r		*bufio.Reader
+	var line	string
+	var err		error
+
+	r	= bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for i := 0; i < count; i++ {
+		line, err	= r.ReadString('\n')
+		if err != nil {
+			t.Errorf("failed to read line: %v", err)
+			return
+		}
+		lines	= append(lines, strings.TrimSuffix(line, "\n"))
+	}
+
+	return
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HTTP_PAYLOAD_JSON	uint	= 1
+	HTTP_PAYLOAD_NDJSON	uint	= 2
+)
+
+type HTTPSinkConfiguration struct {
+	Url		string		// endpoint URL points are POSTed to
+	PayloadFormat	string		// either "json" (a JSON array of points,
+					// default) or "ndjson" (one JSON object per line)
+	Headers		map[string]string // custom request headers
+	Token		string		// bearer token (disabled if empty)
+	TokenFile	string		// file to read the bearer token from, if Token
+					// is empty
+	Username	string		// basic auth username (disabled if empty)
+	Password	string		// basic auth password
+	TLSConfig	*tls.Config	// TLS settings (https:// URLs only)
+	BufferSize	uint		// max. number of buffered points
+	OverflowPolicy	string		// what to do with new points when the buffer
+					// is full: either "drop_newest" (default) or
+					// "drop_oldest"
+	BatchSize	uint		// max. number of points posted at once
+	PushInterval	time.Duration	// how often to post points
+	Timeout		time.Duration	// HTTP request timeout (defaults to 1 minute)
+	MaxRetryDelay	time.Duration	// upper bound of the delay between retries
+					// (defaults to 1 minute)
+}
+
+// HTTP sink object.
+type HTTPSink struct {
+	conf		HTTPSinkConfiguration
+	payloadFormat	uint
+	overflowPolicy	uint
+	fifo		*pointRing
+	lock		sync.Mutex
+	token		string
+	backoff		backoff
+	client		*http.Client
+}
+
+// HTTP post error.
+type httpPostError struct {
+	status		int		// HTTP status code (0 if the request failed)
+	message		string		// error message
+	retryAfter	time.Duration	// delay requested by the server, if any
+}
+
+// Returns a new HTTP sink.
+func NewHTTPSink(conf *HTTPSinkConfiguration) (hs *HTTPSink, err error) {
+	var buf	[]byte
+
+	hs = &HTTPSink{
+		conf:	*conf,
+		client:	&http.Client{
+			Timeout:	conf.Timeout,
+			Transport:	&http.Transport{
+				Proxy:			http.ProxyFromEnvironment,
+				TLSClientConfig:	conf.TLSConfig,
+			},
+		},
+	}
+
+	if hs.conf.Url == "" {
+		err	= errors.New("missing url")
+		return
+	}
+
+	switch hs.conf.PayloadFormat {
+	case "json", "":	hs.payloadFormat = HTTP_PAYLOAD_JSON
+	case "ndjson":		hs.payloadFormat = HTTP_PAYLOAD_NDJSON
+	default:
+		err	= fmt.Errorf("unsupported payload format '%s'",
+				     hs.conf.PayloadFormat)
+		return
+	}
+
+	switch hs.conf.OverflowPolicy {
+	case "drop_newest", "":
+		hs.overflowPolicy	= OVERFLOW_DROP_NEWEST
+
+	case "drop_oldest":
+		hs.overflowPolicy	= OVERFLOW_DROP_OLDEST
+
+	default:
+		err	= fmt.Errorf("unsupported overflow policy '%s'", hs.conf.OverflowPolicy)
+		return
+	}
+
+	hs.token	= hs.conf.Token
+	if hs.token == "" && hs.conf.TokenFile != "" {
+		buf, err	= ioutil.ReadFile(hs.conf.TokenFile)
+		if err != nil {
+			err	= fmt.Errorf("failed to read token file '%s': %v",
+					     hs.conf.TokenFile, err)
+			return
+		}
+		hs.token	= strings.TrimSpace(string(buf))
+	}
+
+	// buffer 100k points by default
+	if hs.conf.BufferSize == 0 {
+		hs.conf.BufferSize	= 100000
+	}
+
+	// default to posting 1k points at once
+	if hs.conf.BatchSize == 0 {
+		hs.conf.BatchSize	= 1000
+	}
+
+	// default to posting once every second
+	if hs.conf.PushInterval == 0 {
+		hs.conf.PushInterval	= 1 * time.Second
+	}
+
+	if hs.client.Timeout == 0 {
+		hs.client.Timeout	= 1 * time.Minute
+	}
+
+	hs.fifo		= newPointRing(hs.conf.BufferSize)
+
+	// retry failed posts on the next push, then back off exponentially
+	hs.backoff	= backoff{
+		initial:	hs.conf.PushInterval,
+		max:		hs.conf.MaxRetryDelay,
+		multiplier:	2,
+		jitter:		0.1,
+	}
+	if hs.backoff.max == 0 {
+		hs.backoff.max	= 1 * time.Minute
+	}
+
+	go hs.writer()
+
+	return
+}
+
+// Pushes points to the sink's internal buffer. Depending on the overflow
+// policy, either new or old points are dropped when the buffer is full.
+func (hs *HTTPSink) Save(points []*Point) (acceptedCount uint) {
+	var pointCount	uint
+	var evicted	uint
+
+	pointCount	= uint(len(points))
+	if pointCount == 0 {
+		return
+	}
+
+	hs.lock.Lock()
+	acceptedCount, evicted	= hs.fifo.push(points, hs.overflowPolicy)
+	hs.lock.Unlock()
+
+	if acceptedCount != pointCount {
+		fmt.Printf("http sink: dropped %v points out of %v\n",
+			   pointCount - acceptedCount, pointCount)
+	}
+
+	if evicted > 0 {
+		fmt.Printf("http sink: buffer full, dropped %v old points\n", evicted)
+	}
+
+	return
+}
+
+// Periodically posts batches of buffered points. When behind, batches are
+// posted continuously until the backlog is drained. Failed posts are retried
+// with an exponential backoff.
+func (hs *HTTPSink) writer() {
+	var points	[]*Point
+	var seq		uint64
+	var ticker	*time.Ticker
+	var draining	bool
+	var failures	uint
+	var skipTicks	int
+	var delay	time.Duration
+	var err		error
+
+	ticker	= time.NewTicker(hs.conf.PushInterval)
+
+	for {
+		if !draining {
+			<-ticker.C
+
+			// wait for the backoff delay to expire
+			if skipTicks > 0 {
+				skipTicks--
+				continue
+			}
+		}
+		draining	= false
+
+		hs.lock.Lock()
+		points, seq	= hs.fifo.peek(points, hs.conf.BatchSize)
+		hs.lock.Unlock()
+
+		if len(points) == 0 {
+			continue
+		}
+
+		err	= hs.write(points)
+		if err != nil {
+			// back off, honoring the delay requested by the server if any
+			failures++
+			delay	= hs.backoff.delay(failures)
+			if hpe, ok := err.(*httpPostError); ok && hpe.retryAfter > delay {
+				delay	= hpe.retryAfter
+			}
+			skipTicks	= int(delay / hs.conf.PushInterval) - 1
+
+			fmt.Printf("http sink: post failed (retrying in %v): %v\n",
+				   delay, err)
+			continue
+		}
+		failures	= 0
+
+		// free points which have been successfully posted
+		hs.lock.Lock()
+		hs.fifo.release(seq + uint64(len(points)))
+		draining	= uint(hs.fifo.len()) >= hs.conf.BatchSize
+		hs.lock.Unlock()
+	}
+
+	return
+}
+
+// Serializes and posts points. Batches rejected by the server as invalid
+// (see isRejection()) are dropped, as retrying them would block the pipeline.
+// Returns an error if the post should be retried later.
+func (hs *HTTPSink) write(points []*Point) (err error) {
+	var buf		bytes.Buffer
+	var hpe		*httpPostError
+	var ok		bool
+
+	hs.serialize(&buf, points)
+	if buf.Len() == 0 {
+		return
+	}
+
+	err	= hs.post(&buf)
+	if err == nil {
+		return
+	}
+
+	hpe, ok	= err.(*httpPostError)
+	if ok && hpe.isRejection() {
+		fmt.Printf("http sink: dropped %v points rejected by the server: %v\n",
+			   len(points), hpe)
+		err	= nil
+	}
+
+	return
+}
+
+// Posts a serialized payload.
+func (hs *HTTPSink) post(buf *bytes.Buffer) (err error) {
+	var req		*http.Request
+	var res		*http.Response
+	var body	[]byte
+
+	req, err	= http.NewRequest(http.MethodPost, hs.conf.Url, buf)
+	if err != nil {
+		err	= fmt.Errorf("failed to build POST request: %v", err)
+		return
+	}
+
+	if hs.payloadFormat == HTTP_PAYLOAD_NDJSON {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if hs.token != "" {
+		req.Header.Set("Authorization", "Bearer " + hs.token)
+	} else if hs.conf.Username != "" {
+		req.SetBasicAuth(hs.conf.Username, hs.conf.Password)
+	}
+
+	// custom headers take precedence over the above
+	for key, value := range hs.conf.Headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err	= hs.client.Do(req)
+	if err != nil {
+		err	= &httpPostError{
+			message:	err.Error(),
+		}
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		// drain the body so that the connection can be reused
+		io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096))
+		return
+	}
+
+	body, _	= ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+	err	= &httpPostError{
+		status:		res.StatusCode,
+		message:	strings.TrimSpace(string(body)),
+		retryAfter:	parseRetryAfter(res.Header.Get("Retry-After"), time.Now()),
+	}
+
+	return
+}
+
+// Serializes points as either a JSON array or newline-delimited JSON objects.
+// Points which cannot be serialized (e.g. NaN values) are dropped.
+func (hs *HTTPSink) serialize(buf *bytes.Buffer, points []*Point) {
+	var payload	[]byte
+	var count	uint
+	var err		error
+
+	for _, p := range points {
+		// drop nil points
+		if p == nil {
+			continue
+		}
+
+		payload, err	= json.Marshal(struct {
+			Timestamp	int64			`json:"timestamp"`
+			Label		string			`json:"label"`
+			Value		interface{}		`json:"value"`
+			Tags		map[string]string	`json:"tags,omitempty"`
+		}{
+			Timestamp:	p.Timestamp.UnixNano() / 1e6,
+			Label:		p.Label,
+			Value:		p.Value,
+			Tags:		p.Tags,
+		})
+		// if we failed to serialize the point for whatever reason, drop it
+		if err != nil {
+			fmt.Printf("http sink: failed to serialize point (%v): %v\n", p, err)
+			continue
+		}
+
+		switch {
+		case hs.payloadFormat == HTTP_PAYLOAD_NDJSON:
+			buf.Write(payload)
+			buf.WriteByte('\n')
+		case count == 0:
+			buf.WriteByte('[')
+			buf.Write(payload)
+		default:
+			buf.WriteByte(',')
+			buf.Write(payload)
+		}
+		count++
+	}
+
+	if hs.payloadFormat == HTTP_PAYLOAD_JSON && count > 0 {
+		buf.WriteByte(']')
+	}
+
+	return
+}
+
+// Returns self-monitoring metrics.
+func (hs *HTTPSink) StatsPoints(prefix string, now time.Time) (points []*Point) {
+	var fifoDepth	int
+
+	hs.lock.Lock()
+	fifoDepth	= hs.fifo.len()
+	hs.lock.Unlock()
+
+	points	= append(points, &Point{
+		Timestamp:	now,
+		Label:		prefix + ".fifo_depth",
+		Value:		uint64(fifoDepth),
+	})
+
+	return
+}
+
+func (hpe *httpPostError) Error() (msg string) {
+	if hpe.status == 0 {
+		msg	= hpe.message
+	} else {
+		msg	= fmt.Sprintf("status code %d: %s", hpe.status, hpe.message)
+	}
+
+	return
+}
+
+// Returns true if the server rejected the payload itself (400, 413 or 422),
+// in which case posting it again would fail the same way. Other client errors
+// (e.g. 401 after a token expired, 403 or 404 during a deployment) may be
+// fixed on the server side and are worth retrying.
+func (hpe *httpPostError) isRejection() (yes bool) {
+	switch hpe.status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge,
+	     http.StatusUnprocessableEntity:
+		yes	= true
+	}
+
+	return
+}
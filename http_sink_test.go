@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPSinkSerialize(t *testing.T) {
+	var hs		*HTTPSink
+	var err		error
+	var res		[]map[string]interface{}
+	var buf		bytes.Buffer
+	var points	[]*Point
+
+	points	= []*Point{
+		{
+			Timestamp:	time.Unix(1569150729, 123000000),
+			Label:		"sensor0.\"temperature\"",
+			Value:		18.5,
+			Tags:		map[string]string{ "room": "kitchen" },
+		},
+		nil,
+		{
+			Timestamp:	time.Unix(1569150729, 0),
+			Label:		"sensor0.broken",
+			Value:		math.NaN(),
+		},
+		{
+			Timestamp:	time.Unix(1569150730, 0),
+			Label:		"sensor0.status",
+			Value:		"ok",
+		},
+	}
+
+	hs, err	= NewHTTPSink(&HTTPSinkConfiguration{
+		Url:		"http://localhost/ingest",
+		PushInterval:	time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	// NaN values cannot be represented in JSON and should be dropped
+	hs.serialize(&buf, points)
+
+	err	= json.Unmarshal(buf.Bytes(), &res)
+	if err != nil {
+		t.Fatalf("payload should have been a valid JSON array, got: %v (%s)",
+			 err, buf.String())
+	}
+
+	if len(res) != 2 || res[0]["timestamp"] != float64(1569150729123) ||
+	   res[0]["label"] != "sensor0.\"temperature\"" || res[0]["value"] != 18.5 ||
+	   res[0]["tags"].(map[string]interface{})["room"] != "kitchen" ||
+	   res[1]["value"] != "ok" || res[1]["tags"] != nil {
+		t.Errorf("unexpected payload: %s", buf.String())
+	}
+
+	hs, err	= NewHTTPSink(&HTTPSinkConfiguration{
+		Url:		"http://localhost/ingest",
+		PayloadFormat:	"ndjson",
+		PushInterval:	time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	buf.Reset()
+	hs.serialize(&buf, points)
+	if buf.String() !=
+	   `{"timestamp":1569150729123,"label":"sensor0.\"temperature\"","value":18.5,"tags":{"room":"kitchen"}}` + "\n" +
+	   `{"timestamp":1569150730000,"label":"sensor0.status","value":"ok"}` + "\n" {
+		t.Errorf("unexpected ndjson payload: %s", buf.String())
+	}
+
+	_, err	= NewHTTPSink(&HTTPSinkConfiguration{
+		Url:		"http://localhost/ingest",
+		PayloadFormat:	"xml",
+	})
+	if err == nil {
+		t.Errorf("sink creation should have failed with an unknown payload format")
+	}
+
+	_, err	= NewHTTPSink(&HTTPSinkConfiguration{})
+	if err == nil {
+		t.Errorf("sink creation should have failed without a url")
+	}
+
+	return
+}
+
+func TestHTTPSink(t *testing.T) {
+	var hs		*HTTPSink
+	var err		error
+	var ts		*httptest.Server
+	var lock	sync.Mutex
+	var requests	[]*http.Request
+	var payloads	[]string
+	var fail	int
+	var failStatus	int
+	var fifoLen	int
+
+	ts	= httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var payload	[]byte
+
+			payload, _	= ioutil.ReadAll(r.Body)
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			requests	= append(requests, r)
+			payloads	= append(payloads, string(payload))
+
+			switch {
+			case fail > 0:
+				fail--
+				w.WriteHeader(failStatus)
+
+			case strings.Contains(string(payload), "invalid"):
+				w.WriteHeader(400)
+				w.Write([]byte("invalid label"))
+
+			default:
+				w.WriteHeader(202)
+			}
+		}))
+	defer ts.Close()
+
+	hs, err	= NewHTTPSink(&HTTPSinkConfiguration{
+		Url:		ts.URL + "/ingest",
+		Token:		"s3cr3t",
+		Headers:	map[string]string{ "X-Site": "house" },
+		BufferSize:	5,
+		BatchSize:	2,
+		PushInterval:	100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	// the first two posts fail with a server error, and should be retried
+	lock.Lock()
+	fail		= 2
+	failStatus	= 503
+	lock.Unlock()
+
+	if hs.Save(httpSinkTestPoints("p", 6)) != 5 {
+		t.Errorf("5 points should have been accepted")
+	}
+
+	// retries are backed off by about 100ms then 200ms
+	time.Sleep(1 * time.Second)
+
+	lock.Lock()
+	if len(requests) != 5 {
+		t.Errorf("expected 5 requests, got: %v (%v)", len(requests), payloads)
+	}
+	for idx, r := range requests {
+		if r.Method != http.MethodPost || r.URL.Path != "/ingest" ||
+		   r.Header.Get("Authorization") != "Bearer s3cr3t" ||
+		   r.Header.Get("X-Site") != "house" ||
+		   r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request #%v: %v %v %v", idx, r.Method, r.URL, r.Header)
+		}
+	}
+	if len(payloads) == 5 &&
+	   (payloads[2] != payloads[0] ||
+	    !strings.Contains(payloads[2], `"label":"p0"`) ||
+	    !strings.Contains(payloads[3], `"label":"p3"`) ||
+	    !strings.Contains(payloads[4], `"label":"p4"`)) {
+		t.Errorf("unexpected payloads: %v", payloads)
+	}
+	requests	= nil
+	payloads	= nil
+	lock.Unlock()
+
+	hs.lock.Lock()
+	fifoLen	= hs.fifo.len()
+	hs.lock.Unlock()
+
+	if fifoLen != 0 {
+		t.Errorf("fifo should have been empty, got: %v", fifoLen)
+	}
+
+	// batches rejected with a client error should be dropped
+	hs.Save(httpSinkTestPoints("invalid", 2))
+	time.Sleep(250 * time.Millisecond)
+	hs.Save(httpSinkTestPoints("p", 1))
+	time.Sleep(250 * time.Millisecond)
+
+	lock.Lock()
+	if len(payloads) != 2 || !strings.Contains(payloads[1], `"label":"p0"`) {
+		t.Errorf("unexpected payloads: %v", payloads)
+	}
+	payloads	= nil
+
+	// auth errors may be fixed on the server side, and should be retried
+	fail		= 1
+	failStatus	= 401
+	lock.Unlock()
+
+	hs.Save(httpSinkTestPoints("p", 1))
+	time.Sleep(500 * time.Millisecond)
+
+	lock.Lock()
+	if len(payloads) != 2 || payloads[1] != payloads[0] {
+		t.Errorf("unexpected payloads: %v", payloads)
+	}
+	lock.Unlock()
+
+	return
+}
+
+func httpSinkTestPoints(prefix string, count int) (points []*Point) {
+	for i := 0; i < count; i++ {
+		points	= append(points, &Point{
+			Timestamp:	time.Unix(1569150729 + int64(i), 0),
+			Label:		fmt.Sprintf("%s%d", prefix, i),
+			Value:		i,
+		})
+	}
+
+	return
+}
@@ -2,47 +2,249 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
 	"time"
 	"strings"
 	"sync"
 )
 
+type InfluxDBSinkConfiguration struct {
+	Url		string		// v1: write endpoint URL
+					// (e.g. http://localhost:8086/write?db=house)
+					// v2: server URL (e.g. http://localhost:8086)
+	Version		uint		// API version: 1 or 2 (defaults to 1)
+	Org		string		// organization (v2 only)
+	Bucket		string		// bucket (v2 only)
+	Token		string		// API token (v2 only)
+	TokenFile	string		// file to read the API token from, if Token
+					// is empty (v2 only)
+	Username	string		// basic auth username (v1 only, disabled if empty)
+	Password	string		// basic auth password (v1 only)
+	TLSConfig	*tls.Config	// TLS settings (https:// URLs only)
+	Rules		[]*LabelRule	// rules mapping point labels to measurements,
+					// fields and tags. Labels matching no rule are
+					// split on their last dot into measurement and field.
+	Tags		map[string]string // static tags added to all points
+	GroupFields	bool		// write fields sharing the same measurement,
+					// tags and timestamp as a single line
+	IntegerFields	bool		// write integer values as influxdb integers
+					// rather than floats. Note that enabling this on
+					// an existing database causes field type conflicts.
+	BufferSize	uint		// max. number of buffered points
+	OverflowPolicy	string		// what to do with new points when the buffer
+					// is full and no on-disk queue is configured:
+					// either "drop_newest" (default) or "drop_oldest"
+	BatchSize	uint		// max. number of points pushed at once
+	PushInterval	time.Duration	// how often to push points
+	Concurrency	uint		// max. number of concurrent requests when
+					// catching up (defaults to 1)
+	Gzip		bool		// gzip request bodies
+	Timeout		time.Duration	// HTTP request timeout (defaults to 1 minute)
+	QueueDir	string		// directory of the on-disk queue, used when
+					// the in-memory buffer is full or the server
+					// unreachable (disabled if empty)
+	QueueMaxSize	int64		// max. size of the on-disk queue, in bytes
+					// (defaults to 1GB)
+	QueueMaxAge	time.Duration	// queued points older than this are dropped
+					// (disabled if 0)
+	QuarantineFile	string		// file to append points rejected by the
+					// server to, in line protocol (disabled if empty)
+	MaxRetryDelay	time.Duration	// upper bound of the delay between retries
+					// (defaults to 1 minute)
+}
+
 // InfluxDB sink object.
 type InfluxDBSink struct {
-	fifo		[]*Point
+	fifo		*pointRing
+	overflowPolicy	uint
 	lock		sync.Mutex
 	pushInterval	time.Duration
 	url		string
+	token		string
+	username	string
+	password	string
 	batchSize	uint
 	bufferSize	uint
+	concurrency	uint
+	gzip		bool
+	rules		[]*LabelRule
+	tags		map[string]string
+	groupFields	bool
+	integerFields	bool		// write integers with the i/u suffixes
+	unsigned	bool		// write unsigned integers with the u suffix
+	queue		*diskQueue
+	quarantineFile	string
+	backoff		backoff
 	client		*http.Client
 }
 
+// InfluxDB write error.
+type influxWriteError struct {
+	status		int		// HTTP status code (0 if the request failed)
+	message		string		// error message
+	retryAfter	time.Duration	// delay requested by the server, if any
+}
+
+// Line protocol escapers, for measurements, tag keys and values and field keys
+// (identifiers) and for string field values. Newlines are not allowed outside
+// of string field values and are written as \n.
+var influxMeasurementEscaper	= strings.NewReplacer(
+	",", "\\,", " ", "\\ ", "\n", "\\n")
+var influxIdentifierEscaper	= strings.NewReplacer(
+	",", "\\,", "=", "\\=", " ", "\\ ", "\n", "\\n")
+var influxStringEscaper		= strings.NewReplacer(
+	"\"", "\\\"", "\\", "\\\\")
+
+// Line protocol entry.
+type influxLine struct {
+	series		string		// measurement and tag set
+	fields		[]string
+	timestamp	int64
+}
+
 // Returns a new influx db sink.
-func NewInfluxDBSink(url string, bufferSize uint, batchSize uint,
-		     pushInterval time.Duration) (is *InfluxDBSink, err error) {
+func NewInfluxDBSink(conf *InfluxDBSinkConfiguration) (is *InfluxDBSink, err error) {
+	var buf		[]byte
+	var params	url.Values
+
+	is = &InfluxDBSink{
+		batchSize:	conf.BatchSize,
+		bufferSize:	conf.BufferSize,
+		concurrency:	conf.Concurrency,
+		gzip:		conf.Gzip,
+		pushInterval:	conf.PushInterval,
+		rules:		conf.Rules,
+		tags:		conf.Tags,
+		groupFields:	conf.GroupFields,
+		integerFields:	conf.IntegerFields,
+		quarantineFile:	conf.QuarantineFile,
+		client:		&http.Client{
+			Timeout:	conf.Timeout,
+			Transport:	&http.Transport{
+				Proxy:			http.ProxyFromEnvironment,
+				TLSClientConfig:	conf.TLSConfig,
+			},
+		},
+	}
 
 	// buffer 100k points by default
-	if bufferSize == 0 {
-		bufferSize = 100000
+	if is.bufferSize == 0 {
+		is.bufferSize = 100000
+	}
+
+	switch conf.OverflowPolicy {
+	case "drop_newest", "":
+		is.overflowPolicy	= OVERFLOW_DROP_NEWEST
+
+	case "drop_oldest":
+		is.overflowPolicy	= OVERFLOW_DROP_OLDEST
+
+	default:
+		err	= fmt.Errorf("unsupported overflow policy '%s'", conf.OverflowPolicy)
+		return
 	}
 
+	is.fifo		= newPointRing(is.bufferSize)
+
 	// default to pushing 1k points at once
-	if batchSize == 0 {
-		batchSize  = 1000
+	if is.batchSize == 0 {
+		is.batchSize  = 1000
 	}
 
-	is = &InfluxDBSink{
-		fifo:		make([]*Point, 0),
-		batchSize:	batchSize,
-		bufferSize:	bufferSize,
-		pushInterval:	pushInterval,
-		url:		url,
-		client:		&http.Client{
-			Timeout:	1 * time.Minute,
-		},
+	// default to pushing once every second
+	if is.pushInterval == 0 {
+		is.pushInterval = 1 * time.Second
+	}
+
+	// default to one request at a time
+	if is.concurrency == 0 {
+		is.concurrency	= 1
+	}
+
+	if is.client.Timeout == 0 {
+		is.client.Timeout	= 1 * time.Minute
+	}
+
+	// retry failed writes on the next push, then back off exponentially
+	is.backoff	= backoff{
+		initial:	is.pushInterval,
+		max:		conf.MaxRetryDelay,
+		multiplier:	2,
+		jitter:		0.1,
+	}
+	if is.backoff.max == 0 {
+		is.backoff.max	= 1 * time.Minute
+	}
+
+	switch conf.Version {
+	case 1, 0:
+		is.url		= fmt.Sprintf("%s&precision=ms", conf.Url)
+		is.username	= conf.Username
+		is.password	= conf.Password
+
+	case 2:
+		// unsigned integers are only supported by the v2 API
+		is.unsigned	= true
+
+		if conf.Org == "" || conf.Bucket == "" {
+			err	= errors.New("org and bucket are required with the v2 API")
+			return
+		}
+
+		is.token	= conf.Token
+		if is.token == "" && conf.TokenFile != "" {
+			buf, err	= ioutil.ReadFile(conf.TokenFile)
+			if err != nil {
+				err	= fmt.Errorf("failed to read token file '%s': %v",
+						     conf.TokenFile, err)
+				return
+			}
+			is.token	= strings.TrimSpace(string(buf))
+		}
+
+		if is.token == "" {
+			err	= errors.New("a token is required with the v2 API")
+			return
+		}
+
+		params		= url.Values{}
+		params.Set("org", conf.Org)
+		params.Set("bucket", conf.Bucket)
+		params.Set("precision", "ms")
+		is.url		= fmt.Sprintf("%s/api/v2/write?%s",
+					      strings.TrimRight(conf.Url, "/"),
+					      params.Encode())
+
+	default:
+		err	= fmt.Errorf("unsupported influxdb API version %v", conf.Version)
+		return
+	}
+
+	if conf.QueueDir != "" {
+		is.queue, err	= newDiskQueue(conf.QueueDir, conf.QueueMaxSize, 0,
+					       conf.QueueMaxAge)
+		if err != nil {
+			err	= fmt.Errorf("failed to open queue in '%s': %v",
+					     conf.QueueDir, err)
+			return
+		}
+
+		if is.queue.Depth() > 0 {
+			fmt.Printf("influxdb sink: replaying %v queued points from %s\n",
+				   is.queue.Depth(), conf.QueueDir)
+		}
 	}
 
 	go is.writer()
@@ -50,10 +252,15 @@ func NewInfluxDBSink(url string, bufferSize uint, batchSize uint,
 	return
 }
 
-// Pushes points to the sink's internal buffer. Points are rejected when
-// the buffer is full.
+// Pushes points to the sink's internal buffer. When the buffer is full,
+// points are either written to the on-disk queue, if enabled, or handled
+// according to the overflow policy.
 func (is *InfluxDBSink) Save(points []*Point) (acceptedCount uint) {
-	var pointCount uint
+	var pointCount	uint
+	var queuedCount	uint
+	var evicted	uint
+	var policy	uint
+	var err		error
 
 	pointCount	= uint(len(points))
 	if pointCount == 0 {
@@ -62,14 +269,24 @@ func (is *InfluxDBSink) Save(points []*Point) (acceptedCount uint) {
 
 	is.lock.Lock()
 
-	acceptedCount	= is.bufferSize - uint(len(is.fifo))
+	// once points are queued on disk, keep queueing new points until the
+	// queue is drained so that points are written in order
+	if is.queue == nil || is.queue.Depth() == 0 {
+		// overflowing points go to the on-disk queue, if enabled
+		policy	= is.overflowPolicy
+		if is.queue != nil {
+			policy	= OVERFLOW_DROP_NEWEST
+		}
 
-	if acceptedCount > pointCount {
-		acceptedCount = pointCount
+		acceptedCount, evicted	= is.fifo.push(points, policy)
 	}
 
-	if acceptedCount > 0 {
-		is.fifo	= append(is.fifo, points[0:acceptedCount]...)
+	if acceptedCount < pointCount && is.queue != nil {
+		queuedCount, err	= is.queue.push(points[acceptedCount:])
+		if err != nil {
+			fmt.Printf("influxdb sink: failed to queue points: %v\n", err)
+		}
+		acceptedCount	+= queuedCount
 	}
 	is.lock.Unlock()
 
@@ -78,97 +295,644 @@ func (is *InfluxDBSink) Save(points []*Point) (acceptedCount uint) {
 			   pointCount - acceptedCount, pointCount)
 	}
 
+	if evicted > 0 {
+		fmt.Printf("influxdb sink: buffer full, dropped %v old points\n", evicted)
+	}
+
 	return
 }
 
-// Periodically reads points from the internal buffer, serializes them and pushes
-// them to influxdb API.
+// Periodically reads points from the internal buffer (or from the on-disk
+// queue once the buffer is empty), serializes them and pushes them to
+// influxdb API. When behind, points are pushed continuously until the
+// backlog is drained. Failed pushes are retried with an exponential backoff.
 func (is *InfluxDBSink) writer() {
-	var batch	[]*Point
-	var batchSize	uint
+	var batches	[][]*Point
+	var points	[]*Point
+	var pointCount	uint
+	var okCount	int
+	var seq		uint64
 	var ticker	*time.Ticker
-	var buf		bytes.Buffer
-	var res		*http.Response
+	var cursor	queueCursor
+	var fromQueue	bool
+	var draining	bool
+	var failures	uint
+	var skipTicks	int
+	var delay	time.Duration
 	var err		error
 
 	ticker	= time.NewTicker(is.pushInterval)
 
 	for {
-		// clear the send buffer
-		buf.Reset()
-
-		<-ticker.C
+		if !draining {
+			<-ticker.C
+
+			// wait for the backoff delay to expire
+			if skipTicks > 0 {
+				skipTicks--
+				continue
+			}
+		}
+		draining	= false
 
 		is.lock.Lock()
-		// determine how many points to grab
-		batchSize = uint(len(is.fifo))
-		if batchSize > is.batchSize {
-			batchSize = is.batchSize
+		// grab up to concurrency batches of batchSize points
+		points, seq	= is.fifo.peek(points, is.batchSize * is.concurrency)
+		pointCount	= uint(len(points))
+		is.lock.Unlock()
+
+		// points buffered in memory are always older than queued ones
+		fromQueue	= false
+		if pointCount == 0 && is.queue != nil && is.queue.Depth() > 0 {
+			points, cursor, err	= is.queue.peek(is.batchSize * is.concurrency)
+			if err != nil {
+				fmt.Printf("influxdb sink: failed to read queued points: %v\n",
+					   err)
+				continue
+			}
+			fromQueue	= true
 		}
 
-		// grab batchSize points
-		batch	= is.fifo[0:batchSize]
-		is.lock.Unlock()
+		batches		= nil
+		for idx := uint(0); idx < uint(len(points)); idx += is.batchSize {
+			if idx + is.batchSize < uint(len(points)) {
+				batches	= append(batches, points[idx:idx+is.batchSize])
+			} else {
+				batches	= append(batches, points[idx:])
+			}
+		}
 
-		if batchSize == 0 {
+		okCount, err	= is.writeBatches(batches)
+
+		// free points which have been successfully pushed, if any
+		if fromQueue && err == nil {
+			err	= is.queue.ack(cursor)
+			if err != nil {
+				fmt.Printf("influxdb sink: failed to update queue: %v\n", err)
+			}
+		} else if !fromQueue {
+			pointCount	= 0
+			for _, batch := range batches[0:okCount] {
+				pointCount	+= uint(len(batch))
+			}
+
+			is.lock.Lock()
+			is.fifo.release(seq + uint64(pointCount))
+			is.lock.Unlock()
+		}
+
+		if err != nil {
+			// back off, honoring the delay requested by the server if any
+			failures++
+			delay	= is.backoff.delay(failures)
+			if iwe, ok := err.(*influxWriteError); ok && iwe.retryAfter > delay {
+				delay	= iwe.retryAfter
+			}
+			skipTicks	= int(delay / is.pushInterval) - 1
+
+			fmt.Printf("influxdb sink: write failed (retrying in %v): %v\n",
+				   delay, err)
+
+			// move buffered points to disk while the server is failing
+			if !fromQueue && is.queue != nil {
+				is.spill()
+			}
 			continue
 		}
+		failures	= 0
 
-		// serialize the batch
-		is.serialize(&buf, batch)
+		// keep going without waiting for the next tick if behind
+		draining	= is.behind()
+	}
 
-		// post the serialized payload to influxdb
-		res, err	= is.client.Post(
-			fmt.Sprintf("%s&precision=ms", is.url), "text", &buf)
+	return
+}
+
+// Returns true if at least one full batch is waiting to be pushed.
+func (is *InfluxDBSink) behind() (yes bool) {
+	is.lock.Lock()
+	yes	= uint(is.fifo.len()) >= is.batchSize
+	is.lock.Unlock()
+
+	if !yes && is.queue != nil {
+		yes	= is.queue.Depth() > 0
+	}
+
+	return
+}
+
+// Writes batches concurrently. Returns the number of leading batches which
+// were successfully written, along with the error of the first failed
+// batch, if any. Batches following a failed one are written again on retry.
+func (is *InfluxDBSink) writeBatches(batches [][]*Point) (okCount int, err error) {
+	var errs	[]error
+	var wg		sync.WaitGroup
+
+	errs	= make([]error, len(batches))
+	for idx := range batches {
+		wg.Add(1)
+		go func(idx int) {
+			errs[idx]	= is.write(batches[idx])
+			wg.Done()
+		}(idx)
+	}
+	wg.Wait()
+
+	for okCount = 0; okCount < len(batches); okCount++ {
+		if errs[okCount] != nil {
+			err	= errs[okCount]
+			return
+		}
+	}
+
+	return
+}
+
+// Serializes and writes points to influxdb. Batches rejected by the server
+// as invalid are bisected to isolate bad points, which are then dropped (and
+// quarantined if enabled), so that they do not block the pipeline.
+// Returns an error if the write should be retried later.
+func (is *InfluxDBSink) write(points []*Point) (err error) {
+	var buf		bytes.Buffer
+	var iwe		*influxWriteError
+	var ok		bool
+	var half	int
+
+	is.serialize(&buf, points)
+	if buf.Len() == 0 {
+		return
+	}
+
+	if is.gzip {
+		err	= gzipBuffer(&buf)
 		if err != nil {
-			fmt.Printf("failed to perform influxdb POST request: %v\n", err)
-			continue
+			return
 		}
-		res.Body.Close()
+	}
 
-		if res.StatusCode != http.StatusNoContent {
-			fmt.Printf("influxdb POST request failed with status code: %d\n",
-				   res.StatusCode)
-			continue
+	err	= is.post(&buf)
+	if err == nil {
+		return
+	}
+
+	iwe, ok	= err.(*influxWriteError)
+	if !ok {
+		return
+	}
+
+	switch {
+	// the server accepted some points and dropped others: do not retry
+	case strings.Contains(iwe.message, "partial write"):
+		fmt.Printf("influxdb sink: some points were rejected: %v\n", iwe)
+		err	= nil
+
+	// the payload is invalid (or too large): split it in two and retry each
+	// half, until bad points are isolated
+	case iwe.status == http.StatusBadRequest ||
+	     iwe.status == http.StatusRequestEntityTooLarge ||
+	     iwe.status == http.StatusUnprocessableEntity:
+		if len(points) > 1 {
+			half	= len(points) / 2
+			err	= is.write(points[0:half])
+			if err != nil {
+				return
+			}
+			err	= is.write(points[half:])
+			return
 		}
 
-		// free points which have been successfully pushed
-		is.lock.Lock()
-		is.fifo		= is.fifo[batchSize:]
-		is.lock.Unlock()
+		is.quarantine(points[0], iwe)
+		err	= nil
+	}
+
+	return
+}
+
+// Posts a serialized payload to influxdb.
+func (is *InfluxDBSink) post(buf *bytes.Buffer) (err error) {
+	var req		*http.Request
+	var res		*http.Response
+	var body	[]byte
+	var iwe		*influxWriteError
+
+	req, err	= http.NewRequest(http.MethodPost, is.url, buf)
+	if err != nil {
+		err	= fmt.Errorf("failed to build POST request: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if is.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	if is.token != "" {
+		req.Header.Set("Authorization", "Token " + is.token)
+	} else if is.username != "" {
+		req.SetBasicAuth(is.username, is.password)
+	}
+
+	res, err	= is.client.Do(req)
+	if err != nil {
+		err	= &influxWriteError{
+			message:	err.Error(),
+		}
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return
+	}
+
+	body, _	= ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+	iwe	= &influxWriteError{
+		status:		res.StatusCode,
+		message:	influxErrorMessage(body),
+		retryAfter:	parseRetryAfter(res.Header.Get("Retry-After"), time.Now()),
+	}
+	err	= iwe
+
+	return
+}
+
+// Moves all points buffered in memory to the on-disk queue, provided the
+// queue is empty (as queued points must be newer than buffered ones).
+func (is *InfluxDBSink) spill() {
+	var points	[]*Point
+	var count	uint
+	var err		error
+
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	if is.fifo.len() == 0 || is.queue.Depth() > 0 {
+		return
+	}
+
+	points, _	= is.fifo.peek(nil, uint(is.fifo.len()))
+	count, err	= is.queue.push(points)
+	if err != nil {
+		fmt.Printf("influxdb sink: failed to queue points: %v\n", err)
+		return
+	}
+
+	fmt.Printf("influxdb sink: moved %v points to the on-disk queue\n", count)
+	is.fifo.pop(uint(len(points)))
+
+	return
+}
+
+// Returns self-monitoring points: the number of points buffered in memory and,
+// if enabled, the depth, size and oldest point age of the on-disk queue, as
+// well as the number of points lost to unreadable queue segments.
+func (is *InfluxDBSink) StatsPoints(prefix string, now time.Time) (points []*Point) {
+	var fifoDepth	int
+	var oldest	time.Time
+	var age		time.Duration
+	var ok		bool
+
+	is.lock.Lock()
+	fifoDepth	= is.fifo.len()
+	is.lock.Unlock()
+
+	points	= append(points, &Point{
+		Timestamp:	now,
+		Label:		prefix + ".fifo_depth",
+		Value:		uint64(fifoDepth),
+	})
+
+	if is.queue == nil {
+		return
+	}
+
+	oldest, ok	= is.queue.Oldest()
+	if ok {
+		age	= now.Sub(oldest)
 	}
 
+	points	= append(points,
+		&Point{
+			Timestamp:	now,
+			Label:		prefix + ".queue_depth",
+			Value:		is.queue.Depth(),
+		},
+		&Point{
+			Timestamp:	now,
+			Label:		prefix + ".queue_size_bytes",
+			Value:		uint64(is.queue.Size()),
+		},
+		&Point{
+			Timestamp:	now,
+			Label:		prefix + ".queue_oldest_age_ms",
+			Value:		durationMs(age),
+		},
+		&Point{
+			Timestamp:	now,
+			Label:		prefix + ".queue_lost_points",
+			Value:		is.queue.Lost(),
+		})
+
 	return
 }
 
 // Turns points into influxdb line protocol entries.
 func (is *InfluxDBSink) serialize(buf *bytes.Buffer, points []*Point) {
-	var idx		int
-	var fieldName	string
+	var lines	[]*influxLine
+	var groups	map[string]*influxLine
+	var line	*influxLine
+	var series	string
+	var field	string
+	var value	string
+	var key		string
+	var ok		bool
+	var err		error
+
+	groups	= make(map[string]*influxLine)
 
 	for _, p := range points {
 		if p == nil {
 			continue
 		}
 
-		// locate the last dot
-		idx		= strings.LastIndex(p.Label, ".")
+		series, field, ok	= is.parseLabel(p)
+		if !ok {
+			continue
+		}
+
+		value, err	= is.formatValue(p.Value)
+		if err != nil {
+			fmt.Printf("discarding point with label '%s': %v\n", p.Label, err)
+			continue
+		}
+
+		line	= &influxLine{
+			series:		series,
+			fields:		[]string{
+				influxIdentifierEscaper.Replace(field) + "=" + value,
+			},
+			timestamp:	p.Timestamp.UnixNano() / 1e6,
+		}
+
+		// merge fields sharing the same series and timestamp, if enabled
+		if is.groupFields {
+			key	= fmt.Sprintf("%s %d", line.series, line.timestamp)
+			if groups[key] != nil {
+				groups[key].fields	= append(groups[key].fields, line.fields...)
+				continue
+			}
+			groups[key]	= line
+		}
+
+		lines	= append(lines, line)
+	}
+
+	for _, line = range lines {
+		buf.WriteString(
+			fmt.Sprintf("%s %s %v\n",
+				line.series, strings.Join(line.fields, ","), line.timestamp))
+	}
+
+	return
+}
+
+// Extracts the series (measurement and tag set) and field name of a point.
+// Tags come from the static sink tags, the point (target) tags and the label
+// rules, in increasing order of precedence.
+func (is *InfluxDBSink) parseLabel(p *Point) (series string, field string, ok bool) {
+	var measurement	string
+	var ruleTags	map[string]string
+	var tags	map[string]string
+	var keys	[]string
+	var idx		int
+	var sb		strings.Builder
+
+	measurement, field, ruleTags, _	= mapLabel(is.rules, p.Label)
+
+	// without a field name, split on the last dot and use the last token
+	// as field name
+	if field == "" {
+		idx		= strings.LastIndex(measurement, ".")
 
 		// if there is no dot or if the dot is either at the beginning or at the end
 		// of the label, we can't split on it: drop the point.
-		if idx < 1 || idx == len(p.Label) - 1 {
+		if idx < 1 || idx == len(measurement) - 1 {
 			fmt.Printf("discarding point with label '%s': cannot split on '.'\n",
 				   p.Label)
+			return
+		}
+
+		field		= measurement[idx+1:]
+		measurement	= measurement[0:idx]
+	}
+
+	tags	= make(map[string]string)
+	for _, source := range []map[string]string{ is.tags, p.Tags, ruleTags } {
+		for key, value := range source {
+			tags[key]	= value
+		}
+	}
+
+	// influxdb recommends sorting tags by key
+	for key := range tags {
+		keys	= append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sb.WriteString(influxMeasurementEscaper.Replace(measurement))
+	for _, key := range keys {
+		// empty tag values are not allowed by the line protocol
+		if key == "" || tags[key] == "" {
 			continue
 		}
 
-		// use the last token as field name
-		fieldName	= p.Label[idx+1:len(p.Label)]
+		sb.WriteString(",")
+		sb.WriteString(influxIdentifierEscaper.Replace(key))
+		sb.WriteString("=")
+		sb.WriteString(influxIdentifierEscaper.Replace(tags[key]))
+	}
 
-		buf.WriteString(
-			fmt.Sprintf("%s %s=%v %v\n",
-				p.Label[0:idx], fieldName,
-				p.Value, p.Timestamp.UnixNano() / 1e6))
+	series	= sb.String()
+	ok	= true
+
+	return
+}
+
+// Formats a point value as a line protocol field value: floats as is,
+// booleans as true/false and strings quoted. Integers are written as floats
+// unless integer fields are enabled, in which case signed integers get the i
+// suffix and unsigned integers the u suffix (i with the v1 API). NaN and
+// infinite values are not supported by influxdb and are rejected.
+func (is *InfluxDBSink) formatValue(v interface{}) (res string, err error) {
+	var f64		float64
+	var i64		int64
+	var u64		uint64
+	var signed	bool
+	var bitSize	int
+
+	switch v := v.(type) {
+	case float64:	f64, bitSize = v, 64
+	case float32:	f64, bitSize = float64(v), 32
+	case int:	i64, signed = int64(v), true
+	case int8:	i64, signed = int64(v), true
+	case int16:	i64, signed = int64(v), true
+	case int32:	i64, signed = int64(v), true
+	case int64:	i64, signed = v, true
+	case uint:	u64 = uint64(v)
+	case uint8:	u64 = uint64(v)
+	case uint16:	u64 = uint64(v)
+	case uint32:	u64 = uint64(v)
+	case uint64:	u64 = v
+	case bool:
+		res	= strconv.FormatBool(v)
+		return
+	case string:
+		res	= "\"" + influxStringEscaper.Replace(v) + "\""
+		return
+	default:
+		err	= fmt.Errorf("unsupported value type %T", v)
+		return
+	}
+
+	switch v.(type) {
+	case float64, float32:
+		if math.IsNaN(f64) || math.IsInf(f64, 0) {
+			err	= fmt.Errorf("unsupported value %v", f64)
+			return
+		}
+		// format float32 values at their own precision, to write their
+		// shortest decimal form (18.7 rather than 18.700000762939453)
+		res	= strconv.FormatFloat(f64, 'g', -1, bitSize)
+
+	default:
+		if !is.integerFields {
+			// bare numbers are stored as floats
+			if signed {
+				res	= strconv.FormatInt(i64, 10)
+			} else {
+				res	= strconv.FormatUint(u64, 10)
+			}
+		} else if signed {
+			res	= strconv.FormatInt(i64, 10) + "i"
+		} else if is.unsigned {
+			res	= strconv.FormatUint(u64, 10) + "u"
+		} else if u64 > math.MaxInt64 {
+			err	= fmt.Errorf("value %v out of range", u64)
+		} else {
+			res	= strconv.FormatUint(u64, 10) + "i"
+		}
+	}
+
+	return
+}
+
+// Replaces the content of buf with its gzip-compressed form.
+func gzipBuffer(buf *bytes.Buffer) (err error) {
+	var zbuf	bytes.Buffer
+	var zw		*gzip.Writer
+
+	zw	= gzip.NewWriter(&zbuf)
+	_, err	= zw.Write(buf.Bytes())
+	if err != nil {
+		return
+	}
+
+	err	= zw.Close()
+	if err != nil {
+		return
+	}
+
+	buf.Reset()
+	zbuf.WriteTo(buf)
+
+	return
+}
+
+// Logs a point rejected by the server and appends it to the quarantine file,
+// if enabled.
+func (is *InfluxDBSink) quarantine(p *Point, iwe *influxWriteError) {
+	var buf		bytes.Buffer
+	var file	*os.File
+	var err		error
+
+	is.serialize(&buf, []*Point{ p })
+	fmt.Printf("influxdb sink: dropping point rejected by the server (%v): %s",
+		   iwe, buf.String())
+
+	if is.quarantineFile == "" {
+		return
+	}
+
+	file, err	= os.OpenFile(is.quarantineFile,
+				      os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err == nil {
+		_, err	= buf.WriteTo(file)
+		file.Close()
+	}
+	if err != nil {
+		fmt.Printf("influxdb sink: failed to write to quarantine file '%s': %v\n",
+			   is.quarantineFile, err)
+	}
+
+	return
+}
+
+func (iwe *influxWriteError) Error() (msg string) {
+	if iwe.status == 0 {
+		msg	= iwe.message
+	} else {
+		msg	= fmt.Sprintf("status code %d: %s", iwe.status, iwe.message)
+	}
+
+	return
+}
+
+// Extracts the error message out of an influxdb error response body, either
+// {"error": "..."} (v1) or {"code": "...", "message": "..."} (v2).
+func influxErrorMessage(body []byte) (msg string) {
+	var res	struct {
+		Error	string	`json:"error"`
+		Message	string	`json:"message"`
+	}
+
+	if json.Unmarshal(body, &res) == nil {
+		if res.Error != "" {
+			msg	= res.Error
+			return
+		}
+
+		if res.Message != "" {
+			msg	= res.Message
+			return
+		}
+	}
+
+	msg	= strings.TrimSpace(string(body))
+
+	return
+}
+
+// Parses the value of a Retry-After header, given either in seconds or as an
+// HTTP date. Returns 0 if the header is missing or invalid.
+func parseRetryAfter(value string, now time.Time) (d time.Duration) {
+	var secs	int
+	var ts		time.Time
+	var err		error
+
+	if value == "" {
+		return
+	}
+
+	secs, err	= strconv.Atoi(value)
+	if err == nil {
+		if secs > 0 {
+			d	= time.Duration(secs) * time.Second
+		}
+		return
+	}
+
+	ts, err		= http.ParseTime(value)
+	if err == nil && ts.After(now) {
+		d	= ts.Sub(now)
 	}
 
 	return
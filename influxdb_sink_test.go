@@ -2,10 +2,17 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 	"strings"
@@ -16,13 +23,18 @@ func TestInfluxDBSinkFifo(t *testing.T) {
 	var err		error
 	var accepted	uint
 
-	is, err	= NewInfluxDBSink("http://localhost?db=test", 10, 5, time.Second)
+	is, err	= NewInfluxDBSink(&InfluxDBSinkConfiguration{
+		Url:		"http://localhost?db=test",
+		BufferSize:	10,
+		BatchSize:	5,
+		PushInterval:	time.Second,
+	})
 	if err != nil {
 		t.Errorf("sink creation should have succeeded, got: %v", err)
 	}
 
-	if len(is.fifo) != 0 {
-		t.Errorf("len(is.fifo) should have been 0, got: %v", len(is.fifo))
+	if is.fifo.len() != 0 {
+		t.Errorf("is.fifo.len() should have been 0, got: %v", is.fifo.len())
 	}
 
 	// save a few points until the fifo is full
@@ -93,8 +105,52 @@ func TestInfluxDBSinkFifo(t *testing.T) {
 		t.Errorf("6 points should have been accepted, saw: %v", accepted)
 	}
 
-	if len(is.fifo) != 10 {
-		t.Errorf("expected 10 buffered points, saw: %v", len(is.fifo))
+	if is.fifo.len() != 10 {
+		t.Errorf("expected 10 buffered points, saw: %v", is.fifo.len())
+	}
+
+	return
+}
+
+func TestInfluxDBSinkOverflow(t *testing.T) {
+	var is		*InfluxDBSink
+	var err		error
+	var accepted	uint
+	var points	[]*Point
+
+	_, err	= NewInfluxDBSink(&InfluxDBSinkConfiguration{
+		Url:		"http://localhost?db=test",
+		OverflowPolicy:	"drop_random",
+	})
+	if err == nil {
+		t.Errorf("sink creation should have failed")
+	}
+
+	is, err	= NewInfluxDBSink(&InfluxDBSinkConfiguration{
+		Url:		"http://localhost?db=test",
+		BufferSize:	3,
+		OverflowPolicy:	"drop_oldest",
+		PushInterval:	time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	accepted	= is.Save(diskQueueTestPoints(0, 2))
+	if accepted != 2 {
+		t.Errorf("2 points should have been accepted, saw: %v", accepted)
+	}
+
+	// the oldest points should make room for new ones
+	accepted	= is.Save(diskQueueTestPoints(2, 2))
+	if accepted != 2 {
+		t.Errorf("2 points should have been accepted, saw: %v", accepted)
+	}
+
+	points, _	= is.fifo.peek(nil, 10)
+	if len(points) != 3 || points[0].Label != "sensor.p1" ||
+	   points[2].Label != "sensor.p3" {
+		t.Errorf("unexpected buffered points: %v", points)
 	}
 
 	return
@@ -107,7 +163,12 @@ func TestInfluxDBSinkSerialize(t *testing.T) {
 	var err		error
 	var count	int
 
-	is, err	= NewInfluxDBSink("http://localhost?db=test", 10, 5, time.Second)
+	is, err	= NewInfluxDBSink(&InfluxDBSinkConfiguration{
+		Url:		"http://localhost?db=test",
+		BufferSize:	10,
+		BatchSize:	5,
+		PushInterval:	time.Second,
+	})
 	if err != nil {
 		t.Errorf("sink creation should have succeeded, got: %v", err)
 	}
@@ -116,7 +177,7 @@ func TestInfluxDBSinkSerialize(t *testing.T) {
 	// go through:
 	// "house.kitchen.sensor2.humidity"
 	// "house.sensor2.humidity",
-	// "house.sensor2,altitude=14.humidity",
+	// "house.sensor2,altitude=14.humidity" (with the comma escaped),
 	points = []*Point{
 		{
 			Timestamp:	time.Unix(1569150732, 15000000),
@@ -169,7 +230,7 @@ func TestInfluxDBSinkSerialize(t *testing.T) {
 			}
 
 		case 2:
-			if line != "house.sensor2,altitude=14 humidity=60.19 1569150733000" {
+			if line != "house.sensor2\\,altitude=14 humidity=60.19 1569150733000" {
 				t.Errorf("unexpected output line at index %d: '%s'", idx, line)
 			}
 
@@ -193,6 +254,154 @@ func TestInfluxDBSinkSerialize(t *testing.T) {
 	return
 }
 
+func TestInfluxDBSinkTags(t *testing.T) {
+	var buf		bytes.Buffer
+	var is		*InfluxDBSink
+	var rules	[]*LabelRule
+	var err		error
+	var expected	string
+
+	rules, err	= newLabelRules([]*labelRuleConf{
+		{ Template: "room.device.field", Name: "env" },
+		{ Match: `^meter\.(\w+)$`, Name: "power", Field: "$1",
+		  Tags: map[string]string{ "site": "main" } },
+	})
+	if err != nil {
+		t.Fatalf("newLabelRules() should have succeeded, got: %v", err)
+	}
+
+	is, err	= NewInfluxDBSink(&InfluxDBSinkConfiguration{
+		Url:		"http://localhost?db=test",
+		Rules:		rules,
+		Tags:		map[string]string{ "host": "logger0", "site": "default" },
+		PushInterval:	time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	is.serialize(&buf, []*Point{
+		{ Timestamp: time.Unix(1569150733, 0), Label: "kitchen.sensor0.temp", Value: 18.7,
+		  Tags: map[string]string{ "unit": "2" } },
+		{ Timestamp: time.Unix(1569150733, 0), Label: "kitchen.sensor0.humidity", Value: 54 },
+		{ Timestamp: time.Unix(1569150733, 0), Label: "meter.voltage", Value: 230.1,
+		  Tags: map[string]string{ "site": "ignored", "phase": "1" } },
+		{ Timestamp: time.Unix(1569150733, 0), Label: "house.attic.sensor2.humidity", Value: 60 },
+	})
+
+	// rule tags take precedence over target tags, which take precedence
+	// over static sink tags
+	expected	=
+		"env,device=sensor0,host=logger0,room=kitchen,site=default,unit=2 temp=18.7 1569150733000\n" +
+		"env,device=sensor0,host=logger0,room=kitchen,site=default humidity=54 1569150733000\n" +
+		"power,host=logger0,phase=1,site=main voltage=230.1 1569150733000\n" +
+		"house.attic.sensor2,host=logger0,site=default humidity=60 1569150733000\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+
+	// with field grouping, fields sharing the same series and timestamp
+	// should be written as a single line
+	is.groupFields	= true
+	buf.Reset()
+	is.serialize(&buf, []*Point{
+		{ Timestamp: time.Unix(1569150733, 0), Label: "kitchen.sensor0.temp", Value: 18.7 },
+		{ Timestamp: time.Unix(1569150733, 0), Label: "meter.voltage", Value: 230.1 },
+		{ Timestamp: time.Unix(1569150733, 0), Label: "kitchen.sensor0.humidity", Value: 54 },
+		{ Timestamp: time.Unix(1569150734, 0), Label: "kitchen.sensor0.humidity", Value: 55 },
+		{ Timestamp: time.Unix(1569150733, 0), Label: "meter.current", Value: 1.5 },
+	})
+
+	expected	=
+		"env,device=sensor0,host=logger0,room=kitchen,site=default temp=18.7,humidity=54 1569150733000\n" +
+		"power,host=logger0,site=main voltage=230.1,current=1.5 1569150733000\n" +
+		"env,device=sensor0,host=logger0,room=kitchen,site=default humidity=55 1569150734000\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+
+	return
+}
+
+func TestInfluxDBSinkEncoding(t *testing.T) {
+	var buf		bytes.Buffer
+	var is		*InfluxDBSink
+	var err		error
+	var expected	string
+
+	is, err	= NewInfluxDBSink(&InfluxDBSinkConfiguration{
+		Url:		"http://localhost?db=test",
+		Tags:		map[string]string{ "site name": "main,east", "empty": "" },
+		PushInterval:	time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	is.serialize(&buf, []*Point{
+		{ Timestamp: time.Unix(1, 0), Label: "a.f64", Value: float64(1.5) },
+		{ Timestamp: time.Unix(1, 0), Label: "a.f32", Value: float32(2) },
+		{ Timestamp: time.Unix(1, 0), Label: "a.temp", Value: float32(18.7) },
+		{ Timestamp: time.Unix(1, 0), Label: "a.i16", Value: int16(-3) },
+		{ Timestamp: time.Unix(1, 0), Label: "a.u32", Value: uint32(4) },
+		{ Timestamp: time.Unix(1, 0), Label: "a.bool", Value: true },
+		{ Timestamp: time.Unix(1, 0), Label: "a.str", Value: "say \"hi\" \\o/" },
+		{ Timestamp: time.Unix(1, 0), Label: "a.nan", Value: math.NaN() },
+		{ Timestamp: time.Unix(1, 0), Label: "a.inf", Value: math.Inf(-1) },
+		{ Timestamp: time.Unix(1, 0), Label: "a.struct", Value: struct{}{} },
+		{ Timestamp: time.Unix(1, 0), Label: "living room.sensor=0.temp C", Value: 1.0 },
+	})
+
+	expected	=
+		"a,site\\ name=main\\,east f64=1.5 1000\n" +
+		"a,site\\ name=main\\,east f32=2 1000\n" +
+		"a,site\\ name=main\\,east temp=18.7 1000\n" +
+		"a,site\\ name=main\\,east i16=-3 1000\n" +
+		"a,site\\ name=main\\,east u32=4 1000\n" +
+		"a,site\\ name=main\\,east bool=true 1000\n" +
+		"a,site\\ name=main\\,east str=\"say \\\"hi\\\" \\\\o/\" 1000\n" +
+		"living\\ room.sensor=0,site\\ name=main\\,east temp\\ C=1 1000\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+
+	// integer fields should get the i suffix when enabled
+	is.integerFields	= true
+	buf.Reset()
+	is.serialize(&buf, []*Point{
+		{ Timestamp: time.Unix(1, 0), Label: "a.i16", Value: int16(-3) },
+		{ Timestamp: time.Unix(1, 0), Label: "a.u32", Value: uint32(4) },
+	})
+	if buf.String() != "a,site\\ name=main\\,east i16=-3i 1000\n" +
+			    "a,site\\ name=main\\,east u32=4i 1000\n" {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+
+	// unsigned integers should get the u suffix with the v2 API
+	is.unsigned	= true
+	buf.Reset()
+	is.serialize(&buf, []*Point{
+		{ Timestamp: time.Unix(1, 0), Label: "a.u32", Value: uint32(4) },
+		{ Timestamp: time.Unix(1, 0), Label: "a.u64", Value: uint64(math.MaxUint64) },
+	})
+	if buf.String() != "a,site\\ name=main\\,east u32=4u 1000\n" +
+			    "a,site\\ name=main\\,east u64=18446744073709551615u 1000\n" {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+
+	// without it, integers not fitting in an int64 should be rejected
+	is.unsigned	= false
+	buf.Reset()
+	is.serialize(&buf, []*Point{
+		{ Timestamp: time.Unix(1, 0), Label: "a.u64", Value: uint64(math.MaxUint64) },
+	})
+	if buf.String() != "" {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+
+	return
+}
+
 func TestInfluxDBSinkLogic(t *testing.T) {
 	var is			*InfluxDBSink
 	var err			error
@@ -236,8 +445,8 @@ func TestInfluxDBSinkLogic(t *testing.T) {
 
 				switch(requestCount) {
 				case 0:
-					// reply with an error
-					w.WriteHeader(400)
+					// reply with a server error
+					w.WriteHeader(503)
 
 				case 1:
 					// reply with 204 no content (OK)
@@ -248,8 +457,8 @@ func TestInfluxDBSinkLogic(t *testing.T) {
 					w.WriteHeader(204)
 
 				case 3:
-					// reply with 201 created (KO)
-					w.WriteHeader(201)
+					// reply with a server error
+					w.WriteHeader(500)
 
 				case 4:
 					// reply with 204 no content (OK)
@@ -269,14 +478,18 @@ func TestInfluxDBSinkLogic(t *testing.T) {
 	// close the test server once done
 	defer ts.Close()
 
-	is, err	= NewInfluxDBSink(fmt.Sprintf("%s/write?db=testdb", ts.URL),
-				  10, 2, 100 * time.Millisecond)
+	is, err	= NewInfluxDBSink(&InfluxDBSinkConfiguration{
+		Url:		fmt.Sprintf("%s/write?db=testdb", ts.URL),
+		BufferSize:	10,
+		BatchSize:	2,
+		PushInterval:	100 * time.Millisecond,
+	})
 	if err != nil {
 		t.Errorf("sink creation should have succeeded, got: %v", err)
 	}
 
-	if len(is.fifo) != 0 {
-		t.Errorf("len(is.fifo) should have been 0, got: %v", len(is.fifo))
+	if is.fifo.len() != 0 {
+		t.Errorf("is.fifo.len() should have been 0, got: %v", is.fifo.len())
 	}
 
 	// save one point
@@ -342,3 +555,720 @@ func TestInfluxDBSinkLogic(t *testing.T) {
 
 	return
 }
+
+func TestInfluxDBSinkRetryPolicy(t *testing.T) {
+	var is		*InfluxDBSink
+	var err		error
+	var dir		string
+	var ts		*httptest.Server
+	var lock	sync.Mutex
+	var requests	[]string
+	var written	string
+	var buf		[]byte
+	var iwe		*influxWriteError
+	var ok		bool
+	var now		time.Time
+
+	now	= time.Unix(1569150729, 0)
+	for _, tc := range []struct {
+		value		string
+		expected	time.Duration
+	}{
+		{ "", 0 },
+		{ "3", 3 * time.Second },
+		{ "-1", 0 },
+		{ "garbage", 0 },
+		{ now.Add(90 * time.Second).UTC().Format(http.TimeFormat), 90 * time.Second },
+		{ now.Add(-90 * time.Second).UTC().Format(http.TimeFormat), 0 },
+	} {
+		if parseRetryAfter(tc.value, now) != tc.expected {
+			t.Errorf("parseRetryAfter('%s'): expected %v, got: %v",
+				 tc.value, tc.expected, parseRetryAfter(tc.value, now))
+		}
+	}
+
+	if influxErrorMessage([]byte(`{"error":"partial write"}`)) != "partial write" ||
+	   influxErrorMessage([]byte(`{"code":"invalid","message":"bad"}`)) != "bad" ||
+	   influxErrorMessage([]byte(" plain text\n")) != "plain text" {
+		t.Errorf("unexpected error messages")
+	}
+
+	dir, err	= ioutil.TempDir("", "datalogger-influx-retry")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts	= httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var payload	[]byte
+
+			payload, _	= ioutil.ReadAll(r.Body)
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			requests	= append(requests, string(payload))
+
+			switch {
+			case strings.Contains(string(payload), "bad"):
+				w.WriteHeader(400)
+				w.Write([]byte(`{"error":"unable to parse"}`))
+
+			case strings.Contains(string(payload), "conflict"):
+				w.WriteHeader(400)
+				w.Write([]byte(`{"error":"partial write: field type conflict dropped=1"}`))
+
+			case strings.Contains(string(payload), "busy"):
+				w.Header().Set("Retry-After", "2")
+				w.WriteHeader(429)
+
+			case strings.Contains(string(payload), "down"):
+				w.WriteHeader(503)
+
+			default:
+				written	+= string(payload)
+				w.WriteHeader(204)
+			}
+		}))
+	defer ts.Close()
+
+	is, err	= NewInfluxDBSink(&InfluxDBSinkConfiguration{
+		Url:		fmt.Sprintf("%s/write?db=testdb", ts.URL),
+		PushInterval:	time.Hour,
+		QuarantineFile:	filepath.Join(dir, "quarantine.txt"),
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	// bad points should be isolated and dropped, all others written
+	err	= is.write([]*Point{
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor.p0", Value: 0 },
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor.p1", Value: 1 },
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor.bad", Value: 2 },
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor.p3", Value: 3 },
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor.p4", Value: 4 },
+	})
+	if err != nil {
+		t.Errorf("write() should have succeeded, got: %v", err)
+	}
+
+	lock.Lock()
+	if len(requests) != 5 {
+		t.Errorf("expected 5 requests, saw: %v", len(requests))
+	}
+	if written != "sensor p0=0 1569150729000\nsensor p1=1 1569150729000\n" +
+		       "sensor p3=3 1569150729000\nsensor p4=4 1569150729000\n" {
+		t.Errorf("unexpected written points: '%s'", written)
+	}
+	requests	= nil
+	lock.Unlock()
+
+	buf, err	= ioutil.ReadFile(filepath.Join(dir, "quarantine.txt"))
+	if err != nil || string(buf) != "sensor bad=2 1569150729000\n" {
+		t.Errorf("unexpected quarantine file content: '%s' (%v)", buf, err)
+	}
+
+	// partial writes should not be retried
+	err	= is.write([]*Point{
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor.conflict", Value: 0 },
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor.p1", Value: 1 },
+	})
+	if err != nil {
+		t.Errorf("write() should have succeeded, got: %v", err)
+	}
+
+	lock.Lock()
+	if len(requests) != 1 {
+		t.Errorf("expected 1 request, saw: %v", len(requests))
+	}
+	requests	= nil
+	lock.Unlock()
+
+	// server errors and rate limiting should be retried
+	err	= is.write([]*Point{
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor.down", Value: 0 },
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor.p1", Value: 1 },
+	})
+	iwe, ok	= err.(*influxWriteError)
+	if !ok || iwe.status != 503 {
+		t.Errorf("write() should have failed with a 503, got: %v", err)
+	}
+
+	err	= is.write([]*Point{
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor.busy", Value: 0 },
+	})
+	iwe, ok	= err.(*influxWriteError)
+	if !ok || iwe.status != 429 || iwe.retryAfter != 2 * time.Second {
+		t.Errorf("write() should have failed with a 429, got: %v", err)
+	}
+
+	lock.Lock()
+	if len(requests) != 2 {
+		t.Errorf("expected 2 requests, saw: %v", len(requests))
+	}
+	lock.Unlock()
+
+	return
+}
+
+func TestInfluxDBSinkBackoff(t *testing.T) {
+	var is		*InfluxDBSink
+	var err		error
+	var ts		*httptest.Server
+	var lock	sync.Mutex
+	var requestCount uint
+
+	ts	= httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			requestCount++
+			if requestCount == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(429)
+				return
+			}
+
+			w.WriteHeader(204)
+		}))
+	defer ts.Close()
+
+	is, err	= NewInfluxDBSink(&InfluxDBSinkConfiguration{
+		Url:		fmt.Sprintf("%s/write?db=testdb", ts.URL),
+		PushInterval:	50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	is.Save([]*Point{
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor.p0", Value: 0 },
+	})
+
+	// the sink should wait for the delay requested by the server
+	time.Sleep(500 * time.Millisecond)
+	lock.Lock()
+	if requestCount != 1 {
+		t.Errorf("expected 1 request, saw: %v", requestCount)
+	}
+	lock.Unlock()
+
+	time.Sleep(1 * time.Second)
+	lock.Lock()
+	if requestCount != 2 {
+		t.Errorf("expected 2 requests, saw: %v", requestCount)
+	}
+	lock.Unlock()
+
+	is.lock.Lock()
+	if is.fifo.len() != 0 {
+		t.Errorf("expected an empty fifo, saw: %v points", is.fifo.len())
+	}
+	is.lock.Unlock()
+
+	return
+}
+
+func TestInfluxDBSinkDrain(t *testing.T) {
+	var is		*InfluxDBSink
+	var err		error
+	var ts		*httptest.Server
+	var lock	sync.Mutex
+	var requestCount uint
+	var inFlight	uint
+	var maxInFlight	uint
+	var lineCount	int
+	var points	[]*Point
+
+	ts	= httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var zr		*gzip.Reader
+			var payload	[]byte
+			var err		error
+
+			lock.Lock()
+			requestCount++
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight	= inFlight
+			}
+			lock.Unlock()
+
+			if r.Header.Get("Content-Encoding") != "gzip" {
+				t.Errorf("unexpected content encoding: '%s'",
+					 r.Header.Get("Content-Encoding"))
+			}
+
+			zr, err		= gzip.NewReader(r.Body)
+			if err == nil {
+				payload, err	= ioutil.ReadAll(zr)
+			}
+			if err != nil {
+				t.Errorf("failed to decompress payload: %v", err)
+			}
+
+			// slow down requests so that they overlap
+			time.Sleep(20 * time.Millisecond)
+
+			lock.Lock()
+			lineCount	+= strings.Count(string(payload), "\n")
+			inFlight--
+			lock.Unlock()
+
+			w.WriteHeader(204)
+		}))
+	defer ts.Close()
+
+	is, err	= NewInfluxDBSink(&InfluxDBSinkConfiguration{
+		Url:		fmt.Sprintf("%s/write?db=testdb", ts.URL),
+		BufferSize:	1000,
+		BatchSize:	10,
+		Concurrency:	3,
+		Gzip:		true,
+		PushInterval:	300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	for i := 0; i < 205; i++ {
+		points	= append(points, &Point{
+			Timestamp:	time.Unix(1569150729, 0),
+			Label:		fmt.Sprintf("sensor.p%d", i),
+			Value:		i,
+		})
+	}
+	is.Save(points)
+
+	// the backlog should be drained right after the first tick, rather than
+	// at a rate of one round of batches per push interval
+	time.Sleep(550 * time.Millisecond)
+
+	lock.Lock()
+	if lineCount != 205 || requestCount != 21 {
+		t.Errorf("expected 205 points in 21 requests, saw: %v in %v",
+			 lineCount, requestCount)
+	}
+	if maxInFlight < 2 || maxInFlight > 3 {
+		t.Errorf("expected 2 to 3 concurrent requests, saw: %v", maxInFlight)
+	}
+	lock.Unlock()
+
+	return
+}
+
+func TestInfluxDBSinkQueue(t *testing.T) {
+	var is		*InfluxDBSink
+	var err		error
+	var dir		string
+	var ts		*httptest.Server
+	var lock	sync.Mutex
+	var up		bool
+	var payloads	string
+	var accepted	uint
+	var points	[]*Point
+
+	dir, err	= ioutil.TempDir("", "datalogger-influx-queue")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts	= httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var payload	[]byte
+
+			payload, _	= ioutil.ReadAll(r.Body)
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			if !up {
+				w.WriteHeader(503)
+				return
+			}
+
+			payloads	+= string(payload)
+			w.WriteHeader(204)
+		}))
+	defer ts.Close()
+
+	is, err	= NewInfluxDBSink(&InfluxDBSinkConfiguration{
+		Url:		fmt.Sprintf("%s/write?db=testdb", ts.URL),
+		BufferSize:	2,
+		BatchSize:	2,
+		PushInterval:	50 * time.Millisecond,
+		QueueDir:	dir,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	accepted	= is.Save([]*Point{
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor.p0", Value: 0 },
+	})
+	if accepted != 1 {
+		t.Errorf("1 point should have been accepted, saw: %v", accepted)
+	}
+
+	// failed pushes should move buffered points to disk
+	time.Sleep(200 * time.Millisecond)
+	if is.queue.Depth() != 1 || is.fifo.len() != 0 {
+		t.Errorf("expected 1 queued point and an empty fifo, saw: %v, %v",
+			 is.queue.Depth(), is.fifo.len())
+	}
+
+	// as long as the queue is not empty, new points should be queued as well
+	accepted	= is.Save([]*Point{
+		{ Timestamp: time.Unix(1569150730, 0), Label: "sensor.p1", Value: 1 },
+		{ Timestamp: time.Unix(1569150731, 0), Label: "sensor.p2", Value: 2 },
+		{ Timestamp: time.Unix(1569150732, 0), Label: "sensor.p3", Value: 3 },
+	})
+	if accepted != 3 {
+		t.Errorf("3 points should have been accepted, saw: %v", accepted)
+	}
+	if is.queue.Depth() != 4 || is.fifo.len() != 0 {
+		t.Errorf("expected 4 queued points and an empty fifo, saw: %v, %v",
+			 is.queue.Depth(), is.fifo.len())
+	}
+
+	points	= is.StatsPoints("test.influxdb0", time.Unix(1569150742, 0))
+	if len(points) != 5 || points[0].Label != "test.influxdb0.fifo_depth" ||
+	   points[1].Label != "test.influxdb0.queue_depth" || points[1].Value != uint64(4) ||
+	   points[3].Label != "test.influxdb0.queue_oldest_age_ms" ||
+	   points[3].Value != float64(13000) ||
+	   points[4].Label != "test.influxdb0.queue_lost_points" || points[4].Value != uint64(0) {
+		t.Errorf("unexpected stats points: %v", points)
+	}
+
+	// once the server is back up, queued points should be replayed in order
+	lock.Lock()
+	up	= true
+	lock.Unlock()
+
+	time.Sleep(800 * time.Millisecond)
+
+	lock.Lock()
+	if payloads != "sensor p0=0 1569150729000\n" +
+			"sensor p1=1 1569150730000\n" +
+			"sensor p2=2 1569150731000\n" +
+			"sensor p3=3 1569150732000\n" {
+		t.Errorf("unexpected payloads: '%s'", payloads)
+	}
+	lock.Unlock()
+
+	if is.queue.Depth() != 0 {
+		t.Errorf("expected an empty queue, saw: %v points", is.queue.Depth())
+	}
+
+	// new points should go through the in-memory buffer again
+	is.Save([]*Point{
+		{ Timestamp: time.Unix(1569150733, 0), Label: "sensor.p4", Value: 4 },
+	})
+	if is.queue.Depth() != 0 {
+		t.Errorf("expected an empty queue, saw: %v points", is.queue.Depth())
+	}
+
+	return
+}
+
+func TestInfluxDBSinkQueueCorruption(t *testing.T) {
+	var is		*InfluxDBSink
+	var err		error
+	var dir		string
+	var ts		*httptest.Server
+	var lock	sync.Mutex
+	var up		bool
+	var payloads	string
+	var deadline	time.Time
+	var received	string
+
+	dir, err	= ioutil.TempDir("", "datalogger-influx-queue")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts	= httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var payload	[]byte
+
+			payload, _	= ioutil.ReadAll(r.Body)
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			if !up {
+				w.WriteHeader(503)
+				return
+			}
+
+			payloads	+= string(payload)
+			w.WriteHeader(204)
+		}))
+	defer ts.Close()
+
+	is, err	= NewInfluxDBSink(&InfluxDBSinkConfiguration{
+		Url:		fmt.Sprintf("%s/write?db=testdb", ts.URL),
+		BufferSize:	2,
+		BatchSize:	2,
+		PushInterval:	50 * time.Millisecond,
+		QueueDir:	dir,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	// get two points queued on disk while the server is down
+	is.Save([]*Point{
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor.p0", Value: 0 },
+	})
+
+	deadline	= time.Now().Add(5 * time.Second)
+	for is.queue.Depth() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	is.Save([]*Point{
+		{ Timestamp: time.Unix(1569150730, 0), Label: "sensor.p1", Value: 1 },
+	})
+	if is.queue.Depth() != 2 {
+		t.Fatalf("expected 2 queued points, saw: %v", is.queue.Depth())
+	}
+
+	// corrupt the segment: the sink should drop it and keep going
+	is.queue.lock.Lock()
+	err	= os.Truncate(is.queue.segmentPath(is.queue.segments[0].seq), 5)
+	is.queue.lock.Unlock()
+	if err != nil {
+		t.Fatalf("failed to truncate segment: %v", err)
+	}
+
+	lock.Lock()
+	up	= true
+	lock.Unlock()
+
+	deadline	= time.Now().Add(5 * time.Second)
+	for is.queue.Depth() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if is.queue.Depth() != 0 || is.queue.Lost() != 2 {
+		t.Fatalf("expected an empty queue and 2 lost points, saw: %v, %v",
+			 is.queue.Depth(), is.queue.Lost())
+	}
+
+	// new points should be pushed again
+	is.Save([]*Point{
+		{ Timestamp: time.Unix(1569150731, 0), Label: "sensor.p2", Value: 2 },
+	})
+
+	deadline	= time.Now().Add(5 * time.Second)
+	for received == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+
+		lock.Lock()
+		received	= payloads
+		lock.Unlock()
+	}
+	if received != "sensor p2=2 1569150731000\n" {
+		t.Errorf("unexpected payloads: '%s'", received)
+	}
+
+	return
+}
+
+func TestInfluxDBSinkConf(t *testing.T) {
+	var is		*InfluxDBSink
+	var err		error
+	var tokenPath	string
+
+	for _, conf := range []*InfluxDBSinkConfiguration{
+		{ Url: "http://localhost:8086", Version: 3 },
+		{ Url: "http://localhost:8086", Version: 2, Bucket: "b", Token: "t" },
+		{ Url: "http://localhost:8086", Version: 2, Org: "o", Token: "t" },
+		{ Url: "http://localhost:8086", Version: 2, Org: "o", Bucket: "b" },
+		{ Url: "http://localhost:8086", Version: 2, Org: "o", Bucket: "b",
+		  TokenFile: "/non/existent" },
+	} {
+		_, err	= NewInfluxDBSink(conf)
+		if err == nil {
+			t.Errorf("NewInfluxDBSink() should have failed with %+v", conf)
+		}
+	}
+
+	// the token should be read from the token file, minus trailing whitespace
+	tokenPath	= filepath.Join(t.TempDir(), "token")
+	err		= ioutil.WriteFile(tokenPath, []byte("s3cr3t\n"), 0600)
+	if err != nil {
+		t.Fatalf("failed to write token file: %v", err)
+	}
+
+	is, err	= NewInfluxDBSink(&InfluxDBSinkConfiguration{
+		Url:		"http://localhost:8086/",
+		Version:	2,
+		Org:		"my org",
+		Bucket:		"house",
+		TokenFile:	tokenPath,
+	})
+	if err != nil {
+		t.Fatalf("NewInfluxDBSink() should have succeeded, got: %v", err)
+	}
+
+	if is.token != "s3cr3t" {
+		t.Errorf("unexpected token: '%s'", is.token)
+	}
+
+	if is.url != "http://localhost:8086/api/v2/write?bucket=house&org=my+org&precision=ms" {
+		t.Errorf("unexpected url: '%s'", is.url)
+	}
+
+	return
+}
+
+func TestInfluxDBSinkAuth(t *testing.T) {
+	var is		*InfluxDBSink
+	var err		error
+	var ts		*httptest.Server
+	var requests	[]*http.Request
+	var lock	sync.Mutex
+	var username	string
+	var password	string
+	var ok		bool
+
+	ts	= httptest.NewServer(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				requests	= append(requests, r)
+				lock.Unlock()
+
+				w.WriteHeader(204)
+			}))
+	defer ts.Close()
+
+	// v2 API with token authentication
+	is, err	= NewInfluxDBSink(&InfluxDBSinkConfiguration{
+		Url:		ts.URL,
+		Version:	2,
+		Org:		"myorg",
+		Bucket:		"house",
+		Token:		"s3cr3t",
+		PushInterval:	50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewInfluxDBSink() should have succeeded, got: %v", err)
+	}
+
+	is.Save([]*Point{
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor0.temperature", Value: 18.7 },
+	})
+
+	// v1 API with basic authentication
+	is, err	= NewInfluxDBSink(&InfluxDBSinkConfiguration{
+		Url:		fmt.Sprintf("%s/write?db=house", ts.URL),
+		Username:	"datalogger",
+		Password:	"pa:ss",
+		PushInterval:	50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewInfluxDBSink() should have succeeded, got: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	is.Save([]*Point{
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor0.temperature", Value: 18.7 },
+	})
+
+	time.Sleep(200 * time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests, saw: %v", len(requests))
+	}
+
+	if requests[0].URL.String() != "/api/v2/write?bucket=house&org=myorg&precision=ms" {
+		t.Errorf("unexpected v2 request URL: %s", requests[0].URL)
+	}
+	if requests[0].Header.Get("Authorization") != "Token s3cr3t" {
+		t.Errorf("unexpected v2 authorization header: '%s'",
+			 requests[0].Header.Get("Authorization"))
+	}
+
+	if requests[1].URL.String() != "/write?db=house&precision=ms" {
+		t.Errorf("unexpected v1 request URL: %s", requests[1].URL)
+	}
+	username, password, ok	= requests[1].BasicAuth()
+	if !ok || username != "datalogger" || password != "pa:ss" {
+		t.Errorf("unexpected v1 credentials: %v, '%s', '%s'", ok, username, password)
+	}
+
+	return
+}
+
+func TestInfluxDBSinkTLS(t *testing.T) {
+	var is		*InfluxDBSink
+	var err		error
+	var ts		*httptest.Server
+	var tlsConfig	*tls.Config
+	var caPath	string
+	var requestCount uint
+	var lock	sync.Mutex
+
+	ts	= httptest.NewTLSServer(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				requestCount++
+				lock.Unlock()
+
+				w.WriteHeader(204)
+			}))
+	defer ts.Close()
+
+	// trust the test server certificate
+	caPath	= filepath.Join(t.TempDir(), "ca.crt")
+	err	= ioutil.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{
+			Type:	"CERTIFICATE",
+			Bytes:	ts.Certificate().Raw,
+		}), 0600)
+	if err != nil {
+		t.Fatalf("failed to write CA file: %v", err)
+	}
+
+	tlsConfig, err	= newTLSConfig(caPath, "", "", false)
+	if err != nil {
+		t.Fatalf("newTLSConfig() should have succeeded, got: %v", err)
+	}
+
+	is, err	= NewInfluxDBSink(&InfluxDBSinkConfiguration{
+		Url:		fmt.Sprintf("%s/write?db=house", ts.URL),
+		TLSConfig:	tlsConfig,
+		PushInterval:	50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewInfluxDBSink() should have succeeded, got: %v", err)
+	}
+
+	is.Save([]*Point{
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor0.temperature", Value: 18.7 },
+	})
+
+	time.Sleep(200 * time.Millisecond)
+
+	lock.Lock()
+	if requestCount != 1 {
+		t.Errorf("expected 1 request, saw: %v", requestCount)
+	}
+	lock.Unlock()
+
+	is.lock.Lock()
+	if is.fifo.len() != 0 {
+		t.Errorf("expected an empty fifo, saw: %v points", is.fifo.len())
+	}
+	is.lock.Unlock()
+
+	return
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strconv"
 	"time"
 )
 
@@ -8,8 +9,47 @@ type Point struct {
 	Timestamp	time.Time
 	Label		string
 	Value		interface{}
+	Tags		map[string]string	// optional target metadata
+	Counter		bool			// value is a monotonically increasing counter
 }
 
 type Sink interface {
 	Save([]*Point)	(uint)
 }
+
+// Sinks exposing self-monitoring metrics implement this interface.
+type StatsSink interface {
+	StatsPoints(prefix string, now time.Time)	([]*Point)
+}
+
+// Returns the value of the point as a float64. Booleans are turned into
+// 0 or 1, float32 values into the float64 of their shortest decimal form
+// (18.7 rather than 18.700000762939453). Returns ok == false if the value
+// is not numeric.
+func (p *Point) Float64() (f64 float64, ok bool) {
+	ok	= true
+
+	switch v := p.Value.(type) {
+	case float64:	f64 = v
+	case float32:
+		f64, _	= strconv.ParseFloat(strconv.FormatFloat(float64(v), 'g', -1, 32), 64)
+	case int:	f64 = float64(v)
+	case int8:	f64 = float64(v)
+	case int16:	f64 = float64(v)
+	case int32:	f64 = float64(v)
+	case int64:	f64 = float64(v)
+	case uint:	f64 = float64(v)
+	case uint8:	f64 = float64(v)
+	case uint16:	f64 = float64(v)
+	case uint32:	f64 = float64(v)
+	case uint64:	f64 = float64(v)
+	case bool:
+		if v {
+			f64 = 1
+		}
+	default:
+		ok	= false
+	}
+
+	return
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Label mapping rule, used to turn dotted point labels into metric names,
+// field names and tags.
+type LabelRule struct {
+	Match	*regexp.Regexp		// regular expression the label must match
+	Name	string			// metric (measurement) name template, where $n
+					// and ${name} expand to submatches of Match
+	Field	string			// field name template (influxdb only)
+	Tags	map[string]string	// tag value templates, keyed by tag name
+}
+
+type labelRuleConf struct {
+	Match		string			`json:"match"`
+	Template	string			`json:"template"`
+	Name		string			`json:"name"`
+	Field		string			`json:"field"`
+	Tags		map[string]string	`json:"tags"`
+}
+
+// Compiles label mapping rules out of their configuration.
+// Rules are either given as a regular expression (match) along with name,
+// field and tag templates, or as a dot-separated template, e.g.
+// "room.device.field", where each token names the corresponding label token:
+// "measurement" and "field" are used as measurement (metric) and field names,
+// "_" tokens are ignored and all other tokens become tags. Without measurement
+// token or name, the measurement is named after the first non-ignored token
+// (e.g. "living_room" for living_room.sensor0.temperature_C and the template
+// above), which still becomes a tag as well.
+func newLabelRules(confs []*labelRuleConf) (rules []*LabelRule, err error) {
+	for idx, rc := range confs {
+		var rule	*LabelRule
+		var expr	string
+
+		rule	= &LabelRule{
+			Name:	rc.Name,
+			Field:	rc.Field,
+			Tags:	make(map[string]string),
+		}
+
+		for key, value := range rc.Tags {
+			rule.Tags[key]	= value
+		}
+
+		switch {
+		case rc.Match != "" && rc.Template != "":
+			err	= errors.New("match and template are mutually exclusive")
+
+		case rc.Match != "":
+			expr	= rc.Match
+
+		case rc.Template != "":
+			expr, err	= compileLabelTemplate(rc.Template, rule)
+
+		default:
+			err	= errors.New("missing match expression or template")
+		}
+
+		if err != nil {
+			err	= fmt.Errorf("rule #%v: %v", idx, err)
+			return
+		}
+
+		rule.Match, err	= regexp.Compile(expr)
+		if err != nil {
+			err	= fmt.Errorf("rule #%v: invalid match expression '%s': %v",
+					     idx, expr, err)
+			return
+		}
+
+		rules	= append(rules, rule)
+	}
+
+	return
+}
+
+// Turns a dot-separated label template into a regular expression, and sets
+// the name, field and tag templates of rule accordingly. Explicit name, field
+// and tag templates take precedence over template tokens.
+func compileLabelTemplate(template string, rule *LabelRule) (expr string, err error) {
+	var groups	[]string
+	var ref		string
+	var firstRef	string
+
+	for idx, token := range strings.Split(template, ".") {
+		if token == "" {
+			err	= fmt.Errorf("empty token in template '%s'", template)
+			return
+		}
+
+		if token == "_" {
+			groups	= append(groups, `[^.]+`)
+			continue
+		}
+
+		// use positional group names as tokens may not be valid group names
+		groups	= append(groups, fmt.Sprintf(`(?P<t%d>[^.]+)`, idx))
+		ref	= fmt.Sprintf("${t%d}", idx)
+		if firstRef == "" {
+			firstRef	= ref
+		}
+
+		switch token {
+		case "measurement":
+			if rule.Name == "" {
+				rule.Name	= ref
+			}
+
+		case "field":
+			if rule.Field == "" {
+				rule.Field	= ref
+			}
+
+		default:
+			if _, found := rule.Tags[token]; !found {
+				rule.Tags[token]	= ref
+			}
+		}
+	}
+
+	if rule.Name == "" {
+		rule.Name	= firstRef
+	}
+
+	if rule.Name == "" {
+		err	= fmt.Errorf("template '%s' has no token other than '_'", template)
+		return
+	}
+
+	expr	= fmt.Sprintf(`^%s$`, strings.Join(groups, `\.`))
+
+	return
+}
+
+// Applies the first rule matching label. Returns ok == false if no rule
+// matched. An empty name template leaves the label untouched.
+func mapLabel(rules []*LabelRule, label string) (name string, field string,
+						 tags map[string]string, ok bool) {
+	var submatches	[]int
+
+	for _, rule := range rules {
+		submatches	= rule.Match.FindStringSubmatchIndex(label)
+		if submatches == nil {
+			continue
+		}
+
+		ok	= true
+		name	= label
+		if rule.Name != "" {
+			name	= string(rule.Match.ExpandString(nil, rule.Name, label, submatches))
+		}
+
+		if rule.Field != "" {
+			field	= string(rule.Match.ExpandString(nil, rule.Field, label, submatches))
+		}
+
+		if len(rule.Tags) > 0 {
+			tags	= make(map[string]string, len(rule.Tags))
+			for key, template := range rule.Tags {
+				tags[key]	= string(rule.Match.ExpandString(
+					nil, template, label, submatches))
+			}
+		}
+
+		return
+	}
+
+	name	= label
+
+	return
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLabelRules(t *testing.T) {
+	var err		error
+	var rules	[]*LabelRule
+	var name	string
+	var tags	map[string]string
+	var ok		bool
+
+	_, err	= newLabelRules([]*labelRuleConf{ { Match: "" } })
+	if err == nil {
+		t.Errorf("newLabelRules() should have failed on a missing match expression")
+	}
+
+	_, err	= newLabelRules([]*labelRuleConf{ { Match: "(" } })
+	if err == nil {
+		t.Errorf("newLabelRules() should have failed on an invalid expression")
+	}
+
+	_, err	= newLabelRules([]*labelRuleConf{ { Match: "a", Template: "a.b" } })
+	if err == nil {
+		t.Errorf("newLabelRules() should have failed with both match and template")
+	}
+
+	_, err	= newLabelRules([]*labelRuleConf{ { Template: "_._" } })
+	if err == nil {
+		t.Errorf("newLabelRules() should have failed without any named token")
+	}
+
+	_, err	= newLabelRules([]*labelRuleConf{ { Template: "room..measurement" } })
+	if err == nil {
+		t.Errorf("newLabelRules() should have failed on an empty token")
+	}
+
+	rules, err	= newLabelRules([]*labelRuleConf{
+		{
+			Match:	`^(?P<room>[^.]+)_room\.([^.]+)\.([^.]+)$`,
+			Name:	"room_$3",
+			Tags:	map[string]string{
+				"room":		"${room}",
+				"device":	"$2",
+			},
+		},
+		{
+			Match:	`^plc\.`,
+		},
+	})
+	if err != nil {
+		t.Fatalf("newLabelRules() should have succeeded, got: %v", err)
+	}
+
+	name, _, tags, ok	= mapLabel(rules, "living_room.sensor0.temperature_C")
+	if !ok || name != "room_temperature_C" || len(tags) != 2 ||
+	   tags["room"] != "living" || tags["device"] != "sensor0" {
+		t.Errorf("unexpected mapping: %v, %v, %v", ok, name, tags)
+	}
+
+	// rules without name templates should leave the label untouched
+	name, _, tags, ok	= mapLabel(rules, "plc.system_time")
+	if !ok || name != "plc.system_time" || tags != nil {
+		t.Errorf("unexpected mapping: %v, %v, %v", ok, name, tags)
+	}
+
+	name, _, tags, ok	= mapLabel(rules, "main_power_meter.p_kW")
+	if ok || name != "main_power_meter.p_kW" || tags != nil {
+		t.Errorf("unexpected mapping: %v, %v, %v", ok, name, tags)
+	}
+
+	return
+}
+
+func TestLabelRuleTemplates(t *testing.T) {
+	var err		error
+	var rules	[]*LabelRule
+	var name	string
+	var field	string
+	var tags	map[string]string
+	var ok		bool
+
+	rules, err	= newLabelRules([]*labelRuleConf{
+		{
+			Template:	"room.device.field",
+			Name:		"sensors",
+			Tags:		map[string]string{ "device": "dev_$2" },
+		},
+		{
+			Template:	"measurement._.field",
+		},
+	})
+	if err != nil {
+		t.Fatalf("newLabelRules() should have succeeded, got: %v", err)
+	}
+
+	name, field, tags, ok	= mapLabel(rules, "living_room.sensor0.temperature_C")
+	if !ok || name != "sensors" || field != "temperature_C" || len(tags) != 2 ||
+	   tags["room"] != "living_room" || tags["device"] != "dev_sensor0" {
+		t.Errorf("unexpected mapping: %v, %v, %v, %v", ok, name, field, tags)
+	}
+
+	// rules are evaluated in order
+	name, field, tags, ok	= mapLabel(rules, "meter.5.p_kW")
+	if !ok || name != "sensors" || field != "p_kW" || tags["room"] != "meter" {
+		t.Errorf("unexpected mapping: %v, %v, %v, %v", ok, name, field, tags)
+	}
+
+	// labels with a different number of tokens should not match
+	name, field, tags, ok	= mapLabel(rules, "plc.system_time")
+	if ok || name != "plc.system_time" || field != "" || tags != nil {
+		t.Errorf("unexpected mapping: %v, %v, %v, %v", ok, name, field, tags)
+	}
+
+	name, field, tags, ok	= mapLabel(rules[1:], "main_power_meter.ch1.p_kW")
+	if !ok || name != "main_power_meter" || field != "p_kW" || len(tags) != 0 {
+		t.Errorf("unexpected mapping: %v, %v, %v, %v", ok, name, field, tags)
+	}
+
+	// without measurement token or name, the first token names the measurement
+	rules, err	= newLabelRules([]*labelRuleConf{ { Template: "room.device.field" } })
+	if err != nil {
+		t.Fatalf("newLabelRules() should have succeeded, got: %v", err)
+	}
+
+	name, field, tags, ok	= mapLabel(rules, "living_room.sensor0.temperature_C")
+	if !ok || name != "living_room" || field != "temperature_C" || len(tags) != 2 ||
+	   tags["room"] != "living_room" || tags["device"] != "sensor0" {
+		t.Errorf("unexpected mapping: %v, %v, %v, %v", ok, name, field, tags)
+	}
+
+	return
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/simonvetter/modbus"
+)
+
+const (
+	LINK_CONNECTING	uint	= 1
+	LINK_UP		uint	= 2
+	LINK_DEGRADED	uint	= 3
+	LINK_DOWN	uint	= 4
+)
+
+// Link status, as reported to monitoring.
+type LinkStatus struct {
+	State		uint		// current state of the link (LINK_CONNECTING,
+					// LINK_UP, LINK_DEGRADED or LINK_DOWN)
+	Since		time.Time	// time of the last state transition
+	LastUp		time.Time	// last time the link transitioned to LINK_UP
+	LastDown	time.Time	// last time the link transitioned to LINK_DOWN
+	Transitions	uint		// number of state transitions since startup
+}
+
+// Reconnection backoff parameters.
+type backoff struct {
+	initial		time.Duration	// delay after the first failed attempt
+	max		time.Duration	// upper bound of the delay
+	multiplier	float64		// growth factor applied after each failed attempt
+					// (if 0, the delay grows linearly by initial)
+	jitter		float64		// random +/- fraction applied to the delay (0 to 1)
+}
+
+// Returns the delay to wait for after attempt failed attempts.
+func (b *backoff) delay(attempt uint) (d time.Duration) {
+	var f64	float64
+
+	if attempt == 0 {
+		return
+	}
+
+	if b.multiplier == 0 {
+		f64	= float64(b.initial) * float64(attempt)
+	} else {
+		f64	= float64(b.initial) * math.Pow(b.multiplier, float64(attempt - 1))
+	}
+	if f64 > float64(b.max) {
+		f64	= float64(b.max)
+	}
+
+	// apply a random jitter of up to +/- jitter * delay to avoid
+	// synchronized reconnection attempts from multiple pollers, without
+	// exceeding the upper bound
+	if b.jitter > 0 {
+		f64	+= f64 * b.jitter * (2 * rand.Float64() - 1)
+		if f64 > float64(b.max) {
+			f64	= float64(b.max)
+		}
+	}
+
+	d	= time.Duration(f64)
+
+	return
+}
+
+// Modbus link object, wrapping a modbus client with reconnection logic
+// and link health tracking.
+type modbusLink struct {
+	url			string
+	mc			*modbus.ModbusClient
+	backoff			backoff
+	maxTimeouts		uint
+	isOpen			bool
+	failedAttempts		uint
+	nextAttempt		time.Time
+	consecutiveTimeouts	uint
+	lock			sync.Mutex
+	status			LinkStatus
+}
+
+// Returns a new modbus link.
+func newModbusLink(conf *PollerConfiguration) (ml *modbusLink, err error) {
+	ml = &modbusLink{
+		url:		conf.Url,
+		backoff:	backoff{
+			initial:	conf.ReconnectDelay,
+			max:		conf.MaxReconnectDelay,
+			multiplier:	conf.ReconnectMultiplier,
+			jitter:		conf.ReconnectJitter,
+		},
+		maxTimeouts:	conf.MaxConsecutiveTimeouts,
+		status:		LinkStatus{
+			State:	LINK_CONNECTING,
+			Since:	time.Now(),
+		},
+	}
+
+	ml.mc, err = modbus.NewClient(&modbus.ClientConfiguration{
+		URL:		conf.Url,
+		Speed:		conf.Speed,
+		DataBits:	conf.DataBits,
+		Parity:		conf.Parity,
+		StopBits:	conf.StopBits,
+		Timeout:	conf.Timeout,
+		TLSClientCert:	conf.TLSClientCert,
+		TLSRootCAs:	conf.TLSRootCAs,
+	})
+
+	return
+}
+
+// Opens the link if necessary, honoring the reconnection backoff.
+// Returns true if the link is ready for use.
+func (ml *modbusLink) open() (ok bool) {
+	var err	error
+
+	if ml.isOpen {
+		ok	= true
+		return
+	}
+
+	// wait for the backoff delay to expire to avoid hammering the
+	// network/serial line with retries
+	if time.Now().Before(ml.nextAttempt) {
+		return
+	}
+
+	err	= ml.mc.Open()
+	if err != nil {
+		ml.failedAttempts++
+		ml.nextAttempt	= time.Now().Add(ml.backoff.delay(ml.failedAttempts))
+
+		fmt.Printf("failed to open modbus link %s (retrying in %v): %v\n",
+			   ml.url, time.Until(ml.nextAttempt).Round(time.Millisecond), err)
+		ml.setState(LINK_DOWN)
+
+		return
+	}
+
+	ml.failedAttempts	= 0
+	ml.consecutiveTimeouts	= 0
+	ml.isOpen		= true
+	ok			= true
+	ml.setState(LINK_UP)
+
+	return
+}
+
+// Returns true if the link is open.
+func (ml *modbusLink) ready() (ok bool) {
+	ok	= ml.isOpen
+
+	return
+}
+
+// Closes the link and schedules an immediate reconnection attempt.
+func (ml *modbusLink) close() {
+	ml.mc.Close()
+	ml.isOpen	= false
+	ml.nextAttempt	= time.Time{}
+	ml.setState(LINK_DOWN)
+
+	return
+}
+
+// Records a successful request.
+func (ml *modbusLink) reportSuccess() {
+	ml.consecutiveTimeouts	= 0
+	ml.setState(LINK_UP)
+
+	return
+}
+
+// Records a failed request. The link is closed whenever the error is
+// not recoverable or when too many consecutive timeouts were seen.
+// Returns true if the link was closed.
+func (ml *modbusLink) reportError(err error) (closed bool) {
+	if !isRecoverableError(err) {
+		ml.close()
+		closed	= true
+		return
+	}
+
+	if isTimeoutError(err) {
+		ml.consecutiveTimeouts++
+
+		if ml.maxTimeouts > 0 && ml.consecutiveTimeouts >= ml.maxTimeouts {
+			fmt.Printf("modbus link %s: %v consecutive timeouts, reopening\n",
+				   ml.url, ml.consecutiveTimeouts)
+			ml.close()
+			closed	= true
+			return
+		}
+
+		ml.setState(LINK_DEGRADED)
+	}
+
+	return
+}
+
+// Returns the current link status.
+func (ml *modbusLink) Status() (ls LinkStatus) {
+	ml.lock.Lock()
+	ls	= ml.status
+	ml.lock.Unlock()
+
+	return
+}
+
+// Updates the link state and transition timestamps.
+func (ml *modbusLink) setState(state uint) {
+	var now	time.Time
+
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+
+	if ml.status.State == state {
+		return
+	}
+
+	now			= time.Now()
+	ml.status.State		= state
+	ml.status.Since		= now
+	ml.status.Transitions++
+
+	switch state {
+	case LINK_UP:	ml.status.LastUp	= now
+	case LINK_DOWN:	ml.status.LastDown	= now
+	}
+
+	fmt.Printf("modbus link %s is now %s\n", ml.url, linkStateName(state))
+
+	return
+}
+
+// Returns a human-readable name for the link state.
+func linkStateName(state uint) (name string) {
+	switch state {
+	case LINK_CONNECTING:	name = "connecting"
+	case LINK_UP:		name = "up"
+	case LINK_DEGRADED:	name = "degraded"
+	case LINK_DOWN:		name = "down"
+	default:		name = "unknown"
+	}
+
+	return
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/simonvetter/modbus"
+)
+
+func TestLinkBackoff(t *testing.T) {
+	var b	*backoff
+	var d	time.Duration
+
+	b = &backoff{
+		initial:	5 * time.Second,
+		max:		25 * time.Second,
+		multiplier:	2,
+	}
+
+	for attempt, expected := range []time.Duration{
+		0, 5 * time.Second, 10 * time.Second, 20 * time.Second,
+		25 * time.Second, 25 * time.Second,
+	} {
+		d = b.delay(uint(attempt))
+		if d != expected {
+			t.Errorf("attempt #%d: expected %v, got: %v", attempt, expected, d)
+		}
+	}
+
+	// with a 20% jitter, delays should stay within +/- 20% of the base value
+	b.jitter	= 0.2
+	for i := 0; i < 100; i++ {
+		d = b.delay(2)
+		if d < 8 * time.Second || d > 12 * time.Second {
+			t.Errorf("delay %v out of the expected jitter range", d)
+		}
+	}
+
+	// jitter should never push delays above the upper bound
+	for i := 0; i < 100; i++ {
+		d = b.delay(5)
+		if d < 20 * time.Second || d > 25 * time.Second {
+			t.Errorf("delay %v out of the expected jitter range", d)
+		}
+	}
+
+	// without a multiplier, delays should grow linearly
+	b = &backoff{
+		initial:	5 * time.Second,
+		max:		25 * time.Second,
+	}
+
+	for attempt, expected := range []time.Duration{
+		0, 5 * time.Second, 10 * time.Second, 15 * time.Second,
+		20 * time.Second, 25 * time.Second, 25 * time.Second,
+	} {
+		d = b.delay(uint(attempt))
+		if d != expected {
+			t.Errorf("attempt #%d: expected %v, got: %v", attempt, expected, d)
+		}
+	}
+
+	return
+}
+
+func TestLinkState(t *testing.T) {
+	var err		error
+	var ml		*modbusLink
+	var ls		LinkStatus
+	var closed	bool
+
+	ml, err	= newModbusLink(&PollerConfiguration{
+		Url:			"tcp://localhost:1",
+		Timeout:		100 * time.Millisecond,
+		ReconnectDelay:		time.Second,
+		MaxReconnectDelay:	time.Second,
+		ReconnectMultiplier:	1,
+		MaxConsecutiveTimeouts:	3,
+	})
+	if err != nil {
+		t.Errorf("newModbusLink() should have succeeded, got: %v", err)
+	}
+
+	ls	= ml.Status()
+	if ls.State != LINK_CONNECTING {
+		t.Errorf("expected LINK_CONNECTING, got: %v", linkStateName(ls.State))
+	}
+	if ls.Transitions != 0 {
+		t.Errorf("expected 0 transitions, got: %v", ls.Transitions)
+	}
+
+	// opening a link to a closed port should fail and schedule a retry
+	if ml.open() {
+		t.Errorf("open() should have failed")
+	}
+
+	ls	= ml.Status()
+	if ls.State != LINK_DOWN {
+		t.Errorf("expected LINK_DOWN, got: %v", linkStateName(ls.State))
+	}
+	if ls.LastDown.IsZero() || ls.Since != ls.LastDown {
+		t.Errorf("LastDown and Since should have been set, saw: %+v", ls)
+	}
+	if time.Until(ml.nextAttempt) <= 0 {
+		t.Errorf("nextAttempt should have been in the future, saw: %v",
+			 ml.nextAttempt)
+	}
+
+	// pretend the link came up
+	ml.isOpen	= true
+	ml.reportSuccess()
+	if ml.Status().State != LINK_UP {
+		t.Errorf("expected LINK_UP, got: %v", linkStateName(ml.Status().State))
+	}
+
+	// modbus exceptions should not affect the link state
+	closed	= ml.reportError(modbus.ErrIllegalDataAddress)
+	if closed || ml.Status().State != LINK_UP {
+		t.Errorf("expected LINK_UP, got: %v", linkStateName(ml.Status().State))
+	}
+
+	// timeouts should degrade the link, then close it once the threshold is hit
+	for i := 1; i <= 3; i++ {
+		closed	= ml.reportError(modbus.ErrRequestTimedOut)
+		if i < 3 && (closed || ml.Status().State != LINK_DEGRADED) {
+			t.Errorf("expected LINK_DEGRADED after %d timeouts, got: %v",
+				 i, linkStateName(ml.Status().State))
+		}
+	}
+	if !closed || ml.isOpen {
+		t.Errorf("the link should have been closed")
+	}
+	if ml.Status().State != LINK_DOWN {
+		t.Errorf("expected LINK_DOWN, got: %v", linkStateName(ml.Status().State))
+	}
+	if !ml.nextAttempt.IsZero() {
+		t.Errorf("a reconnection should have been scheduled immediately")
+	}
+
+	ls	= ml.Status()
+	if ls.Transitions != 4 {
+		t.Errorf("expected 4 transitions, got: %v", ls.Transitions)
+	}
+
+	return
+}
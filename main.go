@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"flag"
 	"os"
@@ -16,7 +17,13 @@ func main() {
 	var pollers	[]*Poller
 	var sink	Sink
 	var sinks	[]Sink
+	var tlsConfig	*tls.Config
+	var rules	[]*LabelRule
 	var points	[]*Point
+	var lastStats	time.Time
+	var statsSinks	map[string]StatsSink
+	var statsSink	StatsSink
+	var ok		bool
 
 	flag.StringVar(&confPath, "conf", "path to configuration file", "")
 	flag.Parse()
@@ -32,24 +39,250 @@ func main() {
 		os.Exit(1)
 	}
 
+	statsSinks	= make(map[string]StatsSink)
+
 	// create and configure data sinks
 	for idx, sc := range conf.Sinks {
 		switch sc.Type {
-		case "json":
-			sink, err = NewFileSink(sc.Url, FILE_TYPE_JSON, sc.FifoSize,
-					time.Duration(sc.MaxAge_ms) * time.Millisecond)
+		case "json", "csv", "parquet":
+			var fileConf	*FileSinkConfiguration
+
+			fileConf	= &FileSinkConfiguration{
+				Path:		sc.Url,
+				BufferSize:	sc.FifoSize,
+				MaxAge:		time.Duration(sc.MaxAge_ms) * time.Millisecond,
+				TimestampFormat: sc.TimestampFormat,
+				TimeZone:	sc.TimeZone,
+				Name:		sc.Name,
+				Rotation:	sc.Rotation,
+				MaxFileSize:	int64(sc.MaxFileSize_mb) << 20,
+				FileNameTemplate: sc.FileNameTemplate,
+				Compression:	sc.Compression,
+				CompressionMode: sc.CompressionMode,
+				CompressionLevel: sc.CompressionLevel,
+			}
+
+			// name sinks after their type and index by default
+			if fileConf.Name == "" {
+				fileConf.Name	= fmt.Sprintf("%s%d", sc.Type, idx)
+			}
+
+			switch {
+			case sc.Type == "json":
+				fileConf.FileType	= FILE_TYPE_JSON
+			case sc.Type == "parquet":
+				fileConf.FileType	= FILE_TYPE_PARQUET
+			case sc.Layout == "long" || sc.Layout == "":
+				fileConf.FileType	= FILE_TYPE_CSV
+			case sc.Layout == "wide":
+				fileConf.FileType	= FILE_TYPE_WIDE_CSV
+				fileConf.BucketInterval	=
+					time.Duration(sc.BucketInterval_ms) * time.Millisecond
+				fileConf.BucketTolerance =
+					time.Duration(sc.BucketTolerance_ms) * time.Millisecond
+			}
 
-		case "csv":
-			sink, err = NewFileSink(sc.Url, FILE_TYPE_CSV, sc.FifoSize,
-					time.Duration(sc.MaxAge_ms) * time.Millisecond)
+			if fileConf.FileType == 0 {
+				err	= fmt.Errorf("unsupported csv layout '%s'", sc.Layout)
+				break
+			}
+
+			sink, err = NewFileSink(fileConf)
 
 		case "influxdb":
-			sink, err = NewInfluxDBSink(sc.Url, sc.FifoSize, 0,
-					time.Duration(sc.MaxAge_ms) * time.Millisecond)
+			tlsConfig, err = newTLSConfig(sc.TLSRootCA, sc.TLSClientCert,
+						      sc.TLSClientKey, sc.TLSSkipVerify)
+			if err != nil {
+				break
+			}
+
+			rules, err = newLabelRules(sc.Rules)
+			if err != nil {
+				break
+			}
+
+			sink, err = NewInfluxDBSink(&InfluxDBSinkConfiguration{
+				Url:		sc.Url,
+				Version:	sc.Version,
+				Org:		sc.Org,
+				Bucket:		sc.Bucket,
+				Token:		sc.Token,
+				TokenFile:	sc.TokenFile,
+				Username:	sc.Username,
+				Password:	sc.Password,
+				TLSConfig:	tlsConfig,
+				Rules:		rules,
+				Tags:		sc.Tags,
+				GroupFields:	sc.GroupFields,
+				IntegerFields:	sc.IntegerFields,
+				BufferSize:	sc.FifoSize,
+				OverflowPolicy:	sc.OverflowPolicy,
+				BatchSize:	sc.BatchSize,
+				PushInterval:	time.Duration(sc.MaxAge_ms) * time.Millisecond,
+				Concurrency:	sc.Concurrency,
+				Gzip:		sc.Gzip,
+				Timeout:	time.Duration(sc.Timeout_ms) * time.Millisecond,
+				QueueDir:	sc.QueueDir,
+				QueueMaxSize:	int64(sc.QueueMaxSize_mb) << 20,
+				QueueMaxAge:	time.Duration(sc.QueueMaxAge_ms) * time.Millisecond,
+				QuarantineFile:	sc.QuarantineFile,
+				MaxRetryDelay:	time.Duration(sc.MaxRetryDelay_ms) * time.Millisecond,
+			})
 
 		case "console":
 			sink, err = NewConsoleSink(sc.FifoSize)
 
+		case "mqtt":
+			tlsConfig, err = newTLSConfig(sc.TLSRootCA, sc.TLSClientCert,
+						      sc.TLSClientKey, sc.TLSSkipVerify)
+			if err != nil {
+				break
+			}
+
+			sink, err = NewMQTTSink(&MQTTSinkConfiguration{
+				Url:		sc.Url,
+				ClientId:	sc.ClientId,
+				Username:	sc.Username,
+				Password:	sc.Password,
+				TLSConfig:	tlsConfig,
+				Topic:		sc.Topic,
+				QoS:		sc.QoS,
+				Retain:		sc.Retain,
+				PayloadFormat:	sc.PayloadFormat,
+				BufferSize:	sc.FifoSize,
+				PushInterval:	time.Duration(sc.MaxAge_ms) * time.Millisecond,
+				Timeout:	time.Duration(sc.Timeout_ms) * time.Millisecond,
+			})
+
+		case "prometheus":
+			rules, err = newLabelRules(sc.Rules)
+			if err != nil {
+				break
+			}
+
+			sink, err = NewPrometheusSink(&PrometheusSinkConfiguration{
+				ListenAddress:	sc.ListenAddress,
+				Path:		sc.Path,
+				Rules:		rules,
+				StaleAge:	time.Duration(sc.StaleAge_ms) * time.Millisecond,
+			})
+
+		case "http":
+			tlsConfig, err = newTLSConfig(sc.TLSRootCA, sc.TLSClientCert,
+						      sc.TLSClientKey, sc.TLSSkipVerify)
+			if err != nil {
+				break
+			}
+
+			sink, err = NewHTTPSink(&HTTPSinkConfiguration{
+				Url:		sc.Url,
+				PayloadFormat:	sc.PayloadFormat,
+				Headers:	sc.Headers,
+				Token:		sc.Token,
+				TokenFile:	sc.TokenFile,
+				Username:	sc.Username,
+				Password:	sc.Password,
+				TLSConfig:	tlsConfig,
+				BufferSize:	sc.FifoSize,
+				OverflowPolicy:	sc.OverflowPolicy,
+				BatchSize:	sc.BatchSize,
+				PushInterval:	time.Duration(sc.MaxAge_ms) * time.Millisecond,
+				Timeout:	time.Duration(sc.Timeout_ms) * time.Millisecond,
+				MaxRetryDelay:	time.Duration(sc.MaxRetryDelay_ms) * time.Millisecond,
+			})
+
+		case "graphite":
+			sink, err = NewGraphiteSink(&GraphiteSinkConfiguration{
+				Url:		sc.Url,
+				Prefix:		sc.Prefix,
+				BufferSize:	sc.FifoSize,
+				OverflowPolicy:	sc.OverflowPolicy,
+				PushInterval:	time.Duration(sc.MaxAge_ms) * time.Millisecond,
+				Timeout:	time.Duration(sc.Timeout_ms) * time.Millisecond,
+				MaxRetryDelay:	time.Duration(sc.MaxRetryDelay_ms) * time.Millisecond,
+			})
+
+		case "statsd":
+			rules, err = newLabelRules(sc.Rules)
+			if err != nil {
+				break
+			}
+
+			sink, err = NewStatsDSink(&StatsDSinkConfiguration{
+				Url:		sc.Url,
+				Prefix:		sc.Prefix,
+				Rules:		rules,
+				Tags:		sc.Tags,
+				TagFormat:	sc.TagFormat,
+				MTU:		sc.MTU,
+				BufferSize:	sc.FifoSize,
+				PushInterval:	time.Duration(sc.MaxAge_ms) * time.Millisecond,
+			})
+
+		case "opentsdb":
+			tlsConfig, err = newTLSConfig(sc.TLSRootCA, sc.TLSClientCert,
+						      sc.TLSClientKey, sc.TLSSkipVerify)
+			if err != nil {
+				break
+			}
+
+			rules, err = newLabelRules(sc.Rules)
+			if err != nil {
+				break
+			}
+
+			sink, err = NewOpenTSDBSink(&OpenTSDBSinkConfiguration{
+				Url:		sc.Url,
+				Username:	sc.Username,
+				Password:	sc.Password,
+				TLSConfig:	tlsConfig,
+				Rules:		rules,
+				Tags:		sc.Tags,
+				BufferSize:	sc.FifoSize,
+				OverflowPolicy:	sc.OverflowPolicy,
+				BatchSize:	sc.BatchSize,
+				PushInterval:	time.Duration(sc.MaxAge_ms) * time.Millisecond,
+				Timeout:	time.Duration(sc.Timeout_ms) * time.Millisecond,
+				MaxRetryDelay:	time.Duration(sc.MaxRetryDelay_ms) * time.Millisecond,
+			})
+
+		case "sqlite":
+			sink, err = NewSQLiteSink(&SQLiteSinkConfiguration{
+				Path:		sc.Url,
+				Table:		sc.Table,
+				BufferSize:	sc.FifoSize,
+				OverflowPolicy:	sc.OverflowPolicy,
+				CommitInterval:	time.Duration(sc.MaxAge_ms) * time.Millisecond,
+				Retention:	time.Duration(sc.Retention_ms) * time.Millisecond,
+			})
+
+		case "modbus":
+			var writes	[]*ModbusWrite
+
+			for _, wc := range sc.Writes {
+				writes	= append(writes, &ModbusWrite{
+					Label:		wc.Label,
+					UnitId:		wc.UnitId,
+					RegType:	wc.RegType,
+					RegAddr:	wc.RegAddr,
+					ScaleFactor:	wc.ScaleFactor,
+				})
+			}
+
+			sink, err = NewModbusSink(&ModbusSinkConfiguration{
+				Url:		sc.Url,
+				Timeout:	time.Duration(sc.Timeout_ms) * time.Millisecond,
+				Speed:		sc.Speed,
+				DataBits:	sc.DataBits,
+				StopBits:	sc.StopBits,
+				Parity:		sc.Parity,
+				Endianness:	sc.Endianness,
+				WordOrder:	sc.WordOrder,
+				Writes:		writes,
+				PushInterval:	time.Duration(sc.MaxAge_ms) * time.Millisecond,
+				MaxRetryDelay:	time.Duration(sc.MaxRetryDelay_ms) * time.Millisecond,
+			})
+
 		default:
 			fmt.Printf("unsupported sink type '%v'\n", sc.Type)
 			os.Exit(2)
@@ -62,6 +295,13 @@ func main() {
 		}
 
 		sinks	= append(sinks, sink)
+
+		// keep track of sinks exposing self-monitoring metrics
+		statsSink, ok	= sink.(StatsSink)
+		if ok {
+			statsSinks[fmt.Sprintf("%s.%s%d", conf.StatsPrefix, sc.Type, idx)] =
+				statsSink
+		}
 	}
 
 	if len(sinks) == 0 {
@@ -99,6 +339,22 @@ func main() {
 			points	= append(points, poller.Points()...)
 		}
 
+		// add self-monitoring points, if enabled
+		if conf.StatsInterval > 0 && time.Since(lastStats) >= conf.StatsInterval {
+			lastStats	= time.Now()
+
+			for _, poller := range pollers {
+				points	= append(points, statsToPoints(poller.Stats(),
+					fmt.Sprintf("%s.%s", conf.StatsPrefix, poller.conf.Name),
+					lastStats.UTC())...)
+			}
+
+			for prefix, statsSink := range statsSinks {
+				points	= append(points,
+					statsSink.StatsPoints(prefix, lastStats.UTC())...)
+			}
+		}
+
 		if len(points) <= 0 {
 			continue
 		}
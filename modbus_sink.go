@@ -0,0 +1,394 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/simonvetter/modbus"
+)
+
+type ModbusSinkConfiguration struct {
+	Url		string		// modbus device URL (e.g. tcp://plc:502 or
+					// rtu:///dev/ttyUSB0)
+	Timeout		time.Duration	// modbus request timeout (defaults to 1s)
+	Speed		uint		// baud rate (serial links only)
+	DataBits	uint		// number of data bits per character
+	StopBits	uint		// number of stop bits
+	Parity		string		// "none" (default), "odd" or "even"
+	Endianness	string		// register endianness: "big" (default)
+					// or "little"
+	WordOrder	string		// word order of 32-bit values: "highfirst"
+					// (default) or "lowfirst"
+	Writes		[]*ModbusWrite	// labels to write and their destination
+	PushInterval	time.Duration	// how often to write pending values
+	MaxRetryDelay	time.Duration	// upper bound of the reconnection delay
+					// (defaults to 1 minute)
+}
+
+// Describes where and how to write the values of a label.
+type ModbusWrite struct {
+	Label		string		// label of the points to write
+	UnitId		uint8		// modbus unit ID of the destination
+	RegType		string		// either "coil" or a holding register type, in
+					// the same form as poller targets (e.g.
+					// "h:uint16", "h:int32" or "h:float32")
+	RegAddr		uint16		// coil or (first) register address
+	ScaleFactor	float64		// factor the value is multiplied by before
+					// encoding (disabled if 0). Integer types are
+					// rounded to the nearest integer.
+}
+
+// Modbus write destination, with its register type decoded.
+type modbusWriteTarget struct {
+	ModbusWrite
+	coil		bool
+	valueType	uint
+}
+
+// Modbus sink object.
+type ModbusSink struct {
+	conf		ModbusSinkConfiguration
+	endianness	modbus.Endianness
+	wordOrder	modbus.WordOrder
+	targets		map[string]*modbusWriteTarget	// keyed by label
+	link		*modbusLink
+	lock		sync.Mutex
+	pending		map[string]*Point		// latest value of each label
+							// waiting to be written
+}
+
+var errValueOutOfRange	= errors.New("value out of range")
+
+// Returns a new modbus sink.
+func NewModbusSink(conf *ModbusSinkConfiguration) (ms *ModbusSink, err error) {
+	var pollerConf	PollerConfiguration
+	var target	*modbusWriteTarget
+
+	ms = &ModbusSink{
+		conf:		*conf,
+		targets:	make(map[string]*modbusWriteTarget),
+		pending:	make(map[string]*Point),
+	}
+
+	if ms.conf.Url == "" {
+		err	= errors.New("missing url")
+		return
+	}
+
+	if len(ms.conf.Writes) == 0 {
+		err	= errors.New("no write defined")
+		return
+	}
+
+	for _, w := range ms.conf.Writes {
+		target	= &modbusWriteTarget{
+			ModbusWrite:	*w,
+		}
+
+		if target.Label == "" {
+			err	= errors.New("missing write label")
+			return
+		}
+
+		if ms.targets[target.Label] != nil {
+			err	= fmt.Errorf("duplicate write label '%s'", target.Label)
+			return
+		}
+
+		switch target.RegType {
+		case "coil", "c":
+			target.coil		= true
+		case "h:uint16", "holding:uint16":
+			target.valueType	= UINT16
+		case "h:int16", "holding:int16":
+			target.valueType	= INT16
+		case "h:uint32", "holding:uint32":
+			target.valueType	= UINT32
+		case "h:int32", "holding:int32":
+			target.valueType	= INT32
+		case "h:float32", "holding:float32":
+			target.valueType	= FLOAT32
+		default:
+			err	= fmt.Errorf("unknown register_type setting '%s' for label '%s'",
+					     target.RegType, target.Label)
+			return
+		}
+
+		ms.targets[target.Label]	= target
+	}
+
+	switch ms.conf.Endianness {
+	case "big", "bigendian", "":	ms.endianness = modbus.BIG_ENDIAN
+	case "little", "littleendian":	ms.endianness = modbus.LITTLE_ENDIAN
+	default:
+		err	= fmt.Errorf("unknown endianness setting '%s'", ms.conf.Endianness)
+		return
+	}
+
+	switch ms.conf.WordOrder {
+	case "highfirst", "hf", "":	ms.wordOrder = modbus.HIGH_WORD_FIRST
+	case "lowfirst", "lf":		ms.wordOrder = modbus.LOW_WORD_FIRST
+	default:
+		err	= fmt.Errorf("unknown word order setting '%s'", ms.conf.WordOrder)
+		return
+	}
+
+	switch ms.conf.Parity {
+	case "none", "":	pollerConf.Parity = modbus.PARITY_NONE
+	case "odd":		pollerConf.Parity = modbus.PARITY_ODD
+	case "even":		pollerConf.Parity = modbus.PARITY_EVEN
+	default:
+		err	= fmt.Errorf("unknown parity setting '%s'", ms.conf.Parity)
+		return
+	}
+
+	if ms.conf.Timeout == 0 {
+		ms.conf.Timeout		= 1 * time.Second
+	}
+
+	// default to writing once every second
+	if ms.conf.PushInterval == 0 {
+		ms.conf.PushInterval	= 1 * time.Second
+	}
+
+	if ms.conf.MaxRetryDelay == 0 {
+		ms.conf.MaxRetryDelay	= 1 * time.Minute
+	}
+
+	// reuse the poller link logic for reconnections
+	pollerConf.Url			= ms.conf.Url
+	pollerConf.Timeout		= ms.conf.Timeout
+	pollerConf.Speed		= ms.conf.Speed
+	pollerConf.DataBits		= ms.conf.DataBits
+	pollerConf.StopBits		= ms.conf.StopBits
+	pollerConf.ReconnectDelay	= ms.conf.PushInterval
+	pollerConf.MaxReconnectDelay	= ms.conf.MaxRetryDelay
+	pollerConf.ReconnectMultiplier	= 2
+	pollerConf.ReconnectJitter	= 0.1
+	pollerConf.MaxConsecutiveTimeouts = 3
+
+	ms.link, err	= newModbusLink(&pollerConf)
+	if err != nil {
+		return
+	}
+
+	go ms.writer()
+
+	return
+}
+
+// Keeps the latest point of each configured label until the next write.
+// Points of other labels are ignored.
+func (ms *ModbusSink) Save(points []*Point) (acceptedCount uint) {
+	ms.lock.Lock()
+	for _, p := range points {
+		if p == nil || ms.targets[p.Label] == nil {
+			continue
+		}
+
+		ms.coalesce(p)
+		acceptedCount++
+	}
+	ms.lock.Unlock()
+
+	return
+}
+
+// Replaces the pending value of a label with p, unless the pending value
+// is more recent. Must be called with the lock held.
+func (ms *ModbusSink) coalesce(p *Point) {
+	var pending	*Point
+
+	pending	= ms.pending[p.Label]
+	if pending == nil || !p.Timestamp.Before(pending.Timestamp) {
+		ms.pending[p.Label]	= p
+	}
+
+	return
+}
+
+// Periodically writes pending values to the device. Values which could not
+// be written are retried on the next run, unless superseded by newer ones
+// in the meantime, so that only the latest value of each label is written
+// when the link is slow or down.
+func (ms *ModbusSink) writer() {
+	var ticker	*time.Ticker
+	var batch	map[string]*Point
+	var err		error
+	var wasReady	bool
+
+	ticker	= time.NewTicker(ms.conf.PushInterval)
+
+	for {
+		<-ticker.C
+
+		ms.lock.Lock()
+		if len(ms.pending) == 0 {
+			ms.lock.Unlock()
+			continue
+		}
+		batch		= ms.pending
+		ms.pending	= make(map[string]*Point)
+		ms.lock.Unlock()
+
+		// set the encoding once per (re)connection
+		wasReady	= ms.link.ready()
+		if ms.link.open() && !wasReady {
+			err	= ms.link.mc.SetEncoding(ms.endianness, ms.wordOrder)
+			if err != nil {
+				fmt.Printf("modbus sink: failed to set encoding: %v\n", err)
+			}
+		}
+
+		for label, p := range batch {
+			// leave values in the batch (to be requeued) while the link
+			// is down
+			if !ms.link.ready() {
+				break
+			}
+
+			err	= ms.write(ms.targets[label], p)
+			switch {
+			case err == nil:
+				ms.link.reportSuccess()
+
+			// the value cannot be written as is: drop it
+			case err == errValueOutOfRange || err == modbus.ErrIllegalFunction ||
+			     err == modbus.ErrIllegalDataAddress ||
+			     err == modbus.ErrIllegalDataValue:
+				fmt.Printf("modbus sink: failed to write %s (%v) to %s: %v\n",
+					   label, p.Value, ms.conf.Url, err)
+
+			default:
+				fmt.Printf("modbus sink: failed to write %s to %s (will retry): %v\n",
+					   label, ms.conf.Url, err)
+				ms.link.reportError(err)
+				continue
+			}
+
+			delete(batch, label)
+		}
+
+		ms.lock.Lock()
+		for _, p := range batch {
+			ms.coalesce(p)
+		}
+		ms.lock.Unlock()
+	}
+
+	return
+}
+
+// Encodes and writes a value to its destination.
+func (ms *ModbusSink) write(target *modbusWriteTarget, p *Point) (err error) {
+	var value	interface{}
+
+	value, err	= encodeModbusValue(target, p.Value)
+	if err != nil {
+		return
+	}
+
+	err	= ms.link.mc.SetUnitId(target.UnitId)
+	if err != nil {
+		return
+	}
+
+	switch v := value.(type) {
+	case bool:	err = ms.link.mc.WriteCoil(target.RegAddr, v)
+	case uint16:	err = ms.link.mc.WriteRegister(target.RegAddr, v)
+	case uint32:	err = ms.link.mc.WriteUint32(target.RegAddr, v)
+	case float32:	err = ms.link.mc.WriteFloat32(target.RegAddr, v)
+	}
+
+	return
+}
+
+// Returns self-monitoring metrics.
+func (ms *ModbusSink) StatsPoints(prefix string, now time.Time) (points []*Point) {
+	var pending	int
+
+	ms.lock.Lock()
+	pending	= len(ms.pending)
+	ms.lock.Unlock()
+
+	points	= append(points, &Point{
+		Timestamp:	now,
+		Label:		prefix + ".pending_writes",
+		Value:		uint64(pending),
+	})
+
+	return
+}
+
+// Scales and converts a point value to the type of its destination: a bool
+// for coils, a uint16 for 16-bit registers, a uint32 for 32-bit integer
+// registers and a float32 for float registers. Signed integers are encoded
+// in two's complement. Returns errValueOutOfRange if the value does not fit.
+func encodeModbusValue(target *modbusWriteTarget, value interface{}) (res interface{}, err error) {
+	var f64	float64
+	var ok	bool
+
+	f64, ok	= (&Point{Value: value}).Float64()
+	if !ok || math.IsNaN(f64) || math.IsInf(f64, 0) {
+		err	= errValueOutOfRange
+		return
+	}
+
+	if target.ScaleFactor != 0 {
+		f64	*= target.ScaleFactor
+	}
+
+	if target.coil {
+		res	= f64 != 0
+		return
+	}
+
+	if target.valueType == FLOAT32 {
+		if math.Abs(f64) > math.MaxFloat32 {
+			err	= errValueOutOfRange
+			return
+		}
+		res	= float32(f64)
+		return
+	}
+
+	f64	= math.Round(f64)
+
+	switch target.valueType {
+	case UINT16:
+		if f64 < 0 || f64 > math.MaxUint16 {
+			err	= errValueOutOfRange
+			return
+		}
+		res	= uint16(f64)
+
+	case INT16:
+		if f64 < math.MinInt16 || f64 > math.MaxInt16 {
+			err	= errValueOutOfRange
+			return
+		}
+		res	= uint16(int16(f64))
+
+	case UINT32:
+		if f64 < 0 || f64 > math.MaxUint32 {
+			err	= errValueOutOfRange
+			return
+		}
+		res	= uint32(f64)
+
+	case INT32:
+		if f64 < math.MinInt32 || f64 > math.MaxInt32 {
+			err	= errValueOutOfRange
+			return
+		}
+		res	= uint32(int32(f64))
+
+	default:
+		err	= errUnsupportedValueType
+	}
+
+	return
+}
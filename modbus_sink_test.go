@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestModbusSinkEncode(t *testing.T) {
+	var res	interface{}
+	var err	error
+
+	for _, tc := range []struct {
+		target		modbusWriteTarget
+		value		interface{}
+		expected	interface{}
+		err		error
+	}{
+		{ modbusWriteTarget{ coil: true }, 1, true, nil },
+		{ modbusWriteTarget{ coil: true }, float32(0), false, nil },
+		{ modbusWriteTarget{ coil: true }, false, false, nil },
+		{ modbusWriteTarget{ valueType: UINT16 }, 1234, uint16(1234), nil },
+		{ modbusWriteTarget{ valueType: UINT16 }, true, uint16(1), nil },
+		{ modbusWriteTarget{ valueType: UINT16 }, 65536, nil, errValueOutOfRange },
+		{ modbusWriteTarget{ valueType: UINT16 }, -1, nil, errValueOutOfRange },
+		{ modbusWriteTarget{
+			ModbusWrite: ModbusWrite{ ScaleFactor: 10 }, valueType: UINT16 },
+		  21.56, uint16(216), nil },
+		{ modbusWriteTarget{ valueType: INT16 }, -2, uint16(0xfffe), nil },
+		{ modbusWriteTarget{ valueType: INT16 }, 32768, nil, errValueOutOfRange },
+		{ modbusWriteTarget{ valueType: UINT32 }, uint64(0x12345678), uint32(0x12345678), nil },
+		{ modbusWriteTarget{
+			ModbusWrite: ModbusWrite{ ScaleFactor: 1000 }, valueType: INT32 },
+		  -1.5, uint32(0xfffffa24), nil },
+		{ modbusWriteTarget{ valueType: FLOAT32 }, 18.5, float32(18.5), nil },
+		{ modbusWriteTarget{ valueType: FLOAT32 }, math.NaN(), nil, errValueOutOfRange },
+		{ modbusWriteTarget{ valueType: FLOAT32 }, 1e39, nil, errValueOutOfRange },
+		{ modbusWriteTarget{ valueType: UINT16 }, "on", nil, errValueOutOfRange },
+	} {
+		res, err	= encodeModbusValue(&tc.target, tc.value)
+		if err != tc.err {
+			t.Errorf("encoding %v (%+v): expected error %v, got: %v",
+				 tc.value, tc.target, tc.err, err)
+			continue
+		}
+
+		if res != tc.expected {
+			t.Errorf("encoding %v (%+v): expected %v (%T), got: %v (%T)",
+				 tc.value, tc.target, tc.expected, tc.expected, res, res)
+		}
+	}
+
+	return
+}
+
+func TestModbusSinkCoalesce(t *testing.T) {
+	var ms	*ModbusSink
+	var err	error
+
+	for _, conf := range []*ModbusSinkConfiguration{
+		{ Writes: []*ModbusWrite{ { Label: "a", RegType: "coil" } } },
+		{ Url: "tcp://localhost:502" },
+		{ Url: "tcp://localhost:502", Writes: []*ModbusWrite{ { RegType: "coil" } } },
+		{ Url: "tcp://localhost:502", Writes: []*ModbusWrite{ { Label: "a", RegType: "i:uint16" } } },
+		{ Url: "tcp://localhost:502", Writes: []*ModbusWrite{
+			{ Label: "a", RegType: "coil" }, { Label: "a", RegType: "h:uint16" } } },
+		{ Url: "tcp://localhost:502", WordOrder: "middle",
+		  Writes: []*ModbusWrite{ { Label: "a", RegType: "coil" } } },
+	} {
+		_, err	= NewModbusSink(conf)
+		if err == nil {
+			t.Errorf("sink creation should have failed with %+v", conf)
+		}
+	}
+
+	ms, err	= NewModbusSink(&ModbusSinkConfiguration{
+		Url:		"tcp://localhost:502",
+		Writes:		[]*ModbusWrite{
+			{ Label: "plc.setpoint", RegType: "h:float32", RegAddr: 100 },
+			{ Label: "plc.enable", RegType: "coil", RegAddr: 10 },
+		},
+		PushInterval:	time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	// only the latest value of each configured label should be kept
+	if ms.Save([]*Point{
+		{ Timestamp: time.Unix(1569150729, 0), Label: "plc.setpoint", Value: 1 },
+		{ Timestamp: time.Unix(1569150731, 0), Label: "plc.setpoint", Value: 3 },
+		{ Timestamp: time.Unix(1569150730, 0), Label: "plc.setpoint", Value: 2 },
+		{ Timestamp: time.Unix(1569150729, 0), Label: "plc.other", Value: 4 },
+		{ Timestamp: time.Unix(1569150729, 0), Label: "plc.enable", Value: true },
+	}) != 4 {
+		t.Errorf("expected 4 accepted points")
+	}
+
+	if len(ms.pending) != 2 || ms.pending["plc.setpoint"].Value != 3 ||
+	   ms.pending["plc.enable"].Value != true {
+		t.Errorf("unexpected pending values: %v", ms.pending)
+	}
+
+	return
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	MQTT_PAYLOAD_JSON	uint	= 1
+	MQTT_PAYLOAD_RAW	uint	= 2
+)
+
+type MQTTSinkConfiguration struct {
+	Url		string		// broker URL (e.g. tcp://broker:1883 or
+					// ssl://broker:8883)
+	ClientId	string		// MQTT client ID (defaults to datalogger-<host>-<pid>)
+	Username	string		// username (disabled if empty)
+	Password	string		// password
+	TLSConfig	*tls.Config	// TLS settings (ssl:// brokers only)
+	Topic		string		// topic template, where {label} is replaced by
+					// the point label, {path} by the label with dots
+					// turned into slashes and {n} by the nth (0-based)
+					// dot-separated label token
+					// (defaults to datalogger/{path})
+	QoS		uint		// QoS level (0, 1 or 2)
+	Retain		bool		// set the retain flag on published messages
+	PayloadFormat	string		// either "json" (timestamp, label and value)
+					// or "raw" (value only), defaults to "json"
+	BufferSize	uint		// max. number of points to buffer while the
+					// broker is unreachable
+	PushInterval	time.Duration	// how often to publish buffered points
+	Timeout		time.Duration	// connect and publish timeout
+}
+
+// MQTT sink object.
+type MQTTSink struct {
+	conf		MQTTSinkConfiguration
+	payloadFormat	uint
+	fifo		[]*Point
+	lock		sync.Mutex
+	client		mqtt.Client
+}
+
+// Returns a new MQTT sink.
+func NewMQTTSink(conf *MQTTSinkConfiguration) (ms *MQTTSink, err error) {
+	var opts	*mqtt.ClientOptions
+	var hostname	string
+
+	ms = &MQTTSink{
+		conf:	*conf,
+		fifo:	make([]*Point, 0),
+	}
+
+	if ms.conf.Url == "" {
+		err	= errors.New("missing broker url")
+		return
+	}
+
+	if ms.conf.QoS > 2 {
+		err	= fmt.Errorf("unsupported qos level %v", ms.conf.QoS)
+		return
+	}
+
+	switch ms.conf.PayloadFormat {
+	case "json", "":	ms.payloadFormat = MQTT_PAYLOAD_JSON
+	case "raw":		ms.payloadFormat = MQTT_PAYLOAD_RAW
+	default:
+		err	= fmt.Errorf("unsupported payload format '%s'",
+				     ms.conf.PayloadFormat)
+		return
+	}
+
+	if ms.conf.Topic == "" {
+		ms.conf.Topic		= "datalogger/{path}"
+	}
+
+	if ms.conf.ClientId == "" {
+		hostname, _		= os.Hostname()
+		ms.conf.ClientId	= fmt.Sprintf("datalogger-%s-%d",
+						      hostname, os.Getpid())
+	}
+
+	// buffer 100k points by default
+	if ms.conf.BufferSize == 0 {
+		ms.conf.BufferSize	= 100000
+	}
+
+	// default to publishing once every second
+	if ms.conf.PushInterval == 0 {
+		ms.conf.PushInterval	= 1 * time.Second
+	}
+
+	if ms.conf.Timeout == 0 {
+		ms.conf.Timeout		= 10 * time.Second
+	}
+
+	// reconnections are handled by the writer goroutine, so that points are
+	// only removed from the fifo once successfully published
+	opts	= mqtt.NewClientOptions()
+	opts.AddBroker(ms.conf.Url)
+	opts.SetClientID(ms.conf.ClientId)
+	opts.SetUsername(ms.conf.Username)
+	opts.SetPassword(ms.conf.Password)
+	opts.SetCleanSession(true)
+	opts.SetAutoReconnect(false)
+	opts.SetConnectTimeout(ms.conf.Timeout)
+	opts.SetWriteTimeout(ms.conf.Timeout)
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		fmt.Printf("mqtt sink: lost connection to %s: %v\n", ms.conf.Url, err)
+	})
+	if ms.conf.TLSConfig != nil {
+		opts.SetTLSConfig(ms.conf.TLSConfig)
+	}
+
+	ms.client	= mqtt.NewClient(opts)
+
+	go ms.writer()
+
+	return
+}
+
+// Pushes points to the sink's internal buffer. Points are rejected when
+// the buffer is full.
+func (ms *MQTTSink) Save(points []*Point) (acceptedCount uint) {
+	var pointCount uint
+
+	pointCount	= uint(len(points))
+	if pointCount == 0 {
+		return
+	}
+
+	ms.lock.Lock()
+
+	acceptedCount	= ms.conf.BufferSize - uint(len(ms.fifo))
+
+	if acceptedCount > pointCount {
+		acceptedCount = pointCount
+	}
+
+	if acceptedCount > 0 {
+		ms.fifo	= append(ms.fifo, points[0:acceptedCount]...)
+	}
+	ms.lock.Unlock()
+
+	if acceptedCount != pointCount {
+		fmt.Printf("mqtt sink: dropped %v points out of %v\n",
+			   pointCount - acceptedCount, pointCount)
+	}
+
+	return
+}
+
+// Periodically (re)connects to the broker and publishes buffered points.
+// Points stay in the buffer until they have been successfully published.
+func (ms *MQTTSink) writer() {
+	var ticker	*time.Ticker
+	var batch	[]*Point
+	var sentCount	int
+	var topic	string
+	var payload	[]byte
+	var err		error
+
+	ticker	= time.NewTicker(ms.conf.PushInterval)
+
+	for {
+		<-ticker.C
+
+		if !ms.client.IsConnectionOpen() {
+			err	= ms.wait(ms.client.Connect())
+			if err != nil {
+				fmt.Printf("mqtt sink: failed to connect to %s: %v\n",
+					   ms.conf.Url, err)
+				continue
+			}
+			fmt.Printf("mqtt sink: connected to %s\n", ms.conf.Url)
+		}
+
+		ms.lock.Lock()
+		batch	= ms.fifo
+		ms.lock.Unlock()
+
+		for sentCount = 0; sentCount < len(batch); sentCount++ {
+			// drop nil points
+			if batch[sentCount] == nil {
+				continue
+			}
+
+			topic, payload, err	= ms.serialize(batch[sentCount])
+			// if we failed to serialize the point for whatever reason, drop it
+			if err != nil {
+				fmt.Printf("mqtt sink: failed to serialize point (%v): %v\n",
+					   batch[sentCount], err)
+				continue
+			}
+
+			err	= ms.wait(ms.client.Publish(topic, byte(ms.conf.QoS),
+							    ms.conf.Retain, payload))
+			if err != nil {
+				fmt.Printf("mqtt sink: failed to publish to %s: %v\n",
+					   topic, err)
+				break
+			}
+		}
+
+		// free points which have been successfully published
+		ms.lock.Lock()
+		ms.fifo	= ms.fifo[sentCount:]
+		ms.lock.Unlock()
+	}
+
+	return
+}
+
+// Waits for a token to complete, up to the configured timeout.
+func (ms *MQTTSink) wait(token mqtt.Token) (err error) {
+	if !token.WaitTimeout(ms.conf.Timeout) {
+		err	= errors.New("timed out")
+		return
+	}
+
+	err	= token.Error()
+
+	return
+}
+
+// Returns the topic and payload of a point.
+func (ms *MQTTSink) serialize(p *Point) (topic string, payload []byte, err error) {
+	topic	= mqttTopic(ms.conf.Topic, p.Label)
+
+	switch ms.payloadFormat {
+	case MQTT_PAYLOAD_JSON:
+		payload, err	= json.Marshal(struct {
+			Timestamp	int64		`json:"timestamp"`
+			Label		string		`json:"label"`
+			Value		interface{}	`json:"value"`
+		}{
+			Timestamp:	p.Timestamp.UnixNano() / 1e6,
+			Label:		p.Label,
+			Value:		p.Value,
+		})
+
+	case MQTT_PAYLOAD_RAW:
+		payload		= []byte(fmt.Sprintf("%v", p.Value))
+	}
+
+	return
+}
+
+// Expands a topic template for the given label.
+// MQTT wildcards (+ and #) found in the label are replaced by underscores.
+func mqttTopic(template string, label string) (topic string) {
+	var sb		strings.Builder
+	var tokens	[]string
+	var start	int
+	var end		int
+	var idx		int
+	var err		error
+
+	label	= strings.NewReplacer("+", "_", "#", "_").Replace(label)
+	tokens	= strings.Split(label, ".")
+
+	for {
+		start	= strings.Index(template, "{")
+		if start < 0 {
+			break
+		}
+
+		end	= strings.Index(template[start:], "}")
+		if end < 0 {
+			break
+		}
+		end	+= start
+
+		sb.WriteString(template[:start])
+
+		switch template[start+1:end] {
+		case "label":
+			sb.WriteString(label)
+
+		case "path":
+			sb.WriteString(strings.Join(tokens, "/"))
+
+		default:
+			// {n} placeholders expand to the nth label token, if any
+			idx, err	= strconv.Atoi(template[start+1:end])
+			if err != nil {
+				// leave unknown placeholders untouched
+				sb.WriteString(template[start:end+1])
+			} else if idx >= 0 && idx < len(tokens) {
+				sb.WriteString(tokens[idx])
+			}
+		}
+
+		template	= template[end+1:]
+	}
+
+	sb.WriteString(template)
+	topic	= sb.String()
+
+	return
+}
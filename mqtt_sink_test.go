@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMQTTTopic(t *testing.T) {
+	for _, tc := range []struct {
+		template	string
+		label		string
+		expected	string
+	}{
+		{ "datalogger/{path}", "living_room.sensor0.temperature_C",
+		  "datalogger/living_room/sensor0/temperature_C" },
+		{ "{label}", "living_room.sensor0.temperature_C",
+		  "living_room.sensor0.temperature_C" },
+		{ "home/{0}/{2}/{1}", "living_room.sensor0.temperature_C",
+		  "home/living_room/temperature_C/sensor0" },
+		{ "home/{5}/x", "living_room.sensor0", "home//x" },
+		{ "home/{unknown}/{path}", "a.b", "home/{unknown}/a/b" },
+		{ "home/{path", "a.b", "home/{path" },
+		{ "{path}", "a+b.c#", "a_b/c_" },
+	} {
+		if mqttTopic(tc.template, tc.label) != tc.expected {
+			t.Errorf("%s/%s: expected '%s', got: '%s'", tc.template, tc.label,
+				 tc.expected, mqttTopic(tc.template, tc.label))
+		}
+	}
+
+	return
+}
+
+func TestMQTTSinkSerialize(t *testing.T) {
+	var ms		*MQTTSink
+	var err		error
+	var topic	string
+	var payload	[]byte
+
+	_, err	= NewMQTTSink(&MQTTSinkConfiguration{
+		Url:		"tcp://localhost:1",
+		PayloadFormat:	"xml",
+	})
+	if err == nil {
+		t.Errorf("NewMQTTSink() should have failed")
+	}
+
+	_, err	= NewMQTTSink(&MQTTSinkConfiguration{
+		Url:		"tcp://localhost:1",
+		QoS:		3,
+	})
+	if err == nil {
+		t.Errorf("NewMQTTSink() should have failed")
+	}
+
+	ms, err	= NewMQTTSink(&MQTTSinkConfiguration{
+		Url:		"tcp://localhost:1",
+		PushInterval:	time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("NewMQTTSink() should have succeeded, got: %v", err)
+	}
+
+	topic, payload, err	= ms.serialize(&Point{
+		Timestamp:	time.Unix(1569150729, 0),
+		Label:		"sensor0.\"temperature\"",
+		Value:		18.7,
+	})
+	if err != nil {
+		t.Errorf("serialize() should have succeeded, got: %v", err)
+	}
+	if topic != "datalogger/sensor0/\"temperature\"" {
+		t.Errorf("unexpected topic: '%s'", topic)
+	}
+	if string(payload) !=
+		"{\"timestamp\":1569150729000,\"label\":\"sensor0.\\\"temperature\\\"\",\"value\":18.7}" {
+		t.Errorf("unexpected payload: '%s'", payload)
+	}
+
+	ms.payloadFormat	= MQTT_PAYLOAD_RAW
+	_, payload, err	= ms.serialize(&Point{
+		Timestamp:	time.Unix(1569150729, 0),
+		Label:		"sensor0.humidity",
+		Value:		uint16(54),
+	})
+	if err != nil {
+		t.Errorf("serialize() should have succeeded, got: %v", err)
+	}
+	if string(payload) != "54" {
+		t.Errorf("unexpected payload: '%s'", payload)
+	}
+
+	return
+}
+
+func TestMQTTSinkLogic(t *testing.T) {
+	var ms		*MQTTSink
+	var err		error
+	var addr	string
+	var broker	*mqttTestBroker
+	var accepted	uint
+
+	// grab a free port, then release it so that the sink fails to connect
+	broker	= newMQTTTestBroker(t, "localhost:0")
+	addr	= broker.listener.Addr().String()
+	broker.close()
+
+	ms, err	= NewMQTTSink(&MQTTSinkConfiguration{
+		Url:		"tcp://" + addr,
+		Topic:		"test/{path}",
+		QoS:		1,
+		BufferSize:	3,
+		PushInterval:	50 * time.Millisecond,
+		Timeout:	time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewMQTTSink() should have succeeded, got: %v", err)
+	}
+
+	accepted	= ms.Save([]*Point{
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor0.temp", Value: 18.7 },
+		nil,
+		{ Timestamp: time.Unix(1569150730, 0), Label: "sensor1.temp", Value: 19 },
+		{ Timestamp: time.Unix(1569150731, 0), Label: "sensor2.temp", Value: 20 },
+	})
+	if accepted != 3 {
+		t.Errorf("3 points should have been accepted, saw: %v", accepted)
+	}
+
+	// points should stay buffered while the broker is unreachable
+	time.Sleep(200 * time.Millisecond)
+	ms.lock.Lock()
+	if len(ms.fifo) != 3 {
+		t.Errorf("expected 3 buffered points, saw: %v", len(ms.fifo))
+	}
+	ms.lock.Unlock()
+
+	// bring the broker up: buffered points should get published
+	broker	= newMQTTTestBroker(t, addr)
+	defer broker.close()
+
+	time.Sleep(500 * time.Millisecond)
+	ms.lock.Lock()
+	if len(ms.fifo) != 0 {
+		t.Errorf("expected an empty fifo, saw: %v points", len(ms.fifo))
+	}
+	ms.lock.Unlock()
+
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+
+	if len(broker.messages) != 2 {
+		t.Fatalf("expected 2 messages, got: %v", len(broker.messages))
+	}
+
+	if broker.messages[0].topic != "test/sensor0/temp" ||
+	   broker.messages[0].payload !=
+		"{\"timestamp\":1569150729000,\"label\":\"sensor0.temp\",\"value\":18.7}" ||
+	   broker.messages[0].qos != 1 {
+		t.Errorf("unexpected message #0: %+v", broker.messages[0])
+	}
+
+	if broker.messages[1].topic != "test/sensor1/temp" ||
+	   broker.messages[1].payload !=
+		"{\"timestamp\":1569150730000,\"label\":\"sensor1.temp\",\"value\":19}" {
+		t.Errorf("unexpected message #1: %+v", broker.messages[1])
+	}
+
+	return
+}
+
+type mqttTestMessage struct {
+	topic		string
+	payload		string
+	qos		byte
+	retain		bool
+}
+
+// Minimal MQTT 3.1.1 broker, accepting connections and recording
+// published messages.
+type mqttTestBroker struct {
+	t		*testing.T
+	listener	net.Listener
+	lock		sync.Mutex
+	messages	[]mqttTestMessage
+}
+
+func newMQTTTestBroker(t *testing.T, addr string) (mb *mqttTestBroker) {
+	var err	error
+
+	mb	= &mqttTestBroker{
+		t:	t,
+	}
+
+	mb.listener, err	= net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", addr, err)
+	}
+
+	go func() {
+		var conn	net.Conn
+
+		for {
+			conn, err	= mb.listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go mb.handle(conn)
+		}
+	}()
+
+	return
+}
+
+func (mb *mqttTestBroker) close() {
+	mb.listener.Close()
+
+	return
+}
+
+func (mb *mqttTestBroker) handle(conn net.Conn) {
+	var err		error
+	var r		*bufio.Reader
+	var header	byte
+	var length	int
+	var multiplier	int
+	var b		byte
+	var body	[]byte
+	var msg		mqttTestMessage
+	var topicLen	int
+
+	defer conn.Close()
+	r	= bufio.NewReader(conn)
+
+	for {
+		header, err	= r.ReadByte()
+		if err != nil {
+			return
+		}
+
+		// decode the variable length remaining length field
+		length		= 0
+		multiplier	= 1
+		for {
+			b, err	= r.ReadByte()
+			if err != nil {
+				return
+			}
+			length		+= int(b & 0x7f) * multiplier
+			multiplier	*= 128
+			if b & 0x80 == 0 {
+				break
+			}
+		}
+
+		body	= make([]byte, length)
+		_, err	= io.ReadFull(r, body)
+		if err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case 1:		// CONNECT: accept
+			conn.Write([]byte{ 0x20, 0x02, 0x00, 0x00 })
+
+		case 3:		// PUBLISH
+			msg		= mqttTestMessage{
+				qos:	(header >> 1) & 0x03,
+				retain:	header & 0x01 == 1,
+			}
+			topicLen	= int(binary.BigEndian.Uint16(body[0:2]))
+			msg.topic	= string(body[2:2+topicLen])
+			body		= body[2+topicLen:]
+
+			if msg.qos > 0 {
+				// acknowledge with PUBACK
+				conn.Write([]byte{ 0x40, 0x02, body[0], body[1] })
+				body	= body[2:]
+			}
+			msg.payload	= string(body)
+
+			mb.lock.Lock()
+			mb.messages	= append(mb.messages, msg)
+			mb.lock.Unlock()
+
+		case 12:	// PINGREQ
+			conn.Write([]byte{ 0xd0, 0x00 })
+
+		case 14:	// DISCONNECT
+			return
+		}
+	}
+
+	return
+}
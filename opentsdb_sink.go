@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+type OpenTSDBSinkConfiguration struct {
+	Url		string		// server URL (e.g. http://localhost:4242)
+	Username	string		// basic auth username (disabled if empty)
+	Password	string		// basic auth password
+	TLSConfig	*tls.Config	// TLS settings (https:// URLs only)
+	Rules		[]*LabelRule	// rules mapping point labels to metric names
+					// and tags. Labels matching no rule are used
+					// as metric names.
+	Tags		map[string]string // static tags added to all datapoints.
+					// As opentsdb requires at least one tag, a host
+					// tag is added to datapoints without any.
+	BufferSize	uint		// max. number of buffered points
+	OverflowPolicy	string		// what to do with new points when the buffer
+					// is full: either "drop_newest" (default) or
+					// "drop_oldest"
+	BatchSize	uint		// max. number of datapoints posted at once
+	PushInterval	time.Duration	// how often to post points
+	Timeout		time.Duration	// HTTP request timeout (defaults to 1 minute)
+	MaxRetryDelay	time.Duration	// upper bound of the delay between retries
+					// (defaults to 1 minute)
+}
+
+// OpenTSDB sink object.
+type OpenTSDBSink struct {
+	conf		OpenTSDBSinkConfiguration
+	url		string
+	hostname	string
+	overflowPolicy	uint
+	fifo		*pointRing
+	lock		sync.Mutex
+	backoff		backoff
+	client		*http.Client
+}
+
+// OpenTSDB datapoint, as posted to /api/put.
+type openTSDBDatapoint struct {
+	Metric		string			`json:"metric"`
+	Timestamp	int64			`json:"timestamp"`
+	Value		interface{}		`json:"value"`
+	Tags		map[string]string	`json:"tags"`
+}
+
+// Response body of /api/put?details requests.
+type openTSDBPutDetails struct {
+	Success		int			`json:"success"`
+	Failed		int			`json:"failed"`
+	Errors		[]struct {
+		Datapoint	json.RawMessage	`json:"datapoint"`
+		Error		string		`json:"error"`
+	}					`json:"errors"`
+}
+
+// Returns a new opentsdb sink.
+func NewOpenTSDBSink(conf *OpenTSDBSinkConfiguration) (ots *OpenTSDBSink, err error) {
+	ots = &OpenTSDBSink{
+		conf:	*conf,
+		client:	&http.Client{
+			Timeout:	conf.Timeout,
+			Transport:	&http.Transport{
+				Proxy:			http.ProxyFromEnvironment,
+				TLSClientConfig:	conf.TLSConfig,
+			},
+		},
+	}
+
+	if ots.conf.Url == "" {
+		err	= errors.New("missing url")
+		return
+	}
+	ots.url		= strings.TrimRight(ots.conf.Url, "/") + "/api/put?details"
+
+	switch ots.conf.OverflowPolicy {
+	case "drop_newest", "":
+		ots.overflowPolicy	= OVERFLOW_DROP_NEWEST
+
+	case "drop_oldest":
+		ots.overflowPolicy	= OVERFLOW_DROP_OLDEST
+
+	default:
+		err	= fmt.Errorf("unsupported overflow policy '%s'", ots.conf.OverflowPolicy)
+		return
+	}
+
+	ots.hostname, _	= os.Hostname()
+	ots.hostname	= openTSDBSanitize(ots.hostname)
+	if ots.hostname == "" {
+		ots.hostname	= "datalogger"
+	}
+
+	// buffer 100k points by default
+	if ots.conf.BufferSize == 0 {
+		ots.conf.BufferSize	= 100000
+	}
+
+	// opentsdb recommends posting no more than 50 datapoints at once
+	if ots.conf.BatchSize == 0 {
+		ots.conf.BatchSize	= 50
+	}
+
+	// default to posting once every second
+	if ots.conf.PushInterval == 0 {
+		ots.conf.PushInterval	= 1 * time.Second
+	}
+
+	if ots.client.Timeout == 0 {
+		ots.client.Timeout	= 1 * time.Minute
+	}
+
+	ots.fifo	= newPointRing(ots.conf.BufferSize)
+
+	// retry failed posts on the next push, then back off exponentially
+	ots.backoff	= backoff{
+		initial:	ots.conf.PushInterval,
+		max:		ots.conf.MaxRetryDelay,
+		multiplier:	2,
+		jitter:		0.1,
+	}
+	if ots.backoff.max == 0 {
+		ots.backoff.max	= 1 * time.Minute
+	}
+
+	go ots.writer()
+
+	return
+}
+
+// Pushes points to the sink's internal buffer. Depending on the overflow
+// policy, either new or old points are dropped when the buffer is full.
+func (ots *OpenTSDBSink) Save(points []*Point) (acceptedCount uint) {
+	var pointCount	uint
+	var evicted	uint
+
+	pointCount	= uint(len(points))
+	if pointCount == 0 {
+		return
+	}
+
+	ots.lock.Lock()
+	acceptedCount, evicted	= ots.fifo.push(points, ots.overflowPolicy)
+	ots.lock.Unlock()
+
+	if acceptedCount != pointCount {
+		fmt.Printf("opentsdb sink: dropped %v points out of %v\n",
+			   pointCount - acceptedCount, pointCount)
+	}
+
+	if evicted > 0 {
+		fmt.Printf("opentsdb sink: buffer full, dropped %v old points\n", evicted)
+	}
+
+	return
+}
+
+// Periodically posts batches of buffered points. When behind, batches are
+// posted continuously until the backlog is drained. Failed posts are retried
+// with an exponential backoff.
+func (ots *OpenTSDBSink) writer() {
+	var points	[]*Point
+	var seq		uint64
+	var ticker	*time.Ticker
+	var draining	bool
+	var failures	uint
+	var skipTicks	int
+	var delay	time.Duration
+	var err		error
+
+	ticker	= time.NewTicker(ots.conf.PushInterval)
+
+	for {
+		if !draining {
+			<-ticker.C
+
+			// wait for the backoff delay to expire
+			if skipTicks > 0 {
+				skipTicks--
+				continue
+			}
+		}
+		draining	= false
+
+		ots.lock.Lock()
+		points, seq	= ots.fifo.peek(points, ots.conf.BatchSize)
+		ots.lock.Unlock()
+
+		if len(points) == 0 {
+			continue
+		}
+
+		err	= ots.write(points)
+		if err != nil {
+			// back off, honoring the delay requested by the server if any
+			failures++
+			delay	= ots.backoff.delay(failures)
+			if hpe, ok := err.(*httpPostError); ok && hpe.retryAfter > delay {
+				delay	= hpe.retryAfter
+			}
+			skipTicks	= int(delay / ots.conf.PushInterval) - 1
+
+			fmt.Printf("opentsdb sink: put failed (retrying in %v): %v\n",
+				   delay, err)
+			continue
+		}
+		failures	= 0
+
+		// free points which have been successfully posted
+		ots.lock.Lock()
+		ots.fifo.release(seq + uint64(len(points)))
+		draining	= uint(ots.fifo.len()) >= ots.conf.BatchSize
+		ots.lock.Unlock()
+	}
+
+	return
+}
+
+// Serializes and posts points to /api/put. Datapoints rejected by the server
+// are logged individually and dropped, as retrying them would block the
+// pipeline. The same goes for whole batches rejected as invalid (see
+// httpPostError.isRejection()). Returns an error if the post should be
+// retried later.
+func (ots *OpenTSDBSink) write(points []*Point) (err error) {
+	var datapoints	[]*openTSDBDatapoint
+	var dp		*openTSDBDatapoint
+	var payload	[]byte
+	var details	*openTSDBPutDetails
+
+	for _, p := range points {
+		dp	= ots.datapoint(p)
+		if dp != nil {
+			datapoints	= append(datapoints, dp)
+		}
+	}
+
+	if len(datapoints) == 0 {
+		return
+	}
+
+	payload, err	= json.Marshal(datapoints)
+	if err != nil {
+		return
+	}
+
+	details, err	= ots.post(payload)
+	if hpe, ok := err.(*httpPostError); ok && hpe.isRejection() {
+		fmt.Printf("opentsdb sink: dropped %v datapoints rejected by the server: %v\n",
+			   len(datapoints), hpe)
+		err	= nil
+		return
+	}
+
+	if details == nil {
+		return
+	}
+
+	// the server gave details about rejected datapoints: do not retry
+	for _, e := range details.Errors {
+		fmt.Printf("opentsdb sink: datapoint rejected (%s): %s\n",
+			   e.Error, e.Datapoint)
+	}
+	err	= nil
+
+	return
+}
+
+// Posts a serialized payload. Returns the details of the put operation if
+// some datapoints were rejected.
+func (ots *OpenTSDBSink) post(payload []byte) (details *openTSDBPutDetails, err error) {
+	var req		*http.Request
+	var res		*http.Response
+	var body	[]byte
+	var pd		openTSDBPutDetails
+
+	req, err	= http.NewRequest(http.MethodPost, ots.url, bytes.NewReader(payload))
+	if err != nil {
+		err	= fmt.Errorf("failed to build POST request: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if ots.conf.Username != "" {
+		req.SetBasicAuth(ots.conf.Username, ots.conf.Password)
+	}
+
+	res, err	= ots.client.Do(req)
+	if err != nil {
+		err	= &httpPostError{
+			message:	err.Error(),
+		}
+		return
+	}
+	defer res.Body.Close()
+
+	body, _	= ioutil.ReadAll(io.LimitReader(res.Body, 1 << 20))
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return
+	}
+
+	// datapoints were rejected (400), possibly along with valid ones
+	if res.StatusCode == http.StatusBadRequest &&
+	   json.Unmarshal(body, &pd) == nil && len(pd.Errors) > 0 {
+		details	= &pd
+		return
+	}
+
+	if len(body) > 4096 {
+		body	= body[:4096]
+	}
+	err	= &httpPostError{
+		status:		res.StatusCode,
+		message:	strings.TrimSpace(string(body)),
+		retryAfter:	parseRetryAfter(res.Header.Get("Retry-After"), time.Now()),
+	}
+
+	return
+}
+
+// Returns the opentsdb datapoint of a point, or nil if the point value is not
+// numeric. Tags from label rules take precedence over point tags, which
+// themselves take precedence over static tags.
+func (ots *OpenTSDBSink) datapoint(p *Point) (dp *openTSDBDatapoint) {
+	var f64		float64
+	var value	interface{}
+	var ok		bool
+	var name	string
+	var field	string
+	var ruleTags	map[string]string
+
+	if p == nil {
+		return
+	}
+
+	f64, ok	= p.Float64()
+	if !ok || math.IsNaN(f64) || math.IsInf(f64, 0) {
+		return
+	}
+
+	// keep integers as such, as opentsdb stores them differently
+	switch v := p.Value.(type) {
+	case int, int8, int16, int32, int64, uint8, uint16, uint32:
+		value	= v
+	case bool:
+		value	= 0
+		if v {
+			value	= 1
+		}
+	default:
+		value	= f64
+	}
+
+	name, field, ruleTags, _	= mapLabel(ots.conf.Rules, p.Label)
+	if field != "" {
+		name	+= "." + field
+	}
+
+	dp	= &openTSDBDatapoint{
+		Metric:		openTSDBSanitize(name),
+		Timestamp:	p.Timestamp.UnixNano() / 1e6,
+		Value:		value,
+		Tags:		make(map[string]string),
+	}
+
+	for _, set := range []map[string]string{ ots.conf.Tags, p.Tags, ruleTags } {
+		for key, tagValue := range set {
+			key		= openTSDBSanitize(key)
+			tagValue	= openTSDBSanitize(tagValue)
+			if key != "" && tagValue != "" {
+				dp.Tags[key]	= tagValue
+			}
+		}
+	}
+
+	if len(dp.Tags) == 0 {
+		dp.Tags["host"]	= ots.hostname
+	}
+
+	return
+}
+
+// Returns self-monitoring metrics.
+func (ots *OpenTSDBSink) StatsPoints(prefix string, now time.Time) (points []*Point) {
+	var fifoDepth	int
+
+	ots.lock.Lock()
+	fifoDepth	= ots.fifo.len()
+	ots.lock.Unlock()
+
+	points	= append(points, &Point{
+		Timestamp:	now,
+		Label:		prefix + ".fifo_depth",
+		Value:		uint64(fifoDepth),
+	})
+
+	return
+}
+
+// Replaces characters which are not allowed in opentsdb metric names and
+// tags (anything but letters, digits, -, _, . and /) with underscores.
+func openTSDBSanitize(s string) (res string) {
+	res	= strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) ||
+		   r == '-' || r == '_' || r == '.' || r == '/' {
+			return r
+		}
+		return '_'
+	}, s)
+
+	return
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOpenTSDBSinkDatapoint(t *testing.T) {
+	var ots		*OpenTSDBSink
+	var err		error
+	var rules	[]*LabelRule
+	var dp		*openTSDBDatapoint
+
+	rules, err	= newLabelRules([]*labelRuleConf{
+		{ Template: "room.sensor.measurement" },
+	})
+	if err != nil {
+		t.Fatalf("newLabelRules() should have succeeded, got: %v", err)
+	}
+
+	ots, err	= NewOpenTSDBSink(&OpenTSDBSinkConfiguration{
+		Url:		"http://localhost:4242/",
+		Rules:		rules,
+		PushInterval:	time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	if ots.url != "http://localhost:4242/api/put?details" {
+		t.Errorf("unexpected url: %v", ots.url)
+	}
+
+	dp	= ots.datapoint(&Point{
+		Timestamp:	time.Unix(1569150729, 123000000),
+		Label:		"living room.sensor0.temperature",
+		Value:		float32(18.5),
+		Tags:		map[string]string{ "floor": "1st (ground)", "empty": "" },
+	})
+	if dp == nil || dp.Metric != "temperature" || dp.Timestamp != 1569150729123 ||
+	   dp.Value != float64(18.5) || len(dp.Tags) != 3 ||
+	   dp.Tags["room"] != "living_room" || dp.Tags["sensor"] != "sensor0" ||
+	   dp.Tags["floor"] != "1st__ground_" {
+		t.Errorf("unexpected datapoint: %+v", dp)
+	}
+
+	// points without any tag should get a host tag
+	dp	= ots.datapoint(&Point{ Label: "plc.counter", Value: uint16(12) })
+	if dp == nil || dp.Metric != "plc.counter" || dp.Value != uint16(12) ||
+	   len(dp.Tags) != 1 || dp.Tags["host"] != ots.hostname {
+		t.Errorf("unexpected datapoint: %+v", dp)
+	}
+
+	for _, value := range []interface{}{ "text", math.NaN() } {
+		if ots.datapoint(&Point{ Label: "plc.status", Value: value }) != nil {
+			t.Errorf("datapoint(%v) should have returned nil", value)
+		}
+	}
+
+	return
+}
+
+func TestOpenTSDBSink(t *testing.T) {
+	var ots		*OpenTSDBSink
+	var err		error
+	var ts		*httptest.Server
+	var lock	sync.Mutex
+	var puts	[][]*openTSDBDatapoint
+	var fail	int
+	var failStatus	int
+	var fifoLen	int
+
+	ts	= httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var payload	[]byte
+			var dps		[]*openTSDBDatapoint
+			var errs	[]string
+
+			payload, _	= ioutil.ReadAll(r.Body)
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			if r.URL.Path != "/api/put" || r.URL.RawQuery != "details" {
+				t.Errorf("unexpected url: %v", r.URL)
+			}
+
+			json.Unmarshal(payload, &dps)
+			puts	= append(puts, dps)
+
+			if fail > 0 {
+				fail--
+				w.WriteHeader(failStatus)
+				return
+			}
+
+			// reject datapoints of metrics containing "bad"
+			for _, dp := range dps {
+				if strings.Contains(dp.Metric, "bad") {
+					errs	= append(errs, `{"datapoint":{"metric":"` +
+						dp.Metric + `"},"error":"Unable to parse value"}`)
+				}
+			}
+
+			if len(errs) > 0 {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"success":1,"failed":1,"errors":[` +
+					strings.Join(errs, ",") + `]}`))
+				return
+			}
+
+			w.WriteHeader(204)
+		}))
+	defer ts.Close()
+
+	ots, err	= NewOpenTSDBSink(&OpenTSDBSinkConfiguration{
+		Url:		ts.URL,
+		Tags:		map[string]string{ "site": "house" },
+		BatchSize:	2,
+		PushInterval:	100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	// the first post fails with a server error and should be retried,
+	// while rejected datapoints should be dropped
+	lock.Lock()
+	fail		= 1
+	failStatus	= 503
+	lock.Unlock()
+
+	ots.Save([]*Point{
+		{ Timestamp: time.Unix(1569150729, 0), Label: "p.good", Value: 1 },
+		{ Timestamp: time.Unix(1569150729, 0), Label: "p.bad", Value: 2 },
+		{ Timestamp: time.Unix(1569150729, 0), Label: "p.other", Value: 3 },
+	})
+
+	time.Sleep(700 * time.Millisecond)
+
+	lock.Lock()
+	if len(puts) != 3 {
+		t.Fatalf("expected 3 puts, got: %v", len(puts))
+	}
+	if len(puts[0]) != 2 || len(puts[1]) != 2 || len(puts[2]) != 1 ||
+	   puts[1][0].Metric != "p.good" || puts[1][1].Metric != "p.bad" ||
+	   puts[2][0].Metric != "p.other" || puts[2][0].Tags["site"] != "house" {
+		t.Errorf("unexpected puts: %v", puts)
+	}
+	puts	= nil
+
+	// permission errors may be fixed on the server side, and should be retried
+	fail		= 1
+	failStatus	= 403
+	lock.Unlock()
+
+	ots.Save([]*Point{
+		{ Timestamp: time.Unix(1569150730, 0), Label: "p.good", Value: 4 },
+	})
+
+	time.Sleep(500 * time.Millisecond)
+
+	lock.Lock()
+	if len(puts) != 2 || len(puts[1]) != 1 || puts[1][0].Metric != "p.good" {
+		t.Errorf("unexpected puts: %v", puts)
+	}
+	lock.Unlock()
+
+	ots.lock.Lock()
+	fifoLen	= ots.fifo.len()
+	ots.lock.Unlock()
+
+	if fifoLen != 0 {
+		t.Errorf("fifo should have been empty, got: %v", fifoLen)
+	}
+
+	return
+}
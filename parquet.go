@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"math"
+	"os"
+)
+
+// Quality of parquet values.
+const (
+	PARQUET_QUALITY_GOOD	int32	= 0
+	PARQUET_QUALITY_INVALID	int32	= 1	// NaN, Inf or non-numeric value
+						// (stored as null)
+)
+
+// Parquet format constants (see parquet.thrift).
+const (
+	parquetMagic			= "PAR1"
+
+	parquetTypeInt32		int32	= 1
+	parquetTypeInt64		int32	= 2
+	parquetTypeDouble		int32	= 5
+	parquetTypeByteArray		int32	= 6
+
+	parquetRequired			int32	= 0
+	parquetOptional			int32	= 1
+
+	parquetConvertedUTF8		int32	= 0
+	parquetConvertedTimestampMillis	int32	= 9
+
+	parquetEncodingPlain		int32	= 0
+	parquetEncodingRLE		int32	= 3
+
+	parquetCodecGzip		int32	= 2
+
+	parquetPageData			int32	= 0
+)
+
+// Thrift compact protocol types.
+const (
+	thriftTrue	byte	= 1
+	thriftFalse	byte	= 2
+	thriftI32	byte	= 5
+	thriftI64	byte	= 6
+	thriftBinary	byte	= 8
+	thriftList	byte	= 9
+	thriftStruct	byte	= 12
+)
+
+// Parquet file writer, storing points in four columns: timestamp (int64,
+// milliseconds since the epoch, UTC), label (string), value (nullable double)
+// and quality (int32).
+// Each call to writeRowGroup() appends a row group after the current footer,
+// then a new footer after the row group. Previous footers are never
+// overwritten and merely become dead space, so that an interrupted write
+// leaves the last complete footer in the file.
+type parquetWriter struct {
+	file		*os.File
+	offset		int64		// end of the last footer
+	rowGroups	[][]byte	// serialized row group metadata
+	numRows		int64
+}
+
+// Metadata of a column chunk.
+type parquetColumnChunk struct {
+	name		string
+	physicalType	int32
+	offset		int64
+	numValues	int64
+	nullCount	int64
+	uncompressed	int64
+	compressed	int64
+	min		[]byte		// min. and max. statistics (omitted if nil)
+	max		[]byte
+}
+
+// Returns a new parquet writer. file must be empty and writable.
+func newParquetWriter(file *os.File) (pw *parquetWriter, err error) {
+	pw = &parquetWriter{
+		file:	file,
+	}
+
+	_, err	= file.WriteAt([]byte(parquetMagic), 0)
+	if err != nil {
+		return
+	}
+
+	// write an empty footer to make the file readable right away
+	pw.offset, err	= pw.writeFooter(int64(len(parquetMagic)))
+
+	return
+}
+
+// Appends points as a new row group after the current footer, then writes
+// a new footer.
+// Nil points are skipped.
+func (pw *parquetWriter) writeRowGroup(points []*Point) (err error) {
+	var timestamps	bytes.Buffer
+	var labels	bytes.Buffer
+	var values	bytes.Buffer
+	var qualities	bytes.Buffer
+	var defLevels	[]bool
+	var rows	int64
+	var minTs	int64
+	var maxTs	int64
+	var ts		int64
+	var f64		float64
+	var ok		bool
+	var quality	int32
+	var chunks	[]*parquetColumnChunk
+	var chunk	*parquetColumnChunk
+	var offset	int64
+	var tw		thriftCompactWriter
+	var totalSize	int64
+
+	for _, p := range points {
+		if p == nil {
+			continue
+		}
+
+		ts	= p.Timestamp.UnixNano() / 1e6
+		if rows == 0 || ts < minTs {
+			minTs	= ts
+		}
+		if rows == 0 || ts > maxTs {
+			maxTs	= ts
+		}
+		binary.Write(&timestamps, binary.LittleEndian, ts)
+
+		binary.Write(&labels, binary.LittleEndian, uint32(len(p.Label)))
+		labels.WriteString(p.Label)
+
+		f64, ok	= p.Float64()
+		if ok && !math.IsNaN(f64) && !math.IsInf(f64, 0) {
+			binary.Write(&values, binary.LittleEndian, f64)
+			quality	= PARQUET_QUALITY_GOOD
+		} else {
+			quality	= PARQUET_QUALITY_INVALID
+		}
+		defLevels	= append(defLevels, quality == PARQUET_QUALITY_GOOD)
+
+		binary.Write(&qualities, binary.LittleEndian, quality)
+		rows++
+	}
+
+	if rows == 0 {
+		return
+	}
+
+	offset	= pw.offset
+	for _, col := range []struct {
+		name		string
+		physicalType	int32
+		data		[]byte
+		defLevels	[]bool
+	}{
+		{ "timestamp", parquetTypeInt64, timestamps.Bytes(), nil },
+		{ "label", parquetTypeByteArray, labels.Bytes(), nil },
+		{ "value", parquetTypeDouble, values.Bytes(), defLevels },
+		{ "quality", parquetTypeInt32, qualities.Bytes(), nil },
+	} {
+		chunk, err	= pw.writeColumnChunk(offset, col.name, col.physicalType,
+						      rows, col.data, col.defLevels)
+		if err != nil {
+			// drop the column chunks written so far, leaving the
+			// previous footer at the end of the file
+			pw.file.Truncate(pw.offset)
+			return
+		}
+		offset	= chunk.offset + chunk.compressed
+		chunks	= append(chunks, chunk)
+	}
+
+	chunks[0].min	= make([]byte, 8)
+	chunks[0].max	= make([]byte, 8)
+	binary.LittleEndian.PutUint64(chunks[0].min, uint64(minTs))
+	binary.LittleEndian.PutUint64(chunks[0].max, uint64(maxTs))
+
+	// serialize the row group metadata
+	tw.listBegin(1, thriftStruct, len(chunks))
+	for _, chunk = range chunks {
+		tw.structBegin(0)
+		tw.i64Field(2, chunk.offset)
+		tw.structBegin(3)
+		tw.i32Field(1, chunk.physicalType)
+		tw.listBegin(2, thriftI32, 2)
+		tw.i32(parquetEncodingPlain)
+		tw.i32(parquetEncodingRLE)
+		tw.listBegin(3, thriftBinary, 1)
+		tw.binary([]byte(chunk.name))
+		tw.i32Field(4, parquetCodecGzip)
+		tw.i64Field(5, chunk.numValues)
+		tw.i64Field(6, chunk.uncompressed)
+		tw.i64Field(7, chunk.compressed)
+		tw.i64Field(9, chunk.offset)
+		tw.structBegin(12)
+		tw.i64Field(3, chunk.nullCount)
+		if chunk.max != nil {
+			tw.binaryField(5, chunk.max)
+			tw.binaryField(6, chunk.min)
+		}
+		tw.structEnd()
+		tw.structEnd()
+		tw.structEnd()
+
+		totalSize	+= chunk.uncompressed
+	}
+	tw.i64Field(2, totalSize)
+	tw.i64Field(3, rows)
+	tw.stop()
+
+	pw.rowGroups	= append(pw.rowGroups, tw.buf.Bytes())
+	pw.numRows	+= rows
+
+	offset, err	= pw.writeFooter(offset)
+	if err != nil {
+		pw.rowGroups	= pw.rowGroups[:len(pw.rowGroups) - 1]
+		pw.numRows	-= rows
+		pw.file.Truncate(pw.offset)
+		return
+	}
+	pw.offset	= offset
+
+	return
+}
+
+// Writes a column chunk made of a single gzip-compressed data page at offset.
+// defLevels holds the definition level of each row for optional columns
+// (true if the value is not null), nil for required ones.
+func (pw *parquetWriter) writeColumnChunk(offset int64, name string, physicalType int32,
+					  rows int64, data []byte, defLevels []bool) (
+					  chunk *parquetColumnChunk, err error) {
+	var page	bytes.Buffer
+	var compressed	bytes.Buffer
+	var gz		*gzip.Writer
+	var tw		thriftCompactWriter
+
+	chunk	= &parquetColumnChunk{
+		name:		name,
+		physicalType:	physicalType,
+		offset:		offset,
+		numValues:	rows,
+	}
+
+	if defLevels != nil {
+		for _, defined := range defLevels {
+			if !defined {
+				chunk.nullCount++
+			}
+		}
+		writeParquetLevels(&page, defLevels)
+	}
+	page.Write(data)
+
+	gz	= gzip.NewWriter(&compressed)
+	gz.Write(page.Bytes())
+	err	= gz.Close()
+	if err != nil {
+		return
+	}
+
+	tw.i32Field(1, parquetPageData)
+	tw.i32Field(2, int32(page.Len()))
+	tw.i32Field(3, int32(compressed.Len()))
+	tw.structBegin(5)
+	tw.i32Field(1, int32(rows))
+	tw.i32Field(2, parquetEncodingPlain)
+	tw.i32Field(3, parquetEncodingRLE)
+	tw.i32Field(4, parquetEncodingRLE)
+	tw.structEnd()
+	tw.stop()
+
+	chunk.uncompressed	= int64(tw.buf.Len() + page.Len())
+	chunk.compressed	= int64(tw.buf.Len() + compressed.Len())
+
+	_, err	= pw.file.WriteAt(append(tw.buf.Bytes(), compressed.Bytes()...), offset)
+
+	return
+}
+
+// Writes the file metadata, its length and the trailing magic at offset.
+// Returns the end offset of the footer.
+func (pw *parquetWriter) writeFooter(offset int64) (end int64, err error) {
+	var tw		thriftCompactWriter
+	var footer	[]byte
+
+	tw.i32Field(1, 1)
+
+	// schema: a root element followed by the four columns
+	tw.listBegin(2, thriftStruct, 5)
+	tw.structBegin(0)
+	tw.binaryField(4, []byte("schema"))
+	tw.i32Field(5, 4)
+	tw.structEnd()
+
+	tw.structBegin(0)
+	tw.i32Field(1, parquetTypeInt64)
+	tw.i32Field(3, parquetRequired)
+	tw.binaryField(4, []byte("timestamp"))
+	tw.i32Field(6, parquetConvertedTimestampMillis)
+	tw.structBegin(10)
+	tw.structBegin(8)
+	tw.boolField(1, true)
+	tw.structBegin(2)
+	tw.structBegin(1)
+	tw.structEnd()
+	tw.structEnd()
+	tw.structEnd()
+	tw.structEnd()
+	tw.structEnd()
+
+	tw.structBegin(0)
+	tw.i32Field(1, parquetTypeByteArray)
+	tw.i32Field(3, parquetRequired)
+	tw.binaryField(4, []byte("label"))
+	tw.i32Field(6, parquetConvertedUTF8)
+	tw.structBegin(10)
+	tw.structBegin(1)
+	tw.structEnd()
+	tw.structEnd()
+	tw.structEnd()
+
+	tw.structBegin(0)
+	tw.i32Field(1, parquetTypeDouble)
+	tw.i32Field(3, parquetOptional)
+	tw.binaryField(4, []byte("value"))
+	tw.structEnd()
+
+	tw.structBegin(0)
+	tw.i32Field(1, parquetTypeInt32)
+	tw.i32Field(3, parquetRequired)
+	tw.binaryField(4, []byte("quality"))
+	tw.structEnd()
+
+	tw.i64Field(3, pw.numRows)
+
+	tw.listBegin(4, thriftStruct, len(pw.rowGroups))
+	for _, rg := range pw.rowGroups {
+		tw.buf.Write(rg)
+	}
+
+	tw.binaryField(6, []byte("datalogger"))
+	tw.stop()
+
+	binary.Write(&tw.buf, binary.LittleEndian, uint32(tw.buf.Len()))
+	tw.buf.WriteString(parquetMagic)
+	footer	= tw.buf.Bytes()
+
+	_, err	= pw.file.WriteAt(footer, offset)
+	if err != nil {
+		return
+	}
+	end	= offset + int64(len(footer))
+
+	return
+}
+
+// Writes definition levels (bit width 1) using the bit-packed flavour of the
+// RLE/bit-packing hybrid encoding, prefixed with their length.
+func writeParquetLevels(buf *bytes.Buffer, levels []bool) {
+	var tmp		[binary.MaxVarintLen64]byte
+	var header	[]byte
+	var groups	int
+	var packed	[]byte
+
+	groups	= (len(levels) + 7) / 8
+	packed	= make([]byte, groups)
+	for idx, level := range levels {
+		if level {
+			packed[idx / 8]	|= 1 << uint(idx % 8)
+		}
+	}
+
+	header	= tmp[:binary.PutUvarint(tmp[:], uint64(groups << 1 | 1))]
+
+	binary.Write(buf, binary.LittleEndian, uint32(len(header) + len(packed)))
+	buf.Write(header)
+	buf.Write(packed)
+
+	return
+}
+
+// Minimal thrift compact protocol encoder, covering what parquet metadata
+// needs.
+type thriftCompactWriter struct {
+	buf	bytes.Buffer
+	lastId	int16
+	stack	[]int16		// last field IDs of enclosing structs
+}
+
+// Writes a field header.
+func (tw *thriftCompactWriter) field(id int16, fieldType byte) {
+	if id > tw.lastId && id - tw.lastId <= 15 {
+		tw.buf.WriteByte(byte(id - tw.lastId) << 4 | fieldType)
+	} else {
+		tw.buf.WriteByte(fieldType)
+		tw.varint(int64(id))
+	}
+	tw.lastId	= id
+
+	return
+}
+
+// Writes a zigzag-encoded varint.
+func (tw *thriftCompactWriter) varint(v int64) {
+	var tmp	[binary.MaxVarintLen64]byte
+
+	tw.buf.Write(tmp[:binary.PutVarint(tmp[:], v)])
+
+	return
+}
+
+func (tw *thriftCompactWriter) i32(v int32) {
+	tw.varint(int64(v))
+
+	return
+}
+
+func (tw *thriftCompactWriter) binary(v []byte) {
+	var tmp	[binary.MaxVarintLen64]byte
+
+	tw.buf.Write(tmp[:binary.PutUvarint(tmp[:], uint64(len(v)))])
+	tw.buf.Write(v)
+
+	return
+}
+
+func (tw *thriftCompactWriter) i32Field(id int16, v int32) {
+	tw.field(id, thriftI32)
+	tw.varint(int64(v))
+
+	return
+}
+
+func (tw *thriftCompactWriter) i64Field(id int16, v int64) {
+	tw.field(id, thriftI64)
+	tw.varint(v)
+
+	return
+}
+
+func (tw *thriftCompactWriter) binaryField(id int16, v []byte) {
+	tw.field(id, thriftBinary)
+	tw.binary(v)
+
+	return
+}
+
+func (tw *thriftCompactWriter) boolField(id int16, v bool) {
+	if v {
+		tw.field(id, thriftTrue)
+	} else {
+		tw.field(id, thriftFalse)
+	}
+
+	return
+}
+
+// Writes a list header. Elements are then written without field headers.
+func (tw *thriftCompactWriter) listBegin(id int16, elemType byte, size int) {
+	var tmp	[binary.MaxVarintLen64]byte
+
+	tw.field(id, thriftList)
+	if size < 15 {
+		tw.buf.WriteByte(byte(size) << 4 | elemType)
+	} else {
+		tw.buf.WriteByte(0xf0 | elemType)
+		tw.buf.Write(tmp[:binary.PutUvarint(tmp[:], uint64(size))])
+	}
+
+	return
+}
+
+// Starts a nested struct. An id of 0 denotes a list element, which has no
+// field header.
+func (tw *thriftCompactWriter) structBegin(id int16) {
+	if id != 0 {
+		tw.field(id, thriftStruct)
+	}
+	tw.stack	= append(tw.stack, tw.lastId)
+	tw.lastId	= 0
+
+	return
+}
+
+// Ends a nested struct.
+func (tw *thriftCompactWriter) structEnd() {
+	tw.stop()
+	tw.lastId	= tw.stack[len(tw.stack) - 1]
+	tw.stack	= tw.stack[:len(tw.stack) - 1]
+
+	return
+}
+
+// Ends the top-level struct.
+func (tw *thriftCompactWriter) stop() {
+	tw.buf.WriteByte(0)
+
+	return
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParquetWriter(t *testing.T) {
+	var err		error
+	var dir		string
+	var file	*os.File
+	var pw		*parquetWriter
+	var meta	map[int16]interface{}
+	var rowGroups	[]interface{}
+	var columns	[]interface{}
+	var page	[]byte
+	var f64		float64
+	var before	[]byte
+	var after	[]byte
+
+	dir, err	= ioutil.TempDir("", "datalogger-parquet")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file, err	= os.Create(filepath.Join(dir, "test.parquet"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	defer file.Close()
+
+	pw, err	= newParquetWriter(file)
+	if err != nil {
+		t.Fatalf("newParquetWriter() should have succeeded, got: %v", err)
+	}
+
+	// a freshly created file should be readable, with no row group
+	meta	= parquetTestReadFooter(t, file.Name())
+	if meta[3] != int64(0) || len(meta[2].([]interface{})) != 5 {
+		t.Errorf("unexpected file metadata: %v", meta)
+	}
+
+	err	= pw.writeRowGroup([]*Point{
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor0.temperature", Value: 18.7 },
+		nil,
+		{ Timestamp: time.Unix(1569150728, 0), Label: "sensor0.humidity", Value: uint16(54) },
+		{ Timestamp: time.Unix(1569150730, 0), Label: "plc.status", Value: "running" },
+	})
+	if err != nil {
+		t.Fatalf("writeRowGroup() should have succeeded, got: %v", err)
+	}
+
+	// the second row group should be appended after the first footer,
+	// leaving it untouched
+	before, _	= ioutil.ReadFile(file.Name())
+
+	err	= pw.writeRowGroup([]*Point{
+		{ Timestamp: time.Unix(1569150731, 0), Label: "sensor0.temperature", Value: math.NaN() },
+		{ Timestamp: time.Unix(1569150731, 0), Label: "plc.running", Value: true },
+	})
+	if err != nil {
+		t.Fatalf("writeRowGroup() should have succeeded, got: %v", err)
+	}
+
+	after, _	= ioutil.ReadFile(file.Name())
+	if len(after) <= len(before) || !bytes.Equal(after[:len(before)], before) {
+		t.Errorf("the previous row group and footer should have been left in place")
+	}
+
+	meta		= parquetTestReadFooter(t, file.Name())
+	rowGroups	= meta[4].([]interface{})
+	if meta[3] != int64(5) || len(rowGroups) != 2 ||
+	   rowGroups[0].(map[int16]interface{})[3] != int64(3) ||
+	   rowGroups[1].(map[int16]interface{})[3] != int64(2) {
+		t.Fatalf("unexpected file metadata: %v", meta)
+	}
+
+	// check the contents of the first row group
+	columns	= rowGroups[0].(map[int16]interface{})[1].([]interface{})
+	if len(columns) != 4 {
+		t.Fatalf("expected 4 columns, got: %v", len(columns))
+	}
+
+	page	= parquetTestReadPage(t, file.Name(), columns[0])
+	if len(page) != 24 ||
+	   binary.LittleEndian.Uint64(page[0:]) != 1569150729000 ||
+	   binary.LittleEndian.Uint64(page[8:]) != 1569150728000 ||
+	   binary.LittleEndian.Uint64(page[16:]) != 1569150730000 {
+		t.Errorf("unexpected timestamp page: %v", page)
+	}
+
+	page	= parquetTestReadPage(t, file.Name(), columns[1])
+	if string(page) != "\x13\x00\x00\x00sensor0.temperature" +
+			    "\x10\x00\x00\x00sensor0.humidity" +
+			    "\x0a\x00\x00\x00plc.status" {
+		t.Errorf("unexpected label page: %q", page)
+	}
+
+	// definition levels (the third value is null), followed by two values
+	page	= parquetTestReadPage(t, file.Name(), columns[2])
+	if len(page) != 4 + 2 + 16 || !bytes.Equal(page[0:6], []byte{ 2, 0, 0, 0, 3, 3 }) {
+		t.Fatalf("unexpected value page: %v", page)
+	}
+	f64	= math.Float64frombits(binary.LittleEndian.Uint64(page[6:]))
+	if f64 != 18.7 {
+		t.Errorf("expected 18.7, got: %v", f64)
+	}
+	f64	= math.Float64frombits(binary.LittleEndian.Uint64(page[14:]))
+	if f64 != 54 {
+		t.Errorf("expected 54, got: %v", f64)
+	}
+
+	page	= parquetTestReadPage(t, file.Name(), columns[3])
+	if !bytes.Equal(page, []byte{ 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0 }) {
+		t.Errorf("unexpected quality page: %v", page)
+	}
+
+	return
+}
+
+// Writes a fixed set of points and compares the result with
+// testdata/reference.parquet, which was read back with an independent
+// implementation (github.com/xitongsys/parquet-go v1.6.2) as:
+//   timestamp: 1569150729000 1569150728000 1569150730000 1569150731000 1569150731000
+//   label:     sensor0.temperature sensor0.humidity plc.status sensor0.temperature plc.running
+//   value:     18.7 54 null null 1
+//   quality:   0 0 1 1 0
+// Any change to the output must be checked the same way before updating
+// the reference file.
+func TestParquetReferenceFile(t *testing.T) {
+	var err		error
+	var dir		string
+	var file	*os.File
+	var pw		*parquetWriter
+	var expected	[]byte
+	var contents	[]byte
+
+	expected, err	= ioutil.ReadFile(filepath.Join("testdata", "reference.parquet"))
+	if err != nil {
+		t.Fatalf("failed to read the reference file: %v", err)
+	}
+
+	dir, err	= ioutil.TempDir("", "datalogger-parquet")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file, err	= os.Create(filepath.Join(dir, "test.parquet"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	defer file.Close()
+
+	pw, err	= newParquetWriter(file)
+	if err != nil {
+		t.Fatalf("newParquetWriter() should have succeeded, got: %v", err)
+	}
+
+	err	= pw.writeRowGroup([]*Point{
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor0.temperature", Value: 18.7 },
+		{ Timestamp: time.Unix(1569150728, 0), Label: "sensor0.humidity", Value: uint16(54) },
+		{ Timestamp: time.Unix(1569150730, 0), Label: "plc.status", Value: "running" },
+	})
+	if err != nil {
+		t.Fatalf("writeRowGroup() should have succeeded, got: %v", err)
+	}
+
+	err	= pw.writeRowGroup([]*Point{
+		{ Timestamp: time.Unix(1569150731, 0), Label: "sensor0.temperature", Value: math.NaN() },
+		{ Timestamp: time.Unix(1569150731, 0), Label: "plc.running", Value: true },
+	})
+	if err != nil {
+		t.Fatalf("writeRowGroup() should have succeeded, got: %v", err)
+	}
+
+	contents, _	= ioutil.ReadFile(file.Name())
+	if !bytes.Equal(contents, expected) {
+		t.Errorf("output differs from the reference file (%v bytes, expected %v)",
+			 len(contents), len(expected))
+	}
+
+	return
+}
+
+// Checks the framing of a parquet file and returns its decoded metadata.
+func parquetTestReadFooter(t *testing.T, path string) (meta map[int16]interface{}) {
+	var contents	[]byte
+	var err		error
+	var length	int
+
+	contents, err	= ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+
+	if len(contents) < 12 || string(contents[0:4]) != "PAR1" ||
+	   string(contents[len(contents) - 4:]) != "PAR1" {
+		t.Fatalf("missing magic bytes in %s", path)
+	}
+
+	length	= int(binary.LittleEndian.Uint32(contents[len(contents) - 8:]))
+	if length > len(contents) - 12 {
+		t.Fatalf("invalid footer length %v", length)
+	}
+
+	meta	= parquetTestReadStruct(t,
+		bytes.NewReader(contents[len(contents) - 8 - length:len(contents) - 8]))
+
+	return
+}
+
+// Returns the uncompressed data page of a column chunk.
+func parquetTestReadPage(t *testing.T, path string, column interface{}) (page []byte) {
+	var contents	[]byte
+	var err		error
+	var meta	map[int16]interface{}
+	var r		*bytes.Reader
+	var header	map[int16]interface{}
+	var gz		*gzip.Reader
+
+	contents, _	= ioutil.ReadFile(path)
+	meta		= column.(map[int16]interface{})[3].(map[int16]interface{})
+
+	r	= bytes.NewReader(contents[meta[9].(int64):])
+	header	= parquetTestReadStruct(t, r)
+
+	gz, err	= gzip.NewReader(
+		bytes.NewReader(contents[meta[9].(int64) + int64(r.Size()) - int64(r.Len()):][:header[3].(int32)]))
+	if err != nil {
+		t.Fatalf("failed to decompress page: %v", err)
+	}
+
+	page, err	= ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("failed to decompress page: %v", err)
+	}
+
+	if len(page) != int(header[2].(int32)) {
+		t.Errorf("expected %v uncompressed bytes, got: %v", header[2], len(page))
+	}
+
+	return
+}
+
+// Decodes a thrift compact struct into a map of field IDs to values.
+func parquetTestReadStruct(t *testing.T, r *bytes.Reader) (res map[int16]interface{}) {
+	var b		byte
+	var err		error
+	var id		int16
+	var delta	int16
+	var v		int64
+
+	res	= make(map[int16]interface{})
+
+	for {
+		b, err	= r.ReadByte()
+		if err != nil {
+			t.Fatalf("truncated struct: %v", err)
+		}
+
+		if b == 0 {
+			return
+		}
+
+		delta	= int16(b >> 4)
+		if delta == 0 {
+			v, _	= binary.ReadVarint(r)
+			id	= int16(v)
+		} else {
+			id	+= delta
+		}
+
+		res[id]	= parquetTestReadValue(t, r, b & 0x0f)
+	}
+
+	return
+}
+
+// Decodes a thrift compact value of the given type.
+func parquetTestReadValue(t *testing.T, r *bytes.Reader, valueType byte) (res interface{}) {
+	var v		int64
+	var u		uint64
+	var b		byte
+	var buf		[]byte
+	var list	[]interface{}
+
+	switch valueType {
+	case thriftTrue:	res = true
+	case thriftFalse:	res = false
+	case thriftI32:
+		v, _	= binary.ReadVarint(r)
+		res	= int32(v)
+	case thriftI64:
+		v, _	= binary.ReadVarint(r)
+		res	= v
+	case thriftBinary:
+		u, _	= binary.ReadUvarint(r)
+		buf	= make([]byte, u)
+		r.Read(buf)
+		res	= buf
+	case thriftList:
+		b, _	= r.ReadByte()
+		u	= uint64(b >> 4)
+		if u == 15 {
+			u, _	= binary.ReadUvarint(r)
+		}
+		for i := uint64(0); i < u; i++ {
+			list	= append(list, parquetTestReadValue(t, r, b & 0x0f))
+		}
+		res	= list
+	case thriftStruct:
+		res	= parquetTestReadStruct(t, r)
+	default:
+		t.Fatalf("unexpected thrift type %v", valueType)
+	}
+
+	return
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"math"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,6 +22,15 @@ const (
 	FLOAT32	uint	= 5
 )
 
+// Value storage policies.
+const (
+	STORE_AUTO	uint	= 0	// keep the decoded (or transformed) value type
+	STORE_FLOAT	uint	= 1	// always store values as floats
+	STORE_INTEGER	uint	= 2	// always store values as (rounded) integers
+)
+
+var errUnsupportedValueType	= errors.New("unsupported value type")
+
 // The Target object describes a target data value.
 type Target struct {
 	MbType		modbus.RegType	// modbus register type:
@@ -31,11 +44,20 @@ type Target struct {
 	ScaleFactor	float64		// scale factor applied to the value (disabled if 0)
 	Offset		float64		// offset applied to the value (disabled if 0)
 	DecimalPlaces	uint		// round the to x decimal places (disabled if 0)
+	Tags		map[string]string // metadata attached to points (e.g. room,
+					  // device), used as tags by sinks supporting them
+	StoreAs		uint		// value storage policy (STORE_AUTO, STORE_FLOAT
+					// or STORE_INTEGER), applied after transforms
+	Counter		bool		// the value is a monotonically increasing
+					// counter (e.g. an energy meter), which sinks
+					// may turn into deltas
 }
 
 type PollerConfiguration struct {
+	Name		string		// poller name, used in self-monitoring labels
 	Url		string		// modbus client target URL
-					// (e.g. tcp://somehost:502 or rtu:///dev/ttyUSB0)
+					// (e.g. tcp://somehost:502, tcp+tls://somehost:802
+					// or rtu:///dev/ttyUSB0)
 	Targets		[]*Target	// target values to query on this modbus link
 	PollInterval	time.Duration	// how long to wait between target polls
 	Timeout		time.Duration	// modbus request timeout parameter
@@ -51,33 +73,96 @@ type PollerConfiguration struct {
 	StopBits	uint		// number of stop bits
 	Parity		uint		// parity: modbus.PARITY_NONE, modbus.PARITY_ODD or
 					// modbus.PARITY_EVEN
+
+					// tls parameters (tcp+tls:// links only):
+	TLSClientCert	*tls.Certificate // client certificate and key
+	TLSRootCAs	*x509.CertPool	// CAs (or server certificate) used to
+					// authenticate the server
+
+					// link health parameters:
+	ReconnectDelay	time.Duration	// delay before the first reconnection attempt
+	MaxReconnectDelay time.Duration	// upper bound of the reconnection delay
+	ReconnectMultiplier float64	// growth factor of the reconnection delay (if 0,
+					// the delay grows linearly by ReconnectDelay)
+	ReconnectJitter	float64		// random +/- fraction applied to the reconnection
+					// delay (0 to 1)
+	MaxConsecutiveTimeouts uint	// number of consecutive timeouts after which the
+					// link is reopened (disabled if 0)
+
+					// concurrency parameters:
+	Connections	uint		// number of modbus links to open in parallel,
+					// each polling a different unit ID (TCP only)
+	UnitMaxFailures	uint		// number of consecutive failures after which
+					// a unit is skipped (disabled if 0)
+	UnitRetryInterval time.Duration	// how often to probe skipped units
 }
 
 // Poller pbject.
 type Poller struct {
 	conf		*PollerConfiguration
 	lock		sync.Mutex
-	mc		*modbus.ModbusClient
+	links		[]*modbusLink
+	units		[]*unitTargets
+	breaker		*unitBreaker
+	stats		*pollerStats
 	points		[]*Point
+	skipping	map[uint8]bool	// units whose targets are being skipped
+					// (protected by lock)
+}
+
+// Targets sharing the same unit ID.
+type unitTargets struct {
+	unitId		uint8
+	targets		[]*Target
 }
 
 // Returns a new poller.
 func NewPoller(conf *PollerConfiguration) (p *Poller, err error) {
+	var link	*modbusLink
+	var name	string
+
+	// key breaker reports on the poller name, like other poller output
+	name	= conf.Name
+	if name == "" {
+		name	= conf.Url
+	}
+
 	p = &Poller{
-		conf:	conf,
+		conf:		conf,
+		breaker:	newUnitBreaker(name, conf.UnitMaxFailures, conf.UnitRetryInterval),
+		stats:		newPollerStats(),
+		skipping:	make(map[uint8]bool),
 	}
 
-	p.mc, err = modbus.NewClient(&modbus.ClientConfiguration{
-		URL:		conf.Url,
-		Speed:		conf.Speed,
-		DataBits:	conf.DataBits,
-		Parity:		conf.Parity,
-		StopBits:	conf.StopBits,
-		Timeout:	conf.Timeout,
-	})
+	// open at least one link
+	for i := uint(0); i == 0 || i < conf.Connections; i++ {
+		link, err	= newModbusLink(conf)
+		if err != nil {
+			return
+		}
 
-	if err != nil {
-		return
+		p.links		= append(p.links, link)
+	}
+
+	// group targets by unit ID, keeping them in configuration order
+	for _, target := range conf.Targets {
+		var ut	*unitTargets
+
+		for _, u := range p.units {
+			if u.unitId == target.UnitId {
+				ut	= u
+				break
+			}
+		}
+
+		if ut == nil {
+			ut	= &unitTargets{
+				unitId:	target.UnitId,
+			}
+			p.units	= append(p.units, ut)
+		}
+
+		ut.targets	= append(ut.targets, target)
 	}
 
 	go p.poll()
@@ -89,134 +174,167 @@ func NewPoller(conf *PollerConfiguration) (p *Poller, err error) {
 func (p *Poller) Points() (res []*Point) {
 	p.lock.Lock()
 	res		= p.points
-	p.points	= p.points[:0]
+	// allocate a new buffer rather than reusing the backing array of res,
+	// as links may be appending to it concurrently
+	p.points	= nil
 	p.lock.Unlock()
 
 	return
 }
 
+// Returns the status of each of the poller's modbus links.
+func (p *Poller) LinkStatus() (ls []LinkStatus) {
+	for _, link := range p.links {
+		ls	= append(ls, link.Status())
+	}
+
+	return
+}
+
+// Returns a snapshot of the poller's statistics.
+func (p *Poller) Stats() (ps PollerStats) {
+	ps		= p.stats.snapshot()
+	ps.Links	= p.LinkStatus()
+	ps.Units	= p.UnitStatus()
+
+	return
+}
+
+// Returns the circuit breaker status of each unit polled so far.
+func (p *Poller) UnitStatus() (us []UnitStatus) {
+	us	= p.breaker.status()
+
+	return
+}
+
 // Reads, decodes and transforms target values every conf.PollInterval.
-// The modbus link (either TCP or RTU) is reconnected automaticaly whenever an
-// unrecoverable i/o error is encountered (i.e. if the error is neither a timeout nor
-// a modbus error).
+// Targets are grouped by unit ID and groups are spread over all links of the
+// poller, so that units can be polled in parallel (e.g. behind a TCP-to-RTU
+// gateway). Units failing consistently are skipped by the circuit breaker
+// rather than stalling every cycle on timeouts, and only probed with their
+// first target every conf.UnitRetryInterval until they answer again.
+// Modbus links (either TCP or RTU) are reopened with a configurable backoff
+// whenever an unrecoverable i/o error is encountered (i.e. if the error is neither
+// a timeout nor a modbus error) or after too many consecutive timeouts.
 // Values read are stored as Point objects in an internal slice and can be collected
 // using the Points() method above.
 func (p *Poller) poll() {
-	var ticker		*time.Ticker
-	var err			error
-	var mcOpen		bool
-	var failedAttempts	uint
-	var value		interface{}
-	var u16			uint16
-	var u32			uint32
-	var f64			float64
+	var ticker	*time.Ticker
 
 	ticker	= time.NewTicker(p.conf.PollInterval)
 
 	for {
 		<-ticker.C
 
-		if !mcOpen {
-			err = p.mc.Open()
-			if err != nil {
-				fmt.Printf("failed to open modbus link %s: %v\n",
-					   p.conf.Url, err)
+		p.pollCycle()
+	}
 
-				// sleep for a capped exponential time to avoid hammering the
-				// network/serial line with retries
-				if failedAttempts < 5 {
-					failedAttempts++
-				}
-				time.Sleep(time.Duration(failedAttempts * 5) * time.Second)
+	return
+}
 
-				continue
-			}
-			failedAttempts	= 0
-			mcOpen		= true
-			fmt.Printf("modbus link %s open\n", p.conf.Url)
-		}
+// Runs a single poll cycle, returning once all links are done.
+func (p *Poller) pollCycle() {
+	var queue	chan *unitTargets
+	var wg		sync.WaitGroup
+	var start	time.Time
+	var duration	time.Duration
 
-		for _, target := range p.conf.Targets {
+	start	= time.Now()
 
-			// set the modbus unit ID
-			p.mc.SetUnitId(target.UnitId)
+	// queue all units which are not being skipped by the circuit breaker
+	queue	= make(chan *unitTargets, len(p.units))
+	for _, ut := range p.units {
+		if p.breaker.allow(ut.unitId) {
+			queue <- ut
+		}
+	}
+	close(queue)
+
+	// have each link consume units from the queue until it is empty
+	for _, link := range p.links {
+		wg.Add(1)
+		go func(link *modbusLink) {
+			p.pollUnits(link, queue)
+			wg.Done()
+		}(link)
+	}
 
-			switch target.ValueType {
-			case UINT16, INT16:
-				u16, err   = p.mc.ReadRegister(target.RegAddr, target.MbType)
+	wg.Wait()
 
-				// decode as signed if required
-				if target.ValueType == INT16 {
-					value	= int16(u16)
-				} else {
-					value	= u16
-				}
+	// units left in the queue could not be polled as all links
+	// went down
+	for ut := range queue {
+		p.skipTargets(ut.unitId, ut.targets)
+	}
 
-			case UINT32, INT32:
-				u32, err   = p.mc.ReadUint32(target.RegAddr, target.MbType)
+	// keep track of cycle durations. Note that the ticker drops ticks
+	// when cycles overrun the poll interval.
+	duration	= time.Since(start)
+	if p.stats.recordCycle(duration, p.conf.PollInterval) {
+		fmt.Printf("%s: poll cycle took %v, longer than the poll " +
+			   "interval (%v)\n",
+			   p.conf.Name, duration.Round(time.Millisecond),
+			   p.conf.PollInterval)
+	}
 
-				// decode as signed if required
-				if target.ValueType == INT32 {
-					value	= int32(u32)
-				} else {
-					value	= u32
-				}
+	return
+}
 
-			case FLOAT32:
-				value, err = p.mc.ReadFloat32(target.RegAddr, target.MbType)
+// Polls units from the queue over link until either the queue is drained
+// or the link goes down, leaving remaining units to other links.
+func (p *Poller) pollUnits(link *modbusLink, queue chan *unitTargets) {
+	var err		error
+	var value	interface{}
+	var ut		*unitTargets
+	var ok		bool
+	var tripped	bool
+	var start	time.Time
 
-			default:
-				fmt.Printf("unsupported register type '%v'\n", target.ValueType)
-			}
+	for {
+		// only grab units from the queue if the link is usable
+		if !link.open() {
+			return
+		}
+
+		ut, ok	= <-queue
+		if !ok {
+			return
+		}
+		p.resumeTargets(ut.unitId)
 
+		for idx, target := range ut.targets {
+			start		= time.Now()
+			value, err	= readTarget(link.mc, target)
+			p.stats.recordRequest(target, time.Since(start), err)
 			if err != nil {
 				fmt.Printf("failed to read target '%s': %v\n",
 				           target.Label, err)
 
-				// if the error is most likely not recoverable,
-				// close the modbus link to force a reconnect
-				if !isRecoverableError(err) {
-					p.mc.Close()
-					mcOpen	= false
-					break
-				}
-
-				continue
-			}
-
-			// apply transforms, if any
-			// note: any use of Offset, ScaleFactor or DecimalPlaces
-			// converts the value to float64
-			if target.ScaleFactor != 0 ||
-			   target.Offset != 0 ||
-			   target.DecimalPlaces != 0 {
-
-				// type conversion
-				switch value.(type) {
-				case uint16:	f64	= float64(value.(uint16))
-				case int16:	f64	= float64(value.(int16))
-				case int32:	f64	= float64(value.(int32))
-				case uint32:	f64	= float64(value.(uint32))
-				case float32:	f64	= float64(value.(float32))
-				}
-
-				// apply the scale factor
-				if target.ScaleFactor != 0 {
-					f64	*= target.ScaleFactor
+				// modbus exceptions come from the unit itself, which
+				// is then obviously responding
+				tripped	= false
+				if isUnitFailure(err) {
+					tripped	= p.breaker.failure(ut.unitId)
+				} else if isModbusException(err) {
+					p.breaker.success(ut.unitId)
 				}
 
-				// apply the offset
-				if target.Offset != 0 {
-					f64	+= target.Offset
+				// stop polling over this link if it had to be closed,
+				// giving up on the rest of the unit for this cycle
+				if link.reportError(err) {
+					p.skipTargets(ut.unitId, ut.targets[idx + 1:])
+					return
 				}
 
-				// round to target.DecimalPlaces decimal places
-				if target.DecimalPlaces != 0 {
-					f64	= round(f64, target.DecimalPlaces)
+				// skip the rest of the unit if the breaker tripped
+				if tripped {
+					break
 				}
 
-				value	= f64
+				continue
 			}
+			link.reportSuccess()
+			p.breaker.success(ut.unitId)
 
 			p.lock.Lock()
 			// turn the value into a Point object and add it to the poller's
@@ -226,6 +344,8 @@ func (p *Poller) poll() {
 					Timestamp:	time.Now().UTC(),
 					Label:		target.Label,
 					Value:		value,
+					Tags:		target.Tags,
+					Counter:	target.Counter,
 				})
 			p.lock.Unlock()
 		}
@@ -234,6 +354,173 @@ func (p *Poller) poll() {
 	return
 }
 
+// Counts targets left unread for the cycle because their link went down.
+// Skips are only logged when a unit starts being skipped, rather than on
+// every cycle while links are in backoff.
+func (p *Poller) skipTargets(unitId uint8, targets []*Target) {
+	var labels	[]string
+	var logged	bool
+
+	if len(targets) == 0 {
+		return
+	}
+
+	p.stats.recordSkipped(len(targets))
+
+	p.lock.Lock()
+	logged			= p.skipping[unitId]
+	p.skipping[unitId]	= true
+	p.lock.Unlock()
+
+	if logged {
+		return
+	}
+
+	for _, target := range targets {
+		labels	= append(labels, target.Label)
+	}
+
+	fmt.Printf("%s: link down, skipping target(s) of unit %v until it can be " +
+		   "polled again (%v this cycle: %s)\n",
+		   p.conf.Name, unitId, len(targets), strings.Join(labels, ", "))
+
+	return
+}
+
+// Marks a unit as polled again after its targets were skipped.
+func (p *Poller) resumeTargets(unitId uint8) {
+	var skipped	bool
+
+	p.lock.Lock()
+	skipped	= p.skipping[unitId]
+	delete(p.skipping, unitId)
+	p.lock.Unlock()
+
+	if skipped {
+		fmt.Printf("%s: polling unit %v again\n", p.conf.Name, unitId)
+	}
+
+	return
+}
+
+// Reads and decodes a target value, then applies transforms, if any.
+func readTarget(mc *modbus.ModbusClient, target *Target) (value interface{}, err error) {
+	var u16			uint16
+	var u32			uint32
+	var f64			float64
+
+	// set the modbus unit ID
+	mc.SetUnitId(target.UnitId)
+
+	switch target.ValueType {
+	case UINT16, INT16:
+		u16, err   = mc.ReadRegister(target.RegAddr, target.MbType)
+
+		// decode as signed if required
+		if target.ValueType == INT16 {
+			value	= int16(u16)
+		} else {
+			value	= u16
+		}
+
+	case UINT32, INT32:
+		u32, err   = mc.ReadUint32(target.RegAddr, target.MbType)
+
+		// decode as signed if required
+		if target.ValueType == INT32 {
+			value	= int32(u32)
+		} else {
+			value	= u32
+		}
+
+	case FLOAT32:
+		value, err = mc.ReadFloat32(target.RegAddr, target.MbType)
+
+	default:
+		err	= errUnsupportedValueType
+	}
+
+	if err != nil {
+		return
+	}
+
+	// apply transforms, if any
+	// note: any use of Offset, ScaleFactor or DecimalPlaces
+	// converts the value to float64
+	if target.ScaleFactor != 0 ||
+	   target.Offset != 0 ||
+	   target.DecimalPlaces != 0 {
+
+		// type conversion
+		switch value.(type) {
+		case uint16:	f64	= float64(value.(uint16))
+		case int16:	f64	= float64(value.(int16))
+		case int32:	f64	= float64(value.(int32))
+		case uint32:	f64	= float64(value.(uint32))
+		case float32:	f64	= float64(value.(float32))
+		}
+
+		// apply the scale factor
+		if target.ScaleFactor != 0 {
+			f64	*= target.ScaleFactor
+		}
+
+		// apply the offset
+		if target.Offset != 0 {
+			f64	+= target.Offset
+		}
+
+		// round to target.DecimalPlaces decimal places
+		if target.DecimalPlaces != 0 {
+			f64	= round(f64, target.DecimalPlaces)
+		}
+
+		value	= f64
+	}
+
+	value	= storeAs(value, target.StoreAs)
+
+	return
+}
+
+// Converts a value according to a storage policy, so that sinks with typed
+// storage (e.g. influxdb) always see the same type for a given target.
+// Values which cannot be represented as integers (NaN, infinity) are left
+// untouched.
+func storeAs(value interface{}, policy uint) (res interface{}) {
+	var f64	float64
+
+	res	= value
+
+	switch policy {
+	case STORE_FLOAT:
+		switch v := value.(type) {
+		case uint16:	res	= float64(v)
+		case int16:	res	= float64(v)
+		case uint32:	res	= float64(v)
+		case int32:	res	= float64(v)
+		case float32:	res	= float64(v)
+		}
+
+	case STORE_INTEGER:
+		switch v := value.(type) {
+		case float32:	f64	= float64(v)
+		case float64:	f64	= v
+		default:
+			return
+		}
+
+		if math.IsNaN(f64) || math.IsInf(f64, 0) ||
+		   f64 > math.MaxInt64 || f64 < math.MinInt64 {
+			return
+		}
+
+		res	= int64(math.Round(f64))
+	}
+
+	return
+}
+
 // Rounds a value to the specified number of decimal places.
 func round(val float64, places uint) (res float64) {
 	var shift	float64 = math.Pow10(int(places))
@@ -255,12 +542,49 @@ func isRecoverableError(err error) (yes bool) {
 	   err == modbus.ErrServerDeviceFailure ||
 	   err == modbus.ErrMemoryParityError ||
 	   err == modbus.ErrServerDeviceBusy ||
+	   err == modbus.ErrAcknowledge ||
 	   err == modbus.ErrGWPathUnavailable ||
 	   err == modbus.ErrGWTargetFailedToRespond ||
 	   err == modbus.ErrRequestTimedOut ||
+	   err == errUnsupportedValueType ||
 	   os.IsTimeout(err) {
 		   yes = true
 	   }
 
 	return
 }
+
+// Returns true if the error is an exception response sent by the unit.
+func isModbusException(err error) (yes bool) {
+	if err == modbus.ErrIllegalFunction ||
+	   err == modbus.ErrIllegalDataAddress ||
+	   err == modbus.ErrIllegalDataValue ||
+	   err == modbus.ErrServerDeviceFailure ||
+	   err == modbus.ErrAcknowledge ||
+	   err == modbus.ErrServerDeviceBusy ||
+	   err == modbus.ErrMemoryParityError {
+		yes = true
+	}
+
+	return
+}
+
+// Returns true if the error indicates that the target unit is not responding.
+func isUnitFailure(err error) (yes bool) {
+	if isTimeoutError(err) ||
+	   err == modbus.ErrGWPathUnavailable ||
+	   err == modbus.ErrGWTargetFailedToRespond {
+		yes = true
+	}
+
+	return
+}
+
+// Returns true if the error is a request timeout.
+func isTimeoutError(err error) (yes bool) {
+	if err == modbus.ErrRequestTimedOut || os.IsTimeout(err) {
+		yes = true
+	}
+
+	return
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"fmt"
 	"math"
+	"net"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/simonvetter/modbus"
 )
 
 func TestPollerRound(t *testing.T) {
@@ -40,3 +46,287 @@ func TestPollerRound(t *testing.T) {
 
 	return
 }
+
+func TestPollerStoreAs(t *testing.T) {
+	var res	interface{}
+
+	for _, tc := range []struct {
+		value		interface{}
+		policy		uint
+		expected	interface{}
+	}{
+		{ uint16(12),		STORE_AUTO,	uint16(12) },
+		{ float64(1.5),		STORE_AUTO,	float64(1.5) },
+		{ uint16(12),		STORE_FLOAT,	float64(12) },
+		{ int32(-7),		STORE_FLOAT,	float64(-7) },
+		{ float32(2.5),		STORE_FLOAT,	float64(2.5) },
+		{ float64(1.5),		STORE_INTEGER,	int64(2) },
+		{ float32(-2.4),	STORE_INTEGER,	int64(-2) },
+		{ int16(-3),		STORE_INTEGER,	int16(-3) },
+		{ math.Inf(1),		STORE_INTEGER,	math.Inf(1) },
+	} {
+		res	= storeAs(tc.value, tc.policy)
+		if res != tc.expected {
+			t.Errorf("storeAs(%T(%v), %v): expected %T(%v), got: %T(%v)",
+				 tc.value, tc.value, tc.policy, tc.expected, tc.expected,
+				 res, res)
+		}
+	}
+
+	// NaN values should be left untouched
+	res	= storeAs(math.NaN(), STORE_INTEGER)
+	if f64, ok := res.(float64); !ok || !math.IsNaN(f64) {
+		t.Errorf("expected NaN, got: %T(%v)", res, res)
+	}
+
+	return
+}
+
+func TestPollerUnitGrouping(t *testing.T) {
+	var err	error
+	var p	*Poller
+
+	p, err	= NewPoller(&PollerConfiguration{
+		Url:			"tcp://localhost:1",
+		PollInterval:		time.Hour,
+		Timeout:		100 * time.Millisecond,
+		Connections:		3,
+		Targets:		[]*Target{
+			{ UnitId: 2, Label: "unit2.reg0", ValueType: UINT16 },
+			{ UnitId: 1, Label: "unit1.reg0", ValueType: UINT16 },
+			{ UnitId: 2, Label: "unit2.reg1", ValueType: UINT16 },
+			{ UnitId: 3, Label: "unit3.reg0", ValueType: UINT16 },
+			{ UnitId: 1, Label: "unit1.reg1", ValueType: UINT16 },
+		},
+	})
+	if err != nil {
+		t.Errorf("NewPoller() should have succeeded, got: %v", err)
+	}
+
+	if len(p.links) != 3 {
+		t.Errorf("expected 3 links, got: %v", len(p.links))
+	}
+
+	if len(p.LinkStatus()) != 3 {
+		t.Errorf("expected 3 link statuses, got: %v", len(p.LinkStatus()))
+	}
+
+	if len(p.units) != 3 {
+		t.Fatalf("expected 3 units, got: %v", len(p.units))
+	}
+
+	for idx, expected := range [][]string{
+		{ "unit2.reg0", "unit2.reg1" },
+		{ "unit1.reg0", "unit1.reg1" },
+		{ "unit3.reg0" },
+	} {
+		if len(p.units[idx].targets) != len(expected) {
+			t.Errorf("unit #%v: expected %v targets, got: %v",
+				 idx, len(expected), len(p.units[idx].targets))
+			continue
+		}
+
+		for i, label := range expected {
+			if p.units[idx].targets[i].Label != label {
+				t.Errorf("unit #%v: expected target '%s' at index %v, got: '%s'",
+					 idx, label, i, p.units[idx].targets[i].Label)
+			}
+		}
+	}
+
+	// targets left unread as their link went down should be counted
+	p.skipTargets(p.units[0].unitId, p.units[0].targets)
+	p.skipTargets(p.units[2].unitId, nil)
+	if p.Stats().SkippedTargets != 2 {
+		t.Errorf("expected 2 skipped targets, got: %v", p.Stats().SkippedTargets)
+	}
+
+	// skips should be logged once, until the unit is polled again
+	p.skipTargets(p.units[0].unitId, p.units[0].targets)
+	if p.Stats().SkippedTargets != 4 || !p.skipping[p.units[0].unitId] {
+		t.Errorf("expected 4 skipped targets and unit %v marked as skipped",
+			 p.units[0].unitId)
+	}
+
+	p.resumeTargets(p.units[0].unitId)
+	if p.skipping[p.units[0].unitId] {
+		t.Errorf("unit %v should no longer be marked as skipped", p.units[0].unitId)
+	}
+
+	return
+}
+
+// Modbus request handler serving holding registers of any unit, each
+// holding unitId * 100 + its address. Reads are delayed to let concurrent
+// requests overlap.
+type pollerTestHandler struct {
+	lock		sync.Mutex
+	delay		time.Duration
+	clients		map[string]bool	// client addresses seen
+	inFlight	int
+	maxInFlight	int
+}
+
+func (th *pollerTestHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
+	err	= modbus.ErrIllegalFunction
+
+	return
+}
+
+func (th *pollerTestHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
+	err	= modbus.ErrIllegalFunction
+
+	return
+}
+
+func (th *pollerTestHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	err	= modbus.ErrIllegalFunction
+
+	return
+}
+
+func (th *pollerTestHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
+	th.lock.Lock()
+	th.clients[req.ClientAddr]	= true
+	th.inFlight++
+	if th.inFlight > th.maxInFlight {
+		th.maxInFlight	= th.inFlight
+	}
+	th.lock.Unlock()
+
+	time.Sleep(th.delay)
+
+	for i := uint16(0); i < req.Quantity; i++ {
+		res	= append(res, uint16(req.UnitId) * 100 + req.Addr + i)
+	}
+
+	th.lock.Lock()
+	th.inFlight--
+	th.lock.Unlock()
+
+	return
+}
+
+func TestPollerParallelUnits(t *testing.T) {
+	var err		error
+	var l		net.Listener
+	var url		string
+	var th		*pollerTestHandler
+	var server	*modbus.ModbusServer
+	var p		*Poller
+	var values	map[string]interface{}
+
+	// grab a free port for the server
+	l, err	= net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	url	= fmt.Sprintf("tcp://%s", l.Addr().String())
+	l.Close()
+
+	th	= &pollerTestHandler{
+		delay:		50 * time.Millisecond,
+		clients:	make(map[string]bool),
+	}
+
+	server, err	= modbus.NewServer(&modbus.ServerConfiguration{
+		URL:		url,
+		Timeout:	10 * time.Second,
+		MaxClients:	4,
+	}, th)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	err	= server.Start()
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	p, err	= NewPoller(&PollerConfiguration{
+		Name:			"parallel",
+		Url:			url,
+		PollInterval:		time.Hour,
+		Timeout:		time.Second,
+		Connections:		2,
+		Targets:		[]*Target{
+			{ UnitId: 1, Label: "unit1.reg0", ValueType: UINT16,
+			  MbType: modbus.HOLDING_REGISTER, RegAddr: 0 },
+			{ UnitId: 2, Label: "unit2.reg0", ValueType: UINT16,
+			  MbType: modbus.HOLDING_REGISTER, RegAddr: 0 },
+			{ UnitId: 3, Label: "unit3.reg5", ValueType: UINT16,
+			  MbType: modbus.HOLDING_REGISTER, RegAddr: 5 },
+			{ UnitId: 4, Label: "unit4.reg0", ValueType: UINT16,
+			  MbType: modbus.HOLDING_REGISTER, RegAddr: 0 },
+			{ UnitId: 1, Label: "unit1.reg1", ValueType: UINT16,
+			  MbType: modbus.HOLDING_REGISTER, RegAddr: 1 },
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewPoller() should have succeeded, got: %v", err)
+	}
+
+	// run a single cycle rather than waiting for the poll interval
+	p.pollCycle()
+
+	values	= make(map[string]interface{})
+	for _, point := range p.Points() {
+		values[point.Label]	= point.Value
+	}
+
+	for label, expected := range map[string]uint16{
+		"unit1.reg0": 100, "unit1.reg1": 101, "unit2.reg0": 200,
+		"unit3.reg5": 305, "unit4.reg0": 400,
+	} {
+		if values[label] != expected {
+			t.Errorf("%s: expected %v, got: %v", label, expected, values[label])
+		}
+	}
+
+	// units should have been polled concurrently over both connections
+	th.lock.Lock()
+	if len(th.clients) != 2 {
+		t.Errorf("expected 2 client connections, saw: %v", len(th.clients))
+	}
+	if th.maxInFlight != 2 {
+		t.Errorf("expected 2 concurrent requests, saw: %v", th.maxInFlight)
+	}
+	th.lock.Unlock()
+
+	return
+}
+
+func TestPollerErrorClasses(t *testing.T) {
+	for _, tc := range []struct {
+		err		error
+		exception	bool
+		unitFailure	bool
+	}{
+		{ modbus.ErrIllegalDataAddress,		true,	false },
+		{ modbus.ErrServerDeviceBusy,		true,	false },
+		{ modbus.ErrAcknowledge,		true,	false },
+		{ modbus.ErrRequestTimedOut,		false,	true },
+		{ modbus.ErrGWTargetFailedToRespond,	false,	true },
+		// local decoding errors say nothing about the unit
+		{ errUnsupportedValueType,		false,	false },
+	} {
+		if isModbusException(tc.err) != tc.exception {
+			t.Errorf("%v: expected isModbusException() to return %v",
+				 tc.err, tc.exception)
+		}
+
+		// exception responses should never tear down the link shared
+		// with other units
+		if tc.exception && !isRecoverableError(tc.err) {
+			t.Errorf("%v: expected isRecoverableError() to return true", tc.err)
+		}
+
+		if isUnitFailure(tc.err) != tc.unitFailure {
+			t.Errorf("%v: expected isUnitFailure() to return %v",
+				 tc.err, tc.unitFailure)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type PrometheusSinkConfiguration struct {
+	ListenAddress	string		// address to serve metrics on (e.g. :9273)
+	Path		string		// HTTP path of the metrics endpoint
+					// (defaults to /metrics)
+	Rules		[]*LabelRule	// rules mapping point labels to metric names
+					// and labels. Labels matching no rule are
+					// exposed as is, with dots turned into underscores.
+	StaleAge	time.Duration	// series not updated for longer than this
+					// are dropped (defaults to 5 minutes)
+}
+
+// Prometheus sink object.
+type PrometheusSink struct {
+	conf		PrometheusSinkConfiguration
+	lock		sync.Mutex
+	series		map[string]*promSeries
+	listener	net.Listener
+}
+
+// Last known value of a series.
+type promSeries struct {
+	name		string
+	labels		string		// serialized label set, e.g. {room="kitchen"}
+	value		float64
+	timestamp	time.Time
+}
+
+// Returns a new prometheus sink and starts serving metrics.
+func NewPrometheusSink(conf *PrometheusSinkConfiguration) (ps *PrometheusSink, err error) {
+	var mux		*http.ServeMux
+
+	ps = &PrometheusSink{
+		conf:	*conf,
+		series:	make(map[string]*promSeries),
+	}
+
+	if ps.conf.ListenAddress == "" {
+		err	= errors.New("missing listen address")
+		return
+	}
+
+	if ps.conf.Path == "" {
+		ps.conf.Path		= "/metrics"
+	}
+
+	if ps.conf.StaleAge == 0 {
+		ps.conf.StaleAge	= 5 * time.Minute
+	}
+
+	ps.listener, err	= net.Listen("tcp", ps.conf.ListenAddress)
+	if err != nil {
+		return
+	}
+
+	mux	= http.NewServeMux()
+	mux.Handle(ps.conf.Path, ps)
+
+	go ps.serve(mux)
+
+	return
+}
+
+// Serves HTTP requests until the listener is closed.
+func (ps *PrometheusSink) serve(handler http.Handler) {
+	var err	error
+
+	err	= http.Serve(ps.listener, handler)
+	fmt.Printf("prometheus sink: stopped serving on %s: %v\n",
+		   ps.conf.ListenAddress, err)
+
+	return
+}
+
+// Records the latest value of each point. Non-numeric points are rejected.
+func (ps *PrometheusSink) Save(points []*Point) (acceptedCount uint) {
+	var f64		float64
+	var ok		bool
+	var s		*promSeries
+
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	for _, p := range points {
+		if p == nil {
+			continue
+		}
+
+		f64, ok	= p.Float64()
+		if !ok {
+			continue
+		}
+
+		s	= ps.series[p.Label]
+		if s == nil {
+			s			= &promSeries{}
+			s.name, s.labels	= ps.mapLabel(p.Label)
+			ps.series[p.Label]	= s
+		}
+
+		// ignore out of order points
+		if p.Timestamp.Before(s.timestamp) {
+			continue
+		}
+
+		s.value		= f64
+		s.timestamp	= p.Timestamp
+		acceptedCount++
+	}
+
+	return
+}
+
+// Serves metrics in the prometheus text exposition format.
+func (ps *PrometheusSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf		bytes.Buffer
+
+	ps.serialize(&buf, time.Now())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buf.WriteTo(w)
+
+	return
+}
+
+// Drops stale series and writes all remaining ones to buf, grouped by
+// metric name.
+func (ps *PrometheusSink) serialize(buf *bytes.Buffer, now time.Time) {
+	var series	[]*promSeries
+	var unique	map[string]*promSeries
+	var lastName	string
+
+	// several point labels may map to the same series, which prometheus
+	// would reject as duplicates: keep the newest sample of each series
+	unique	= make(map[string]*promSeries)
+
+	ps.lock.Lock()
+	for label, s := range ps.series {
+		if now.Sub(s.timestamp) > ps.conf.StaleAge {
+			delete(ps.series, label)
+			continue
+		}
+
+		if prev, found := unique[s.name + s.labels]; found &&
+		   !s.timestamp.After(prev.timestamp) {
+			continue
+		}
+
+		unique[s.name + s.labels]	= &promSeries{
+			name:		s.name,
+			labels:		s.labels,
+			value:		s.value,
+			timestamp:	s.timestamp,
+		}
+	}
+	ps.lock.Unlock()
+
+	for _, s := range unique {
+		series	= append(series, s)
+	}
+
+	sort.Slice(series, func(i int, j int) bool {
+		if series[i].name != series[j].name {
+			return series[i].name < series[j].name
+		}
+
+		return series[i].labels < series[j].labels
+	})
+
+	for _, s := range series {
+		if s.name != lastName {
+			fmt.Fprintf(buf, "# TYPE %s gauge\n", s.name)
+			lastName	= s.name
+		}
+
+		fmt.Fprintf(buf, "%s%s %s\n", s.name, s.labels, promFormatValue(s.value))
+	}
+
+	return
+}
+
+// Maps a point label to a sanitized metric name and serialized label set.
+func (ps *PrometheusSink) mapLabel(label string) (name string, labels string) {
+	var tags	map[string]string
+	var keys	[]string
+	var sb		strings.Builder
+
+	name, _, tags, _	= mapLabel(ps.conf.Rules, label)
+	name		= promSanitize(name, true)
+
+	if len(tags) == 0 {
+		return
+	}
+
+	for key := range tags {
+		keys	= append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sb.WriteString("{")
+	for idx, key := range keys {
+		if idx > 0 {
+			sb.WriteString(",")
+		}
+
+		sb.WriteString(promSanitize(key, false))
+		sb.WriteString("=\"")
+		sb.WriteString(strings.NewReplacer(
+			"\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(tags[key]))
+		sb.WriteString("\"")
+	}
+	sb.WriteString("}")
+	labels	= sb.String()
+
+	return
+}
+
+// Turns s into a valid metric (colons allowed) or label name, replacing
+// invalid characters by underscores.
+func promSanitize(s string, allowColons bool) (res string) {
+	var sb	strings.Builder
+
+	for idx, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+			sb.WriteRune(c)
+
+		case c >= '0' && c <= '9':
+			// names may not start with a digit
+			if idx == 0 {
+				sb.WriteRune('_')
+			}
+			sb.WriteRune(c)
+
+		case c == ':' && allowColons:
+			sb.WriteRune(c)
+
+		default:
+			sb.WriteRune('_')
+		}
+	}
+
+	res	= sb.String()
+	if res == "" {
+		res	= "_"
+	}
+
+	return
+}
+
+// Formats a sample value.
+func promFormatValue(f64 float64) (res string) {
+	switch {
+	case math.IsNaN(f64):		res = "NaN"
+	case math.IsInf(f64, 1):	res = "+Inf"
+	case math.IsInf(f64, -1):	res = "-Inf"
+	default:			res = strconv.FormatFloat(f64, 'g', -1, 64)
+	}
+
+	return
+}
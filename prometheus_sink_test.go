@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPrometheusSink(t *testing.T) {
+	var err		error
+	var ps		*PrometheusSink
+	var rules	[]*LabelRule
+	var accepted	uint
+	var now		time.Time
+	var buf		bytes.Buffer
+	var res		*http.Response
+	var body	[]byte
+
+	_, err	= NewPrometheusSink(&PrometheusSinkConfiguration{})
+	if err == nil {
+		t.Errorf("NewPrometheusSink() should have failed")
+	}
+
+	rules, err	= newLabelRules([]*labelRuleConf{
+		{
+			Match:	`^([^.]+)\.(sensor[0-9]+)\.([^.]+)$`,
+			Name:	"house_$3",
+			Tags:	map[string]string{
+				"room":		"$1",
+				"sensor":	"$2",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("newLabelRules() should have succeeded, got: %v", err)
+	}
+
+	ps, err	= NewPrometheusSink(&PrometheusSinkConfiguration{
+		ListenAddress:	"localhost:0",
+		Rules:		rules,
+		StaleAge:	time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewPrometheusSink() should have succeeded, got: %v", err)
+	}
+	defer ps.listener.Close()
+
+	now	= time.Now()
+
+	accepted	= ps.Save([]*Point{
+		{ Timestamp: now, Label: "living_room.sensor0.temperature_C", Value: float32(18.7) },
+		{ Timestamp: now, Label: "kitchen.sensor1.temperature_C", Value: int16(-3) },
+		{ Timestamp: now, Label: "kitchen.sensor1.humidity", Value: uint32(60) },
+		{ Timestamp: now, Label: "plc.system-time", Value: uint32(1234) },
+		{ Timestamp: now, Label: "plc.running", Value: true },
+		{ Timestamp: now, Label: "plc.name", Value: "plc0" },
+		{ Timestamp: now, Label: "3phase.nan", Value: math.NaN() },
+		{ Timestamp: now.Add(-2 * time.Minute), Label: "old.value", Value: 1 },
+		nil,
+	})
+	if accepted != 7 {
+		t.Errorf("expected 7 accepted points, saw: %v", accepted)
+	}
+
+	// newer values should replace older ones, out of order points are ignored
+	// and labels mapping to the same series should only yield the newest one
+	accepted	= ps.Save([]*Point{
+		{ Timestamp: now.Add(time.Second), Label: "kitchen.sensor1.humidity",
+		  Value: 61.5 },
+		{ Timestamp: now.Add(-time.Second), Label: "plc.running", Value: false },
+		{ Timestamp: now.Add(time.Second), Label: "plc.system_time", Value: uint32(1235) },
+	})
+	if accepted != 2 {
+		t.Errorf("expected 2 accepted points, saw: %v", accepted)
+	}
+
+	ps.serialize(&buf, now)
+	if buf.String() !=
+		"# TYPE _3phase_nan gauge\n" +
+		"_3phase_nan NaN\n" +
+		"# TYPE house_humidity gauge\n" +
+		"house_humidity{room=\"kitchen\",sensor=\"sensor1\"} 61.5\n" +
+		"# TYPE house_temperature_C gauge\n" +
+		"house_temperature_C{room=\"kitchen\",sensor=\"sensor1\"} -3\n" +
+		"house_temperature_C{room=\"living_room\",sensor=\"sensor0\"} 18.7\n" +
+		"# TYPE plc_running gauge\n" +
+		"plc_running 1\n" +
+		"# TYPE plc_system_time gauge\n" +
+		"plc_system_time 1235\n" {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+
+	// stale series should have been dropped
+	if len(ps.series) != 7 {
+		t.Errorf("expected 7 series, saw: %v", len(ps.series))
+	}
+
+	// scrape the metrics endpoint
+	res, err	= http.Get("http://" + ps.listener.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to scrape metrics: %v", err)
+	}
+	defer res.Body.Close()
+
+	body, err	= ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Errorf("failed to read response body: %v", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected a 200 status code, saw: %v", res.StatusCode)
+	}
+
+	if string(body) != buf.String() {
+		t.Errorf("unexpected scrape output:\n%s", body)
+	}
+
+	return
+}
@@ -0,0 +1,128 @@
+package main
+
+const (
+	OVERFLOW_DROP_NEWEST	uint	= 1
+	OVERFLOW_DROP_OLDEST	uint	= 2
+)
+
+// Fixed-size ring buffer of points, with O(1) push and pop operations.
+// Each point is given a sequence number when pushed, so that consumers can
+// release points they have processed even if some of them were evicted in
+// the meantime. Not thread-safe.
+type pointRing struct {
+	points		[]*Point
+	head		int		// index of the oldest point
+	count		int		// number of points in the buffer
+	headSeq		uint64		// sequence number of the oldest point
+}
+
+// Returns a new ring buffer holding up to capacity points.
+func newPointRing(capacity uint) (pr *pointRing) {
+	pr	= &pointRing{
+		points:	make([]*Point, capacity),
+	}
+
+	return
+}
+
+// Returns the number of points in the buffer.
+func (pr *pointRing) len() (count int) {
+	count	= pr.count
+
+	return
+}
+
+// Appends points to the buffer. When the buffer is full, either new points are
+// rejected (OVERFLOW_DROP_NEWEST) or the oldest points are evicted to make room
+// (OVERFLOW_DROP_OLDEST). Returns the number of points which were accepted and
+// the number of points which were evicted.
+func (pr *pointRing) push(points []*Point, policy uint) (accepted uint, evicted uint) {
+	var capacity	int
+	var tail	int
+	var n		int
+
+	capacity	= len(pr.points)
+	if capacity == 0 {
+		return
+	}
+
+	// only keep the last capacity points if that many are pushed at once
+	if policy == OVERFLOW_DROP_OLDEST && len(points) > capacity {
+		evicted	= uint(len(points) - capacity)
+		points	= points[len(points) - capacity:]
+	}
+
+	// make room for new points by evicting the oldest ones, if allowed
+	if policy == OVERFLOW_DROP_OLDEST && pr.count + len(points) > capacity {
+		evicted	+= uint(pr.count + len(points) - capacity)
+		pr.pop(uint(pr.count + len(points) - capacity))
+	}
+
+	if len(points) > capacity - pr.count {
+		points	= points[0:capacity - pr.count]
+	}
+
+	// copy points in at most two chunks, wrapping around the end of
+	// the buffer
+	for len(points) > 0 {
+		tail	= (pr.head + pr.count) % capacity
+		if tail < pr.head {
+			n	= copy(pr.points[tail:pr.head], points)
+		} else {
+			n	= copy(pr.points[tail:], points)
+		}
+
+		points		= points[n:]
+		pr.count	+= n
+		accepted	+= uint(n)
+	}
+
+	return
+}
+
+// Copies up to max of the oldest points to dst (reusing its storage) without
+// removing them, and returns the sequence number of the first one.
+func (pr *pointRing) peek(dst []*Point, max uint) (res []*Point, seq uint64) {
+	var count	int
+	var idx		int
+
+	count	= pr.count
+	if uint(count) > max {
+		count	= int(max)
+	}
+
+	res	= dst[:0]
+	if pr.head + count <= len(pr.points) {
+		res	= append(res, pr.points[pr.head:pr.head+count]...)
+	} else {
+		idx	= len(pr.points) - pr.head
+		res	= append(res, pr.points[pr.head:]...)
+		res	= append(res, pr.points[0:count-idx]...)
+	}
+	seq	= pr.headSeq
+
+	return
+}
+
+// Removes up to count of the oldest points.
+func (pr *pointRing) pop(count uint) {
+	for ; count > 0 && pr.count > 0; count-- {
+		// drop the reference so that the point can be garbage collected
+		pr.points[pr.head]	= nil
+		pr.head			= (pr.head + 1) % len(pr.points)
+		pr.count--
+		pr.headSeq++
+	}
+
+	return
+}
+
+// Removes all points with a sequence number lower than seq, i.e. points
+// which were returned by peek() and processed, unless evicted already.
+func (pr *pointRing) release(seq uint64) {
+	if seq > pr.headSeq {
+		pr.pop(uint(seq - pr.headSeq))
+	}
+
+	return
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPointRing(t *testing.T) {
+	var pr		*pointRing
+	var points	[]*Point
+	var seq		uint64
+	var accepted	uint
+	var evicted	uint
+
+	pr	= newPointRing(4)
+
+	accepted, evicted	= pr.push(diskQueueTestPoints(0, 3), OVERFLOW_DROP_NEWEST)
+	if accepted != 3 || evicted != 0 || pr.len() != 3 {
+		t.Errorf("unexpected push() result: %v, %v, %v", accepted, evicted, pr.len())
+	}
+
+	// new points should be rejected once full
+	accepted, evicted	= pr.push(diskQueueTestPoints(3, 3), OVERFLOW_DROP_NEWEST)
+	if accepted != 1 || evicted != 0 || pr.len() != 4 {
+		t.Errorf("unexpected push() result: %v, %v, %v", accepted, evicted, pr.len())
+	}
+
+	points, seq	= pr.peek(nil, 2)
+	if len(points) != 2 || seq != 0 || points[0].Label != "sensor.p0" ||
+	   points[1].Label != "sensor.p1" {
+		t.Errorf("unexpected peek() result: %v, %v", points, seq)
+	}
+
+	// evict the two oldest points while the first two are being processed
+	accepted, evicted	= pr.push(diskQueueTestPoints(4, 2), OVERFLOW_DROP_OLDEST)
+	if accepted != 2 || evicted != 2 || pr.len() != 4 {
+		t.Errorf("unexpected push() result: %v, %v, %v", accepted, evicted, pr.len())
+	}
+
+	// releasing already evicted points should be a no-op
+	pr.release(seq + 2)
+	if pr.len() != 4 {
+		t.Errorf("expected 4 points, saw: %v", pr.len())
+	}
+
+	points, seq	= pr.peek(points, 10)
+	if len(points) != 4 || seq != 2 || points[0].Label != "sensor.p2" ||
+	   points[3].Label != "sensor.p5" {
+		t.Errorf("unexpected peek() result: %v, %v", points, seq)
+	}
+
+	pr.release(seq + 3)
+	if pr.len() != 1 {
+		t.Errorf("expected 1 point, saw: %v", pr.len())
+	}
+
+	// pushing more points than the capacity should keep the last ones
+	accepted, evicted	= pr.push(diskQueueTestPoints(10, 6), OVERFLOW_DROP_OLDEST)
+	if accepted != 4 || evicted != 3 || pr.len() != 4 {
+		t.Errorf("unexpected push() result: %v, %v, %v", accepted, evicted, pr.len())
+	}
+
+	points, _	= pr.peek(points, 10)
+	if len(points) != 4 || points[0].Label != "sensor.p12" ||
+	   points[3].Label != "sensor.p15" {
+		t.Errorf("unexpected peek() result: %v", points)
+	}
+
+	pr.pop(10)
+	if pr.len() != 0 || pr.points[pr.head] != nil {
+		t.Errorf("expected an empty buffer, saw: %v points", pr.len())
+	}
+
+	// points should wrap around the end of the buffer
+	pr.push(diskQueueTestPoints(20, 3), OVERFLOW_DROP_NEWEST)
+	pr.pop(2)
+	accepted, _	= pr.push(diskQueueTestPoints(23, 4), OVERFLOW_DROP_NEWEST)
+	if accepted != 3 {
+		t.Errorf("3 points should have been accepted, saw: %v", accepted)
+	}
+
+	points, _	= pr.peek(points, 10)
+	for idx, p := range points {
+		if p.Label != fmt.Sprintf("sensor.p%d", 22 + idx) {
+			t.Errorf("unexpected point #%v: %v", idx, p.Label)
+		}
+	}
+	if len(points) != 4 {
+		t.Errorf("expected 4 points, saw: %v", len(points))
+	}
+
+	return
+}
+
+// Simulates sustained load on the ring buffer: the dispatcher pushes 100
+// points at a time while the writer pushes them out in batches of 1000.
+// Memory use should stay flat (0 allocs/op).
+func BenchmarkPointRing(b *testing.B) {
+	var pr		*pointRing
+	var batch	[]*Point
+	var seq		uint64
+	var points	[]*Point
+
+	pr	= newPointRing(100000)
+	points	= benchmarkPoints(100)
+	batch	= make([]*Point, 0, 1000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pr.push(points, OVERFLOW_DROP_NEWEST)
+
+		if pr.len() >= 1000 {
+			batch, seq	= pr.peek(batch, 1000)
+			pr.release(seq + uint64(len(batch)))
+		}
+	}
+
+	return
+}
+
+// Same as BenchmarkPointRing, with the former slice-based fifo, for reference.
+func BenchmarkSliceFifo(b *testing.B) {
+	var fifo	[]*Point
+	var points	[]*Point
+
+	fifo	= make([]*Point, 0)
+	points	= benchmarkPoints(100)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		fifo	= append(fifo, points...)
+
+		if len(fifo) >= 1000 {
+			fifo	= fifo[1000:]
+		}
+	}
+
+	return
+}
+
+func benchmarkPoints(count int) (points []*Point) {
+	for i := 0; i < count; i++ {
+		points	= append(points, &Point{
+			Timestamp:	time.Unix(1569150729, 0),
+			Label:		"sensor.value",
+			Value:		float64(i),
+		})
+	}
+
+	return
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	// pure-Go driver (no cgo), registered as "sqlite"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	SQLITE_QUALITY_GOOD	uint	= 0
+	SQLITE_QUALITY_INVALID	uint	= 1	// NaN, Inf or unsupported value type
+)
+
+type SQLiteSinkConfiguration struct {
+	Path		string		// path to the database file (created if needed)
+	Table		string		// table name (defaults to points)
+	BufferSize	uint		// max. number of points to buffer between
+					// transactions
+	OverflowPolicy	string		// what to do with new points when the buffer
+					// is full: "drop_newest" (default) rejects them,
+					// "drop_oldest" evicts the oldest buffered points
+	CommitInterval	time.Duration	// how often buffered points are written, each
+					// commit being a single transaction
+	Retention	time.Duration	// points older than this are deleted
+					// (disabled if 0)
+	PruneInterval	time.Duration	// how often to delete expired points
+}
+
+// SQLite sink object.
+type SQLiteSink struct {
+	conf		SQLiteSinkConfiguration
+	overflowPolicy	uint
+	fifo		*pointRing
+	lock		sync.Mutex
+	db		*sql.DB
+	insertQuery	string
+	pruneQuery	string
+	lastPrune	time.Time
+	rowCount	uint64
+}
+
+// Returns a new SQLite sink.
+func NewSQLiteSink(conf *SQLiteSinkConfiguration) (ss *SQLiteSink, err error) {
+	var table	string
+
+	ss = &SQLiteSink{
+		conf:	*conf,
+	}
+
+	if ss.conf.Path == "" {
+		err	= errors.New("missing database path")
+		return
+	}
+
+	if ss.conf.Table == "" {
+		ss.conf.Table		= "points"
+	}
+
+	switch ss.conf.OverflowPolicy {
+	case "drop_newest", "":
+		ss.overflowPolicy	= OVERFLOW_DROP_NEWEST
+	case "drop_oldest":
+		ss.overflowPolicy	= OVERFLOW_DROP_OLDEST
+	default:
+		err	= fmt.Errorf("unsupported overflow policy '%s'", ss.conf.OverflowPolicy)
+		return
+	}
+
+	// buffer 100k points by default
+	if ss.conf.BufferSize == 0 {
+		ss.conf.BufferSize	= 100000
+	}
+
+	// default to committing once every 10 seconds
+	if ss.conf.CommitInterval == 0 {
+		ss.conf.CommitInterval	= 10 * time.Second
+	}
+
+	// default to pruning expired points once an hour
+	if ss.conf.PruneInterval == 0 {
+		ss.conf.PruneInterval	= 1 * time.Hour
+	}
+
+	ss.fifo		= newPointRing(ss.conf.BufferSize)
+
+	table		= sqliteIdentifier(ss.conf.Table)
+	ss.insertQuery	= fmt.Sprintf(
+		"INSERT INTO %s (timestamp, label, value, value_text, quality) " +
+		"VALUES (?, ?, ?, ?, ?)", table)
+	ss.pruneQuery	= fmt.Sprintf("DELETE FROM %s WHERE timestamp < ?", table)
+
+	ss.db, err	= sql.Open("sqlite", ss.conf.Path)
+	if err != nil {
+		return
+	}
+
+	// use a single connection: sqlite serializes writes anyway, and pragmas
+	// apply to the connection they were issued on
+	ss.db.SetMaxOpenConns(1)
+
+	err	= ss.createSchema()
+	if err != nil {
+		ss.db.Close()
+		err	= fmt.Errorf("failed to initialize %s: %v", ss.conf.Path, err)
+		return
+	}
+
+	go ss.writer()
+
+	return
+}
+
+// Buffers points until the next commit. Depending on the overflow policy,
+// either new or old points are dropped when the buffer is full.
+func (ss *SQLiteSink) Save(points []*Point) (acceptedCount uint) {
+	var pointCount	uint
+	var evicted	uint
+
+	pointCount	= uint(len(points))
+	if pointCount == 0 {
+		return
+	}
+
+	ss.lock.Lock()
+	acceptedCount, evicted	= ss.fifo.push(points, ss.overflowPolicy)
+	ss.lock.Unlock()
+
+	if acceptedCount != pointCount {
+		fmt.Printf("sqlite sink: dropped %v points out of %v\n",
+			   pointCount - acceptedCount, pointCount)
+	}
+
+	if evicted > 0 {
+		fmt.Printf("sqlite sink: buffer full, dropped %v old points\n", evicted)
+	}
+
+	return
+}
+
+// Writer goroutine. Commits buffered points once every commit interval, or
+// sooner when the buffer fills up, and periodically prunes expired points.
+func (ss *SQLiteSink) writer() {
+	var ticker		*time.Ticker
+	var tickRate		time.Duration
+	var highWaterMark	int
+	var lastCommit		time.Time
+	var pending		int
+	var err			error
+
+	tickRate	= ss.conf.CommitInterval
+	if tickRate > 1 * time.Second {
+		tickRate	= 1 * time.Second
+	}
+
+	highWaterMark	= (int(ss.conf.BufferSize) * 80) / 100
+
+	ticker		= time.NewTicker(tickRate)
+
+	for {
+		<-ticker.C
+
+		if ss.conf.Retention > 0 && time.Since(ss.lastPrune) >= ss.conf.PruneInterval {
+			err	= ss.prune(time.Now())
+			if err != nil {
+				fmt.Printf("sqlite sink: failed to prune expired points: %v\n", err)
+			}
+			ss.lastPrune	= time.Now()
+		}
+
+		ss.lock.Lock()
+		pending	= ss.fifo.len()
+		ss.lock.Unlock()
+
+		if pending == 0 ||
+		   (time.Since(lastCommit) < ss.conf.CommitInterval && pending <= highWaterMark) {
+			continue
+		}
+
+		// points stay in the buffer (and are retried on the next tick) if
+		// the transaction fails
+		err	= ss.commit()
+		if err != nil {
+			fmt.Printf("sqlite sink: failed to write to %s: %v\n", ss.conf.Path, err)
+			continue
+		}
+
+		lastCommit	= time.Now()
+	}
+
+	return
+}
+
+// Writes all buffered points in a single transaction.
+func (ss *SQLiteSink) commit() (err error) {
+	var tx		*sql.Tx
+	var stmt	*sql.Stmt
+	var points	[]*Point
+	var seq		uint64
+	var value	interface{}
+	var text	interface{}
+	var quality	uint
+
+	ss.lock.Lock()
+	points, seq	= ss.fifo.peek(nil, uint(ss.fifo.len()))
+	ss.lock.Unlock()
+
+	tx, err	= ss.db.Begin()
+	if err != nil {
+		return
+	}
+
+	stmt, err	= tx.Prepare(ss.insertQuery)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	for _, p := range points {
+		// drop nil points
+		if p == nil {
+			continue
+		}
+
+		value, text, quality	= sqliteValue(p.Value)
+
+		_, err	= stmt.Exec(p.Timestamp.UnixNano() / 1e6, p.Label,
+				    value, text, quality)
+		if err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return
+		}
+	}
+	stmt.Close()
+
+	err	= tx.Commit()
+	if err != nil {
+		return
+	}
+
+	ss.lock.Lock()
+	ss.fifo.release(seq + uint64(len(points)))
+	ss.rowCount	+= uint64(len(points))
+	ss.lock.Unlock()
+
+	return
+}
+
+// Deletes points older than the retention period.
+func (ss *SQLiteSink) prune(now time.Time) (err error) {
+	var res		sql.Result
+	var count	int64
+
+	res, err	= ss.db.Exec(ss.pruneQuery,
+				     now.Add(-ss.conf.Retention).UnixNano() / 1e6)
+	if err != nil {
+		return
+	}
+
+	count, _	= res.RowsAffected()
+	if count > 0 {
+		fmt.Printf("sqlite sink: pruned %v expired points\n", count)
+	}
+
+	return
+}
+
+// Creates the points table and its indexes if they don't exist yet.
+// Timestamps are stored as milliseconds since the epoch. Numeric values
+// go to the value column, other values to the value_text column.
+func (ss *SQLiteSink) createSchema() (err error) {
+	var table	string
+
+	table	= sqliteIdentifier(ss.conf.Table)
+
+	for _, query := range []string{
+		// WAL lets readers query the database while points are written
+		"PRAGMA journal_mode=WAL",
+		"PRAGMA busy_timeout=5000",
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (" +
+			"timestamp INTEGER NOT NULL, " +
+			"label TEXT NOT NULL, " +
+			"value NUMERIC, " +
+			"value_text TEXT, " +
+			"quality INTEGER NOT NULL DEFAULT 0)", table),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (timestamp)",
+			sqliteIdentifier(ss.conf.Table + "_timestamp_idx"), table),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (label, timestamp)",
+			sqliteIdentifier(ss.conf.Table + "_label_timestamp_idx"), table),
+	} {
+		_, err	= ss.db.Exec(query)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Returns self-monitoring metrics.
+func (ss *SQLiteSink) StatsPoints(prefix string, now time.Time) (points []*Point) {
+	var fifoDepth	int
+	var rowCount	uint64
+
+	ss.lock.Lock()
+	fifoDepth	= ss.fifo.len()
+	rowCount	= ss.rowCount
+	ss.lock.Unlock()
+
+	points	= append(points,
+		&Point{
+			Timestamp:	now,
+			Label:		prefix + ".fifo_depth",
+			Value:		uint64(fifoDepth),
+		},
+		&Point{
+			Timestamp:	now,
+			Label:		prefix + ".rows_written",
+			Value:		rowCount,
+		})
+
+	return
+}
+
+// Returns the value and value_text columns and the quality of a point value.
+// Integers are kept as such (except for uint64 values which don't fit
+// in an int64), booleans are turned into 0 or 1.
+func sqliteValue(v interface{}) (value interface{}, text interface{}, quality uint) {
+	quality	= SQLITE_QUALITY_GOOD
+
+	switch v := v.(type) {
+	case float64:	value, text, quality = sqliteFloat(v)
+	case float32:	value, text, quality = sqliteFloat(float64(v))
+	case int:	value = int64(v)
+	case int8:	value = int64(v)
+	case int16:	value = int64(v)
+	case int32:	value = int64(v)
+	case int64:	value = v
+	case uint:	value = sqliteUint(uint64(v))
+	case uint8:	value = int64(v)
+	case uint16:	value = int64(v)
+	case uint32:	value = int64(v)
+	case uint64:	value = sqliteUint(v)
+	case bool:
+		value	= int64(0)
+		if v {
+			value	= int64(1)
+		}
+	case string:
+		text	= v
+	default:
+		text	= fmt.Sprintf("%v", v)
+		quality	= SQLITE_QUALITY_INVALID
+	}
+
+	return
+}
+
+// Returns v as the value column unless it is NaN or infinite, in which case
+// it goes to the value_text column and is flagged as invalid.
+func sqliteFloat(v float64) (value interface{}, text interface{}, quality uint) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		text	= fmt.Sprintf("%v", v)
+		quality	= SQLITE_QUALITY_INVALID
+	} else {
+		value	= v
+		quality	= SQLITE_QUALITY_GOOD
+	}
+
+	return
+}
+
+// Returns v as an int64 if it fits, as a float64 otherwise.
+func sqliteUint(v uint64) (value interface{}) {
+	if v > math.MaxInt64 {
+		value	= float64(v)
+	} else {
+		value	= int64(v)
+	}
+
+	return
+}
+
+// Quotes an SQL identifier.
+func sqliteIdentifier(name string) (quoted string) {
+	quoted	= `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+
+	return
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLiteSink(t *testing.T) {
+	var ss		*SQLiteSink
+	var dir		string
+	var err		error
+	var db		*sql.DB
+	var rows	*sql.Rows
+	var count	int
+	var ts		int64
+	var label	string
+	var value	sql.NullFloat64
+	var text	sql.NullString
+	var quality	uint
+	var fifoLen	int
+
+	dir, err	= ioutil.TempDir("", "datalogger-sqlite")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err	= NewSQLiteSink(&SQLiteSinkConfiguration{})
+	if err == nil {
+		t.Errorf("sink creation should have failed without a path")
+	}
+
+	ss, err	= NewSQLiteSink(&SQLiteSinkConfiguration{
+		Path:		filepath.Join(dir, "test.db"),
+		CommitInterval:	200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	ss.Save([]*Point{
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor0.temperature", Value: 18.5 },
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor0.humidity", Value: uint16(54) },
+		{ Timestamp: time.Unix(1569150730, 0), Label: "sensor1.status", Value: "ok" },
+		{ Timestamp: time.Unix(1569150730, 0), Label: "sensor1.alarm", Value: true },
+		{ Timestamp: time.Unix(1569150731, 0), Label: "sensor1.level", Value: math.NaN() },
+	})
+
+	// points should only be written once the commit interval has elapsed
+	time.Sleep(100 * time.Millisecond)
+
+	db, err	= sql.Open("sqlite", filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	err	= db.QueryRow("SELECT COUNT(*) FROM points").Scan(&count)
+	if err != nil || count != 0 {
+		t.Errorf("expected no rows yet, got: %v, %v", count, err)
+	}
+
+	time.Sleep(1200 * time.Millisecond)
+
+	ss.lock.Lock()
+	fifoLen	= ss.fifo.len()
+	ss.lock.Unlock()
+
+	if fifoLen != 0 {
+		t.Errorf("fifo should have been empty, got: %v", fifoLen)
+	}
+
+	rows, err	= db.Query("SELECT timestamp, label, value, value_text, quality " +
+				   "FROM points ORDER BY rowid")
+	if err != nil {
+		t.Fatalf("failed to query points: %v", err)
+	}
+	defer rows.Close()
+
+	count	= 0
+	for rows.Next() {
+		err	= rows.Scan(&ts, &label, &value, &text, &quality)
+		if err != nil {
+			t.Fatalf("failed to scan row: %v", err)
+		}
+
+		switch count {
+		case 0:
+			if ts != 1569150729000 || label != "sensor0.temperature" ||
+			   !value.Valid || value.Float64 != 18.5 || text.Valid ||
+			   quality != SQLITE_QUALITY_GOOD {
+				t.Errorf("unexpected row #0: %v %v %v %v %v", ts, label, value, text, quality)
+			}
+		case 1:
+			if label != "sensor0.humidity" || value.Float64 != 54 ||
+			   quality != SQLITE_QUALITY_GOOD {
+				t.Errorf("unexpected row #1: %v %v %v %v %v", ts, label, value, text, quality)
+			}
+		case 2:
+			if ts != 1569150730000 || value.Valid || text.String != "ok" ||
+			   quality != SQLITE_QUALITY_GOOD {
+				t.Errorf("unexpected row #2: %v %v %v %v %v", ts, label, value, text, quality)
+			}
+		case 3:
+			if value.Float64 != 1 || text.Valid {
+				t.Errorf("unexpected row #3: %v %v %v %v %v", ts, label, value, text, quality)
+			}
+		case 4:
+			if value.Valid || text.String != "NaN" || quality != SQLITE_QUALITY_INVALID {
+				t.Errorf("unexpected row #4: %v %v %v %v %v", ts, label, value, text, quality)
+			}
+		}
+		count++
+	}
+
+	if count != 5 {
+		t.Errorf("expected 5 rows, got: %v", count)
+	}
+
+	// the schema should be left untouched when reopening an existing database
+	_, err	= NewSQLiteSink(&SQLiteSinkConfiguration{
+		Path:		filepath.Join(dir, "test.db"),
+	})
+	if err != nil {
+		t.Errorf("sink creation should have succeeded, got: %v", err)
+	}
+
+	return
+}
+
+func TestSQLiteSinkRetention(t *testing.T) {
+	var ss		*SQLiteSink
+	var dir		string
+	var err		error
+	var count	int
+	var now		time.Time
+	var fifoLen	int
+
+	dir, err	= ioutil.TempDir("", "datalogger-sqlite")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the custom table name should be quoted properly
+	ss, err	= NewSQLiteSink(&SQLiteSinkConfiguration{
+		Path:		filepath.Join(dir, "test.db"),
+		Table:		"house \"readings\"",
+		BufferSize:	3,
+		OverflowPolicy:	"drop_oldest",
+		CommitInterval:	time.Hour,
+		Retention:	24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	now	= time.Now()
+	ss.Save([]*Point{
+		{ Timestamp: now.Add(-72 * time.Hour), Label: "p0", Value: 0 },
+		{ Timestamp: now.Add(-48 * time.Hour), Label: "p1", Value: 1 },
+		{ Timestamp: now.Add(-25 * time.Hour), Label: "p2", Value: 2 },
+		{ Timestamp: now.Add(-23 * time.Hour), Label: "p3", Value: 3 },
+	})
+
+	// the oldest point should have been evicted
+	ss.lock.Lock()
+	fifoLen	= ss.fifo.len()
+	ss.lock.Unlock()
+
+	if fifoLen != 3 {
+		t.Errorf("expected 3 buffered points, got: %v", fifoLen)
+	}
+
+	err	= ss.commit()
+	if err != nil {
+		t.Fatalf("commit() should have succeeded, got: %v", err)
+	}
+
+	err	= ss.db.QueryRow(`SELECT COUNT(*) FROM "house ""readings"""`).Scan(&count)
+	if err != nil || count != 3 {
+		t.Errorf("expected 3 rows, got: %v, %v", count, err)
+	}
+
+	err	= ss.prune(now)
+	if err != nil {
+		t.Errorf("prune() should have succeeded, got: %v", err)
+	}
+
+	err	= ss.db.QueryRow(`SELECT COUNT(*) FROM "house ""readings"""`).Scan(&count)
+	if err != nil || count != 1 {
+		t.Errorf("expected a single row after pruning, got: %v, %v", count, err)
+	}
+
+	_, err	= NewSQLiteSink(&SQLiteSinkConfiguration{
+		Path:		filepath.Join(dir, "test.db"),
+		OverflowPolicy:	"drop_everything",
+	})
+	if err == nil {
+		t.Errorf("sink creation should have failed with an unknown overflow policy")
+	}
+
+	return
+}
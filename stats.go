@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the request latency histogram buckets.
+var latencyBuckets	= []time.Duration{
+	1 * time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	1 * time.Second, 2 * time.Second, 5 * time.Second,
+}
+
+// Latency histogram object.
+type LatencyHistogram struct {
+	Bounds		[]time.Duration	// upper bound of each bucket
+	Counts		[]uint64	// number of samples in each bucket, plus
+					// a final overflow bucket
+	Count		uint64		// total number of samples
+	Sum		time.Duration	// sum of all samples
+}
+
+// Returns a new, empty latency histogram.
+func newLatencyHistogram() (lh *LatencyHistogram) {
+	lh = &LatencyHistogram{
+		Bounds:	latencyBuckets,
+		Counts:	make([]uint64, len(latencyBuckets) + 1),
+	}
+
+	return
+}
+
+// Adds a sample to the histogram.
+func (lh *LatencyHistogram) observe(d time.Duration) {
+	var idx	int
+
+	for idx = 0; idx < len(lh.Bounds); idx++ {
+		if d <= lh.Bounds[idx] {
+			break
+		}
+	}
+
+	lh.Counts[idx]++
+	lh.Count++
+	lh.Sum	+= d
+
+	return
+}
+
+// Returns an estimate of the q quantile (0 to 1), as the upper bound of the
+// bucket it falls into. Samples in the overflow bucket are reported as the
+// largest bound.
+func (lh *LatencyHistogram) Quantile(q float64) (d time.Duration) {
+	var rank	uint64
+	var seen	uint64
+
+	if lh.Count == 0 {
+		return
+	}
+
+	rank	= uint64(math.Ceil(q * float64(lh.Count)))
+	if rank == 0 {
+		rank	= 1
+	}
+
+	for idx, count := range lh.Counts {
+		seen	+= count
+		if seen >= rank {
+			if idx < len(lh.Bounds) {
+				d	= lh.Bounds[idx]
+			} else {
+				d	= lh.Bounds[len(lh.Bounds) - 1]
+			}
+			return
+		}
+	}
+
+	return
+}
+
+// Returns a copy of the histogram.
+func (lh *LatencyHistogram) clone() (res *LatencyHistogram) {
+	res	= &LatencyHistogram{
+		Bounds:	lh.Bounds,
+		Counts:	make([]uint64, len(lh.Counts)),
+		Count:	lh.Count,
+		Sum:	lh.Sum,
+	}
+	copy(res.Counts, lh.Counts)
+
+	return
+}
+
+// Poller statistics, as reported to monitoring.
+type PollerStats struct {
+	Cycles		uint64			// number of completed poll cycles
+	Overruns	uint64			// number of cycles which took longer
+						// than the poll interval
+	LastCycle	time.Duration		// duration of the last poll cycle
+	MaxCycle	time.Duration		// longest poll cycle since startup
+	TotalCycleTime	time.Duration		// sum of all poll cycle durations
+	Requests	uint64			// number of modbus requests
+	Errors		uint64			// number of failed modbus requests
+	SkippedTargets	uint64			// number of target reads skipped as
+						// their link went down mid-cycle
+	RequestLatency	*LatencyHistogram	// modbus request latencies
+	TargetErrors	map[string]uint64	// number of failed requests per target label
+	Links		[]LinkStatus		// status of each modbus link
+	Units		[]UnitStatus		// circuit breaker status of each unit
+}
+
+// Internal, lock-protected poller statistics.
+type pollerStats struct {
+	lock		sync.Mutex
+	stats		PollerStats
+}
+
+// Returns a new poller statistics object.
+func newPollerStats() (ps *pollerStats) {
+	ps = &pollerStats{
+		stats:	PollerStats{
+			RequestLatency:	newLatencyHistogram(),
+			TargetErrors:	make(map[string]uint64),
+		},
+	}
+
+	return
+}
+
+// Records a poll cycle. Returns true if the cycle overran the poll interval.
+func (ps *pollerStats) recordCycle(d time.Duration, interval time.Duration) (overrun bool) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	ps.stats.Cycles++
+	ps.stats.LastCycle	= d
+	ps.stats.TotalCycleTime	+= d
+	if d > ps.stats.MaxCycle {
+		ps.stats.MaxCycle	= d
+	}
+
+	if d > interval {
+		ps.stats.Overruns++
+		overrun	= true
+	}
+
+	return
+}
+
+// Records a modbus request to target.
+func (ps *pollerStats) recordRequest(target *Target, d time.Duration, err error) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	ps.stats.Requests++
+	ps.stats.RequestLatency.observe(d)
+
+	if err != nil {
+		ps.stats.Errors++
+		ps.stats.TargetErrors[target.Label]++
+	}
+
+	return
+}
+
+// Records targets skipped for the cycle as their link went down.
+func (ps *pollerStats) recordSkipped(count int) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	ps.stats.SkippedTargets	+= uint64(count)
+
+	return
+}
+
+// Returns a snapshot of the statistics.
+func (ps *pollerStats) snapshot() (res PollerStats) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	res			= ps.stats
+	res.RequestLatency	= ps.stats.RequestLatency.clone()
+	res.TargetErrors	= make(map[string]uint64, len(ps.stats.TargetErrors))
+	for label, count := range ps.stats.TargetErrors {
+		res.TargetErrors[label]	= count
+	}
+
+	return
+}
+
+// Turns poller statistics into self-monitoring points, labeled
+// <prefix>.<metric>, plus one <prefix>.target_errors.<label> point per target
+// which failed at least once.
+func statsToPoints(stats PollerStats, prefix string, now time.Time) (points []*Point) {
+	var linksUp	uint
+	var unitsSkipped uint
+	var labels	[]string
+
+	for _, ls := range stats.Links {
+		if ls.State == LINK_UP || ls.State == LINK_DEGRADED {
+			linksUp++
+		}
+	}
+
+	for _, us := range stats.Units {
+		if us.Skipped {
+			unitsSkipped++
+		}
+	}
+
+	for _, metric := range []struct {
+		name	string
+		value	interface{}
+	}{
+		{ "cycle_ms",		durationMs(stats.LastCycle) },
+		{ "cycle_max_ms",	durationMs(stats.MaxCycle) },
+		{ "cycles",		stats.Cycles },
+		{ "overruns",		stats.Overruns },
+		{ "requests",		stats.Requests },
+		{ "errors",		stats.Errors },
+		{ "targets_skipped",	stats.SkippedTargets },
+		{ "request_p50_ms",	durationMs(stats.RequestLatency.Quantile(0.5)) },
+		{ "request_p95_ms",	durationMs(stats.RequestLatency.Quantile(0.95)) },
+		{ "links_up",		linksUp },
+		{ "units_skipped",	unitsSkipped },
+	} {
+		points	= append(points, &Point{
+			Timestamp:	now,
+			Label:		fmt.Sprintf("%s.%s", prefix, metric.name),
+			Value:		metric.value,
+		})
+	}
+
+	for label := range stats.TargetErrors {
+		labels	= append(labels, label)
+	}
+	sort.Strings(labels)
+
+	for _, label := range labels {
+		points	= append(points, &Point{
+			Timestamp:	now,
+			Label:		fmt.Sprintf("%s.target_errors.%s", prefix, label),
+			Value:		stats.TargetErrors[label],
+		})
+	}
+
+	return
+}
+
+// Returns d in milliseconds.
+func durationMs(d time.Duration) (ms float64) {
+	ms	= float64(d) / float64(time.Millisecond)
+
+	return
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var lh	*LatencyHistogram
+
+	lh	= newLatencyHistogram()
+	if lh.Quantile(0.5) != 0 {
+		t.Errorf("empty histograms should report 0, got: %v", lh.Quantile(0.5))
+	}
+
+	for _, d := range []time.Duration{
+		500 * time.Microsecond, 1 * time.Millisecond, 3 * time.Millisecond,
+		4 * time.Millisecond, 8 * time.Millisecond, 15 * time.Millisecond,
+		40 * time.Millisecond, 90 * time.Millisecond, 150 * time.Millisecond,
+		1 * time.Minute,
+	} {
+		lh.observe(d)
+	}
+
+	if lh.Count != 10 {
+		t.Errorf("expected 10 samples, got: %v", lh.Count)
+	}
+
+	if lh.Counts[0] != 2 || lh.Counts[2] != 2 || lh.Counts[len(lh.Counts) - 1] != 1 {
+		t.Errorf("unexpected bucket counts: %v", lh.Counts)
+	}
+
+	if lh.Quantile(0.5) != 10 * time.Millisecond {
+		t.Errorf("expected p50 to be 10ms, got: %v", lh.Quantile(0.5))
+	}
+
+	if lh.Quantile(0.9) != 200 * time.Millisecond {
+		t.Errorf("expected p90 to be 200ms, got: %v", lh.Quantile(0.9))
+	}
+
+	// overflowing samples should be reported as the largest bound
+	if lh.Quantile(1) != 5 * time.Second {
+		t.Errorf("expected p100 to be 5s, got: %v", lh.Quantile(1))
+	}
+
+	return
+}
+
+func TestPollerStats(t *testing.T) {
+	var ps		*pollerStats
+	var snap	PollerStats
+	var target	*Target
+	var points	[]*Point
+
+	ps	= newPollerStats()
+	target	= &Target{ Label: "plc.reg0" }
+
+	if ps.recordCycle(80 * time.Millisecond, 100 * time.Millisecond) {
+		t.Errorf("80ms cycle should not have been an overrun")
+	}
+	if !ps.recordCycle(120 * time.Millisecond, 100 * time.Millisecond) {
+		t.Errorf("120ms cycle should have been an overrun")
+	}
+
+	ps.recordRequest(target, 3 * time.Millisecond, nil)
+	ps.recordRequest(target, 30 * time.Millisecond, errors.New("timeout"))
+	ps.recordRequest(&Target{ Label: "plc.reg1" }, 3 * time.Millisecond, nil)
+	ps.recordSkipped(2)
+
+	snap	= ps.snapshot()
+	if snap.Cycles != 2 || snap.Overruns != 1 ||
+	   snap.LastCycle != 120 * time.Millisecond ||
+	   snap.MaxCycle != 120 * time.Millisecond ||
+	   snap.TotalCycleTime != 200 * time.Millisecond {
+		t.Errorf("unexpected cycle stats: %+v", snap)
+	}
+
+	if snap.Requests != 3 || snap.Errors != 1 || snap.RequestLatency.Count != 3 ||
+	   snap.SkippedTargets != 2 {
+		t.Errorf("unexpected request stats: %+v", snap)
+	}
+
+	if len(snap.TargetErrors) != 1 || snap.TargetErrors["plc.reg0"] != 1 {
+		t.Errorf("unexpected target errors: %v", snap.TargetErrors)
+	}
+
+	// snapshots should not be affected by later updates
+	ps.recordRequest(target, 3 * time.Millisecond, errors.New("timeout"))
+	if snap.TargetErrors["plc.reg0"] != 1 || snap.RequestLatency.Count != 3 {
+		t.Errorf("snapshot should not have been modified")
+	}
+
+	snap.Links	= []LinkStatus{ { State: LINK_UP }, { State: LINK_DOWN } }
+	snap.Units	= []UnitStatus{ { UnitId: 1, Skipped: true } }
+
+	points	= statsToPoints(snap, "datalogger.poller0", time.Unix(1569150729, 0))
+	for _, expected := range []struct {
+		label	string
+		value	interface{}
+	}{
+		{ "datalogger.poller0.cycle_ms",	float64(120) },
+		{ "datalogger.poller0.cycle_max_ms",	float64(120) },
+		{ "datalogger.poller0.cycles",		uint64(2) },
+		{ "datalogger.poller0.overruns",	uint64(1) },
+		{ "datalogger.poller0.requests",	uint64(3) },
+		{ "datalogger.poller0.errors",		uint64(1) },
+		{ "datalogger.poller0.targets_skipped",	uint64(2) },
+		{ "datalogger.poller0.request_p50_ms",	float64(5) },
+		{ "datalogger.poller0.request_p95_ms",	float64(50) },
+		{ "datalogger.poller0.links_up",	uint(1) },
+		{ "datalogger.poller0.units_skipped",	uint(1) },
+		{ "datalogger.poller0.target_errors.plc.reg0", uint64(1) },
+	} {
+		var found	bool
+
+		for _, p := range points {
+			if p.Label != expected.label {
+				continue
+			}
+
+			found	= true
+			if p.Value != expected.value {
+				t.Errorf("%s: expected %v, got: %v",
+					 p.Label, expected.value, p.Value)
+			}
+			if !p.Timestamp.Equal(time.Unix(1569150729, 0)) {
+				t.Errorf("%s: unexpected timestamp %v", p.Label, p.Timestamp)
+			}
+		}
+
+		if !found {
+			t.Errorf("missing point '%s'", expected.label)
+		}
+	}
+
+	return
+}
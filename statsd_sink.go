@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	STATSD_TAGS_NONE	uint	= 0
+	STATSD_TAGS_DOGSTATSD	uint	= 1
+)
+
+type StatsDSinkConfiguration struct {
+	Url		string		// statsd endpoint, in the form udp://host:port
+					// (port defaults to 8125)
+	Prefix		string		// metric name prefix
+	Rules		[]*LabelRule	// rules mapping point labels to metric names
+					// and tags. Labels matching no rule are used
+					// as metric names.
+	Tags		map[string]string // static tags added to all metrics
+	TagFormat	string		// either "" (no tags, default) or "dogstatsd"
+					// (|#key:value,... suffix)
+	MTU		uint		// max. datagram size, in bytes (defaults to 1432)
+	BufferSize	uint		// max. number of points buffered between pushes
+	PushInterval	time.Duration	// how often to send buffered points
+}
+
+// StatsD sink object.
+type StatsDSink struct {
+	conf		StatsDSinkConfiguration
+	address		string
+	prefix		string
+	tagFormat	uint
+	fifo		*pointRing
+	lock		sync.Mutex
+	conn		net.Conn
+	counters	map[string]float64	// last value of counter points, by label
+}
+
+// Characters with a special meaning in the statsd protocol, which are
+// replaced with underscores in metric names and tags.
+var statsdNameSanitizer	= strings.NewReplacer(
+	":", "_", "|", "_", "@", "_", "#", "_", ",", "_", "\n", "_", " ", "_")
+var statsdTagSanitizer	= strings.NewReplacer(
+	"|", "_", "#", "_", ",", "_", "\n", "_")
+
+// Returns a new statsd sink.
+func NewStatsDSink(conf *StatsDSinkConfiguration) (ss *StatsDSink, err error) {
+	var host	string
+	var port	string
+
+	ss = &StatsDSink{
+		conf:		*conf,
+		counters:	make(map[string]float64),
+	}
+
+	if !strings.HasPrefix(ss.conf.Url, "udp://") {
+		err	= fmt.Errorf("unsupported url '%s' (expected udp://)", ss.conf.Url)
+		return
+	}
+
+	// use the default statsd port if none is specified
+	ss.address	= strings.TrimPrefix(ss.conf.Url, "udp://")
+	host, port, err	= net.SplitHostPort(ss.address)
+	if err != nil {
+		host	= ss.address
+		port	= "8125"
+		err	= nil
+	}
+	if host == "" {
+		err	= errors.New("missing host")
+		return
+	}
+	ss.address	= net.JoinHostPort(host, port)
+
+	if ss.conf.Prefix != "" {
+		ss.prefix	= strings.TrimSuffix(
+			statsdNameSanitizer.Replace(ss.conf.Prefix), ".") + "."
+	}
+
+	switch ss.conf.TagFormat {
+	case "", "none":	ss.tagFormat = STATSD_TAGS_NONE
+	case "dogstatsd":	ss.tagFormat = STATSD_TAGS_DOGSTATSD
+	default:
+		err	= fmt.Errorf("unsupported tag format '%s'", ss.conf.TagFormat)
+		return
+	}
+
+	// 1432 bytes fit in a single ethernet frame, even over ipv6
+	if ss.conf.MTU == 0 {
+		ss.conf.MTU		= 1432
+	}
+
+	// buffer 100k points by default
+	if ss.conf.BufferSize == 0 {
+		ss.conf.BufferSize	= 100000
+	}
+
+	// default to sending once every second
+	if ss.conf.PushInterval == 0 {
+		ss.conf.PushInterval	= 1 * time.Second
+	}
+
+	ss.fifo		= newPointRing(ss.conf.BufferSize)
+
+	// UDP sockets are connectionless: dialing only resolves the address
+	ss.conn, err	= net.Dial("udp", ss.address)
+	if err != nil {
+		return
+	}
+
+	go ss.writer()
+
+	return
+}
+
+// Pushes points to the sink's internal buffer. Points are rejected when
+// the buffer is full.
+func (ss *StatsDSink) Save(points []*Point) (acceptedCount uint) {
+	var pointCount	uint
+
+	pointCount	= uint(len(points))
+	if pointCount == 0 {
+		return
+	}
+
+	ss.lock.Lock()
+	acceptedCount, _	= ss.fifo.push(points, OVERFLOW_DROP_NEWEST)
+	ss.lock.Unlock()
+
+	if acceptedCount != pointCount {
+		fmt.Printf("statsd sink: dropped %v points out of %v\n",
+			   pointCount - acceptedCount, pointCount)
+	}
+
+	return
+}
+
+// Periodically sends buffered points, packing as many metrics as possible
+// in each datagram. Delivery is not guaranteed over UDP, hence points are
+// dropped rather than retried if sending fails.
+func (ss *StatsDSink) writer() {
+	var ticker	*time.Ticker
+	var points	[]*Point
+	var payload	bytes.Buffer
+	var lines	[]string
+
+	ticker	= time.NewTicker(ss.conf.PushInterval)
+
+	for {
+		<-ticker.C
+
+		ss.lock.Lock()
+		points, _	= ss.fifo.peek(points, uint(ss.fifo.len()))
+		ss.fifo.pop(uint(len(points)))
+		ss.lock.Unlock()
+
+		payload.Reset()
+		for _, p := range points {
+			lines	= ss.serialize(p, lines[:0])
+
+			for _, line := range lines {
+				// flush the datagram before it exceeds the MTU
+				if payload.Len() > 0 &&
+				   uint(payload.Len() + 1 + len(line)) > ss.conf.MTU {
+					ss.send(&payload)
+				}
+
+				if payload.Len() > 0 {
+					payload.WriteByte('\n')
+				}
+				payload.WriteString(line)
+			}
+		}
+
+		if payload.Len() > 0 {
+			ss.send(&payload)
+		}
+	}
+
+	return
+}
+
+// Sends and empties a datagram.
+func (ss *StatsDSink) send(payload *bytes.Buffer) {
+	var err	error
+
+	_, err	= ss.conn.Write(payload.Bytes())
+	if err != nil {
+		fmt.Printf("statsd sink: failed to send to %s: %v\n", ss.conf.Url, err)
+	}
+	payload.Reset()
+
+	return
+}
+
+// Appends the metric lines of a point to lines: a gauge, plus a counter
+// delta for counter points. Non-numeric values are skipped.
+func (ss *StatsDSink) serialize(p *Point, lines []string) (res []string) {
+	var f64		float64
+	var last	float64
+	var delta	float64
+	var seen	bool
+	var ok		bool
+	var name	string
+	var tags	string
+
+	res	= lines
+
+	if p == nil {
+		return
+	}
+
+	f64, ok	= p.Float64()
+	if !ok || math.IsNaN(f64) || math.IsInf(f64, 0) {
+		return
+	}
+
+	name, tags	= ss.mapLabel(p)
+
+	// gauges with a sign are applied as deltas by statsd: reset the gauge
+	// to zero before setting a negative value
+	if f64 < 0 {
+		res	= append(res, name + ":0|g" + tags)
+	}
+	res	= append(res, name + ":" + statsdFormat(f64) + "|g" + tags)
+
+	if p.Counter {
+		last, seen		= ss.counters[p.Label]
+		ss.counters[p.Label]	= f64
+
+		// the first reading only serves as a reference
+		if !seen {
+			return
+		}
+
+		// assume the counter was reset (or wrapped around) if it went
+		// backwards, and count from zero
+		delta	= f64 - last
+		if delta < 0 {
+			delta	= f64
+		}
+
+		if delta > 0 {
+			res	= append(res, name + ":" + statsdFormat(delta) + "|c" + tags)
+		}
+	}
+
+	return
+}
+
+// Returns the sanitized metric name of a point and its tag suffix, if any.
+// Tags from label rules take precedence over point tags, which themselves
+// take precedence over static tags.
+func (ss *StatsDSink) mapLabel(p *Point) (name string, suffix string) {
+	var field	string
+	var ruleTags	map[string]string
+	var tags	map[string]string
+	var keys	[]string
+	var sb		strings.Builder
+
+	name, field, ruleTags, _	= mapLabel(ss.conf.Rules, p.Label)
+	if field != "" {
+		name	+= "." + field
+	}
+	name	= ss.prefix + statsdNameSanitizer.Replace(name)
+
+	if ss.tagFormat == STATSD_TAGS_NONE {
+		return
+	}
+
+	tags	= make(map[string]string)
+	for _, set := range []map[string]string{ ss.conf.Tags, p.Tags, ruleTags } {
+		for key, value := range set {
+			tags[key]	= value
+		}
+	}
+
+	for key, value := range tags {
+		if key != "" && value != "" {
+			keys	= append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	sort.Strings(keys)
+
+	sb.WriteString("|#")
+	for idx, key := range keys {
+		if idx > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(statsdTagSanitizer.Replace(strings.ReplaceAll(key, ":", "_")))
+		sb.WriteString(":")
+		sb.WriteString(statsdTagSanitizer.Replace(tags[key]))
+	}
+	suffix	= sb.String()
+
+	return
+}
+
+// Formats a value without exponent, as not all statsd servers support them.
+func statsdFormat(f64 float64) (res string) {
+	res	= strconv.FormatFloat(f64, 'f', -1, 64)
+
+	return
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsDSinkSerialize(t *testing.T) {
+	var ss		*StatsDSink
+	var err		error
+	var rules	[]*LabelRule
+	var lines	[]string
+
+	rules, err	= newLabelRules([]*labelRuleConf{
+		{ Template: "room.sensor.measurement" },
+	})
+	if err != nil {
+		t.Fatalf("newLabelRules() should have succeeded, got: %v", err)
+	}
+
+	ss, err	= NewStatsDSink(&StatsDSinkConfiguration{
+		Url:		"udp://localhost",
+		Prefix:		"house",
+		Rules:		rules,
+		PushInterval:	time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	if ss.address != "localhost:8125" {
+		t.Errorf("unexpected address: %v", ss.address)
+	}
+
+	// without a tag format, tags are ignored
+	lines	= ss.serialize(&Point{
+		Label:	"kitchen.sensor0.temperature",
+		Value:	18.5,
+		Tags:	map[string]string{ "floor": "1" },
+	}, nil)
+	if len(lines) != 1 || lines[0] != "house.temperature:18.5|g" {
+		t.Errorf("unexpected lines: %v", lines)
+	}
+
+	lines	= ss.serialize(&Point{ Label: "plc.status|1:a", Value: "running" }, nil)
+	if len(lines) != 0 {
+		t.Errorf("non-numeric values should have been skipped, got: %v", lines)
+	}
+
+	// negative gauges should be reset to zero first
+	lines	= ss.serialize(&Point{ Label: "plc.offset:1", Value: int16(-3) }, nil)
+	if len(lines) != 2 || lines[0] != "house.plc.offset_1:0|g" ||
+	   lines[1] != "house.plc.offset_1:-3|g" {
+		t.Errorf("unexpected lines: %v", lines)
+	}
+
+	ss, err	= NewStatsDSink(&StatsDSinkConfiguration{
+		Url:		"udp://localhost:9125",
+		Rules:		rules,
+		Tags:		map[string]string{ "site": "house", "room": "unknown" },
+		TagFormat:	"dogstatsd",
+		PushInterval:	time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	lines	= ss.serialize(&Point{
+		Label:	"kitchen.sensor0.temperature",
+		Value:	18.5,
+		Tags:	map[string]string{ "floor": "1,2" },
+	}, nil)
+	if len(lines) != 1 ||
+	   lines[0] != "temperature:18.5|g|#floor:1_2,room:kitchen,sensor:sensor0,site:house" {
+		t.Errorf("unexpected lines: %v", lines)
+	}
+
+	// counters should emit deltas from the second reading on, and count
+	// from zero after a reset
+	for _, tc := range []struct {
+		value		uint32
+		expected	[]string
+	}{
+		{ 1000, []string{ "meter.e_kWh:1000|g|#room:unknown,site:house" } },
+		{ 1000, []string{ "meter.e_kWh:1000|g|#room:unknown,site:house" } },
+		{ 1250, []string{ "meter.e_kWh:1250|g|#room:unknown,site:house", "meter.e_kWh:250|c|#room:unknown,site:house" } },
+		{ 20,   []string{ "meter.e_kWh:20|g|#room:unknown,site:house", "meter.e_kWh:20|c|#room:unknown,site:house" } },
+	} {
+		lines	= ss.serialize(&Point{
+			Label:		"meter.e_kWh",
+			Value:		tc.value,
+			Counter:	true,
+		}, lines[:0])
+		if strings.Join(lines, " ") != strings.Join(tc.expected, " ") {
+			t.Errorf("value %v: expected %v, got: %v", tc.value, tc.expected, lines)
+		}
+	}
+
+	for _, conf := range []*StatsDSinkConfiguration{
+		{ Url: "tcp://localhost:8125" },
+		{ Url: "udp://:8125" },
+		{ Url: "udp://localhost", TagFormat: "influx" },
+	} {
+		_, err	= NewStatsDSink(conf)
+		if err == nil {
+			t.Errorf("sink creation should have failed with %+v", conf)
+		}
+	}
+
+	return
+}
+
+func TestStatsDSink(t *testing.T) {
+	var ss		*StatsDSink
+	var err		error
+	var pc		net.PacketConn
+	var buf		[]byte
+	var n		int
+	var points	[]*Point
+	var count	int
+	var fifoLen	int
+
+	pc, err	= net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer pc.Close()
+
+	ss, err	= NewStatsDSink(&StatsDSinkConfiguration{
+		Url:		"udp://" + pc.LocalAddr().String(),
+		MTU:		512,
+		PushInterval:	50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("sink creation should have succeeded, got: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		points	= append(points, &Point{
+			Timestamp:	time.Unix(1569150729, 0),
+			Label:		"sensor.value",
+			Value:		i,
+		})
+	}
+	ss.Save(points)
+
+	// 100 metrics of about 20 bytes each should be split in several datagrams
+	buf	= make([]byte, 65536)
+	for dgrams := 0; count < 100; dgrams++ {
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err	= pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("failed to read datagram #%v: %v", dgrams, err)
+		}
+
+		if n > 512 {
+			t.Errorf("datagram #%v exceeds the MTU (%v bytes)", dgrams, n)
+		}
+
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if !strings.HasPrefix(line, "sensor.value:") || !strings.HasSuffix(line, "|g") {
+				t.Errorf("unexpected line: '%s'", line)
+			}
+			count++
+		}
+
+		if count == 100 && dgrams < 3 {
+			t.Errorf("expected at least 4 datagrams, got: %v", dgrams + 1)
+		}
+	}
+
+	ss.lock.Lock()
+	fifoLen	= ss.fifo.len()
+	ss.lock.Unlock()
+
+	if fifoLen != 0 {
+		t.Errorf("fifo should have been empty, got: %v", fifoLen)
+	}
+
+	return
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+var errNotWideCSV	= errors.New("not a wide csv file")
+
+// Wide CSV writer, producing files with a header row holding one column per
+// label, and one row per timestamp bucket:
+//	timestamp,label1,label2,...
+//	1569150729000,18.7,54,...
+// Points are grouped into rows either by aligning their timestamps to fixed
+// intervals (bucket), or, if bucket is 0, by grouping points within tolerance
+// of the first point of the row, which fits points from the same poll cycle.
+// In the latter mode, a label showing up twice starts a new row.
+// Columns of new labels are appended to the header as they show up, with the
+// file rewritten to update its header.
+type wideCSVWriter struct {
+	bucket		time.Duration	// row interval (disabled if 0)
+	tolerance	time.Duration	// max. time span of a row if bucket is 0
+	formatTs	func(time.Time) string	// timestamp formatter
+	path		string
+	file		*os.File
+	headerLen	int64		// size of the header row, in bytes
+	columns		[]string	// labels, in header order
+	index		map[string]int	// column index of each label
+	rows		[]*wideCSVRow	// rows waiting to be written, oldest first
+}
+
+// A row of the wide CSV file, covering points in [start, end).
+type wideCSVRow struct {
+	start		time.Time
+	end		time.Time
+	values		map[string]interface{}
+}
+
+// Returns a new wide CSV writer.
+func newWideCSVWriter(bucket time.Duration, tolerance time.Duration,
+		       formatTs func(time.Time) string) (ww *wideCSVWriter) {
+	ww = &wideCSVWriter{
+		bucket:		bucket,
+		tolerance:	tolerance,
+		formatTs:	formatTs,
+		index:		make(map[string]int),
+	}
+
+	return
+}
+
+// Opens (or creates) a file for appending. If the file already exists, its
+// header is parsed to restore the column order. Files without a wide csv
+// header are rejected with errNotWideCSV.
+func (ww *wideCSVWriter) open(path string) (file *os.File, err error) {
+	var header	[]string
+	var buf		bytes.Buffer
+	var cw		*csv.Writer
+
+	file, err	= os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return
+	}
+
+	ww.path		= path
+	ww.file		= file
+	ww.headerLen	= 0
+	ww.columns	= nil
+	ww.index	= make(map[string]int)
+
+	header, err	= csv.NewReader(bufio.NewReader(file)).Read()
+	if err == io.EOF {
+		err	= nil
+		return
+	}
+	if err != nil || len(header) == 0 || header[0] != "timestamp" {
+		file.Close()
+		ww.file	= nil
+		err	= errNotWideCSV
+		return
+	}
+
+	for _, label := range header[1:] {
+		ww.index[label]	= len(ww.columns)
+		ww.columns	= append(ww.columns, label)
+	}
+
+	// re-encode the header to find out where rows start
+	cw	= csv.NewWriter(&buf)
+	cw.Write(header)
+	cw.Flush()
+	ww.headerLen	= int64(buf.Len())
+
+	return
+}
+
+// Adds a point to its row.
+func (ww *wideCSVWriter) add(p *Point) {
+	var row	*wideCSVRow
+	var ts	time.Time
+
+	ts	= p.Timestamp
+
+	// look for the row the point belongs to, starting with the most recent
+	for idx := len(ww.rows) - 1; idx >= 0; idx-- {
+		if !ts.Before(ww.rows[idx].start) && ts.Before(ww.rows[idx].end) {
+			row	= ww.rows[idx]
+			break
+		}
+	}
+
+	// a label showing up twice within tolerance belongs to the next poll cycle
+	if row != nil && ww.bucket == 0 {
+		if _, found := row.values[p.Label]; found {
+			row	= nil
+		}
+	}
+
+	if row == nil {
+		row	= &wideCSVRow{
+			values:	make(map[string]interface{}),
+		}
+
+		if ww.bucket > 0 {
+			row.start	= ts.Truncate(ww.bucket)
+			row.end		= row.start.Add(ww.bucket)
+		} else {
+			row.start	= ts
+			row.end		= ts.Add(ww.tolerance)
+		}
+
+		ww.rows	= append(ww.rows, row)
+	}
+
+	// keep the latest value when several points fall into the same bucket
+	row.values[p.Label]	= p.Value
+
+	return
+}
+
+// Writes rows which can no longer receive points (i.e. ending before now),
+// or all rows if force is true. Returns the number of rows written.
+func (ww *wideCSVWriter) flush(now time.Time, force bool) (count uint, err error) {
+	var buf		bytes.Buffer
+	var cw		*csv.Writer
+	var newLabels	[]string
+	var record	[]string
+	var ready	int
+
+	if ww.file == nil {
+		err	= errors.New("file closed")
+		return
+	}
+
+	// rows are kept in arrival order: stop at the first row still open
+	for ready = 0; ready < len(ww.rows); ready++ {
+		if !force && ww.rows[ready].end.After(now) {
+			break
+		}
+	}
+
+	if ready == 0 {
+		return
+	}
+
+	// add columns for labels not yet in the header
+	for _, row := range ww.rows[:ready] {
+		for label := range row.values {
+			if _, found := ww.index[label]; !found {
+				ww.index[label]	= -1
+				newLabels	= append(newLabels, label)
+			}
+		}
+	}
+
+	if len(newLabels) > 0 {
+		sort.Strings(newLabels)
+		for _, label := range newLabels {
+			ww.index[label]	= len(ww.columns)
+			ww.columns	= append(ww.columns, label)
+		}
+
+		err	= ww.rewriteHeader()
+		if err != nil {
+			// forget about the new columns, to retry adding them later
+			for _, label := range newLabels {
+				delete(ww.index, label)
+			}
+			ww.columns	= ww.columns[:len(ww.columns) - len(newLabels)]
+			return
+		}
+	}
+
+	cw	= csv.NewWriter(&buf)
+	for _, row := range ww.rows[:ready] {
+		record	= make([]string, len(ww.columns) + 1)
+		record[0]	= ww.formatTs(row.start)
+		for label, value := range row.values {
+			record[ww.index[label] + 1]	= fmt.Sprintf("%v", value)
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+
+	_, err	= buf.WriteTo(ww.file)
+	if err != nil {
+		return
+	}
+
+	count		= uint(ready)
+	ww.rows		= ww.rows[ready:]
+
+	return
+}
+
+// Writes the header row of the current columns. Existing rows, if any, are
+// copied after the new header into a temporary file, which then replaces the
+// current file. Rows are padded with empty fields to the new column count, as
+// strict csv readers reject records shorter than the header.
+func (ww *wideCSVWriter) rewriteHeader() (err error) {
+	var buf		bytes.Buffer
+	var cw		*csv.Writer
+	var info	os.FileInfo
+	var tmp		*os.File
+	var tmpPath	string
+	var cr		*csv.Reader
+	var tw		*bufio.Writer
+	var record	[]string
+
+	cw	= csv.NewWriter(&buf)
+	cw.Write(append([]string{ "timestamp" }, ww.columns...))
+	cw.Flush()
+
+	info, err	= ww.file.Stat()
+	if err != nil {
+		return
+	}
+
+	// empty file: simply write the header
+	if info.Size() == 0 {
+		_, err	= ww.file.Write(buf.Bytes())
+		if err == nil {
+			ww.headerLen	= int64(buf.Len())
+		}
+		return
+	}
+
+	tmpPath		= ww.path + ".tmp"
+	tmp, err	= os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return
+	}
+
+	tw	= bufio.NewWriter(tmp)
+	tw.Write(buf.Bytes())
+
+	cr	= csv.NewReader(bufio.NewReader(io.NewSectionReader(ww.file, ww.headerLen,
+							      info.Size() - ww.headerLen)))
+	cr.FieldsPerRecord	= -1
+	cw	= csv.NewWriter(tw)
+	for {
+		record, err	= cr.Read()
+		if err != nil {
+			break
+		}
+
+		for len(record) < len(ww.columns) + 1 {
+			record	= append(record, "")
+		}
+		cw.Write(record)
+	}
+	if err == io.EOF {
+		cw.Flush()
+		err	= cw.Error()
+	}
+	if err == nil {
+		err	= tw.Flush()
+	}
+	if err == nil {
+		err	= tmp.Sync()
+	}
+	if err == nil {
+		err	= os.Rename(tmpPath, ww.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return
+	}
+
+	fmt.Printf("updated the header of %s (%v columns)\n", ww.path, len(ww.columns))
+
+	// keep appending to the new file
+	ww.file.Close()
+	tmp.Close()
+
+	ww.file, err	= os.OpenFile(ww.path, os.O_APPEND|os.O_RDWR, 0600)
+	if err == nil {
+		ww.headerLen	= int64(buf.Len())
+	}
+
+	return
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWideCSVWriter(t *testing.T) {
+	var err		error
+	var dir		string
+	var path	string
+	var ww		*wideCSVWriter
+	var count	uint
+	var contents	[]byte
+
+	dir, err	= ioutil.TempDir("", "datalogger-wide-csv")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path	= filepath.Join(dir, "test.csv")
+
+	ww	= newWideCSVWriter(0, 500 * time.Millisecond, wideCSVTestFormat)
+	_, err	= ww.open(path)
+	if err != nil {
+		t.Fatalf("open() should have succeeded, got: %v", err)
+	}
+
+	// two poll cycles, the second one repeating a label within tolerance
+	for _, p := range []*Point{
+		{ Timestamp: time.Unix(1569150729, 0), Label: "sensor0.temperature", Value: 18.7 },
+		{ Timestamp: time.Unix(1569150729, 100000000), Label: "sensor0.humidity", Value: 54 },
+		{ Timestamp: time.Unix(1569150729, 200000000), Label: "sensor0.temperature", Value: 18.8 },
+		{ Timestamp: time.Unix(1569150729, 300000000), Label: "sensor0.humidity", Value: 55 },
+		{ Timestamp: time.Unix(1569150730, 0), Label: "sensor0.temperature", Value: 18.9 },
+	} {
+		ww.add(p)
+	}
+
+	// the last row is still open and should be kept for later
+	count, err	= ww.flush(time.Unix(1569150730, 100000000), false)
+	if err != nil || count != 2 {
+		t.Errorf("expected 2 rows to be written, got: %v (err: %v)", count, err)
+	}
+
+	contents, _	= ioutil.ReadFile(path)
+	if string(contents) != "timestamp,sensor0.humidity,sensor0.temperature\n" +
+				"1569150729000,54,18.7\n" +
+				"1569150729200,55,18.8\n" {
+		t.Errorf("unexpected contents: %q", contents)
+	}
+
+	// a new label should update the header, keeping existing columns in place
+	ww.add(&Point{ Timestamp: time.Unix(1569150730, 50000000), Label: "plc.status", Value: "run,ning" })
+	count, err	= ww.flush(time.Unix(1569150731, 0), false)
+	if err != nil || count != 1 {
+		t.Errorf("expected 1 row to be written, got: %v (err: %v)", count, err)
+	}
+
+	contents, _	= ioutil.ReadFile(path)
+	if string(contents) != "timestamp,sensor0.humidity,sensor0.temperature,plc.status\n" +
+				"1569150729000,54,18.7,\n" +
+				"1569150729200,55,18.8,\n" +
+				"1569150730000,,18.9,\"run,ning\"\n" {
+		t.Errorf("unexpected contents: %q", contents)
+	}
+	ww.file.Close()
+
+	// reopening the file should restore the column order, and aligned
+	// buckets should keep the latest value of each label
+	ww	= newWideCSVWriter(10 * time.Second, 0, wideCSVTestFormat)
+	_, err	= ww.open(path)
+	if err != nil {
+		t.Fatalf("open() should have succeeded, got: %v", err)
+	}
+
+	if len(ww.columns) != 3 || ww.columns[2] != "plc.status" {
+		t.Errorf("unexpected columns: %v", ww.columns)
+	}
+
+	for _, p := range []*Point{
+		{ Timestamp: time.Unix(1569150741, 0), Label: "sensor0.temperature", Value: 19 },
+		{ Timestamp: time.Unix(1569150742, 0), Label: "plc.status", Value: "stopped" },
+		{ Timestamp: time.Unix(1569150745, 0), Label: "sensor0.temperature", Value: 19.1 },
+		{ Timestamp: time.Unix(1569150752, 0), Label: "sensor0.temperature", Value: 19.2 },
+	} {
+		ww.add(p)
+	}
+
+	// force writing all rows, as done on rotation
+	count, err	= ww.flush(time.Unix(1569150752, 0), true)
+	if err != nil || count != 2 {
+		t.Errorf("expected 2 rows to be written, got: %v (err: %v)", count, err)
+	}
+
+	contents, _	= ioutil.ReadFile(path)
+	if string(contents) != "timestamp,sensor0.humidity,sensor0.temperature,plc.status\n" +
+				"1569150729000,54,18.7,\n" +
+				"1569150729200,55,18.8,\n" +
+				"1569150730000,,18.9,\"run,ning\"\n" +
+				"1569150740000,,19.1,stopped\n" +
+				"1569150750000,,19.2,\n" {
+		t.Errorf("unexpected contents: %q", contents)
+	}
+	ww.file.Close()
+
+	// files without a wide csv header should be rejected
+	ioutil.WriteFile(path, []byte("1569150729000,sensor0.humidity,54\n"), 0600)
+	_, err	= newWideCSVWriter(0, time.Second, wideCSVTestFormat).open(path)
+	if err != errNotWideCSV {
+		t.Errorf("open() should have failed with errNotWideCSV, got: %v", err)
+	}
+
+	return
+}
+
+// Formats timestamps as milliseconds since the epoch.
+func wideCSVTestFormat(ts time.Time) (res string) {
+	res	= fmt.Sprintf("%d", ts.UnixNano() / 1e6)
+
+	return
+}